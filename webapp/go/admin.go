@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/middleware"
+)
+
+// /api/admin と /internal の Basic 認証。どちらかが空なら誰も通さない
+var (
+	adminUser     = getEnv("ADMIN_USER", "")
+	adminPassword = getEnv("ADMIN_PASSWORD", "")
+)
+
+func adminAuth() echo.MiddlewareFunc {
+	return middleware.BasicAuth(func(user, password string, c echo.Context) (bool, error) {
+		if adminUser == "" || adminPassword == "" {
+			return false, nil
+		}
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(adminUser)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(adminPassword)) == 1
+		return userOK && passwordOK, nil
+	})
+}
+
+type EstateStatusRequest struct {
+	Status string `json:"status"`
+}
+
+type EstateStatusResponse struct {
+	ID     int64  `json:"id"`
+	Status string `json:"status"`
+}
+
+// putEstateStatus は物件の掲載状態 (available / under_contract / unlisted) を変える
+func putEstateStatus(c echo.Context) error {
+	ctx := c.Request().Context()
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	var req EstateStatusRequest
+	if err := c.Bind(&req); err != nil {
+		c.Echo().Logger.Infof("put estate status failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if !isValidEstateStatus(req.Status) {
+		c.Echo().Logger.Infof("put estate status failed : invalid status %v", req.Status)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	var exists int
+	err = db.GetContext(ctx, &exists, "SELECT COUNT(*) FROM estate WHERE id = ?", id)
+	if err != nil {
+		c.Logger().Errorf("putEstateStatus DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if exists == 0 {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE estate SET status = ? WHERE id = ?", req.Status, id)
+	if err != nil {
+		c.Logger().Errorf("putEstateStatus DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// low_priced に出るのは available のものだけ
+	if req.Status == EstateStatusAvailable {
+		err = addLowPricedEstates(ctx, []int64{int64(id)})
+	} else {
+		err = removeFromLowPricedSet(ctx, lowPricedEstateSetKey, int64(id))
+	}
+	if err != nil {
+		c.Logger().Errorf("failed to update low priced estates : %v", err)
+	}
+	// 検索結果が変わるので cache は飛ばす
+	_ = purgeEstateIDsFromRedis()
+	refreshLowPricedEstateCache(ctx)
+	purgeSurrogateKeys(c.Logger(), surrogateKeyForEstate(int64(id)), surrogateKeyEstateSearch)
+
+	return c.JSON(http.StatusOK, EstateStatusResponse{ID: int64(id), Status: req.Status})
+}
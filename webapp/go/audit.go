@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 書き込み系の API (入稿、購入、資料請求、管理画面での変更、initialize) を audit_log に追記する。
+// リクエストを待たせないよう、queue に積んで runAuditWriter がまとめて INSERT する
+var (
+	auditQueue         = make(chan AuditEntry, getEnvInt("AUDIT_QUEUE_SIZE", 1024))
+	auditFlushInterval = getEnvDuration("AUDIT_FLUSH_INTERVAL", 100*time.Millisecond)
+)
+
+const (
+	auditInsertBatchSize = 100
+	// JSON の body はキーを拾うためにこれだけ読む
+	auditMaxPeekBody     = 64 << 10
+	auditMaxSummaryBytes = 1024
+	auditDefaultPerPage  = 50
+	auditMaxPerPage      = 500
+)
+
+type AuditEntry struct {
+	ID        int64     `db:"id" json:"id"`
+	Action    string    `db:"action" json:"action"`
+	Actor     string    `db:"actor" json:"actor"`
+	IP        string    `db:"ip" json:"ip"`
+	Method    string    `db:"method" json:"method"`
+	Path      string    `db:"path" json:"path"`
+	Status    int       `db:"status" json:"status"`
+	Summary   string    `db:"summary" json:"summary"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+type AuditResponse struct {
+	Count   int64        `json:"count"`
+	Entries []AuditEntry `json:"entries"`
+}
+
+// auditActor は誰が叩いたか。管理画面なら Basic 認証のユーザ、
+// API キーがあればその hash (キーそのものは残さない)、どちらも無ければ IP
+func auditActor(c echo.Context) string {
+	if user, _, ok := c.Request().BasicAuth(); ok && user != "" {
+		return "user:" + user
+	}
+	if key := c.Request().Header.Get("X-API-Key"); key != "" {
+		sum := sha256.Sum256([]byte(key))
+		return "key:" + hex.EncodeToString(sum[:8])
+	}
+	return "ip:" + c.RealIP()
+}
+
+// peekJSONKeys は JSON の body のトップレベルのキーを返す。
+// 値にはメールアドレスなどが入るので残さない。読んだ body は handler のために戻しておく
+func peekJSONKeys(req *http.Request) []string {
+	if req.Body == nil || !strings.HasPrefix(req.Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, auditMaxPeekBody))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+	if err != nil {
+		return nil
+	}
+	m := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// auditSummary はパスのパラメータ、クエリ、JSON のキー、アップロードされたファイルを短くまとめる
+func auditSummary(c echo.Context, jsonKeys []string) string {
+	parts := make([]string, 0)
+	for i, name := range c.ParamNames() {
+		parts = append(parts, name+"="+c.ParamValues()[i])
+	}
+	if q := c.Request().URL.RawQuery; q != "" {
+		parts = append(parts, "query="+q)
+	}
+	if len(jsonKeys) > 0 {
+		parts = append(parts, "keys="+strings.Join(jsonKeys, ","))
+	}
+	// multipart は handler がもう読んでいるのでそれを見る
+	if form := c.Request().MultipartForm; form != nil {
+		for field, files := range form.File {
+			for _, f := range files {
+				parts = append(parts, fmt.Sprintf("file=%s:%s(%d bytes)", field, f.Filename, f.Size))
+			}
+		}
+	}
+	s := strings.Join(parts, " ")
+	if len(s) > auditMaxSummaryBytes {
+		s = s[:auditMaxSummaryBytes]
+	}
+	return s
+}
+
+// audit は handler が終わったあとに action として audit_log に記録する
+func audit(action string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			jsonKeys := peekJSONKeys(req)
+			err := next(c)
+
+			status := c.Response().Status
+			if err != nil {
+				status = http.StatusInternalServerError
+				if he, ok := err.(*echo.HTTPError); ok {
+					status = he.Code
+				}
+			}
+			entry := AuditEntry{
+				Action:    action,
+				Actor:     auditActor(c),
+				IP:        c.RealIP(),
+				Method:    req.Method,
+				Path:      req.URL.Path,
+				Status:    status,
+				Summary:   auditSummary(c, jsonKeys),
+				CreatedAt: time.Now(),
+			}
+			// 追記が追いつかないときは待つ (記録を落とさない)
+			auditQueue <- entry
+			return err
+		}
+	}
+}
+
+// runAuditWriter は auditQueue に積まれたものをまとめて audit_log に入れる
+func runAuditWriter(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+	entries := make([]AuditEntry, 0, auditInsertBatchSize)
+	flush := func() {
+		if len(entries) == 0 {
+			return
+		}
+		if err := insertAuditEntries(ctx, entries); err != nil {
+			logger.Errorf("failed to write audit log (%d entries) : %v", len(entries), err)
+		}
+		entries = entries[:0]
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			flush()
+			return
+		case e := <-auditQueue:
+			entries = append(entries, e)
+			if len(entries) >= auditInsertBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func insertAuditEntries(ctx context.Context, entries []AuditEntry) error {
+	placeholders := make([]string, 0, len(entries))
+	params := make([]interface{}, 0, len(entries)*8)
+	for _, e := range entries {
+		placeholders = append(placeholders, "(?,?,?,?,?,?,?,?)")
+		params = append(params, e.Action, e.Actor, e.IP, e.Method, e.Path, e.Status, e.Summary, e.CreatedAt)
+	}
+	query := "INSERT INTO audit_log (action, actor, ip, method, path, status, summary, created_at) VALUES " + strings.Join(placeholders, ",")
+	_, err := db.ExecContext(ctx, query, params...)
+	return err
+}
+
+// getAudit は audit_log を新しい順に返す。
+// action, actor, ip, status, since / until (RFC3339) で絞れる
+func getAudit(c echo.Context) error {
+	ctx := c.Request().Context()
+	f := newSQLFilter()
+	if v := c.QueryParam("action"); v != "" {
+		f.Eq(colAuditAction, v)
+	}
+	if v := c.QueryParam("actor"); v != "" {
+		f.Eq(colAuditActor, v)
+	}
+	if v := c.QueryParam("ip"); v != "" {
+		f.Eq(colAuditIP, v)
+	}
+	if v := c.QueryParam("status"); v != "" {
+		status, err := strconv.Atoi(v)
+		if err != nil {
+			c.Logger().Infof("Invalid format status parameter : %v", err)
+			return c.NoContent(http.StatusBadRequest)
+		}
+		f.Eq(colAuditStatus, status)
+	}
+	for _, p := range []struct {
+		name string
+		add  func(col sqlColumn, v interface{})
+	}{{"since", f.Gte}, {"until", f.Lt}} {
+		v := c.QueryParam(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.Logger().Infof("Invalid format %s parameter : %v", p.name, err)
+			return c.NoContent(http.StatusBadRequest)
+		}
+		p.add(colCreatedAt, t)
+	}
+	if f.Empty() {
+		f.Raw("TRUE")
+	}
+
+	page := 0
+	if v := c.QueryParam("page"); v != "" {
+		var err error
+		page, err = strconv.Atoi(v)
+		if err != nil || page < 0 {
+			c.Logger().Infof("Invalid format page parameter : %v", v)
+			return c.NoContent(http.StatusBadRequest)
+		}
+	}
+	perPage := auditDefaultPerPage
+	if v := c.QueryParam("perPage"); v != "" {
+		var err error
+		perPage, err = strconv.Atoi(v)
+		if err != nil || perPage <= 0 || perPage > auditMaxPerPage {
+			c.Logger().Infof("Invalid format perPage parameter : %v", v)
+			return c.NoContent(http.StatusBadRequest)
+		}
+	}
+
+	where, params := f.Where()
+	count, err := countRows(ctx, "audit_log", where, params)
+	if err != nil {
+		c.Logger().Errorf("getAudit DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	entries := make([]AuditEntry, 0, perPage)
+	err = selectRows(ctx, &entries, "audit_log", where, params, "id DESC", nil, int64(perPage), int64(page*perPage))
+	if err != nil {
+		c.Logger().Errorf("getAudit DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, AuditResponse{Count: count, Entries: entries})
+}
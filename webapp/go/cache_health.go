@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// redis が落ちたときに毎回 500 にしないよう、しばらく redis を使わずに MySQL を直接見る。
+// 検索の ID リストはその間 instance の中の LRU (local_ids_cache.go) に持つ
+var (
+	cacheUnhealthyPeriod = getEnvDuration("CACHE_UNHEALTHY_PERIOD", 10*time.Second)
+	cacheProbeInterval   = getEnvDuration("CACHE_PROBE_INTERVAL", 2*time.Second)
+
+	cacheUnhealthy      int32
+	cacheUnhealthyUntil int64
+	// redis が落ちている間に cache を飛ばせなかったら、戻ったときに飛ばす
+	cachePurgePending int32
+
+	// markCacheUnhealthy はリクエストの途中で呼ばれて logger を持っていないので、
+	// 使えなくなった理由はここに置いて runCacheHealthProbe が echo の logger に出す
+	cacheUnhealthyErrMu sync.Mutex
+	cacheUnhealthyErr   error
+)
+
+// cacheAvailable は cache を使ってよいかを返す
+func cacheAvailable() bool {
+	return atomic.LoadInt32(&cacheUnhealthy) == 0
+}
+
+// isCacheConnectionError は redis につながらなかったときのエラーかどうか
+func isCacheConnectionError(err error) bool {
+	// クライアントが切断しただけなら redis は悪くない
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	// pool の timeout などは net.Error ではない
+	msg := err.Error()
+	if strings.Contains(msg, "connection pool") || strings.Contains(msg, "connection refused") || strings.Contains(msg, "client is closed") {
+		return true
+	}
+	// sentinel の failover 直後に、replica に降格した古い master への接続が残っていると READONLY が返る。
+	// しばらく redis を使わずにいる間に新しい master につなぎ直す
+	return strings.HasPrefix(msg, "READONLY")
+}
+
+// markCacheUnhealthy は cacheUnhealthyPeriod の間 cache を使わないようにする
+func markCacheUnhealthy(err error) {
+	atomic.StoreInt64(&cacheUnhealthyUntil, time.Now().Add(cacheUnhealthyPeriod).UnixNano())
+	if atomic.CompareAndSwapInt32(&cacheUnhealthy, 0, 1) {
+		cacheUnhealthyErrMu.Lock()
+		cacheUnhealthyErr = err
+		cacheUnhealthyErrMu.Unlock()
+	}
+}
+
+// takeCacheUnhealthyErr はまだ log に出していない、cache が使えなくなった理由を返す
+func takeCacheUnhealthyErr() error {
+	cacheUnhealthyErrMu.Lock()
+	defer cacheUnhealthyErrMu.Unlock()
+	err := cacheUnhealthyErr
+	cacheUnhealthyErr = nil
+	return err
+}
+
+func setCachePurgePending() {
+	atomic.StoreInt32(&cachePurgePending, 1)
+}
+
+// runCacheHealthProbe は cache が使えなくなっていたら定期的に searchIDsCache を見に行って、戻っていれば使えるようにする
+func runCacheHealthProbe(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(cacheProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := takeCacheUnhealthyErr(); err != nil {
+			logger.Warnf("cache is unhealthy, bypassing for %v : %v", cacheUnhealthyPeriod, err)
+		}
+		if cacheAvailable() || time.Now().UnixNano() < atomic.LoadInt64(&cacheUnhealthyUntil) {
+			continue
+		}
+		if err := searchIDsCache.Ping(ctx); err != nil {
+			markCacheUnhealthy(err)
+			continue
+		}
+		// 落ちている間に入稿されていたら古い cache が残っているので飛ばしてから戻す
+		if atomic.LoadInt32(&cachePurgePending) == 1 {
+			if err := purgePendingCaches(ctx); err != nil {
+				markCacheUnhealthy(err)
+				continue
+			}
+			atomic.StoreInt32(&cachePurgePending, 0)
+		}
+		atomic.StoreInt32(&cacheUnhealthy, 0)
+		logger.Infof("cache is healthy again")
+	}
+}
+
+// purgePendingCaches は searchIDsCache の版を全部上げて、redis に持っている low_priced の set を消す
+func purgePendingCaches(ctx context.Context) error {
+	for _, prefix := range purgeableIDsCachePrefixes() {
+		if err := searchIDsCache.Purge(ctx, prefix); err != nil {
+			return err
+		}
+	}
+	return purgeLowPricedSets(ctx)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// redis には cache 以外 (initialize の lock、geocode などの外部 API の結果) も入っているので、
+// FLUSHALL はせずに消していいものだけを消す。
+// 検索の ID リストは版ごとの index (set) に key を入れておき、版を上げたときに古い版の key をまとめて消す
+
+// cacheKeyPrefixes は DB から作り直せる cache の key の prefix
+var cacheKeyPrefixes = []string{
+	"estate:",
+	"chair:",
+	"low_priced:",
+	"suggest:",
+	responseCacheKeyPrefix,
+}
+
+// purgeableIDsCachePrefixes は DB が変わったら捨てる searchIDsCache の prefix。
+// 落ちている間に飛ばせなかったら、runCacheHealthProbe が戻ったときにこれを全部 Purge する
+func purgeableIDsCachePrefixes() []string {
+	return []string{
+		"estate",
+		"chair",
+		lowPricedChairCachePrefix,
+		lowPricedEstateCachePrefix,
+		suggestChairNamePrefix,
+		suggestEstateAddressPrefix,
+		responseCacheKeyPrefix + responseCacheGroupChair,
+		responseCacheKeyPrefix + responseCacheGroupEstate,
+	}
+}
+
+// idsCacheIndexKey は prefix (estate / chair) の version 版の ID リストの key を入れておく set
+func idsCacheIndexKey(prefix string, version int64) string {
+	return fmt.Sprintf("%s:v%d:keys", prefix, version)
+}
+
+// idsCacheIndexKeyOf は {prefix}:v{版}:{{hash}} の key が入る index を返す
+func idsCacheIndexKeyOf(key string) string {
+	return key[:strings.LastIndexByte(key, ':')] + ":keys"
+}
+
+// addToIndexScript は KEYS[1] の index に ARGV[1] の key を入れて、index の TTL を ARGV[2] ミリ秒以上に延ばす。
+// index が中の key より先に切れると、版を上げたときにその key を消せなくなる
+var addToIndexScript = redis.NewScript(`
+redis.call("sadd", KEYS[1], ARGV[1])
+local ttl = tonumber(ARGV[2])
+if redis.call("pttl", KEYS[1]) < ttl then
+	redis.call("pexpire", KEYS[1], ttl)
+end
+return 1
+`)
+
+// addToIDsCacheIndex は ttl の TTL を付けた key を版の index に入れる。
+// pipeline でも使えるように EVALSHA ではなく EVAL で送る
+func addToIDsCacheIndex(ctx context.Context, c redis.Cmdable, key string, ttl time.Duration) *redis.Cmd {
+	return addToIndexScript.Eval(ctx, c, []string{idsCacheIndexKeyOf(key)}, key, ttl.Milliseconds())
+}
+
+// bumpIDsCacheVersion は versionKey の版を上げて、1 つ前の版の ID リストを消す
+func bumpIDsCacheVersion(ctx context.Context, versionKey string, prefix string) error {
+	version, err := rdb.Incr(ctx, versionKey).Result()
+	if err != nil {
+		return err
+	}
+	return deleteIndexedKeys(ctx, idsCacheIndexKey(prefix, version-1))
+}
+
+// deleteIndexedKeys は index の set に入っている key と index 自体を消す
+func deleteIndexedKeys(ctx context.Context, index string) error {
+	keys, err := rdb.SMembers(ctx, index).Result()
+	if err != nil {
+		return err
+	}
+	// cluster では key ごとに slot が違うので 1 つずつ消す
+	pipe := rdb.Pipeline()
+	for _, key := range keys {
+		pipe.Del(ctx, key)
+	}
+	pipe.Del(ctx, index)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// deleteKeysByPrefix は prefixes で始まる key を SCAN で探して消す。cluster では master ごとに SCAN する。
+// 同じ node でも slot が違う key は 1 つのコマンドで消せないので、1 つずつ pipeline で消す
+func deleteKeysByPrefix(ctx context.Context, prefixes ...string) error {
+	return forEachRedisMaster(ctx, func(ctx context.Context, c redis.Cmdable) error {
+		for _, prefix := range prefixes {
+			var cursor uint64
+			for {
+				keys, next, err := c.Scan(ctx, cursor, prefix+"*", 1000).Result()
+				if err != nil {
+					return err
+				}
+				if len(keys) > 0 {
+					pipe := c.Pipeline()
+					for _, key := range keys {
+						pipe.Unlink(ctx, key)
+					}
+					if _, err := pipe.Exec(ctx); err != nil {
+						return err
+					}
+				}
+				if next == 0 {
+					break
+				}
+				cursor = next
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/labstack/echo"
+)
+
+// cacheStats は cache ごとの hit / miss などの数。atomic に数える
+type cacheStats struct {
+	name      string
+	hits      uint64
+	misses    uint64
+	errors    uint64
+	fills     uint64
+	fillNanos uint64
+	// keys は今 cache に入っている key の数を返す (数えられない cache は nil)
+	keys func(ctx context.Context) (int64, error)
+}
+
+var (
+	cacheStatsMu       sync.Mutex
+	cacheStatsRegistry = make(map[string]*cacheStats)
+)
+
+// redis 上の cache
+var (
+	estateIDsCacheStats = newCacheStats("estate_ids", nil)
+	chairIDsCacheStats  = newCacheStats("chair_ids", nil)
+	commuteCacheStats   = newCacheStats("commute", nil)
+	redisCacheStats     = newCacheStats("redis", redisKeyCount)
+)
+
+// newCacheStats は name の cache の統計を登録する
+func newCacheStats(name string, keys func(ctx context.Context) (int64, error)) *cacheStats {
+	cacheStatsMu.Lock()
+	defer cacheStatsMu.Unlock()
+	s := &cacheStats{name: name, keys: keys}
+	cacheStatsRegistry[name] = s
+	return s
+}
+
+func (s *cacheStats) Hit(n int) {
+	atomic.AddUint64(&s.hits, uint64(n))
+}
+
+func (s *cacheStats) Miss(n int) {
+	atomic.AddUint64(&s.misses, uint64(n))
+}
+
+func (s *cacheStats) Error() {
+	atomic.AddUint64(&s.errors, 1)
+}
+
+// ObserveFill は cache を埋めるのにかかった時間を記録する
+func (s *cacheStats) ObserveFill(d time.Duration) {
+	atomic.AddUint64(&s.fills, 1)
+	atomic.AddUint64(&s.fillNanos, uint64(d))
+}
+
+// redisKeyCount は全 master の key の数を数える
+func redisKeyCount(ctx context.Context) (int64, error) {
+	var mu sync.Mutex
+	var total int64
+	err := forEachRedisMaster(ctx, func(ctx context.Context, c redis.Cmdable) error {
+		n, err := c.DBSize(ctx).Result()
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		total += n
+		mu.Unlock()
+		return nil
+	})
+	return total, err
+}
+
+type CacheStat struct {
+	Name           string  `json:"name"`
+	Hits           uint64  `json:"hits"`
+	Misses         uint64  `json:"misses"`
+	Errors         uint64  `json:"errors"`
+	HitRatio       float64 `json:"hitRatio"`
+	Fills          uint64  `json:"fills"`
+	FillSeconds    float64 `json:"fillSeconds"`
+	AvgFillSeconds float64 `json:"avgFillSeconds"`
+	Keys           *int64  `json:"keys,omitempty"`
+	KeyCountError  string  `json:"keyCountError,omitempty"`
+}
+
+type CacheStatsResponse struct {
+	Caches []CacheStat `json:"caches"`
+}
+
+// collectCacheStats は登録されている cache の統計を名前順に集める
+func collectCacheStats(ctx context.Context) []CacheStat {
+	cacheStatsMu.Lock()
+	all := make([]*cacheStats, 0, len(cacheStatsRegistry))
+	for _, s := range cacheStatsRegistry {
+		all = append(all, s)
+	}
+	cacheStatsMu.Unlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+
+	stats := make([]CacheStat, 0, len(all))
+	for _, s := range all {
+		st := CacheStat{
+			Name:        s.name,
+			Hits:        atomic.LoadUint64(&s.hits),
+			Misses:      atomic.LoadUint64(&s.misses),
+			Errors:      atomic.LoadUint64(&s.errors),
+			Fills:       atomic.LoadUint64(&s.fills),
+			FillSeconds: time.Duration(atomic.LoadUint64(&s.fillNanos)).Seconds(),
+		}
+		if total := st.Hits + st.Misses; total > 0 {
+			st.HitRatio = float64(st.Hits) / float64(total)
+		}
+		if st.Fills > 0 {
+			st.AvgFillSeconds = st.FillSeconds / float64(st.Fills)
+		}
+		if s.keys != nil {
+			n, err := s.keys(ctx)
+			if err != nil {
+				st.KeyCountError = err.Error()
+			} else {
+				st.Keys = &n
+			}
+		}
+		stats = append(stats, st)
+	}
+	return stats
+}
+
+// getCacheStats は cache の統計を人が読む用の JSON で返す
+func getCacheStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, CacheStatsResponse{Caches: collectCacheStats(c.Request().Context())})
+}
+
+// getMetrics は cache の統計を Prometheus の text format で返す
+func getMetrics(c echo.Context) error {
+	stats := collectCacheStats(c.Request().Context())
+	var b strings.Builder
+	writeMetric := func(name string, typ string, help string, value func(st CacheStat) (float64, bool)) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, st := range stats {
+			if v, ok := value(st); ok {
+				fmt.Fprintf(&b, "%s{cache=%q} %g\n", name, st.Name, v)
+			}
+		}
+	}
+	writeMetric("isuumo_cache_hits_total", "counter", "Number of cache hits.", func(st CacheStat) (float64, bool) {
+		return float64(st.Hits), true
+	})
+	writeMetric("isuumo_cache_misses_total", "counter", "Number of cache misses.", func(st CacheStat) (float64, bool) {
+		return float64(st.Misses), true
+	})
+	writeMetric("isuumo_cache_errors_total", "counter", "Number of cache lookup errors.", func(st CacheStat) (float64, bool) {
+		return float64(st.Errors), true
+	})
+	writeMetric("isuumo_cache_fill_seconds_sum", "counter", "Total time spent filling the cache.", func(st CacheStat) (float64, bool) {
+		return st.FillSeconds, true
+	})
+	writeMetric("isuumo_cache_fill_seconds_count", "counter", "Number of cache fills.", func(st CacheStat) (float64, bool) {
+		return float64(st.Fills), true
+	})
+	writeMetric("isuumo_cache_keys", "gauge", "Number of keys currently in the cache.", func(st CacheStat) (float64, bool) {
+		if st.Keys == nil {
+			return 0, false
+		}
+		return float64(*st.Keys), true
+	})
+	writeTxMetrics(&b)
+	return c.Blob(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// リクエストから切り離して裏で cache を埋めたり消したりするときの timeout
+var cacheBackgroundTimeout = getEnvDuration("CACHE_BACKGROUND_TIMEOUT", 10*time.Second)
+
+// cacheDefaultTTL は TTL を指定していない cache の TTL
+func cacheDefaultTTL() time.Duration {
+	return time.Duration(currentConfig().CacheDefaultTTL)
+}
+
+// jitterTTL は ttl を ±CacheTTLJitter の範囲でランダムにずらす。0 以下ならそのまま返す
+func jitterTTL(ttl time.Duration) time.Duration {
+	jitter := currentConfig().CacheTTLJitter
+	if ttl <= 0 || jitter <= 0 {
+		return ttl
+	}
+	factor := 1 + jitter*(2*rand.Float64()-1)
+	jittered := time.Duration(float64(ttl) * factor)
+	// redis の TTL は秒単位なので、それより短くはしない
+	if jittered < time.Second {
+		return time.Second
+	}
+	return jittered
+}
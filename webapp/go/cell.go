@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/astj/isucon10-yosen/webapp/go/geo"
+)
+
+// なぞって検索の前段で使う cell の数の上限
+const nazotteMaxCells = 16
+
+// cellIDUpdateBatchSize は 1 回の UPDATE で cell_id を埋める行数
+const cellIDUpdateBatchSize = 1000
+
+// initializeCellIDs は dump で入れた物件の cell_id を埋める。
+// S2 の cell ID は MySQL では計算できないので Go で計算して、cellIDUpdateBatchSize 件ずつ CASE でまとめて更新する
+func initializeCellIDs(ctx context.Context) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	locations := []struct {
+		ID        int64   `db:"id"`
+		Latitude  float64 `db:"latitude"`
+		Longitude float64 `db:"longitude"`
+	}{}
+	if err := tx.SelectContext(ctx, &locations, "SELECT id, latitude, longitude FROM estate"); err != nil {
+		return err
+	}
+	for start := 0; start < len(locations); start += cellIDUpdateBatchSize {
+		end := start + cellIDUpdateBatchSize
+		if end > len(locations) {
+			end = len(locations)
+		}
+		batch := locations[start:end]
+		cases := make([]string, 0, len(batch))
+		params := make([]interface{}, 0, 3*len(batch))
+		for _, l := range batch {
+			cellID := geo.CellIDFromPoint(geo.Point{Lat: l.Latitude, Lng: l.Longitude})
+			cases = append(cases, "WHEN ? THEN ?")
+			params = append(params, l.ID, uint64(cellID))
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(batch)), ",")
+		for _, l := range batch {
+			params = append(params, l.ID)
+		}
+		query := "UPDATE estate SET cell_id = CASE id " + strings.Join(cases, " ") + " END WHERE id IN (" + placeholders + ")"
+		if _, err := tx.ExecContext(ctx, query, params...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// cellCondition は bounding box を覆う cell_id の範囲の条件を作る
+func cellCondition(b BoundingBox) (string, []interface{}) {
+	return cellRangeCondition(geo.Covering(geo.Bound{
+		Min: geo.Point{Lat: b.TopLeftCorner.Latitude, Lng: b.TopLeftCorner.Longitude},
+		Max: geo.Point{Lat: b.BottomRightCorner.Latitude, Lng: b.BottomRightCorner.Longitude},
+	}, nazotteMaxCells))
+}
+
+// polygonCellCondition は polygon を覆う cell_id の範囲の条件を作る
+func polygonCellCondition(p geo.Polygon) (string, []interface{}) {
+	return cellRangeCondition(geo.PolygonCovering(p, nazotteMaxCells))
+}
+
+func cellRangeCondition(ranges []geo.CellRange) (string, []interface{}) {
+	// 面積のない polygon は何も含まない
+	if len(ranges) == 0 {
+		return "FALSE", nil
+	}
+	conditions := make([]string, 0, len(ranges))
+	params := make([]interface{}, 0, 2*len(ranges))
+	for _, r := range ranges {
+		conditions = append(conditions, "cell_id BETWEEN ? AND ?")
+		params = append(params, uint64(r.Min), uint64(r.Max))
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", params
+}
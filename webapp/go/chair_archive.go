@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+// 売り切れた椅子は chair から消すが、後から調べたり再入荷したりできるように chair_archive に残す
+const (
+	chairArchiveDefaultPerPage = 25
+	chairArchiveMaxPerPage     = 100
+)
+
+// chairArchiveColumns は chair から chair_archive に写すカラム。chair にカラムを足したらここにも足す。
+// stock は売り切れた時点のものなので 0 で入れる。neg_popularity は generated column なので写さない
+const chairArchiveColumns = "id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, score, sale_price, sale_until, thumbnail_hash, material, weight, created_at, updated_at"
+
+type ArchivedChair struct {
+	ArchiveID  int64     `db:"archive_id" json:"archiveId"`
+	ArchivedAt time.Time `db:"archived_at" json:"archivedAt"`
+	Chair
+}
+
+type ChairArchiveResponse struct {
+	Count  int64           `json:"count"`
+	Chairs []ArchivedChair `json:"chairs"`
+}
+
+// archiveChair は id の椅子を chair_archive に写す。chair から消す前に同じ transaction で呼ぶ
+func archiveChair(ctx context.Context, tx *sqlx.Tx, id int) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO chair_archive ("+chairArchiveColumns+", stock) SELECT "+chairArchiveColumns+", 0 FROM chair WHERE id = ?", id)
+	return err
+}
+
+// getChairArchive は売り切れた椅子を新しく売り切れた順に返す。
+// id (椅子の ID)、name (部分一致)、kind、color で絞れる
+func getChairArchive(c echo.Context) error {
+	ctx := c.Request().Context()
+	f := newSQLFilter()
+	if v := c.QueryParam("id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			c.Logger().Infof("Invalid format id parameter : %v", err)
+			return c.NoContent(http.StatusBadRequest)
+		}
+		f.Eq(colID, id)
+	}
+	if v := c.QueryParam("name"); v != "" {
+		f.Raw(string(colChairName)+" LIKE CONCAT('%', ?, '%')", v)
+	}
+	if v := c.QueryParam("kind"); v != "" {
+		f.Eq(colChairKind, v)
+	}
+	if v := c.QueryParam("color"); v != "" {
+		f.Eq(colChairColor, v)
+	}
+	if f.Empty() {
+		f.Raw("TRUE")
+	}
+
+	page := 0
+	if v := c.QueryParam("page"); v != "" {
+		var err error
+		page, err = strconv.Atoi(v)
+		if err != nil || page < 0 {
+			c.Logger().Infof("Invalid format page parameter : %v", v)
+			return c.NoContent(http.StatusBadRequest)
+		}
+	}
+	perPage := chairArchiveDefaultPerPage
+	if v := c.QueryParam("perPage"); v != "" {
+		var err error
+		perPage, err = strconv.Atoi(v)
+		if err != nil || perPage <= 0 || perPage > chairArchiveMaxPerPage {
+			c.Logger().Infof("Invalid format perPage parameter : %v", v)
+			return c.NoContent(http.StatusBadRequest)
+		}
+	}
+
+	where, params := f.Where()
+	count, err := countRows(ctx, "chair_archive", where, params)
+	if err != nil {
+		c.Logger().Errorf("getChairArchive DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	chairs := make([]ArchivedChair, 0, perPage)
+	err = selectRows(ctx, &chairs, "chair_archive", where, params, "archived_at DESC, archive_id DESC", nil, int64(perPage), int64(page*perPage))
+	if err != nil {
+		c.Logger().Errorf("getChairArchive DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	for i := range chairs {
+		chairs[i].setEffectivePrice(chairs[i].ArchivedAt)
+	}
+	return c.JSON(http.StatusOK, ChairArchiveResponse{Count: count, Chairs: chairs})
+}
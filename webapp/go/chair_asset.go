@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// 椅子の 3D モデルや寸法図などの素材は chair_asset に (chair_id, type) ごとに URL で持つ。
+// 種類を増やすときは chairAssetTypes に足すだけでいい (テーブルは変えない)
+const (
+	ChairAssetModelGLB     = "model_glb"
+	ChairAssetDimensionPNG = "dimension_png"
+)
+
+var chairAssetTypes = map[string]bool{
+	ChairAssetModelGLB:     true,
+	ChairAssetDimensionPNG: true,
+}
+
+// chairAssetURLMaxLength は chair_asset.url の長さ
+const chairAssetURLMaxLength = 256
+
+type ChairAssetsResponse struct {
+	ID     int64             `json:"id"`
+	Assets map[string]string `json:"assets"`
+}
+
+func getChairAssets(ctx context.Context, id int64) (map[string]string, error) {
+	var rows []struct {
+		Type string `db:"type"`
+		URL  string `db:"url"`
+	}
+	if err := db.SelectContext(ctx, &rows, "SELECT type, url FROM chair_asset WHERE chair_id = ?", id); err != nil {
+		return nil, err
+	}
+	assets := make(map[string]string, len(rows))
+	for _, r := range rows {
+		assets[r.Type] = r.URL
+	}
+	return assets, nil
+}
+
+// putChairAssets は body の {"種類": "URL"} で椅子の素材を上書きする。
+// 書かれていない種類はそのまま残し、空文字か null なら消す
+func putChairAssets(c echo.Context) error {
+	ctx := c.Request().Context()
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	req := map[string]*string{}
+	if err := c.Bind(&req); err != nil {
+		c.Echo().Logger.Infof("put chair assets failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	for typ, url := range req {
+		if !chairAssetTypes[typ] {
+			c.Echo().Logger.Infof("put chair assets failed : unknown type %v", typ)
+			return c.NoContent(http.StatusBadRequest)
+		}
+		if url != nil && len(strings.TrimSpace(*url)) > chairAssetURLMaxLength {
+			c.Echo().Logger.Infof("put chair assets failed : url too long for %v", typ)
+			return c.NoContent(http.StatusBadRequest)
+		}
+	}
+
+	var exists int
+	if err := db.GetContext(ctx, &exists, "SELECT COUNT(*) FROM chair WHERE id = ?", id); err != nil {
+		c.Logger().Errorf("putChairAssets DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if exists == 0 {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		c.Logger().Errorf("failed to begin tx : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+	for typ, url := range req {
+		if url == nil || strings.TrimSpace(*url) == "" {
+			_, err = tx.ExecContext(ctx, "DELETE FROM chair_asset WHERE chair_id = ? AND type = ?", id, typ)
+		} else {
+			_, err = tx.ExecContext(ctx, "INSERT INTO chair_asset (chair_id, type, url) VALUES (?,?,?) ON DUPLICATE KEY UPDATE url = VALUES(url)", id, typ, strings.TrimSpace(*url))
+		}
+		if err != nil {
+			c.Logger().Errorf("putChairAssets DB execution error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.Logger().Errorf("failed to commit tx : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// 詳細のレスポンスだけが変わる
+	purgeResponseCache(ctx, responseCacheGroupChair)
+	purgeSurrogateKeys(c.Logger(), surrogateKeyForChair(int64(id)))
+
+	assets, err := getChairAssets(ctx, int64(id))
+	if err != nil {
+		c.Logger().Errorf("putChairAssets DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, ChairAssetsResponse{ID: int64(id), Assets: assets})
+}
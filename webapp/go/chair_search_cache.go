@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 椅子の検索結果の ID リストも estate と同じく redis の list に持つ。
+// key は chair:v{版}:{sha1(正規化した条件)} で、入稿や売り切れで椅子が変わったら版を上げて古い版を消す
+const chairIDsCacheVersionKey = "chair:version"
+
+// chairIDsCacheKey は今の版での条件 q と並び順 sort の key を返す
+func chairIDsCacheKey(ctx context.Context, q ChairSearchQuery, sort string) (string, error) {
+	return searchIDsCache.Key(ctx, "chair", genChairCacheKey(q, sort))
+}
+
+// genChairCacheKey は genCacheKey の椅子版。sort で並び順が変わるので sort も入れる
+func genChairCacheKey(q ChairSearchQuery, sort string) string {
+	v := url.Values{}
+	v.Set("priceRangeId", normalizeIntParam(q.PriceRangeID))
+	v.Set("heightRangeId", normalizeIntParam(q.HeightRangeID))
+	v.Set("widthRangeId", normalizeIntParam(q.WidthRangeID))
+	v.Set("depthRangeId", normalizeIntParam(q.DepthRangeID))
+	v.Set("kind", q.Kind)
+	v.Set("color", q.Color)
+	v.Set("features", normalizeFeatureList(q.Features))
+	v.Set("newerThan", normalizeTimeParam(q.NewerThan))
+	v.Set("weightRangeId", normalizeIntParam(q.WeightRangeID))
+	v.Set("material", q.Material)
+	v.Set("priceMin", normalizeIntParam(q.PriceMin))
+	v.Set("priceMax", normalizeIntParam(q.PriceMax))
+	v.Set("heightMin", normalizeIntParam(q.HeightMin))
+	v.Set("heightMax", normalizeIntParam(q.HeightMax))
+	v.Set("widthMin", normalizeIntParam(q.WidthMin))
+	v.Set("widthMax", normalizeIntParam(q.WidthMax))
+	v.Set("depthMin", normalizeIntParam(q.DepthMin))
+	v.Set("depthMax", normalizeIntParam(q.DepthMax))
+	v.Set("minPopularity", normalizeIntParam(q.MinPopularity))
+	v.Set("excludeFeatures", normalizeFeatureList(q.ExcludeFeatures))
+	featuresMatch, _ := normalizeFeaturesMatch(q.FeaturesMatch)
+	v.Set("featuresMatch", featuresMatch)
+	v.Set("sort", sort)
+	v.Set("order", chairOrderName)
+	return v.Encode()
+}
+
+// chairIDsCacheTTL は設定の TTL を、セールが一番早く終わるまでに縮めたもの。
+// セールが終わると値段の絞り込みや並び順が変わるので、そこで作り直す
+func chairIDsCacheTTL(ctx context.Context) time.Duration {
+	ttl := time.Duration(currentConfig().ChairIDsCacheTTL)
+	var saleUntil sql.NullTime
+	err := db.GetContext(ctx, &saleUntil, "SELECT MIN(sale_until) FROM chair WHERE sale_price IS NOT NULL AND sale_until > UTC_TIMESTAMP(6)")
+	if err != nil || !saleUntil.Valid {
+		return ttl
+	}
+	if d := time.Until(saleUntil.Time); d > 0 && (ttl <= 0 || d < ttl) {
+		ttl = d
+	}
+	return ttl
+}
+
+// purgeChairIDsFromRedis は椅子が増えたり消えたりしたときに版を上げる
+func purgeChairIDsFromRedis(ctx context.Context) error {
+	chairLocalIDsCache.Purge()
+	return handlePurgeError(searchIDsCache.Purge(ctx, "chair"))
+}
+
+// searchChairIDsFromMysql は cache に埋める用に、条件に合う椅子の ID を全部並べて返す
+func searchChairIDsFromMysql(ctx context.Context, where string, params []interface{}, order string) ([]int64, error) {
+	return selectIDs(ctx, "chair", where, params, order)
+}
+
+// searchChairsWithCache は where / order の検索結果を ID リストの cache から返す。
+// 無ければ MySQL から ID を全部取って cache に入れてから返す (同じ条件は 1 回にまとめる)。keyword のときは順番が検索ごとに違うので使わない
+func searchChairsWithCache(ctx context.Context, logger echo.Logger, q ChairSearchQuery, sort string, where string, params []interface{}, order string, limit int64, offset int64) ([]Chair, int64, error) {
+	// redis が落ちている間は instance の中の cache を使う
+	if !cacheAvailable() {
+		return searchChairsWithLocalCache(ctx, q, sort, where, params, order, limit, offset)
+	}
+	key, err := chairIDsCacheKey(ctx, q, sort)
+	var ids []int64
+	var count int64
+	if err == nil {
+		ids, count, err = searchIDsCache.Get(ctx, key, limit, offset)
+	}
+	if err == errCacheNotHit {
+		chairIDsCacheStats.Miss(1)
+		var all []int64
+		all, err = fillIDsCache(logger, key, chairIDsCacheStats, chairIDsCacheTTL, func(ctx context.Context) ([]int64, error) {
+			return searchChairIDsFromMysql(ctx, where, params, order)
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		count = int64(len(all))
+		ids = pageIDs(all, limit, offset)
+	} else {
+		if err != nil {
+			chairIDsCacheStats.Error()
+		} else {
+			chairIDsCacheStats.Hit(1)
+		}
+		if isCacheConnectionError(err) {
+			markCacheUnhealthy(err)
+			return searchChairsWithLocalCache(ctx, q, sort, where, params, order, limit, offset)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	chairs, err := selectChairsFromIDs(ctx, ids)
+	if err != nil {
+		return nil, 0, err
+	}
+	return chairs, count, nil
+}
+
+// searchChairsWithLocalCache は redis が使えない間に、ID リストを instance の中の LRU から引く
+func searchChairsWithLocalCache(ctx context.Context, q ChairSearchQuery, sort string, where string, params []interface{}, order string, limit int64, offset int64) ([]Chair, int64, error) {
+	all, err := chairLocalIDsCache.getOrFill(hashCacheKey(genChairCacheKey(q, sort)), func(ctx context.Context) ([]int64, error) {
+		return searchChairIDsFromMysql(ctx, where, params, order)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	chairs, err := selectChairsFromIDs(ctx, pageIDs(all, limit, offset))
+	if err != nil {
+		return nil, 0, err
+	}
+	return chairs, int64(len(all)), nil
+}
+
+// searchChairsWithoutCache は COUNT とページの SELECT を別々の接続で同時に投げる。
+// 件数は countKey (正規化した条件) で cache する
+func searchChairsWithoutCache(ctx context.Context, countKey string, where string, params []interface{}, order string, orderParams []interface{}, limit int64, offset int64) ([]Chair, int64, error) {
+	var count int64
+	var countErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		count, countErr = cachedCount(ctx, "chair", countKey, chairIDsCacheTTL, func() (int64, error) {
+			return countRows(ctx, "chair", where, params)
+		})
+	}()
+
+	chairs := []Chair{}
+	var err error
+	if limit > 0 {
+		err = selectRows(ctx, &chairs, "chair", where, params, order, orderParams, limit, offset)
+	}
+	wg.Wait()
+	if countErr != nil {
+		return nil, 0, countErr
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return chairs, count, nil
+}
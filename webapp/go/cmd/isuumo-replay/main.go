@@ -0,0 +1,154 @@
+// isuumo-replay は REQUEST_RECORD で記録したリクエストを別の host に送り直す。
+//
+//	isuumo-replay -target http://localhost:1323 -speed 2 file:requests.jsonl
+//	isuumo-replay -target http://localhost:1323 redis:localhost:6379/isuumo:requests
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astj/isucon10-yosen/webapp/go/record"
+	"github.com/go-redis/redis/v8"
+)
+
+func main() {
+	target := flag.String("target", "http://localhost:1323", "送り先")
+	speed := flag.Float64("speed", 1, "再生速度の倍率。0 なら間隔を空けずに送る")
+	concurrency := flag.Int("concurrency", 16, "同時に送るリクエストの数の上限")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: isuumo-replay [-target URL] [-speed N] [-concurrency N] file:<path>|redis:<addr>/<stream>")
+		os.Exit(2)
+	}
+
+	requests, err := load(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	replay(*target, requests, *speed, *concurrency)
+}
+
+func load(source string) ([]*record.Request, error) {
+	switch {
+	case strings.HasPrefix(source, "file:"):
+		f, err := os.Open(strings.TrimPrefix(source, "file:"))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r := record.NewReader(f)
+		requests := []*record.Request{}
+		for {
+			req, err := r.Next()
+			if err == io.EOF {
+				return requests, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			requests = append(requests, req)
+		}
+	case strings.HasPrefix(source, "redis:"):
+		rest := strings.TrimPrefix(source, "redis:")
+		i := strings.Index(rest, "/")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid redis source: %v", source)
+		}
+		rdb := redis.NewClient(&redis.Options{Addr: rest[:i]})
+		defer rdb.Close()
+		messages, err := rdb.XRange(context.Background(), rest[i+1:], "-", "+").Result()
+		if err != nil {
+			return nil, err
+		}
+		requests := make([]*record.Request, 0, len(messages))
+		for _, m := range messages {
+			line, ok := m.Values[record.StreamField].(string)
+			if !ok {
+				continue
+			}
+			req, err := record.NewReader(strings.NewReader(line)).Next()
+			if err != nil {
+				return nil, err
+			}
+			requests = append(requests, req)
+		}
+		return requests, nil
+	default:
+		return nil, fmt.Errorf("unknown source: %v", source)
+	}
+}
+
+// replay は記録されたときの間隔を speed 倍に縮めて送る
+func replay(target string, requests []*record.Request, speed float64, concurrency int) {
+	if len(requests) == 0 {
+		return
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	statuses := map[int]int{}
+
+	start := time.Now()
+	origin := requests[0].Time
+	for _, req := range requests {
+		if speed > 0 {
+			at := time.Duration(float64(req.Time.Sub(origin)) / speed)
+			if d := at - time.Since(start); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		if req.Truncated {
+			fmt.Fprintf(os.Stderr, "skip truncated request: %v %v\n", req.Method, req.URI)
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(req *record.Request) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			status := send(client, target, req)
+			mu.Lock()
+			statuses[status]++
+			mu.Unlock()
+		}(req)
+	}
+	wg.Wait()
+
+	fmt.Printf("replayed %d requests in %v\n", len(requests), time.Since(start))
+	for status, n := range statuses {
+		fmt.Printf("  %d: %d\n", status, n)
+	}
+}
+
+// send は 1 リクエスト送ってステータスコードを返す。送れなかったら 0
+func send(client *http.Client, target string, req *record.Request) int {
+	httpReq, err := http.NewRequest(req.Method, strings.TrimRight(target, "/")+req.URI, bytes.NewReader(req.Body))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 0
+	}
+	for k, v := range req.Header {
+		httpReq.Header.Set(k, v)
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 0
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.StatusCode
+}
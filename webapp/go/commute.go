@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astj/isucon10-yosen/webapp/go/geo"
+	"github.com/labstack/echo"
+)
+
+const (
+	// 通勤時間は searchIDsCache に commute:v{版}:{目的地}-{物件 ID} の key で 1 件ずつ持つ
+	commuteCachePrefix = "commute"
+	commuteCacheTTL    = 24 * time.Hour
+	// 候補を絞るときの移動速度の上限 (m/分)。これより速くは移動できないとみなす
+	commuteMaxMetersPerMinute = 1000
+	// maxMinutes はこれより長く指定されても、これで切る (3 時間より遠いところは通勤とみなさない)
+	commuteMaxMinutes = 180
+	// commuteTruncatedHeader は候補を commuteMaxCandidates 件で打ち切ったときに付けるレスポンスヘッダー。
+	// 打ち切ったときの count は、調べた候補の中で通えるものの数になる
+	commuteTruncatedHeader = "X-Commute-Truncated"
+	// routing API を同時に呼ぶ数
+	commuteAPIWorkers = 8
+)
+
+var (
+	// COMMUTE_API_URL が空なら API は呼ばずに直線距離から見積もる
+	commuteAPIURL = getEnv("COMMUTE_API_URL", "")
+	// 見積もりに使う平均の移動速度 (m/分)
+	commuteMetersPerMinute = float64(getEnvInt("COMMUTE_METERS_PER_MINUTE", 400))
+	// 1 リクエストで通勤時間を調べる物件数の上限 (並び順の上位から)。
+	// 全部 routing API に聞くことがあるので小さくしておく
+	commuteMaxCandidates = getEnvInt("COMMUTE_MAX_CANDIDATES", 200)
+	commuteHTTPClient    = &http.Client{Timeout: 3 * time.Second}
+)
+
+// searchEstateCommute は to (緯度,経度) まで maxMinutes 分以内で通える物件を返す
+func searchEstateCommute(c echo.Context) error {
+	ctx := c.Request().Context()
+	to, err := parseLatLng(c.QueryParam("to"))
+	if err != nil {
+		c.Logger().Infof("Invalid to parameter : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	maxMinutes, err := strconv.Atoi(c.QueryParam("maxMinutes"))
+	if err != nil || maxMinutes <= 0 {
+		c.Logger().Infof("Invalid maxMinutes parameter : %v", c.QueryParam("maxMinutes"))
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if maxMinutes > commuteMaxMinutes {
+		maxMinutes = commuteMaxMinutes
+	}
+	page, perPage, err := parsePaging(c)
+	if err != nil {
+		c.Logger().Infof("Invalid paging parameter : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	// どんなに速くても届かない範囲は最初から除く
+	b := commuteBoundingBox(to, float64(maxMinutes)*commuteMaxMetersPerMinute)
+	cellCond, params := cellCondition(b)
+	query := `SELECT * FROM estate WHERE ` + cellCond + ` AND latitude <= ? AND latitude >= ? AND longitude <= ? AND longitude >= ? AND status = 'available' ORDER BY ` + estateOrder + ` LIMIT ?`
+	params = append(params, b.BottomRightCorner.Latitude, b.TopLeftCorner.Latitude, b.BottomRightCorner.Longitude, b.TopLeftCorner.Longitude, commuteMaxCandidates)
+	candidates := []Estate{}
+	if err := db.SelectContext(ctx, &candidates, query, params...); err != nil {
+		c.Logger().Errorf("searchEstateCommute DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if len(candidates) >= commuteMaxCandidates {
+		c.Response().Header().Set(commuteTruncatedHeader, "true")
+	}
+
+	minutes, err := commuteMinutes(ctx, to, candidates)
+	if err != nil {
+		c.Logger().Errorf("searchEstateCommute routing error : %v", err)
+		return c.NoContent(http.StatusBadGateway)
+	}
+
+	matched := []Estate{}
+	for i := range candidates {
+		if minutes[i] <= int64(maxMinutes) {
+			m := minutes[i]
+			candidates[i].CommuteMinutes = &m
+			matched = append(matched, candidates[i])
+		}
+	}
+
+	res := EstateSearchResponse{Count: int64(len(matched)), Estates: []Estate{}}
+	if start := page * perPage; start < len(matched) {
+		end := start + perPage
+		if end > len(matched) {
+			end = len(matched)
+		}
+		res.Estates = matched[start:end]
+	}
+	hideEstateTimestamps(c, res.Estates)
+	return renderList(c, http.StatusOK, res)
+}
+
+// parsePaging は page (0 始まり) と perPage を読む。省略されたら 0 と Limit
+func parsePaging(c echo.Context) (int, int, error) {
+	page, perPage := 0, Limit
+	var err error
+	if c.QueryParam("page") != "" {
+		if page, err = strconv.Atoi(c.QueryParam("page")); err != nil || page < 0 {
+			return 0, 0, fmt.Errorf("invalid page: %v", c.QueryParam("page"))
+		}
+	}
+	if c.QueryParam("perPage") != "" {
+		if perPage, err = strconv.Atoi(c.QueryParam("perPage")); err != nil || perPage <= 0 || exceedsMaxPerPage(perPage) {
+			return 0, 0, fmt.Errorf("invalid perPage: %v", c.QueryParam("perPage"))
+		}
+	}
+	return page, perPage, nil
+}
+
+// parseLatLng は "35.68,139.76" を読む
+func parseLatLng(s string) (Coordinate, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return Coordinate{}, fmt.Errorf("invalid coordinate: %q", s)
+	}
+	lat, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return Coordinate{}, err
+	}
+	lng, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return Coordinate{}, err
+	}
+	coordinate := Coordinate{Latitude: lat, Longitude: lng}
+	return coordinate, coordinate.validate()
+}
+
+// commuteBoundingBox は center から meters 以内を囲む矩形
+func commuteBoundingBox(center Coordinate, meters float64) BoundingBox {
+	dLat := meters / 111320
+	dLng := 180.0
+	if cos := math.Cos(center.Latitude * math.Pi / 180); cos > 0.01 {
+		dLng = math.Min(180, dLat/cos)
+	}
+	return BoundingBox{
+		TopLeftCorner: Coordinate{
+			Latitude:  math.Max(-90, center.Latitude-dLat),
+			Longitude: math.Max(-180, center.Longitude-dLng),
+		},
+		BottomRightCorner: Coordinate{
+			Latitude:  math.Min(90, center.Latitude+dLat),
+			Longitude: math.Min(180, center.Longitude+dLng),
+		},
+	}
+}
+
+// commuteKey は目的地 to までの物件 id の通勤時間の key。
+// 最後の ':' までが同じなので、全部同じ版の index に入る
+func commuteKey(version int64, to Coordinate, id int64) string {
+	return fmt.Sprintf("%s:v%d:%.3f,%.3f-%d", commuteCachePrefix, version, to.Latitude, to.Longitude, id)
+}
+
+// commuteMinutes は各物件から to までの通勤時間 (分) を返す。
+// 目的地は 100m 程度に丸めて searchIDsCache に cache する
+func commuteMinutes(ctx context.Context, to Coordinate, estates []Estate) ([]int64, error) {
+	minutes := make([]int64, len(estates))
+	if len(estates) == 0 {
+		return minutes, nil
+	}
+	keys := make([]string, len(estates))
+	version, err := searchIDsCache.Version(ctx, commuteCachePrefix)
+	var cached [][]byte
+	if err == nil {
+		for i, e := range estates {
+			keys[i] = commuteKey(version, to, e.ID)
+		}
+		cached, err = searchIDsCache.GetValues(ctx, keys)
+	}
+	if err != nil {
+		// cache が引けないだけなら全部計算して、書き込みもしない
+		commuteCacheStats.Error()
+		if isCacheConnectionError(err) {
+			markCacheUnhealthy(err)
+		}
+		cached, keys = make([][]byte, len(estates)), nil
+	}
+
+	missing := []int{}
+	for i, v := range cached {
+		if v == nil {
+			missing = append(missing, i)
+			continue
+		}
+		m, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			missing = append(missing, i)
+			continue
+		}
+		minutes[i] = m
+	}
+	commuteCacheStats.Hit(len(estates) - len(missing))
+	commuteCacheStats.Miss(len(missing))
+	if len(missing) == 0 {
+		return minutes, nil
+	}
+
+	start := time.Now()
+	if err := fetchCommuteMinutes(ctx, to, estates, missing, minutes); err != nil {
+		return nil, err
+	}
+	commuteCacheStats.ObserveFill(time.Since(start))
+	if keys == nil {
+		return minutes, nil
+	}
+	values := make(map[string][]byte, len(missing))
+	for _, i := range missing {
+		values[keys[i]] = []byte(strconv.FormatInt(minutes[i], 10))
+	}
+	if err := searchIDsCache.PutValues(ctx, values, commuteCacheTTL); isCacheConnectionError(err) {
+		markCacheUnhealthy(err)
+	}
+	return minutes, nil
+}
+
+// fetchCommuteMinutes は estates[i] (i は indexes) の通勤時間を minutes[i] に入れる
+func fetchCommuteMinutes(ctx context.Context, to Coordinate, estates []Estate, indexes []int, minutes []int64) error {
+	if commuteAPIURL == "" {
+		for _, i := range indexes {
+			minutes[i] = estimateCommuteMinutes(estates[i], to)
+		}
+		return nil
+	}
+
+	sem := make(chan struct{}, commuteAPIWorkers)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for _, i := range indexes {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			m, err := requestCommuteMinutes(ctx, Coordinate{Latitude: estates[i].Latitude, Longitude: estates[i].Longitude}, to)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				return
+			}
+			minutes[i] = m
+		}(i)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// estimateCommuteMinutes は直線距離を平均の移動速度で割って見積もる
+func estimateCommuteMinutes(e Estate, to Coordinate) int64 {
+	d := geo.Distance(geo.Point{Lat: e.Latitude, Lng: e.Longitude}, geo.Point{Lat: to.Latitude, Lng: to.Longitude})
+	return int64(math.Ceil(d / commuteMetersPerMinute))
+}
+
+// requestCommuteMinutes は routing API に GET {COMMUTE_API_URL}?from=lat,lng&to=lat,lng を投げて
+// {"minutes": N} を受け取る
+func requestCommuteMinutes(ctx context.Context, from Coordinate, to Coordinate) (int64, error) {
+	q := url.Values{}
+	q.Set("from", fmt.Sprintf("%f,%f", from.Latitude, from.Longitude))
+	q.Set("to", fmt.Sprintf("%f,%f", to.Latitude, to.Longitude))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, commuteAPIURL+"?"+q.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := commuteHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("routing api returned %v", resp.Status)
+	}
+	var body struct {
+		Minutes float64 `json:"minutes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, err
+	}
+	return int64(math.Ceil(body.Minutes)), nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// 複数台構成のときに initialize を 1 回だけ実行するための lock と、
+// 終わったことを他の instance に伝えるための channel
+const (
+	initializeLockKey    = "isuumo:initialize:lock"
+	initializeLockTTL    = 90 * time.Second
+	reinitializedChannel = "isuumo:reinitialized"
+)
+
+var instanceID = newInstanceID()
+
+// localResetHooks は initialize されたときに instance ごとの状態を捨てるために呼ばれる。
+// 他の instance で initialize された場合も呼ばれる
+var localResetHooks []func()
+
+// 自分が持っている lock のときだけ消す
+var releaseLockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+func resetLocalState() {
+	for _, f := range localResetHooks {
+		f()
+	}
+}
+
+// acquireInitializeLock は initialize の lock を取る。
+// 他の instance が initialize 中の場合は false が返る
+func acquireInitializeLock(ctx context.Context) (bool, error) {
+	return rdb.SetNX(ctx, initializeLockKey, instanceID, initializeLockTTL).Result()
+}
+
+func releaseInitializeLock(ctx context.Context) error {
+	return releaseLockScript.Run(ctx, rdb, []string{initializeLockKey}, instanceID).Err()
+}
+
+// waitInitializeLock は他の instance の initialize が終わる (lock が消える) まで待つ
+func waitInitializeLock(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, initializeLockTTL)
+	defer cancel()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		n, err := rdb.Exists(ctx, initializeLockKey).Result()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// notifyReinitialized は initialize が終わったことを他の instance に伝える
+func notifyReinitialized(ctx context.Context) error {
+	resetLocalState()
+	return rdb.Publish(ctx, reinitializedChannel, instanceID).Err()
+}
+
+// subscribeReinitialized は他の instance で initialize されたら手元の状態を捨てる
+func subscribeReinitialized(ctx context.Context) {
+	pubsub := rdb.Subscribe(ctx, reinitializedChannel)
+	defer pubsub.Close()
+	for msg := range pubsub.Channel() {
+		if msg.Payload == instanceID {
+			continue
+		}
+		resetLocalState()
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// 検索の件数の cache。ID リストの cache は LLEN が件数になるが、keyword のときは ID リストを持たないので、
+// 同じ条件でページを進めるたびに COUNT(*) を投げないように件数だけ持っておく。
+// key は ID リストと同じ版の {prefix}:v{版}:{hash} にして、版を上げたときに一緒に消す
+var searchCountCacheStats = newCacheStats("search_count", nil)
+
+// versionedCacheKey は versionKey の今の版での、正規化した条件の hash の key を返す。
+// hash の部分を {} で囲んで cluster の hash tag にし、作り直すときの一時 key を同じ slot に置けるようにする
+func versionedCacheKey(ctx context.Context, versionKey string, prefix string, hash string) (string, error) {
+	version, err := rdb.Get(ctx, versionKey).Int64()
+	if err != nil && err != redis.Nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:v%d:{%s}", prefix, version, hash), nil
+}
+
+// cachedCount は条件 normalized の件数を返す。cache に無ければ count で数えて ttl(ctx) の間入れておく
+func cachedCount(ctx context.Context, prefix string, normalized string, ttl func(ctx context.Context) time.Duration, count func() (int64, error)) (int64, error) {
+	if !cacheAvailable() {
+		return count()
+	}
+	// ID リストの key と被らないようにする
+	key, err := searchIDsCache.Key(ctx, prefix, "count:"+normalized)
+	if err == nil {
+		var values [][]byte
+		values, err = searchIDsCache.GetValues(ctx, []string{key})
+		if err == nil && values[0] != nil {
+			if n, err := strconv.ParseInt(string(values[0]), 10, 64); err == nil {
+				searchCountCacheStats.Hit(1)
+				return n, nil
+			}
+		}
+	}
+	if err != nil {
+		searchCountCacheStats.Error()
+		if isCacheConnectionError(err) {
+			markCacheUnhealthy(err)
+		}
+		return count()
+	}
+	searchCountCacheStats.Miss(1)
+	n, err := count()
+	if err != nil {
+		return 0, err
+	}
+	value := []byte(strconv.FormatInt(n, 10))
+	if err := searchIDsCache.PutValues(ctx, map[string][]byte{key: value}, ttl(ctx)); isCacheConnectionError(err) {
+		markCacheUnhealthy(err)
+	}
+	return n, nil
+}
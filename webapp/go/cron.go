@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule は 5 フィールド (分 時 日 月 曜日) の cron 式。
+// 各フィールドは * / a-b / a,b / */n / a-b/n が書ける
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// 日と曜日の両方が指定されていたら、どちらかに合えば実行する (cron と同じ)。
+	// cron と同じく * で始まるフィールド (*/2 など) は指定されていない扱いにする
+	domRestricted, dowRestricted bool
+}
+
+type cronField struct {
+	min, max int
+}
+
+var cronFields = []cronField{
+	{0, 59}, // 分
+	{0, 23}, // 時
+	{1, 31}, // 日
+	{1, 12}, // 月
+	{0, 7},  // 曜日 (0 と 7 は日曜)
+}
+
+func parseCron(expr string) (cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return cronSchedule{}, fmt.Errorf("cron expression must have %d fields: %q", len(cronFields), expr)
+	}
+	bits := make([]uint64, len(fields))
+	for i, f := range fields {
+		b, err := parseCronField(f, cronFields[i])
+		if err != nil {
+			return cronSchedule{}, fmt.Errorf("invalid cron field %q: %v", f, err)
+		}
+		bits[i] = b
+	}
+	// 7 も日曜
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return cronSchedule{
+		minute:        bits[0],
+		hour:          bits[1],
+		dom:           bits[2],
+		month:         bits[3],
+		dow:           bits[4],
+		domRestricted: !strings.HasPrefix(fields[2], "*"),
+		dowRestricted: !strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+func parseCronField(s string, field cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			step = n
+			part = part[:i]
+		}
+		lo, hi := field.min, field.max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, err
+			}
+			if hi, err = strconv.Atoi(bounds[1]); err != nil {
+				return 0, err
+			}
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, err
+			}
+			lo, hi = n, n
+		}
+		if lo < field.min || hi > field.max || lo > hi {
+			return 0, fmt.Errorf("out of range %d-%d", lo, hi)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// Matches は t (の分) に実行するかどうかを返す
+func (s cronSchedule) Matches(t time.Time) bool {
+	return s.minute&(1<<uint(t.Minute())) != 0 && s.hour&(1<<uint(t.Hour())) != 0 &&
+		s.month&(1<<uint(t.Month())) != 0 && s.dayMatches(t)
+}
+
+func (s cronSchedule) dayMatches(t time.Time) bool {
+	domOK := s.dom&(1<<uint(t.Day())) != 0
+	dowOK := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domRestricted && s.dowRestricted {
+		return domOK || dowOK
+	}
+	return domOK && dowOK
+}
+
+// cronSearchLimit より先まで探しても合わない式 (2 月 30 日など) は実行されないものとする
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+// Next は t より後で最初に実行する分を返す。実行されない式ならゼロ値
+func (s cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(cronSearchLimit)
+	for t.Before(limit) {
+		y, mo, d := t.Date()
+		switch {
+		case s.month&(1<<uint(mo)) == 0:
+			t = time.Date(y, mo+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(y, mo, d+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(y, mo, d, t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
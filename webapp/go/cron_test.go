@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr                          string
+		minute, hour, dom, month, dow uint64
+		domRestricted, dowRestricted  bool
+	}{
+		{"* * * * *", 1<<60 - 1, 1<<24 - 1, 1<<32 - 2, 1<<13 - 2, 1<<8 - 1, false, false},
+		{"0,30 9-17/4 1 */6 1-5", 1 | 1<<30, 1<<9 | 1<<13 | 1<<17, 1 << 1, 1<<1 | 1<<7, 0x3e, true, true},
+		// 7 も日曜
+		{"0 0 * * 7", 1, 1, 1<<32 - 2, 1<<13 - 2, 1 | 1<<7, false, true},
+		// */2 は * で始まるので指定されていない扱い
+		{"0 0 */2 * 1", 1, 1, 0xaaaaaaaa, 1<<13 - 2, 1 << 1, false, true},
+		{"0 0 1 * */2", 1, 1, 1 << 1, 1<<13 - 2, 0x55, true, false},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		want := cronSchedule{tt.minute, tt.hour, tt.dom, tt.month, tt.dow, tt.domRestricted, tt.dowRestricted}
+		if s != want {
+			t.Errorf("parseCron(%q) = %+v, want %+v", tt.expr, s, want)
+		}
+	}
+
+	for _, expr := range []string{"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "a * * * *", "1-a * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) is accepted", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// 2020-09-11 は金曜
+	base := time.Date(2020, 9, 11, 10, 15, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2020, 9, 11, 10, 16, 0, 0, time.UTC)},
+		{"15 * * * *", time.Date(2020, 9, 11, 11, 15, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2020, 9, 11, 10, 20, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2020, 9, 12, 3, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 1", time.Date(2020, 9, 14, 0, 0, 0, 0, time.UTC)},
+		{"30 8 1 1 *", time.Date(2021, 1, 1, 8, 30, 0, 0, time.UTC)},
+		// 日と曜日の両方が指定されていたらどちらか
+		{"0 0 20 * 1", time.Date(2020, 9, 14, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 3", time.Date(2020, 9, 13, 0, 0, 0, 0, time.UTC)},
+		// */2 の日は指定されていない扱いなので、奇数日かつ月曜
+		{"0 0 */2 * 1", time.Date(2020, 9, 21, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.expr, err)
+		}
+		got := s.Next(base)
+		if !got.Equal(tt.want) {
+			t.Errorf("Next(%q) = %v, want %v", tt.expr, got, tt.want)
+		}
+		if !got.IsZero() && !s.Matches(got) {
+			t.Errorf("Matches(%q, %v) = false", tt.expr, got)
+		}
+	}
+
+	// 分の頭ちょうどからでも次の分を返す
+	s, _ := parseCron("* * * * *")
+	at := time.Date(2020, 9, 11, 10, 15, 0, 0, time.UTC)
+	if got := s.Next(at); !got.Equal(at.Add(time.Minute)) {
+		t.Errorf("Next(%v) = %v", at, got)
+	}
+}
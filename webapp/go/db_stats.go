@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+// リクエストごとに MySQL に投げたクエリの数と時間を数えて、DBQueryHeaders が on なら
+// X-DB-Queries / X-DB-Time (ミリ秒) で返す。curl で N+1 になっているところがすぐわかる。
+// 数えるのは countingDB を通したものだけで、トランザクションの中のクエリは数えない
+
+type queryStatsKey struct{}
+
+type queryStats struct {
+	queries int64
+	nanos   int64
+}
+
+func (s *queryStats) observe(d time.Duration) {
+	atomic.AddInt64(&s.queries, 1)
+	atomic.AddInt64(&s.nanos, int64(d))
+}
+
+func queryStatsFrom(ctx context.Context) *queryStats {
+	s, _ := ctx.Value(queryStatsKey{}).(*queryStats)
+	return s
+}
+
+// countingDB は ctx に queryStats があればクエリを数える *sqlx.DB
+type countingDB struct {
+	*sqlx.DB
+}
+
+func observeQuery(ctx context.Context, start time.Time) {
+	if s := queryStatsFrom(ctx); s != nil {
+		s.observe(time.Since(start))
+	}
+}
+
+func (db *countingDB) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	defer observeQuery(ctx, time.Now())
+	return db.DB.SelectContext(ctx, dest, query, args...)
+}
+
+func (db *countingDB) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	defer observeQuery(ctx, time.Now())
+	return db.DB.GetContext(ctx, dest, query, args...)
+}
+
+// QueryContext は sqlc で生成した query (dbq) から呼ばれる
+func (db *countingDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	defer observeQuery(ctx, time.Now())
+	return db.DB.QueryContext(ctx, query, args...)
+}
+
+func (db *countingDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	defer observeQuery(ctx, time.Now())
+	return db.DB.ExecContext(ctx, query, args...)
+}
+
+// dbQueryStatsWriter は header を書く直前に数えた結果を足す
+type dbQueryStatsWriter struct {
+	http.ResponseWriter
+	stats *queryStats
+}
+
+func (w *dbQueryStatsWriter) WriteHeader(code int) {
+	h := w.ResponseWriter.Header()
+	h.Set("X-DB-Queries", strconv.FormatInt(atomic.LoadInt64(&w.stats.queries), 10))
+	h.Set("X-DB-Time", strconv.FormatFloat(float64(atomic.LoadInt64(&w.stats.nanos))/float64(time.Millisecond), 'f', 3, 64))
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func dbQueryHeaders() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !currentConfig().DBQueryHeaders {
+				return next(c)
+			}
+			stats := &queryStats{}
+			req := c.Request()
+			c.SetRequest(req.WithContext(context.WithValue(req.Context(), queryStatsKey{}, stats)))
+			c.Response().Writer = &dbQueryStatsWriter{ResponseWriter: c.Response().Writer, stats: stats}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 詳細ページや資料請求では同じ ID の行を何度も引くので、instance の中で少しだけ持っておく。
+// 他の instance での購入や入稿は消せないので、TTL (DetailCacheTTL) は短くしておく
+var (
+	chairDetailCache  = newRowCache("chair_detail")
+	estateDetailCache = newRowCache("estate_detail")
+)
+
+func init() {
+	localResetHooks = append(localResetHooks, chairDetailCache.Purge, estateDetailCache.Purge)
+}
+
+type rowCacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// rowCache は ID ごとの行を TTL 付きで持つ
+type rowCache struct {
+	m     sync.Map
+	stats *cacheStats
+}
+
+func newRowCache(name string) *rowCache {
+	rc := &rowCache{}
+	rc.stats = newCacheStats(name, func(ctx context.Context) (int64, error) {
+		var n int64
+		rc.m.Range(func(_, _ interface{}) bool {
+			n++
+			return true
+		})
+		return n, nil
+	})
+	return rc
+}
+
+func (rc *rowCache) get(id int64) (interface{}, bool) {
+	if currentConfig().DetailCacheTTL <= 0 {
+		return nil, false
+	}
+	v, ok := rc.m.Load(id)
+	if !ok {
+		rc.stats.Miss(1)
+		return nil, false
+	}
+	e := v.(rowCacheEntry)
+	if time.Now().After(e.expires) {
+		rc.m.Delete(id)
+		rc.stats.Miss(1)
+		return nil, false
+	}
+	rc.stats.Hit(1)
+	return e.value, true
+}
+
+func (rc *rowCache) put(id int64, v interface{}) {
+	ttl := time.Duration(currentConfig().DetailCacheTTL)
+	if ttl <= 0 {
+		return
+	}
+	rc.m.Store(id, rowCacheEntry{value: v, expires: time.Now().Add(ttl)})
+}
+
+// Delete は id の行を捨てる
+func (rc *rowCache) Delete(id int64) {
+	rc.m.Delete(id)
+}
+
+// Purge は全部捨てる
+func (rc *rowCache) Purge() {
+	rc.m.Range(func(k, _ interface{}) bool {
+		rc.m.Delete(k)
+		return true
+	})
+}
+
+// getChairByID は id の椅子を返す。売り切れて消えていれば sql.ErrNoRows
+func getChairByID(ctx context.Context, id int64) (Chair, error) {
+	if v, ok := chairDetailCache.get(id); ok {
+		return v.(Chair), nil
+	}
+	start := time.Now()
+	var chair Chair
+	if err := db.GetContext(ctx, &chair, "SELECT * FROM chair WHERE id = ?", id); err != nil {
+		return Chair{}, err
+	}
+	chairDetailCache.put(id, chair)
+	chairDetailCache.stats.ObserveFill(time.Since(start))
+	return chair, nil
+}
+
+// getEstateByID は id の物件を返す。status は呼ぶ側で見る
+func getEstateByID(ctx context.Context, id int64) (Estate, error) {
+	if v, ok := estateDetailCache.get(id); ok {
+		return v.(Estate), nil
+	}
+	start := time.Now()
+	var estate Estate
+	if err := db.GetContext(ctx, &estate, "SELECT * FROM estate WHERE id = ?", id); err != nil {
+		return Estate{}, err
+	}
+	estateDetailCache.put(id, estate)
+	estateDetailCache.stats.ObserveFill(time.Since(start))
+	return estate, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// 物件の画像は estate_image に並び順 (position) 付きで持つ。
+// 入稿の CSV では popularity の後ろの列に | 区切りで URL を書く (列が無ければ画像なし)
+
+type EstateImagesResponse struct {
+	Images []string `json:"images"`
+}
+
+func parseEstateImages(s string) []string {
+	images := make([]string, 0)
+	for _, url := range strings.Split(s, "|") {
+		if url = strings.TrimSpace(url); url != "" {
+			images = append(images, url)
+		}
+	}
+	return images
+}
+
+// replaceEstateImages は id の物件の画像を images に置き換える
+func replaceEstateImages(ctx context.Context, e execerContext, id int64, images []string) error {
+	if _, err := e.ExecContext(ctx, "DELETE FROM estate_image WHERE estate_id = ?", id); err != nil {
+		return err
+	}
+	if len(images) == 0 {
+		return nil
+	}
+	placeholders := make([]string, 0, len(images))
+	params := make([]interface{}, 0, len(images)*3)
+	for i, url := range images {
+		placeholders = append(placeholders, "(?,?,?)")
+		params = append(params, id, i, url)
+	}
+	_, err := e.ExecContext(ctx, "INSERT INTO estate_image (estate_id, position, url) VALUES "+strings.Join(placeholders, ","), params...)
+	return err
+}
+
+func getEstateImages(ctx context.Context, id int64) ([]string, error) {
+	images := make([]string, 0)
+	err := db.SelectContext(ctx, &images, "SELECT url FROM estate_image WHERE estate_id = ? ORDER BY position", id)
+	return images, err
+}
+
+// getEstateImagesHandler は物件の画像を並び順で返す
+func getEstateImagesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	estate, err := getEstateByID(ctx, int64(id))
+	if err == nil && estate.Status != EstateStatusAvailable {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.Echo().Logger.Infof("getEstateImages estate id %v not found", id)
+			return c.NoContent(http.StatusNotFound)
+		}
+		c.Echo().Logger.Errorf("Database Execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	images, err := getEstateImages(ctx, estate.ID)
+	if err != nil {
+		c.Echo().Logger.Errorf("Database Execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	setSurrogateKeys(c, surrogateKeyEstate, surrogateKeyForEstate(estate.ID))
+	return c.JSON(http.StatusOK, EstateImagesResponse{Images: images})
+}
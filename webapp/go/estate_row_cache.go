@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+)
+
+// 検索結果の物件の行を searchIDsCache に 1 件ずつ持っておき、ID リストから引くときは GetValues の 1 往復でまとめて取る。
+// 無かったものだけ MySQL に IN で聞いて埋める。
+// key は ID リストと同じ版の estate:v{版}:row-{id} にして、物件が変わって版が上がったら読まれなくなる。
+// 最後の ':' までが ID リストと同じなので同じ版の index に入り、Purge で ID リストと一緒に消える
+var estateRowCacheStats = newCacheStats("estate_rows", nil)
+
+func estateRowKey(version int64, id int64) string {
+	return fmt.Sprintf("estate:v%d:row-%d", version, id)
+}
+
+// getEstatesFromRowCache は ids の物件を ids の順に返す。ID リストを作った後に消えたものは詰める
+func getEstatesFromRowCache(ctx context.Context, ids []int64) ([]Estate, error) {
+	version, err := searchIDsCache.Version(ctx, "estate")
+	if err != nil {
+		return selectEstatesOnRowCacheError(ctx, ids, err)
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = estateRowKey(version, id)
+	}
+	values, err := searchIDsCache.GetValues(ctx, keys)
+	if err != nil {
+		return selectEstatesOnRowCacheError(ctx, ids, err)
+	}
+
+	estates := make([]Estate, len(ids))
+	found := make([]bool, len(ids))
+	missing := make([]int64, 0)
+	missingAt := make(map[int64]int)
+	for i, b := range values {
+		if b != nil && gob.NewDecoder(bytes.NewReader(b)).Decode(&estates[i]) == nil {
+			found[i] = true
+			continue
+		}
+		missing = append(missing, ids[i])
+		missingAt[ids[i]] = i
+	}
+	estateRowCacheStats.Hit(len(ids) - len(missing))
+	if len(missing) == 0 {
+		return estates, nil
+	}
+	estateRowCacheStats.Miss(len(missing))
+
+	rows, err := selectEstatesFromIDs(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	fill := make(map[string][]byte, len(rows))
+	for _, e := range rows {
+		i := missingAt[e.ID]
+		estates[i] = e
+		found[i] = true
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+			continue
+		}
+		fill[estateRowKey(version, e.ID)] = buf.Bytes()
+	}
+	if err := searchIDsCache.PutValues(ctx, fill, cacheDefaultTTL()); isCacheConnectionError(err) {
+		markCacheUnhealthy(err)
+	}
+
+	if len(rows) == len(missing) {
+		return estates, nil
+	}
+	res := make([]Estate, 0, len(ids))
+	for i := range estates {
+		if found[i] {
+			res = append(res, estates[i])
+		}
+	}
+	return res, nil
+}
+
+func selectEstatesOnRowCacheError(ctx context.Context, ids []int64, err error) ([]Estate, error) {
+	estateRowCacheStats.Error()
+	if isCacheConnectionError(err) {
+		markCacheUnhealthy(err)
+	}
+	return selectEstatesFromIDs(ctx, ids)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// fakeQueryFunc は query と args に対して返す列と行を決める
+type fakeQueryFunc func(query string, args []driver.Value) ([]string, [][]driver.Value, error)
+
+// useFakeDB は db を fn で答える偽物に差し替える。
+// 引数の変換は database/sql の既定のもの (slice は通らない) なので、sqlx.In し忘れは本物の MySQL と同じくエラーになる
+func useFakeDB(t *testing.T, fn fakeQueryFunc) {
+	t.Helper()
+	orig := db
+	db = &countingDB{sqlx.NewDb(sql.OpenDB(fakeConnector{fn}), "mysql")}
+	t.Cleanup(func() {
+		db.Close()
+		db = orig
+	})
+}
+
+type fakeConnector struct{ fn fakeQueryFunc }
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) { return fakeConn(c), nil }
+func (c fakeConnector) Driver() driver.Driver                        { return fakeDriver{c.fn} }
+
+type fakeDriver struct{ fn fakeQueryFunc }
+
+func (d fakeDriver) Open(string) (driver.Conn, error) { return fakeConn(d), nil }
+
+type fakeConn struct{ fn fakeQueryFunc }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{fn: c.fn, query: query}, nil
+}
+func (c fakeConn) Close() error { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("fakedb: transactions are not supported")
+}
+
+type fakeStmt struct {
+	fn    fakeQueryFunc
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return strings.Count(s.query, "?") }
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if _, _, err := s.fn(s.query, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	cols, rows, err := s.fn(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{cols: cols, rows: rows}, nil
+}
+
+type fakeRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
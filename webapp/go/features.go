@@ -0,0 +1,75 @@
+package main
+
+import "strings"
+
+// FeatureSynonyms は features の検索語の言い換え (../fixture/feature_synonyms.json)。
+// 検索語はここに書かれている特徴のどれかにマッチすればよいものとして扱う
+type FeatureSynonyms struct {
+	Estate map[string][]string `json:"estate"`
+	Chair  map[string][]string `json:"chair"`
+}
+
+var featureSynonyms FeatureSynonyms
+
+// expandFeatures は検索語を言い換えも含めた特徴のリストに展開する
+func expandFeatures(synonyms map[string][]string, terms []string) []string {
+	expanded := make([]string, 0, len(terms))
+	for _, t := range terms {
+		expanded = append(expanded, t)
+		expanded = append(expanded, synonyms[t]...)
+	}
+	return expanded
+}
+
+// featureCondition は 1 つの検索語について、言い換えのどれかにマッチすればよい条件を作る。
+// 常に 1 つの式なので、NOT を前に付ければ言い換えのどれにもマッチしない条件になる
+func featureCondition(synonyms map[string][]string, term string) (string, []interface{}) {
+	return anyFeatureCondition(synonyms, []string{term})
+}
+
+// anyFeatureCondition は featuresMatch=any のときの、検索語 (と言い換え) のどれかにマッチすればよい条件を作る
+func anyFeatureCondition(synonyms map[string][]string, terms []string) (string, []interface{}) {
+	terms = expandFeatures(synonyms, terms)
+	conditions := make([]string, 0, len(terms))
+	params := make([]interface{}, 0, len(terms))
+	for _, t := range terms {
+		conditions = append(conditions, "features LIKE CONCAT('%', ?, '%')")
+		params = append(params, t)
+	}
+	if len(conditions) == 1 {
+		return conditions[0], params
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", params
+}
+
+// matchFeatures は保存されている features (カンマ区切り) のうち、
+// 検索条件のどれかにマッチするものを返す。検索と同じく部分一致で判定する
+func matchFeatures(stored string, wanted []string) []string {
+	matched := make([]string, 0, len(wanted))
+	for _, f := range strings.Split(stored, ",") {
+		for _, w := range wanted {
+			if w != "" && strings.Contains(f, w) {
+				matched = append(matched, f)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// featuresMatch の値。指定がなければ all
+const (
+	FeaturesMatchAll = "all"
+	FeaturesMatchAny = "any"
+)
+
+// normalizeFeaturesMatch は featuresMatch を all / any に揃える。それ以外なら false
+func normalizeFeaturesMatch(s string) (string, bool) {
+	switch s {
+	case "", FeaturesMatchAll:
+		return FeaturesMatchAll, true
+	case FeaturesMatchAny:
+		return FeaturesMatchAny, true
+	}
+	return s, false
+}
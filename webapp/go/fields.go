@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// fields=id,name,... で返すフィールドを絞るときに使う、JSON のキーから値を書き出す関数の表。
+// 値は一覧と同じ marshal.go の append 関数で書くので、fields を指定しないときと同じ形になる。
+// omit が true を返すものは omitempty と同じく出力しない
+type chairField struct {
+	omit   func(ch *Chair) bool
+	append func(b []byte, ch *Chair) []byte
+}
+
+type estateField struct {
+	omit   func(e *Estate) bool
+	append func(b []byte, e *Estate) []byte
+}
+
+var chairFields = map[string]chairField{
+	"id":             {append: func(b []byte, ch *Chair) []byte { return strconv.AppendInt(b, ch.ID, 10) }},
+	"name":           {append: func(b []byte, ch *Chair) []byte { return appendJSONString(b, ch.Name) }},
+	"description":    {append: func(b []byte, ch *Chair) []byte { return appendJSONString(b, ch.Description) }},
+	"thumbnail":      {append: func(b []byte, ch *Chair) []byte { return appendJSONString(b, ch.Thumbnail.URL()) }},
+	"price":          {append: func(b []byte, ch *Chair) []byte { return strconv.AppendInt(b, ch.Price, 10) }},
+	"height":         {append: func(b []byte, ch *Chair) []byte { return strconv.AppendInt(b, ch.Height, 10) }},
+	"width":          {append: func(b []byte, ch *Chair) []byte { return strconv.AppendInt(b, ch.Width, 10) }},
+	"depth":          {append: func(b []byte, ch *Chair) []byte { return strconv.AppendInt(b, ch.Depth, 10) }},
+	"color":          {append: func(b []byte, ch *Chair) []byte { return appendJSONString(b, ch.Color) }},
+	"features":       {append: func(b []byte, ch *Chair) []byte { return appendJSONString(b, ch.Features) }},
+	"kind":           {append: func(b []byte, ch *Chair) []byte { return appendJSONString(b, ch.Kind) }},
+	"effectivePrice": {append: func(b []byte, ch *Chair) []byte { return strconv.AppendInt(b, ch.EffectivePrice, 10) }},
+	"material": {
+		omit:   func(ch *Chair) bool { return ch.Material == "" },
+		append: func(b []byte, ch *Chair) []byte { return appendJSONString(b, ch.Material) },
+	},
+	"weight": {
+		omit:   func(ch *Chair) bool { return ch.Weight == nil },
+		append: func(b []byte, ch *Chair) []byte { return strconv.AppendInt(b, *ch.Weight, 10) },
+	},
+	"salePrice": {
+		omit:   func(ch *Chair) bool { return ch.SalePrice == nil },
+		append: func(b []byte, ch *Chair) []byte { return strconv.AppendInt(b, *ch.SalePrice, 10) },
+	},
+	"saleUntil": {
+		omit:   func(ch *Chair) bool { return ch.SaleUntil == nil },
+		append: func(b []byte, ch *Chair) []byte { return appendJSONTime(b, *ch.SaleUntil) },
+	},
+	"matchedFeatures": {
+		omit:   func(ch *Chair) bool { return len(ch.MatchedFeatures) == 0 },
+		append: func(b []byte, ch *Chair) []byte { return appendJSONStrings(b, ch.MatchedFeatures) },
+	},
+	"assets": {
+		omit:   func(ch *Chair) bool { return len(ch.Assets) == 0 },
+		append: func(b []byte, ch *Chair) []byte { return appendJSONStringMap(b, ch.Assets) },
+	},
+	"createdAt": {
+		omit:   func(ch *Chair) bool { return ch.CreatedAt == nil },
+		append: func(b []byte, ch *Chair) []byte { return appendJSONTime(b, *ch.CreatedAt) },
+	},
+	"updatedAt": {
+		omit:   func(ch *Chair) bool { return ch.UpdatedAt == nil },
+		append: func(b []byte, ch *Chair) []byte { return appendJSONTime(b, *ch.UpdatedAt) },
+	},
+}
+
+var estateFields = map[string]estateField{
+	"id":          {append: func(b []byte, e *Estate) []byte { return strconv.AppendInt(b, e.ID, 10) }},
+	"thumbnail":   {append: func(b []byte, e *Estate) []byte { return appendJSONString(b, e.Thumbnail.URL()) }},
+	"name":        {append: func(b []byte, e *Estate) []byte { return appendJSONString(b, e.Name) }},
+	"description": {append: func(b []byte, e *Estate) []byte { return appendJSONString(b, e.Description) }},
+	"latitude":    {append: func(b []byte, e *Estate) []byte { return appendJSONFloat(b, e.Latitude) }},
+	"longitude":   {append: func(b []byte, e *Estate) []byte { return appendJSONFloat(b, e.Longitude) }},
+	"address":     {append: func(b []byte, e *Estate) []byte { return appendJSONString(b, e.Address) }},
+	"rent":        {append: func(b []byte, e *Estate) []byte { return strconv.AppendInt(b, e.Rent, 10) }},
+	"doorHeight":  {append: func(b []byte, e *Estate) []byte { return strconv.AppendInt(b, e.DoorHeight, 10) }},
+	"doorWidth":   {append: func(b []byte, e *Estate) []byte { return strconv.AppendInt(b, e.DoorWidth, 10) }},
+	"features":    {append: func(b []byte, e *Estate) []byte { return appendJSONString(b, e.Features) }},
+	"nearestStation": {
+		omit:   func(e *Estate) bool { return e.NearestStation == nil },
+		append: func(b []byte, e *Estate) []byte { return appendJSONString(b, *e.NearestStation) },
+	},
+	"stationWalkMinutes": {
+		omit:   func(e *Estate) bool { return e.StationWalkMinutes == nil },
+		append: func(b []byte, e *Estate) []byte { return strconv.AppendInt(b, *e.StationWalkMinutes, 10) },
+	},
+	"layout": {
+		omit:   func(e *Estate) bool { return e.Layout == "" },
+		append: func(b []byte, e *Estate) []byte { return appendJSONString(b, e.Layout) },
+	},
+	"managementFee": {
+		omit:   func(e *Estate) bool { return e.ManagementFee == 0 },
+		append: func(b []byte, e *Estate) []byte { return strconv.AppendInt(b, e.ManagementFee, 10) },
+	},
+	"deposit": {
+		omit:   func(e *Estate) bool { return e.Deposit == 0 },
+		append: func(b []byte, e *Estate) []byte { return strconv.AppendInt(b, e.Deposit, 10) },
+	},
+	"commuteMinutes": {
+		omit:   func(e *Estate) bool { return e.CommuteMinutes == nil },
+		append: func(b []byte, e *Estate) []byte { return strconv.AppendInt(b, *e.CommuteMinutes, 10) },
+	},
+	"matchedFeatures": {
+		omit:   func(e *Estate) bool { return len(e.MatchedFeatures) == 0 },
+		append: func(b []byte, e *Estate) []byte { return appendJSONStrings(b, e.MatchedFeatures) },
+	},
+	"images": {
+		omit:   func(e *Estate) bool { return len(e.Images) == 0 },
+		append: func(b []byte, e *Estate) []byte { return appendJSONStrings(b, e.Images) },
+	},
+	"createdAt": {
+		omit:   func(e *Estate) bool { return e.CreatedAt == nil },
+		append: func(b []byte, e *Estate) []byte { return appendJSONTime(b, *e.CreatedAt) },
+	},
+	"updatedAt": {
+		omit:   func(e *Estate) bool { return e.UpdatedAt == nil },
+		append: func(b []byte, e *Estate) []byte { return appendJSONTime(b, *e.UpdatedAt) },
+	},
+}
+
+type sparseChairSearchResponse struct {
+	Count  int64             `json:"count"`
+	Chairs []json.RawMessage `json:"chairs"`
+}
+
+type sparseChairListResponse struct {
+	Chairs []json.RawMessage `json:"chairs"`
+}
+
+type sparseEstateSearchResponse struct {
+	Count   int64             `json:"count"`
+	Estates []json.RawMessage `json:"estates"`
+}
+
+type sparseEstateListResponse struct {
+	Estates []json.RawMessage `json:"estates"`
+}
+
+// renderList は chair / estate の一覧のレスポンスを返す。
+// fields が指定されていれば各要素をそのフィールドだけにする。Accept が JSON:API なら JSON:API で返す。
+// 検索のレスポンスは Accept が protobuf なら protobuf で返す
+func renderList(c echo.Context, status int, v interface{}) error {
+	if wantsJSONAPI(c) {
+		return renderJSONAPI(c, status, v)
+	}
+	if wantsProtobuf(c) {
+		if b, ok := marshalProtoResponse(v); ok {
+			c.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+			return c.Blob(status, protobufMediaType, b)
+		}
+	}
+	if c.QueryParam("fields") == "" {
+		if b, ok := marshalListResponse(v); ok {
+			return c.JSONBlob(status, b)
+		}
+		return c.JSON(status, v)
+	}
+	fields := parseFields(c.QueryParam("fields"))
+
+	var res interface{}
+	var err error
+	switch r := v.(type) {
+	case ChairSearchResponse:
+		sparse := sparseChairSearchResponse{Count: r.Count}
+		sparse.Chairs, err = sparseChairs(r.Chairs, fields)
+		res = sparse
+	case ChairListResponse:
+		sparse := sparseChairListResponse{}
+		sparse.Chairs, err = sparseChairs(r.Chairs, fields)
+		res = sparse
+	case EstateSearchResponse:
+		sparse := sparseEstateSearchResponse{Count: r.Count}
+		sparse.Estates, err = sparseEstates(r.Estates, fields)
+		res = sparse
+	case EstateListResponse:
+		sparse := sparseEstateListResponse{}
+		sparse.Estates, err = sparseEstates(r.Estates, fields)
+		res = sparse
+	default:
+		return c.JSON(status, v)
+	}
+	if err != nil {
+		c.Logger().Infof("Invalid fields parameter : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	return c.JSON(status, res)
+}
+
+// parseFields は重複を除いて指定された順に並べる
+func parseFields(s string) []string {
+	seen := map[string]bool{}
+	fields := []string{}
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" || seen[f] {
+			continue
+		}
+		seen[f] = true
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func sparseChairs(chairs []Chair, fields []string) ([]json.RawMessage, error) {
+	selected := make([]chairField, 0, len(fields))
+	for _, f := range fields {
+		cf, ok := chairFields[f]
+		if !ok {
+			return nil, fmt.Errorf("unknown chair field: %q", f)
+		}
+		selected = append(selected, cf)
+	}
+	res := make([]json.RawMessage, 0, len(chairs))
+	for i := range chairs {
+		b := []byte{'{'}
+		for j, cf := range selected {
+			if cf.omit != nil && cf.omit(&chairs[i]) {
+				continue
+			}
+			b = appendJSONFieldKey(b, fields[j])
+			b = cf.append(b, &chairs[i])
+		}
+		res = append(res, append(b, '}'))
+	}
+	return res, nil
+}
+
+func sparseEstates(estates []Estate, fields []string) ([]json.RawMessage, error) {
+	selected := make([]estateField, 0, len(fields))
+	for _, f := range fields {
+		ef, ok := estateFields[f]
+		if !ok {
+			return nil, fmt.Errorf("unknown estate field: %q", f)
+		}
+		selected = append(selected, ef)
+	}
+	res := make([]json.RawMessage, 0, len(estates))
+	for i := range estates {
+		b := []byte{'{'}
+		for j, ef := range selected {
+			if ef.omit != nil && ef.omit(&estates[i]) {
+				continue
+			}
+			b = appendJSONFieldKey(b, fields[j])
+			b = ef.append(b, &estates[i])
+		}
+		res = append(res, append(b, '}'))
+	}
+	return res, nil
+}
+
+// appendJSONFieldKey は key と ':' を書く。'{' の直後でなければ先に ',' を書く
+func appendJSONFieldKey(b []byte, key string) []byte {
+	if b[len(b)-1] != '{' {
+		b = append(b, ',')
+	}
+	b = appendJSONString(b, key)
+	return append(b, ':')
+}
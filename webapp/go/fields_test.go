@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// sparse な出力は、fields を指定しないときの json.Marshal から指定したキーだけ取り出したものと同じになること
+func assertSparseMatches(t *testing.T, full []byte, sparse json.RawMessage, fields []string) {
+	t.Helper()
+	var want, got map[string]json.RawMessage
+	if err := json.Unmarshal(full, &want); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(sparse, &got); err != nil {
+		t.Fatalf("invalid JSON %s: %v", sparse, err)
+	}
+	n := 0
+	for _, f := range fields {
+		w, ok := want[f]
+		g, found := got[f]
+		if !ok {
+			if found {
+				t.Errorf("%s: omitted field %q is written as %s", sparse, f, g)
+			}
+			continue
+		}
+		n++
+		if !bytes.Equal(g, w) {
+			t.Errorf("%s: field %q = %s, want %s", sparse, f, g, w)
+		}
+	}
+	if len(got) != n {
+		t.Errorf("%s: has %d fields, want %d", sparse, len(got), n)
+	}
+}
+
+func TestSparseChairs(t *testing.T) {
+	weight := int64(12)
+	salePrice := int64(9800)
+	until := time.Date(2020, 9, 11, 10, 0, 0, 123000000, time.UTC)
+	chairs := []Chair{
+		{
+			ID: 1, Name: `<椅子> "A" & \B`, Description: "line\nbreak ", Thumbnail: "/images/chair/1.png",
+			Price: 12000, Height: 80, Width: 50, Depth: 40, Color: "黒", Features: "折りたたみ可", Kind: "ゲーミングチェア",
+			Material: "木", Weight: &weight, SalePrice: &salePrice, SaleUntil: &until, EffectivePrice: 9800,
+			MatchedFeatures: []string{"折りたたみ可"}, Assets: map[string]string{"b": "/b.glb", "a": "/a.glb"},
+			CreatedAt: &until, UpdatedAt: &until,
+		},
+		// omitempty のフィールドは書かず、空の文字列や 0 はそのまま書く
+		{ID: 2, MatchedFeatures: []string{}, Assets: map[string]string{}},
+	}
+	fieldSets := [][]string{
+		{"id"},
+		{"name", "description", "thumbnail"},
+		{"id", "material", "weight", "salePrice", "saleUntil", "effectivePrice", "matchedFeatures", "assets", "createdAt", "updatedAt"},
+		{"price", "height", "width", "depth", "color", "features", "kind"},
+	}
+	for _, fields := range fieldSets {
+		res, err := sparseChairs(chairs, fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != len(chairs) {
+			t.Fatalf("sparseChairs(%v) returns %d chairs", fields, len(res))
+		}
+		for i := range chairs {
+			full, err := json.Marshal(chairs[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertSparseMatches(t, full, res[i], fields)
+		}
+	}
+
+	res, _ := sparseChairs(chairs, []string{"weight", "name", "id"})
+	if want := `{"weight":12,"name":"\u003c椅子\u003e \"A\" \u0026 \\B","id":1}`; string(res[0]) != want {
+		t.Errorf("sparse chair = %s, want %s", res[0], want)
+	}
+	if want := `{"name":"","id":2}`; string(res[1]) != want {
+		t.Errorf("sparse chair = %s, want %s", res[1], want)
+	}
+	if _, err := sparseChairs(chairs, []string{"id", "popularity"}); err == nil {
+		t.Error("unknown field is accepted")
+	}
+}
+
+func TestSparseEstates(t *testing.T) {
+	station := "東京"
+	walk := int64(5)
+	commute := int64(30)
+	at := time.Date(2020, 9, 11, 10, 0, 0, 0, time.FixedZone("JST", 9*60*60))
+	estates := []Estate{
+		{
+			ID: 1, Thumbnail: "/images/estate/1.png", Name: "<b>物件</b>", Description: "\x00\x1f\u2028",
+			Latitude: 35.681236, Longitude: 139.767125, Address: "東京都", Rent: 100000, DoorHeight: 200, DoorWidth: 90,
+			Features: "駅近", NearestStation: &station, StationWalkMinutes: &walk, Layout: "1LDK",
+			ManagementFee: 5000, Deposit: 100000, CommuteMinutes: &commute,
+			MatchedFeatures: []string{"駅近"}, Images: []string{"/1.png", "/2.png"}, CreatedAt: &at, UpdatedAt: &at,
+		},
+		{ID: 2, Latitude: 1e-7, Longitude: -1e21, Images: []string{}},
+	}
+	fieldSets := [][]string{
+		{"id", "thumbnail", "name", "description"},
+		{"latitude", "longitude", "address", "rent", "doorHeight", "doorWidth", "features"},
+		{"nearestStation", "stationWalkMinutes", "layout", "managementFee", "deposit", "commuteMinutes"},
+		{"matchedFeatures", "images", "createdAt", "updatedAt"},
+	}
+	for _, fields := range fieldSets {
+		res, err := sparseEstates(estates, fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range estates {
+			full, err := json.Marshal(estates[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertSparseMatches(t, full, res[i], fields)
+		}
+	}
+
+	// 全部 omit されたときは空のオブジェクトになる
+	res, _ := sparseEstates(estates, []string{"layout", "deposit"})
+	if string(res[1]) != "{}" {
+		t.Errorf("sparse estate = %s, want {}", res[1])
+	}
+	if _, err := sparseEstates(estates, []string{"score"}); err == nil {
+		t.Error("unknown field is accepted")
+	}
+}
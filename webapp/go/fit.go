@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+// chairSide は椅子の 1 辺。Axis は width / height / depth のどれか
+type chairSide struct {
+	Axis   string
+	Length int64
+}
+
+// chairPassingSides は椅子の短い方から 2 辺を返す。
+// この 2 辺がドアの幅と高さに (どちら向きでも) 収まれば椅子は通る
+func chairPassingSides(ch *Chair) (chairSide, chairSide) {
+	sides := []chairSide{
+		{Axis: "width", Length: ch.Width},
+		{Axis: "height", Length: ch.Height},
+		{Axis: "depth", Length: ch.Depth},
+	}
+	sort.SliceStable(sides, func(i, j int) bool {
+		return sides[i].Length < sides[j].Length
+	})
+	return sides[0], sides[1]
+}
+
+// FitOrientation はドアを通すときの向き。ドアの幅 / 高さ方向に椅子のどの辺を合わせるか
+type FitOrientation struct {
+	DoorWidthAxis  string `json:"doorWidthAxis"`
+	DoorHeightAxis string `json:"doorHeightAxis"`
+}
+
+type FitResponse struct {
+	ChairID  int64 `json:"chairId"`
+	EstateID int64 `json:"estateId"`
+	Fits     bool  `json:"fits"`
+	// Orientation は通る向き。両方の向きで通るなら短い辺をドアの幅に合わせる方
+	Orientation *FitOrientation `json:"orientation,omitempty"`
+}
+
+// chairFitOrientation は椅子が物件のドアを通る向きを返す。通らなければ nil
+func chairFitOrientation(ch *Chair, e *Estate) *FitOrientation {
+	m1, m2 := chairPassingSides(ch)
+	if e.DoorWidth >= m1.Length && e.DoorHeight >= m2.Length {
+		return &FitOrientation{DoorWidthAxis: m1.Axis, DoorHeightAxis: m2.Axis}
+	}
+	if e.DoorWidth >= m2.Length && e.DoorHeight >= m1.Length {
+		return &FitOrientation{DoorWidthAxis: m2.Axis, DoorHeightAxis: m1.Axis}
+	}
+	return nil
+}
+
+// getFit は chairId の椅子が estateId の物件のドアを通るかを返す
+func getFit(c echo.Context) error {
+	ctx := c.Request().Context()
+	chairID, err := strconv.ParseInt(c.QueryParam("chairId"), 10, 64)
+	if err != nil {
+		c.Logger().Infof("Invalid format getFit chairId : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	estateID, err := strconv.ParseInt(c.QueryParam("estateId"), 10, 64)
+	if err != nil {
+		c.Logger().Infof("Invalid format getFit estateId : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	chair, err := getChairByID(ctx, chairID)
+	if err == nil && chair.Stock <= 0 {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.Logger().Infof("Requested chair id \"%v\" not found", chairID)
+			return c.NoContent(http.StatusNotFound)
+		}
+		c.Logger().Errorf("Database execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	estate, err := getEstateByID(ctx, estateID)
+	if err == nil && estate.Status != EstateStatusAvailable {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.Logger().Infof("Requested estate id \"%v\" not found", estateID)
+			return c.NoContent(http.StatusNotFound)
+		}
+		c.Logger().Errorf("Database execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	orientation := chairFitOrientation(&chair, &estate)
+	setSurrogateKeys(c, surrogateKeyForChair(chair.ID), surrogateKeyForEstate(estate.ID))
+	return c.JSON(http.StatusOK, FitResponse{
+		ChairID:     chair.ID,
+		EstateID:    estate.ID,
+		Fits:        orientation != nil,
+		Orientation: orientation,
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strconv"
+)
+
+// GCConfig は起動時に入れる GC の設定。ベンチの負荷で GC に止められる時間をマシンの大きさに合わせて調整する。
+// どれも env で指定しなければ何もしない (GOGC / GOMEMLIMIT はそのまま runtime が読む)
+type GCConfig struct {
+	// GCPercent は debug.SetGCPercent に渡す値。GC_PERCENT (off なら -1)。nil なら GOGC に任せる
+	GCPercent *int
+	// MemoryLimit は debug.SetMemoryLimit に渡す byte 数 (GC_MEMORY_LIMIT)。0 なら GOMEMLIMIT に任せる。
+	// go1.19 より前の toolchain では使えない
+	MemoryLimit int64
+	// BallastBytes は起動時に確保して持ち続ける byte 数 (GC_BALLAST_BYTES)。
+	// heap を底上げして小さい heap で GC が頻発するのを防ぐ
+	BallastBytes int64
+}
+
+// gcBallast は GC に回収されないように参照を持ち続ける
+var gcBallast []byte
+
+func loadGCConfig() (GCConfig, error) {
+	var conf GCConfig
+	if v := os.Getenv("GC_PERCENT"); v != "" {
+		percent := -1
+		if v != "off" {
+			p, err := strconv.Atoi(v)
+			if err != nil {
+				return conf, fmt.Errorf("invalid GC_PERCENT=%v : %v", v, err)
+			}
+			percent = p
+		}
+		conf.GCPercent = &percent
+	}
+	conf.MemoryLimit = int64(getEnvInt("GC_MEMORY_LIMIT", 0))
+	conf.BallastBytes = int64(getEnvInt("GC_BALLAST_BYTES", 0))
+	return conf, nil
+}
+
+// applyGCConfig は GC の設定を runtime に反映する
+func applyGCConfig(conf GCConfig) error {
+	if conf.GCPercent != nil {
+		debug.SetGCPercent(*conf.GCPercent)
+	}
+	if conf.MemoryLimit > 0 {
+		if err := setMemoryLimit(conf.MemoryLimit); err != nil {
+			return err
+		}
+	}
+	if conf.BallastBytes > 0 {
+		gcBallast = make([]byte, conf.BallastBytes)
+	}
+	return nil
+}
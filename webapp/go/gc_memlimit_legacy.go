@@ -0,0 +1,11 @@
+//go:build !go1.19
+// +build !go1.19
+
+package main
+
+import "errors"
+
+// debug.SetMemoryLimit は go1.19 から
+func setMemoryLimit(limit int64) error {
+	return errors.New("GC_MEMORY_LIMIT requires go1.19 or later")
+}
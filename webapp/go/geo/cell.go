@@ -0,0 +1,63 @@
+package geo
+
+import (
+	"sort"
+
+	"github.com/golang/geo/s2"
+)
+
+// CellLevel は保存する S2 cell の level (level 14 で 1 辺 500m くらい)。
+// 駅から歩ける範囲くらいのなぞり方でも、cell で絞った段階で余分な物件が多くならないようにする
+const CellLevel = 14
+
+// CellID は S2 の cell ID。保存するのは level CellLevel の cell で、
+// 粗い level の cell に含まれる cell の ID はその cell の RangeMin から RangeMax の間に入る
+type CellID uint64
+
+// CellRange は cell ID の閉区間
+type CellRange struct {
+	Min CellID
+	Max CellID
+}
+
+// CellIDFromPoint は点が入る level CellLevel の cell ID
+func CellIDFromPoint(p Point) CellID {
+	return CellID(s2.CellIDFromLatLng(s2.LatLngFromDegrees(p.Lat, p.Lng)).Parent(CellLevel))
+}
+
+// Covering は矩形を maxCells 個以下の cell (level CellLevel 以下) で覆って、cell ID の範囲にする
+func Covering(b Bound, maxCells int) []CellRange {
+	rect := s2.RectFromLatLng(s2.LatLngFromDegrees(b.Min.Lat, b.Min.Lng)).AddPoint(s2.LatLngFromDegrees(b.Max.Lat, b.Max.Lng))
+	coverer := &s2.RegionCoverer{MaxLevel: CellLevel, MaxCells: maxCells}
+	ranges := []CellRange{}
+	for _, c := range coverer.Covering(rect) {
+		ranges = append(ranges, CellRange{Min: CellID(c.RangeMin()), Max: CellID(c.RangeMax())})
+	}
+	return mergeCellRanges(ranges)
+}
+
+// PolygonCovering は polygon を覆う cell ID の範囲を返す。
+// S2 の polygon は辺が大円になり、緯度経度の直線で判定する Contains とずれるので、外周を囲む矩形を覆う
+func PolygonCovering(p Polygon, maxCells int) []CellRange {
+	if len(p) == 0 || p[0].degenerate() {
+		return []CellRange{}
+	}
+	return Covering(p.Bound(), maxCells)
+}
+
+// mergeCellRanges は隣り合う範囲をつなげる。
+// 葉の cell ID は奇数なので、隣の cell の RangeMin は RangeMax + 2 になる
+func mergeCellRanges(ranges []CellRange) []CellRange {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Min < ranges[j].Min })
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if len(merged) > 0 && merged[len(merged)-1].Max+2 >= r.Min {
+			if r.Max > merged[len(merged)-1].Max {
+				merged[len(merged)-1].Max = r.Max
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
@@ -0,0 +1,98 @@
+package geo
+
+import "testing"
+
+func covered(ranges []CellRange, p Point) bool {
+	id := CellIDFromPoint(p)
+	for _, r := range ranges {
+		if r.Min <= id && id <= r.Max {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPolygonCovering(t *testing.T) {
+	// 東京駅のまわりの凹んだ L 字
+	concave := Polygon{Ring{
+		{35.670, 139.750}, {35.700, 139.750}, {35.700, 139.770},
+		{35.685, 139.770}, {35.685, 139.790}, {35.670, 139.790},
+	}}
+	tests := []struct {
+		name     string
+		polygon  Polygon
+		maxCells int
+		inside   []Point
+		outside  []Point
+	}{
+		{
+			name:     "concave",
+			polygon:  concave,
+			maxCells: 16,
+			inside: []Point{
+				{35.680, 139.760}, {35.695, 139.755}, {35.675, 139.785},
+				// 辺と頂点の上
+				{35.670, 139.760}, {35.700, 139.770}, {35.685, 139.780},
+			},
+			outside: []Point{{34.700, 135.500}, {43.060, 141.350}},
+		},
+		{
+			name:     "one cell",
+			polygon:  concave,
+			maxCells: 1,
+			inside:   []Point{{35.680, 139.760}, {35.675, 139.785}},
+			outside:  []Point{{34.700, 135.500}},
+		},
+		{
+			name:     "small polygon inside one cell",
+			polygon:  Polygon{Ring{{35.6810, 139.7660}, {35.6812, 139.7660}, {35.6812, 139.7662}}},
+			maxCells: 16,
+			inside:   []Point{{35.6811, 139.7661}},
+			outside:  []Point{{35.800, 139.766}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges := PolygonCovering(tt.polygon, tt.maxCells)
+			if len(ranges) == 0 || len(ranges) > tt.maxCells {
+				t.Fatalf("got %d ranges, want 1..%d", len(ranges), tt.maxCells)
+			}
+			for _, p := range tt.inside {
+				if !tt.polygon[0].covers(p) {
+					t.Fatalf("test point %v is not in the polygon", p)
+				}
+				if !covered(ranges, p) {
+					t.Errorf("%v is not covered", p)
+				}
+			}
+			for _, p := range tt.outside {
+				if covered(ranges, p) {
+					t.Errorf("%v is covered", p)
+				}
+			}
+		})
+	}
+}
+
+func TestPolygonCoveringDegenerate(t *testing.T) {
+	for _, p := range []Polygon{{}, {Ring{}}, {Ring{{35, 139}, {35.1, 139.1}}}, {Ring{{35, 139}, {35.1, 139.1}, {35.2, 139.2}}}} {
+		if ranges := PolygonCovering(p, 16); len(ranges) != 0 {
+			t.Errorf("PolygonCovering(%v) = %v, want none", p, ranges)
+		}
+	}
+}
+
+func TestCellIDFromPoint(t *testing.T) {
+	a := CellIDFromPoint(Point{35.6812, 139.7671})
+	if b := CellIDFromPoint(Point{35.6813, 139.7672}); a != b {
+		t.Errorf("nearby points are in different cells: %v %v", a, b)
+	}
+	if b := CellIDFromPoint(Point{34.7025, 135.4959}); a == b {
+		t.Errorf("Tokyo and Osaka are in the same cell: %v", a)
+	}
+	// 保存するのは level CellLevel の cell なので、どの covering の範囲とも比べられる
+	ranges := Covering(Bound{Min: Point{35.68, 139.76}, Max: Point{35.69, 139.77}}, 4)
+	if !covered(ranges, Point{35.6812, 139.7671}) {
+		t.Errorf("%v is not covered by %v", a, ranges)
+	}
+}
@@ -0,0 +1,236 @@
+// Package geo は緯度経度で表した polygon の包含判定や面積などの計算をまとめたもの。
+// MySQL の spatial 関数を使わずに Go 側で判定するために使う。計算自体は paulmach/orb に任せている
+package geo
+
+import (
+	"math"
+
+	"github.com/paulmach/orb"
+	orbgeo "github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/planar"
+)
+
+// Point は緯度経度の点
+type Point struct {
+	Lat float64
+	Lng float64
+}
+
+// Ring は閉じた折れ線。最初と最後の点は同じでも違っていてもよい
+type Ring []Point
+
+// Polygon は最初の Ring が外周、残りが穴
+type Polygon []Ring
+
+// MultiPolygon は複数の Polygon。どれかに含まれていれば含まれているとみなす
+type MultiPolygon []Polygon
+
+// Bound は緯度経度が共に最小の点と最大の点で表した矩形
+type Bound struct {
+	Min Point
+	Max Point
+}
+
+// Contains は点が矩形の中 (境界を含む) にあるか
+func (b Bound) Contains(p Point) bool {
+	return b.Min.Lat <= p.Lat && p.Lat <= b.Max.Lat && b.Min.Lng <= p.Lng && p.Lng <= b.Max.Lng
+}
+
+// Bound は Ring を囲む最小の矩形
+func (r Ring) Bound() Bound {
+	if len(r) == 0 {
+		return Bound{}
+	}
+	b := r.orb().Bound()
+	return Bound{Min: fromOrb(b.Min), Max: fromOrb(b.Max)}
+}
+
+// Contains は点が Ring の内側にあるかを判定する。MySQL の ST_Contains と同じく、辺や頂点の上の点は含まない。
+// 日付変更線をまたぐ Ring は経度を 0-360 に直してから判定し、
+// 面積のない (異なる頂点が 3 つ未満か一直線に並んだ) Ring はどの点も含まない
+func (r Ring) Contains(p Point) bool {
+	return r.locate(p) == inside
+}
+
+// covers は辺や頂点の上の点も含むか
+func (r Ring) covers(p Point) bool {
+	return r.locate(p) != outside
+}
+
+type location int
+
+const (
+	outside location = iota
+	inside
+	onBoundary
+)
+
+func (r Ring) locate(p Point) location {
+	if r.degenerate() {
+		return outside
+	}
+	ring, pt := r.orb(), toOrb(p)
+	if crossesAntimeridian(ring) {
+		ring, pt = unwrapRing(ring), unwrapPoint(pt)
+	}
+	if ringTouches(ring, pt) {
+		return onBoundary
+	}
+	if planar.RingContains(ring, pt) {
+		return inside
+	}
+	return outside
+}
+
+// boundaryTolerance (度、1µm くらい) より辺に近い点は辺の上とみなす。
+// 頂点の間を小数で指定した点は、ちょうど辺の上でも誤差でずれることがある
+const boundaryTolerance = 1e-11
+
+// ringTouches は点が閉じた ring のどれかの辺 (両端を含む) の上にあるか
+func ringTouches(ring orb.Ring, p orb.Point) bool {
+	for i := 1; i < len(ring); i++ {
+		a, b := ring[i-1], ring[i]
+		dx, dy := b[0]-a[0], b[1]-a[1]
+		px, py := p[0]-a[0], p[1]-a[1]
+		length := math.Hypot(dx, dy)
+		if length == 0 {
+			if math.Hypot(px, py) <= boundaryTolerance {
+				return true
+			}
+			continue
+		}
+		// 辺からの距離と、辺の方向への射影が辺の中に入っているか
+		if math.Abs(dx*py-dy*px)/length > boundaryTolerance {
+			continue
+		}
+		if t := (dx*px + dy*py) / length; t >= -boundaryTolerance && t <= length+boundaryTolerance {
+			return true
+		}
+	}
+	return false
+}
+
+// degenerateArea より狭い (度^2、1cm 四方くらい) Ring は面積がないとみなす。
+// 一直線に並んだ頂点でも、小数の誤差で面積が 0 にならないことがある
+const degenerateArea = 1e-14
+
+// degenerate は面積のない (異なる頂点が 3 つ未満か一直線に並んだ) Ring か。
+// 経度 139 度のような大きい座標のまま掛け算すると誤差が大きいので、始点からの差で面積を求める
+func (r Ring) degenerate() bool {
+	ring := r.orb()
+	if crossesAntimeridian(ring) {
+		ring = unwrapRing(ring)
+	}
+	if len(ring) == 0 {
+		return true
+	}
+	origin := ring[0]
+	shifted := make(orb.Ring, len(ring))
+	for i, p := range ring {
+		shifted[i] = orb.Point{p[0] - origin[0], p[1] - origin[1]}
+	}
+	return math.Abs(planar.Area(shifted)) < degenerateArea
+}
+
+// Area は Ring の面積 (m^2) を球面で近似して求める
+func (r Ring) Area() float64 {
+	if len(r) < 3 {
+		return 0
+	}
+	return math.Abs(orbgeo.Area(r.orb()))
+}
+
+// Bound は外周を囲む最小の矩形
+func (p Polygon) Bound() Bound {
+	if len(p) == 0 {
+		return Bound{}
+	}
+	return p[0].Bound()
+}
+
+// Contains は点が外周の内側にあり、どの穴にも入っていないかを判定する。
+// ST_Contains と同じく、外周と穴の境界上の点は含まない
+func (p Polygon) Contains(pt Point) bool {
+	if len(p) == 0 || !p[0].Contains(pt) {
+		return false
+	}
+	for _, hole := range p[1:] {
+		if hole.covers(pt) {
+			return false
+		}
+	}
+	return true
+}
+
+// Area は外周の面積から穴の面積を引いたもの (m^2)
+func (p Polygon) Area() float64 {
+	if len(p) == 0 {
+		return 0
+	}
+	area := p[0].Area()
+	for _, hole := range p[1:] {
+		area -= hole.Area()
+	}
+	return area
+}
+
+// Distance は 2 点間の大円距離 (m)
+func Distance(a Point, b Point) float64 {
+	return orbgeo.DistanceHaversine(toOrb(a), toOrb(b))
+}
+
+// Contains は点がどれかの Polygon に含まれているか
+func (mp MultiPolygon) Contains(pt Point) bool {
+	for _, p := range mp {
+		if p.Contains(pt) {
+			return true
+		}
+	}
+	return false
+}
+
+// orb は (経度, 緯度) の順なので並べ替える
+func toOrb(p Point) orb.Point {
+	return orb.Point{p.Lng, p.Lat}
+}
+
+func fromOrb(p orb.Point) Point {
+	return Point{Lat: p.Lat(), Lng: p.Lon()}
+}
+
+// orb は orb.Ring に変換する。orb の Ring は閉じている前提なので最後に始点を足す
+func (r Ring) orb() orb.Ring {
+	ring := make(orb.Ring, 0, len(r)+1)
+	for _, p := range r {
+		ring = append(ring, toOrb(p))
+	}
+	if len(ring) > 0 && ring[0] != ring[len(ring)-1] {
+		ring = append(ring, ring[0])
+	}
+	return ring
+}
+
+// crossesAntimeridian は隣り合う頂点の経度が 180 度より離れている (= 日付変更線側を回っている) 辺があるか
+func crossesAntimeridian(r orb.Ring) bool {
+	for i := 1; i < len(r); i++ {
+		if math.Abs(r[i].Lon()-r[i-1].Lon()) > 180 {
+			return true
+		}
+	}
+	return false
+}
+
+func unwrapRing(r orb.Ring) orb.Ring {
+	unwrapped := make(orb.Ring, len(r))
+	for i, p := range r {
+		unwrapped[i] = unwrapPoint(p)
+	}
+	return unwrapped
+}
+
+func unwrapPoint(p orb.Point) orb.Point {
+	if p.Lon() < 0 {
+		return orb.Point{p.Lon() + 360, p.Lat()}
+	}
+	return p
+}
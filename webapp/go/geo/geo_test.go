@@ -0,0 +1,142 @@
+package geo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPolygonContains(t *testing.T) {
+	square := Ring{{0, 0}, {0, 10}, {10, 10}, {10, 0}}
+	// 凹んだ L 字 (右上が欠けている)
+	concave := Ring{{0, 0}, {0, 10}, {5, 10}, {5, 5}, {10, 5}, {10, 0}}
+	// 経度 170 度から -170 度まで日付変更線をまたぐ
+	antimeridian := Ring{{-10, 170}, {10, 170}, {10, -170}, {-10, -170}}
+	hole := Ring{{4, 4}, {4, 6}, {6, 6}, {6, 4}}
+
+	tests := []struct {
+		name    string
+		polygon Polygon
+		point   Point
+		want    bool
+	}{
+		{"inside square", Polygon{square}, Point{5, 5}, true},
+		{"outside square", Polygon{square}, Point{11, 5}, false},
+		{"closed ring", Polygon{append(square, square[0])}, Point{5, 5}, true},
+		{"concave inside", Polygon{concave}, Point{2, 8}, true},
+		{"concave notch", Polygon{concave}, Point{8, 8}, false},
+		{"concave inside below notch", Polygon{concave}, Point{8, 2}, true},
+		{"on edge", Polygon{square}, Point{0, 5}, false},
+		{"on vertex", Polygon{square}, Point{10, 10}, false},
+		{"on concave inner vertex", Polygon{concave}, Point{5, 5}, false},
+		{"on concave inner edge", Polygon{concave}, Point{7, 5}, false},
+		{"just inside edge", Polygon{square}, Point{0.000001, 5}, true},
+		{"just outside edge", Polygon{square}, Point{-0.000001, 5}, false},
+		{"on decimal edge", Polygon{Ring{{35.670, 139.750}, {35.700, 139.780}, {35.670, 139.790}}}, Point{35.685, 139.765}, false},
+		{"in hole", Polygon{square, hole}, Point{5, 5}, false},
+		{"on hole edge", Polygon{square, hole}, Point{4, 5}, false},
+		{"outside hole", Polygon{square, hole}, Point{2, 2}, true},
+		{"antimeridian east side", Polygon{antimeridian}, Point{0, 175}, true},
+		{"antimeridian west side", Polygon{antimeridian}, Point{0, -175}, true},
+		{"antimeridian on line", Polygon{antimeridian}, Point{0, 180}, true},
+		{"antimeridian on edge", Polygon{antimeridian}, Point{10, -175}, false},
+		{"antimeridian outside", Polygon{antimeridian}, Point{0, 0}, false},
+		{"empty polygon", Polygon{}, Point{0, 0}, false},
+		{"empty ring", Polygon{Ring{}}, Point{0, 0}, false},
+		{"single point", Polygon{Ring{{1, 1}}}, Point{1, 1}, false},
+		{"two points", Polygon{Ring{{0, 0}, {10, 10}}}, Point{5, 5}, false},
+		{"collinear", Polygon{Ring{{0, 0}, {5, 5}, {10, 10}}}, Point{5, 5}, false},
+		{"collinear with rounding error", Polygon{Ring{{35, 139}, {35.1, 139.1}, {35.2, 139.2}}}, Point{35.1, 139.1}, false},
+		{"repeated vertex", Polygon{Ring{{0, 0}, {0, 0}, {10, 10}, {0, 0}}}, Point{5, 5}, false},
+		{"degenerate hole", Polygon{square, Ring{{5, 5}, {5, 5}}}, Point{5, 5}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.polygon.Contains(tt.point); got != tt.want {
+				t.Errorf("Contains(%v) = %v, want %v", tt.point, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMultiPolygonContains(t *testing.T) {
+	mp := MultiPolygon{
+		{Ring{{0, 0}, {0, 1}, {1, 1}, {1, 0}}},
+		{Ring{{5, 5}, {5, 6}, {6, 6}, {6, 5}}},
+	}
+	tests := []struct {
+		point Point
+		want  bool
+	}{
+		{Point{0.5, 0.5}, true},
+		{Point{5.5, 5.5}, true},
+		{Point{3, 3}, false},
+	}
+	for _, tt := range tests {
+		if got := mp.Contains(tt.point); got != tt.want {
+			t.Errorf("Contains(%v) = %v, want %v", tt.point, got, tt.want)
+		}
+	}
+}
+
+func TestRingBound(t *testing.T) {
+	tests := []struct {
+		name string
+		ring Ring
+		want Bound
+	}{
+		{"empty", Ring{}, Bound{}},
+		{"single point", Ring{{1, 2}}, Bound{Point{1, 2}, Point{1, 2}}},
+		{"concave", Ring{{0, 0}, {0, 10}, {5, 10}, {5, 5}, {10, 5}, {10, 0}}, Bound{Point{0, 0}, Point{10, 10}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ring.Bound(); got != tt.want {
+				t.Errorf("Bound() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolygonArea(t *testing.T) {
+	// 赤道付近の 1 度四方はおよそ 111km 四方
+	square := Ring{{0, 0}, {0, 1}, {1, 1}, {1, 0}}
+	hole := Ring{{0.25, 0.25}, {0.25, 0.75}, {0.75, 0.75}, {0.75, 0.25}}
+	tests := []struct {
+		name    string
+		polygon Polygon
+		want    float64
+	}{
+		{"square", Polygon{square}, 1.2364e10},
+		{"with hole", Polygon{square, hole}, 1.2364e10 * 0.75},
+		{"degenerate", Polygon{Ring{{0, 0}, {1, 1}}}, 0},
+		{"empty", Polygon{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.polygon.Area()
+			if math.Abs(got-tt.want) > tt.want*0.01 {
+				t.Errorf("Area() = %v, want about %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Point
+		want float64
+	}{
+		{"same point", Point{35, 139}, Point{35, 139}, 0},
+		{"one degree of latitude", Point{0, 0}, Point{1, 0}, 111195},
+		{"across antimeridian", Point{0, 179.5}, Point{0, -179.5}, 111195},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Distance(tt.a, tt.b)
+			if math.Abs(got-tt.want) > 1000 {
+				t.Errorf("Distance() = %v, want about %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package geo
+
+import "github.com/paulmach/orb/simplify"
+
+// Simplify は Douglas-Peucker 法で、前後の点を結んだ線分から epsilon (度) 以内にしか離れていない点を落とす。
+// 始点は必ず残る
+func (r Ring) Simplify(epsilon float64) Ring {
+	if len(r) < 4 {
+		return r
+	}
+	closed := r[0] == r[len(r)-1]
+	line := simplify.DouglasPeucker(epsilon).Ring(r.orb())
+	// 潰れて面積がなくなるくらいなら元のままにする
+	if len(line) < 4 {
+		return r
+	}
+	if !closed {
+		line = line[:len(line)-1]
+	}
+	simplified := make(Ring, 0, len(line))
+	for _, p := range line {
+		simplified = append(simplified, fromOrb(p))
+	}
+	return simplified
+}
+
+// Simplify は外周と穴のそれぞれを簡略化する
+func (p Polygon) Simplify(epsilon float64) Polygon {
+	simplified := make(Polygon, 0, len(p))
+	for _, r := range p {
+		simplified = append(simplified, r.Simplify(epsilon))
+	}
+	return simplified
+}
@@ -0,0 +1,53 @@
+package geo
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRingSimplify(t *testing.T) {
+	tests := []struct {
+		name    string
+		ring    Ring
+		epsilon float64
+		want    Ring
+	}{
+		{
+			name:    "drops points on straight edges",
+			ring:    Ring{{0, 0}, {0, 5}, {0, 10}, {5, 10}, {10, 10}, {10, 0}},
+			epsilon: 0.1,
+			want:    Ring{{0, 0}, {0, 10}, {10, 10}, {10, 0}},
+		},
+		{
+			name:    "keeps closed ring closed",
+			ring:    Ring{{0, 0}, {0, 5}, {0, 10}, {10, 10}, {10, 0}, {0, 0}},
+			epsilon: 0.1,
+			want:    Ring{{0, 0}, {0, 10}, {10, 10}, {10, 0}, {0, 0}},
+		},
+		{
+			name:    "keeps concave notch larger than epsilon",
+			ring:    Ring{{0, 0}, {0, 10}, {5, 10}, {5, 5}, {10, 5}, {10, 0}},
+			epsilon: 0.1,
+			want:    Ring{{0, 0}, {0, 10}, {5, 10}, {5, 5}, {10, 5}, {10, 0}},
+		},
+		{
+			name:    "too few points",
+			ring:    Ring{{0, 0}, {0, 10}, {10, 10}},
+			epsilon: 100,
+			want:    Ring{{0, 0}, {0, 10}, {10, 10}},
+		},
+		{
+			name:    "collapsing ring is left as is",
+			ring:    Ring{{0, 0}, {0, 0.01}, {0.01, 0.01}, {0.01, 0}},
+			epsilon: 1,
+			want:    Ring{{0, 0}, {0, 0.01}, {0.01, 0.01}, {0.01, 0}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ring.Simplify(tt.epsilon); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Simplify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 入稿された物件の緯度経度が空か 0,0 のときに、住所から緯度経度を引く。
+// GEOCODER=api なら GEOCODER_API_URL を呼び、centroid なら ../fixture/geocode_centroids.json の
+// 都道府県 (や市区町村) の中心を使う。引いた結果は住所ごとに searchIDsCache に cache する
+type geocoder interface {
+	// Geocode は address の緯度経度を返す。見つからなければ false
+	Geocode(ctx context.Context, address string) (Coordinate, bool, error)
+}
+
+const (
+	// key は geocode:v{版}:{住所の hash}。DB から作り直せるものではないので initialize でも版は上げない
+	geocodeCachePrefix = "geocode"
+	geocodeCacheTTL    = 7 * 24 * time.Hour
+	// 見つからなかったことも cache して、同じ住所で何度も API を呼ばない
+	geocodeNotFound = "-"
+)
+
+var (
+	geocoderKind       = getEnv("GEOCODER", "centroid")
+	geocoderAPIURL     = getEnv("GEOCODER_API_URL", "")
+	geocoderHTTPClient = &http.Client{Timeout: 3 * time.Second}
+
+	estateGeocoder geocoder
+)
+
+func init() {
+	g, err := newGeocoder(geocoderKind)
+	if err != nil {
+		fmt.Printf("geocoder setup failed : %v\n", err)
+		os.Exit(1)
+	}
+	estateGeocoder = g
+}
+
+func newGeocoder(kind string) (geocoder, error) {
+	switch kind {
+	case "off":
+		return nil, nil
+	case "api":
+		if geocoderAPIURL == "" {
+			return nil, fmt.Errorf("GEOCODER_API_URL is required for GEOCODER=api")
+		}
+		return &apiGeocoder{url: geocoderAPIURL}, nil
+	case "centroid":
+		return loadCentroidGeocoder("../fixture/geocode_centroids.json")
+	default:
+		return nil, fmt.Errorf("unknown GEOCODER : %v", kind)
+	}
+}
+
+// apiGeocoder は GET {GEOCODER_API_URL}?address=... を投げて {"latitude": N, "longitude": N} を受け取る。404 なら見つからない
+type apiGeocoder struct {
+	url string
+}
+
+func (g *apiGeocoder) Geocode(ctx context.Context, address string) (Coordinate, bool, error) {
+	q := url.Values{}
+	q.Set("address", address)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.url+"?"+q.Encode(), nil)
+	if err != nil {
+		return Coordinate{}, false, err
+	}
+	resp, err := geocoderHTTPClient.Do(req)
+	if err != nil {
+		return Coordinate{}, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return Coordinate{}, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Coordinate{}, false, fmt.Errorf("geocoding api returned %v", resp.Status)
+	}
+	var c Coordinate
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		return Coordinate{}, false, err
+	}
+	return c, true, c.validate()
+}
+
+type geocodeCentroid struct {
+	Prefix    string  `json:"prefix"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// centroidGeocoder は住所の先頭が一番長く一致するものの中心を返す。
+// 都道府県だけでなく "東京都千代田区" のような市区町村も足せる
+type centroidGeocoder struct {
+	centroids []geocodeCentroid
+}
+
+// loadCentroidGeocoder は p を読む。ファイルが無ければ geocoding しない
+func loadCentroidGeocoder(p string) (geocoder, error) {
+	jsonText, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	g := &centroidGeocoder{}
+	if err := json.Unmarshal(jsonText, &g.centroids); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *centroidGeocoder) Geocode(ctx context.Context, address string) (Coordinate, bool, error) {
+	var best *geocodeCentroid
+	for i, c := range g.centroids {
+		if strings.HasPrefix(address, c.Prefix) && (best == nil || len(c.Prefix) > len(best.Prefix)) {
+			best = &g.centroids[i]
+		}
+	}
+	if best == nil {
+		return Coordinate{}, false, nil
+	}
+	return Coordinate{Latitude: best.Latitude, Longitude: best.Longitude}, true, nil
+}
+
+// geocodeAddress は searchIDsCache を見てから estateGeocoder で address を引く
+func geocodeAddress(ctx context.Context, address string) (Coordinate, bool, error) {
+	if estateGeocoder == nil || address == "" {
+		return Coordinate{}, false, nil
+	}
+	key, err := searchIDsCache.Key(ctx, geocodeCachePrefix, address)
+	var values [][]byte
+	if err == nil {
+		values, err = searchIDsCache.GetValues(ctx, []string{key})
+	}
+	if err == nil && values[0] != nil {
+		cached := string(values[0])
+		if cached == geocodeNotFound {
+			return Coordinate{}, false, nil
+		}
+		if c, err := parseLatLng(cached); err == nil {
+			return c, true, nil
+		}
+	} else if err != nil {
+		// cache が引けないだけなら geocoder に聞いて、書き込みはしない
+		if isCacheConnectionError(err) {
+			markCacheUnhealthy(err)
+		}
+		key = ""
+	}
+
+	c, found, err := estateGeocoder.Geocode(ctx, address)
+	if err != nil {
+		return Coordinate{}, false, err
+	}
+	if key == "" {
+		return c, found, nil
+	}
+	value := geocodeNotFound
+	if found {
+		value = fmt.Sprintf("%v,%v", c.Latitude, c.Longitude)
+	}
+	_ = searchIDsCache.PutValues(ctx, map[string][]byte{key: []byte(value)}, geocodeCacheTTL)
+	return c, found, nil
+}
+
+// geocodeMissingCoordinates は緯度経度の列が空か 0,0 の行を住所から埋める。
+// 埋められなかった行はそのままにして、importEstates で行のエラーにする
+func geocodeMissingCoordinates(ctx context.Context, logger echo.Logger, files []uploadedCSV) {
+	if estateGeocoder == nil {
+		return
+	}
+	for _, file := range files {
+		for _, row := range file.Records {
+			// id, name, description, thumbnail, address, latitude, longitude, ...
+			if len(row) < 7 || !isMissingCoordinate(row[5], row[6]) {
+				continue
+			}
+			c, found, err := geocodeAddress(ctx, row[4])
+			if err != nil {
+				logger.Errorf("failed to geocode %q : %v", row[4], err)
+				continue
+			}
+			if found {
+				row[5] = strconv.FormatFloat(c.Latitude, 'f', -1, 64)
+				row[6] = strconv.FormatFloat(c.Longitude, 'f', -1, 64)
+			}
+		}
+	}
+}
+
+func isMissingCoordinate(latitude string, longitude string) bool {
+	latitude, longitude = strings.TrimSpace(latitude), strings.TrimSpace(longitude)
+	if latitude == "" || longitude == "" {
+		return true
+	}
+	lat, err1 := strconv.ParseFloat(latitude, 64)
+	lng, err2 := strconv.ParseFloat(longitude, 64)
+	return err1 == nil && err2 == nil && lat == 0 && lng == 0
+}
@@ -3,17 +3,21 @@ module github.com/astj/isucon10-yosen/webapp/go
 go 1.14
 
 require (
+	github.com/bradfitz/gomemcache v0.0.0-20190913173617-a41fca850d0b
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
 	github.com/go-redis/redis/v8 v8.0.0-beta.12
 	github.com/go-sql-driver/mysql v1.5.0
+	github.com/golang/geo v0.0.0-20200730024412-e86565bf3f35
 	github.com/jmoiron/sqlx v1.2.0
+	github.com/klauspost/compress v1.10.10
 	github.com/labstack/echo v3.3.10+incompatible
 	github.com/labstack/gommon v0.3.0
 	github.com/mattn/go-colorable v0.1.6 // indirect
 	github.com/newrelic/go-agent/v3 v3.9.0
 	github.com/newrelic/go-agent/v3/integrations/nrecho-v3 v1.0.0
 	github.com/newrelic/go-agent/v3/integrations/nrmysql v1.2.0
+	github.com/paulmach/orb v0.1.6
 	github.com/stretchr/testify v1.6.1
 	github.com/valyala/fasttemplate v1.1.0 // indirect
 	golang.org/x/crypto v0.0.0-20200510223506-06a226fb4e37 // indirect
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// idsCache は検索の cache (ID リスト、件数、物件の行、レスポンス) の置き場所。
+// IDS_CACHE_BACKEND で redis (複数台で共有)、memcached (複数台で共有) と memory (instance の中だけ) を選べる。
+// チューニング中に redis を外して比べたいとき用で、low_priced の set や initialize の lock などは redis のまま
+type idsCache interface {
+	// Ping はつながるかを見る。cache が使えなくなっている間に runCacheHealthProbe が呼ぶ
+	Ping(ctx context.Context) error
+	// Version は prefix (estate / chair / レスポンスのグループ) の今の版を返す
+	Version(ctx context.Context, prefix string) (int64, error)
+	// Key は prefix の今の版での、正規化した条件 normalized の key を返す。
+	// 検索する前に取っておいて、Get と PutList には同じ key を渡す (途中で版が上がったら古い版に入る)
+	Key(ctx context.Context, prefix string, normalized string) (string, error)
+	// HashedKey は Key と同じだが、hashCacheKey 済みの hash を受け取る (cache の snapshot を戻すときに使う)
+	HashedKey(ctx context.Context, prefix string, hash string) (string, error)
+	// Get は key の list の offset 件目から limit 件と、全体の長さを返す。無ければ errCacheNotHit
+	Get(ctx context.Context, key string, limit int64, offset int64) ([]int64, int64, error)
+	// PutList は key の list を ids で置き換える。ttl が 0 なら cacheDefaultTTL
+	PutList(ctx context.Context, key string, ids []int64, ttl time.Duration) error
+	// GetValues は keys の値を keys の順に返す。無い key は nil
+	GetValues(ctx context.Context, keys []string) ([][]byte, error)
+	// PutValues は values をまとめて入れる。ttl が 0 なら cacheDefaultTTL
+	PutValues(ctx context.Context, values map[string][]byte, ttl time.Duration) error
+	// Purge は prefix の版を上げて、それまでの key を読まれないようにする
+	Purge(ctx context.Context, prefix string) error
+	// PurgeAll は initialize で全部捨てるときに呼ぶ。redis は deleteKeysByPrefix で消すので何もしない
+	PurgeAll(ctx context.Context) error
+	// Len は持っている key の数
+	Len(ctx context.Context) (int64, error)
+}
+
+var searchIDsCache = newIDsCache(getEnv("IDS_CACHE_BACKEND", "redis"))
+
+var idsCacheStats = newCacheStats("ids_cache", func(ctx context.Context) (int64, error) {
+	return searchIDsCache.Len(ctx)
+})
+
+// idsCacheVersionKeys は redis で ID リストの数を数えるときに見る版の key
+var idsCacheVersionKeys = map[string]string{
+	"estate": estateIDsCacheVersionKey,
+	"chair":  chairIDsCacheVersionKey,
+}
+
+// idsCacheVersionKey は prefix の版の key。estate / chair 以外 (レスポンスのグループ) も {prefix}:version にする
+func idsCacheVersionKey(prefix string) string {
+	return prefix + ":version"
+}
+
+func newIDsCache(backend string) idsCache {
+	switch backend {
+	case "redis":
+		return redisIDsCache{}
+	case "memcached":
+		return newMemcachedIDsCache(getEnv("MEMCACHED_ADDRS", "127.0.0.1:11211"))
+	case "memory":
+		// Purge は自分の instance の中しか消せないので、他の instance で入稿されると古い結果を返し続ける
+		if !getEnvBool("SINGLE_INSTANCE", false) {
+			fmt.Printf("IDS_CACHE_BACKEND=memory is only for a single instance; set SINGLE_INSTANCE=1 to use it\n")
+			os.Exit(1)
+		}
+		m := &memoryIDsCache{
+			lru:      newLocalIDsCache("ids_cache_memory", localIDsCacheSize),
+			versions: make(map[string]int64),
+		}
+		localResetHooks = append(localResetHooks, m.lru.Purge)
+		return m
+	default:
+		fmt.Printf("unknown IDS_CACHE_BACKEND: %s\n", backend)
+		os.Exit(1)
+		return nil
+	}
+}
+
+// redisIDsCache は ID リストを redis の list に、それ以外を string に持つ。key は {prefix}:v{版}:{{hash}}
+type redisIDsCache struct{}
+
+func (redisIDsCache) Ping(ctx context.Context) error {
+	return rdb.Ping(ctx).Err()
+}
+
+func (redisIDsCache) Version(ctx context.Context, prefix string) (int64, error) {
+	version, err := rdb.Get(ctx, idsCacheVersionKey(prefix)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return version, err
+}
+
+func (r redisIDsCache) Key(ctx context.Context, prefix string, normalized string) (string, error) {
+	return r.HashedKey(ctx, prefix, hashCacheKey(normalized))
+}
+
+func (redisIDsCache) HashedKey(ctx context.Context, prefix string, hash string) (string, error) {
+	return versionedCacheKey(ctx, idsCacheVersionKey(prefix), prefix, hash)
+}
+
+func (redisIDsCache) Get(ctx context.Context, key string, limit int64, offset int64) ([]int64, int64, error) {
+	return getIDsFromRedis(ctx, key, limit, offset)
+}
+
+func (redisIDsCache) PutList(ctx context.Context, key string, ids []int64, ttl time.Duration) error {
+	return putIDsToRedis(ctx, key, ids, ttl)
+}
+
+func (redisIDsCache) GetValues(ctx context.Context, keys []string) ([][]byte, error) {
+	return getMulti(ctx, keys)
+}
+
+// PutValues は ID リストと同じく、版を上げたときに消せるように key を index に入れておく
+func (redisIDsCache) PutValues(ctx context.Context, values map[string][]byte, ttl time.Duration) error {
+	if len(values) == 0 {
+		return nil
+	}
+	if ttl <= 0 {
+		ttl = cacheDefaultTTL()
+	}
+	pipe := rdb.Pipeline()
+	for key, value := range values {
+		expiration := jitterTTL(ttl)
+		pipe.Set(ctx, key, value, expiration)
+		addToIDsCacheIndex(ctx, pipe, key, expiration)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (redisIDsCache) Purge(ctx context.Context, prefix string) error {
+	return bumpIDsCacheVersion(ctx, idsCacheVersionKey(prefix), prefix)
+}
+
+func (redisIDsCache) PurgeAll(ctx context.Context) error {
+	return nil
+}
+
+// Len は今の版の index に入っている key の数
+func (redisIDsCache) Len(ctx context.Context) (int64, error) {
+	var n int64
+	for prefix, versionKey := range idsCacheVersionKeys {
+		version, err := rdb.Get(ctx, versionKey).Int64()
+		if err != nil && err != redis.Nil {
+			return 0, err
+		}
+		c, err := rdb.SCard(ctx, idsCacheIndexKey(prefix, version)).Result()
+		if err != nil {
+			return 0, err
+		}
+		n += c
+	}
+	return n, nil
+}
+
+// memoryIDsCache は instance の中の LRU (大きさは LOCAL_IDS_CACHE_SIZE) に持つ。版も instance ごと。
+// 他の instance の Purge は届かないので、1 台で動かすとき (SINGLE_INSTANCE=1) だけ使える
+type memoryIDsCache struct {
+	lru      *localIDsCache
+	mu       sync.Mutex
+	versions map[string]int64
+}
+
+func (m *memoryIDsCache) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *memoryIDsCache) Version(ctx context.Context, prefix string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.versions[prefix], nil
+}
+
+func (m *memoryIDsCache) Key(ctx context.Context, prefix string, normalized string) (string, error) {
+	return m.HashedKey(ctx, prefix, hashCacheKey(normalized))
+}
+
+func (m *memoryIDsCache) HashedKey(ctx context.Context, prefix string, hash string) (string, error) {
+	version, _ := m.Version(ctx, prefix)
+	return fmt.Sprintf("%s:v%d:%s", prefix, version, hash), nil
+}
+
+func (m *memoryIDsCache) Get(ctx context.Context, key string, limit int64, offset int64) ([]int64, int64, error) {
+	ids, ok := m.lru.get(key)
+	if !ok || len(ids) == 0 {
+		return nil, 0, errCacheNotHit
+	}
+	return pageIDs(ids, limit, offset), int64(len(ids)), nil
+}
+
+func (m *memoryIDsCache) PutList(ctx context.Context, key string, ids []int64, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = cacheDefaultTTL()
+	}
+	m.lru.put(key, ids, jitterTTL(ttl))
+	return nil
+}
+
+func (m *memoryIDsCache) GetValues(ctx context.Context, keys []string) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i], _ = m.lru.getValue(key)
+	}
+	return values, nil
+}
+
+func (m *memoryIDsCache) PutValues(ctx context.Context, values map[string][]byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = cacheDefaultTTL()
+	}
+	for key, value := range values {
+		m.lru.putValue(key, value, jitterTTL(ttl))
+	}
+	return nil
+}
+
+// Purge は版を上げて、instance の中の key を捨てる
+func (m *memoryIDsCache) Purge(ctx context.Context, prefix string) error {
+	m.mu.Lock()
+	m.versions[prefix]++
+	m.mu.Unlock()
+	m.lru.Purge()
+	return nil
+}
+
+func (m *memoryIDsCache) PurgeAll(ctx context.Context) error {
+	m.lru.Purge()
+	return nil
+}
+
+func (m *memoryIDsCache) Len(ctx context.Context) (int64, error) {
+	m.lru.mu.Lock()
+	defer m.lru.mu.Unlock()
+	return int64(m.lru.ll.Len()), nil
+}
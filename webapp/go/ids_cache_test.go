@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemoryIDsCachePurge(t *testing.T) {
+	ctx := context.Background()
+	m := &memoryIDsCache{
+		lru:      newLocalIDsCache("ids_cache_memory_test", 10),
+		versions: make(map[string]int64),
+	}
+	key, _ := m.Key(ctx, "estate", "q")
+	m.PutList(ctx, key, []int64{3, 1, 2}, time.Minute)
+	m.PutValues(ctx, map[string][]byte{estateRowKey(0, 1): []byte("row")}, time.Minute)
+
+	ids, total, err := m.Get(ctx, key, 2, 1)
+	if err != nil || total != 3 || !reflect.DeepEqual(ids, []int64{1, 2}) {
+		t.Fatalf("Get = %v, %v, %v", ids, total, err)
+	}
+	values, _ := m.GetValues(ctx, []string{estateRowKey(0, 1), estateRowKey(0, 2)})
+	if string(values[0]) != "row" || values[1] != nil {
+		t.Fatalf("GetValues = %q", values)
+	}
+
+	m.Purge(ctx, "estate")
+	if newKey, _ := m.Key(ctx, "estate", "q"); newKey == key {
+		t.Errorf("key is not changed after purge: %s", newKey)
+	}
+	if _, _, err := m.Get(ctx, key, 2, 0); err != errCacheNotHit {
+		t.Errorf("Get after purge: %v", err)
+	}
+	if values, _ := m.GetValues(ctx, []string{estateRowKey(0, 1)}); values[0] != nil {
+		t.Errorf("GetValues after purge = %q", values)
+	}
+}
+
+// 物件の行の key は ID リストと同じ版の index に入らないと、Purge で消えずに残ってしまう
+func TestEstateRowKeyIndex(t *testing.T) {
+	for _, version := range []int64{0, 3} {
+		key := estateRowKey(version, 12)
+		if got, want := idsCacheIndexKeyOf(key), idsCacheIndexKey("estate", version); got != want {
+			t.Errorf("index of %s = %s, want %s", key, got, want)
+		}
+	}
+}
+
+func TestEncodeIDs(t *testing.T) {
+	for _, ids := range [][]int64{{}, {1}, {30000, 1, 0, -1, 1 << 40}} {
+		got, err := decodeIDs(encodeIDs(ids))
+		if err != nil || !reflect.DeepEqual(got, ids) {
+			t.Errorf("decodeIDs(encodeIDs(%v)) = %v, %v", ids, got, err)
+		}
+	}
+	if _, err := decodeIDs([]byte{0x80}); err == nil {
+		t.Error("broken list is decoded")
+	}
+}
+
+// memcached は 30 日より大きい expiration を unix time として読むので、それ以上は 30 日にする
+func TestMemcachedExpiration(t *testing.T) {
+	if got, want := memcachedExpiration(60*24*time.Hour), int32(memcachedMaxRelativeExpiration/time.Second); got != want {
+		t.Errorf("memcachedExpiration(60 days) = %d, want %d", got, want)
+	}
+	if got := memcachedExpiration(time.Hour); got < int32(time.Hour/2/time.Second) || got > int32(2*time.Hour/time.Second) {
+		t.Errorf("memcachedExpiration(1h) = %d", got)
+	}
+	if got := memcachedExpiration(time.Millisecond); got != 1 {
+		t.Errorf("memcachedExpiration(1ms) = %d, want 1", got)
+	}
+}
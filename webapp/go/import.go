@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// URL 指定の入稿 (データ提供元がファイルを上げる代わりに置き場所を教えてくる)
+var (
+	// 取りに行ってよいホスト。空なら URL 指定の入稿は受け付けない
+	importAllowedHosts = parseImportAllowedHosts(getEnv("IMPORT_ALLOWED_HOSTS", ""))
+	importMaxBytes     = int64(getEnvInt("IMPORT_MAX_BYTES", 20<<20))
+	importHTTPClient   = &http.Client{
+		Timeout: getEnvDuration("IMPORT_FETCH_TIMEOUT", 60*time.Second),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			// redirect で許可していないホストに飛ばされないようにする
+			if !isImportHostAllowed(req.URL) {
+				return errImportHostNotAllowed
+			}
+			return nil
+		},
+	}
+)
+
+var (
+	errImportHostNotAllowed = errors.New("import host is not allowed")
+	errImportTooLarge       = errors.New("import source is too large")
+)
+
+type ImportRequest struct {
+	Type       string `json:"type"`
+	URL        string `json:"url"`
+	Duplicates string `json:"duplicates"`
+}
+
+// ImportJob は URL 指定の入稿 1 回分の状態
+type ImportJob struct {
+	ID         int64      `json:"id"`
+	Type       string     `json:"type"`
+	URL        string     `json:"url"`
+	Status     string     `json:"status"`
+	Rows       int        `json:"rows"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+const (
+	importJobQueued    = "queued"
+	importJobRunning   = "running"
+	importJobSucceeded = "succeeded"
+	importJobFailed    = "failed"
+)
+
+// 終わったジョブはこれだけ覚えておく
+const importJobHistorySize = 100
+
+var (
+	importJobsMu  sync.Mutex
+	importJobs    = make(map[int64]*ImportJob)
+	importJobSeq  int64
+	importJobDone = make([]int64, 0, importJobHistorySize)
+)
+
+func parseImportAllowedHosts(s string) map[string]bool {
+	hosts := make(map[string]bool)
+	for _, h := range strings.Split(s, ",") {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h != "" {
+			hosts[h] = true
+		}
+	}
+	return hosts
+}
+
+func isImportHostAllowed(u *url.URL) bool {
+	return importAllowedHosts[strings.ToLower(u.Hostname())]
+}
+
+// validateImportSource は取りに行ってよい URL か確かめる
+func validateImportSource(kind string, rawURL string) (*url.URL, error) {
+	if kind != "chair" && kind != "estate" {
+		return nil, fmt.Errorf("invalid import type: %s", kind)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+	if !isImportHostAllowed(u) {
+		return nil, errImportHostNotAllowed
+	}
+	return u, nil
+}
+
+// postImport は URL から CSV を取ってきて入稿する。取り込みは裏で走らせて、すぐ 202 を返す
+func postImport(c echo.Context) error {
+	var req ImportRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Infof("post import failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	u, err := validateImportSource(req.Type, req.URL)
+	if err == errImportHostNotAllowed {
+		c.Logger().Infof("post import failed : %v", err)
+		return c.NoContent(http.StatusForbidden)
+	}
+	if err != nil {
+		c.Logger().Infof("post import failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	switch req.Duplicates {
+	case "":
+		req.Duplicates = "flag"
+	case "flag", "reject", "merge":
+	default:
+		c.Logger().Infof("invalid duplicates mode : %v", req.Duplicates)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	job := newImportJob(req.Type, u.String())
+	logger := c.Logger()
+	go func() {
+		setImportJobStatus(job.ID, importJobRunning, 0, nil)
+		rows, err := runURLImport(context.Background(), logger, req.Type, u.String(), req.Duplicates)
+		if err != nil {
+			logger.Errorf("import %d from %s failed: %v", job.ID, u, err)
+			setImportJobStatus(job.ID, importJobFailed, rows, err)
+			return
+		}
+		setImportJobStatus(job.ID, importJobSucceeded, rows, nil)
+	}()
+
+	return c.JSON(http.StatusAccepted, job)
+}
+
+// getImport は URL 指定の入稿の進み具合を返す
+func getImport(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	importJobsMu.Lock()
+	defer importJobsMu.Unlock()
+	job, ok := importJobs[id]
+	if !ok {
+		return c.NoContent(http.StatusNotFound)
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+func newImportJob(kind string, rawURL string) ImportJob {
+	importJobsMu.Lock()
+	defer importJobsMu.Unlock()
+	importJobSeq++
+	job := &ImportJob{
+		ID:        importJobSeq,
+		Type:      kind,
+		URL:       rawURL,
+		Status:    importJobQueued,
+		CreatedAt: time.Now(),
+	}
+	importJobs[job.ID] = job
+	return *job
+}
+
+func setImportJobStatus(id int64, status string, rows int, err error) {
+	importJobsMu.Lock()
+	defer importJobsMu.Unlock()
+	job, ok := importJobs[id]
+	if !ok {
+		return
+	}
+	job.Status = status
+	job.Rows = rows
+	if err != nil {
+		job.Error = err.Error()
+	}
+	if status != importJobSucceeded && status != importJobFailed {
+		return
+	}
+	now := time.Now()
+	job.FinishedAt = &now
+	// 古いものから忘れる
+	importJobDone = append(importJobDone, id)
+	if len(importJobDone) > importJobHistorySize {
+		delete(importJobs, importJobDone[0])
+		importJobDone = importJobDone[1:]
+	}
+}
+
+// runURLImport は rawURL の CSV を取ってきて、普通の入稿と同じように入れる。入れた行数を返す
+func runURLImport(ctx context.Context, logger echo.Logger, kind string, rawURL string, duplicateMode string) (int, error) {
+	u, err := validateImportSource(kind, rawURL)
+	if err != nil {
+		return 0, err
+	}
+	records, err := fetchImportCSV(ctx, u)
+	if err != nil {
+		return 0, err
+	}
+	files := []uploadedCSV{{Filename: path.Base(u.Path), Records: records}}
+
+	switch kind {
+	case "chair":
+		ngramRows, status := importChairs(ctx, logger, files)
+		if status != 0 {
+			return 0, fmt.Errorf("chair import failed with status %d", status)
+		}
+		afterChairImport(logger, ngramRows)
+		return len(records), nil
+	default:
+		stations, err := loadStations(ctx)
+		if err != nil {
+			return 0, err
+		}
+		res, status := importEstates(ctx, logger, files, duplicateMode, stations)
+		if status != 0 {
+			if len(res.rowErrors) > 0 {
+				return 0, fmt.Errorf("estate import failed with %d invalid rows (first: row %d %s)", len(res.rowErrors), res.rowErrors[0].Row, res.rowErrors[0].Message)
+			}
+			return 0, fmt.Errorf("estate import failed with status %d", status)
+		}
+		afterEstateImport(logger, res.ngramRows)
+		return len(records), nil
+	}
+}
+
+// fetchImportCSV は u から CSV を取ってくる。importMaxBytes を超えたら諦める
+func fetchImportCSV(ctx context.Context, u *url.URL) ([][]string, error) {
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := importHTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: unexpected status %d", u, res.StatusCode)
+	}
+	if res.ContentLength > importMaxBytes {
+		return nil, errImportTooLarge
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, importMaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > importMaxBytes {
+		return nil, errImportTooLarge
+	}
+	return csv.NewReader(bytes.NewReader(body)).ReadAll()
+}
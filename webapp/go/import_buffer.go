@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// IMPORT_BUFFER=true のときは、postChair / postEstate は CSV を読んで確かめるところまでその場でやり、
+// 読めない行があればいつも通り 400 を返す。問題なければ queue に積んで 202 を返し、
+// runImportBuffer がまとめて 1 つの transaction で入れる。verify の入稿がまとめて来ても
+// HTTP のレスポンスは MySQL の書き込みを待たない。
+// 積んだ行は instance のメモリにしかないので、落ちたら消える。
+// queue が一杯のとき、transaction=per_file、duplicates=reject のときは今まで通りその場で入れる
+var (
+	importBufferEnabled       = getEnvBool("IMPORT_BUFFER", false)
+	importBufferBatchRows     = getEnvInt("IMPORT_BUFFER_BATCH_ROWS", 1000)
+	importBufferFlushInterval = getEnvDuration("IMPORT_BUFFER_FLUSH_INTERVAL", 200*time.Millisecond)
+	importBufferQueue         = make(chan bufferedImport, getEnvInt("IMPORT_BUFFER_QUEUE_SIZE", 256))
+)
+
+// bufferedImport は 1 リクエスト分の、確かめ終わった入稿
+type bufferedImport struct {
+	kind          string
+	duplicateMode string
+	chairs        []chairRecord
+	estates       []estateRecord
+}
+
+func (b bufferedImport) rows() int {
+	return len(b.chairs) + len(b.estates)
+}
+
+// BufferedImportResponse は queue に積んだときのレスポンス
+type BufferedImportResponse struct {
+	QueuedRows int `json:"queuedRows"`
+}
+
+// enqueueImport は queue に積む。一杯なら false
+func enqueueImport(b bufferedImport) bool {
+	select {
+	case importBufferQueue <- b:
+		return true
+	default:
+		return false
+	}
+}
+
+// runImportBuffer は queue に積まれた入稿を、種類と duplicates ごとに importBufferBatchRows 行か
+// importBufferFlushInterval ごとにまとめて入れる
+func runImportBuffer(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(importBufferFlushInterval)
+	defer ticker.Stop()
+	pending := map[string][]bufferedImport{}
+	pendingRows := map[string]int{}
+	flush := func(key string) {
+		if len(pending[key]) == 0 {
+			return
+		}
+		writeBufferedImports(ctx, logger, pending[key])
+		delete(pending, key)
+		delete(pendingRows, key)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			for key := range pending {
+				flush(key)
+			}
+			return
+		case b := <-importBufferQueue:
+			key := b.kind + ":" + b.duplicateMode
+			pending[key] = append(pending[key], b)
+			pendingRows[key] += b.rows()
+			if pendingRows[key] >= importBufferBatchRows {
+				flush(key)
+			}
+		case <-ticker.C:
+			for key := range pending {
+				flush(key)
+			}
+		}
+	}
+}
+
+// writeBufferedImports はまとめて入れる。失敗したら 1 リクエストずつ入れ直して、
+// ダメな入稿に巻き込まれて他の入稿が消えないようにする
+func writeBufferedImports(ctx context.Context, logger echo.Logger, batch []bufferedImport) {
+	merged := bufferedImport{kind: batch[0].kind, duplicateMode: batch[0].duplicateMode}
+	for _, b := range batch {
+		merged.chairs = append(merged.chairs, b.chairs...)
+		merged.estates = append(merged.estates, b.estates...)
+	}
+	if writeBufferedImport(ctx, logger, merged) || len(batch) == 1 {
+		return
+	}
+	for _, b := range batch {
+		if !writeBufferedImport(ctx, logger, b) {
+			logger.Errorf("dropped buffered %s import (%d rows)", b.kind, b.rows())
+		}
+	}
+}
+
+func writeBufferedImport(ctx context.Context, logger echo.Logger, b bufferedImport) bool {
+	switch b.kind {
+	case "chair":
+		ngramRows, status := insertChairs(ctx, logger, b.chairs)
+		if status != 0 {
+			return false
+		}
+		afterChairImport(logger, ngramRows)
+	default:
+		stations, err := loadStations(ctx)
+		if err != nil {
+			logger.Errorf("failed to load stations: %v", err)
+			return false
+		}
+		res, status := insertEstates(ctx, logger, b.estates, b.duplicateMode, stations)
+		if status != 0 {
+			return false
+		}
+		if len(res.duplicates) > 0 {
+			logger.Infof("buffered estate import found duplicates : %v", res.duplicates)
+		}
+		afterEstateImport(logger, res.ngramRows)
+	}
+	return true
+}
+
+// tryBufferChairs は使えるなら files を読んで確かめてから queue に積み、202 を返す。
+// 読めない行があれば 400 を返す。queue に積めなかったら false
+func tryBufferChairs(c echo.Context, files []uploadedCSV) (bool, error) {
+	if !importBufferEnabled {
+		return false, nil
+	}
+	records, err := parseChairRecords(files)
+	if err != nil {
+		c.Logger().Infof("%v", err)
+		return true, c.NoContent(http.StatusBadRequest)
+	}
+	return tryBufferImport(c, bufferedImport{kind: "chair", chairs: records})
+}
+
+// tryBufferEstates は tryBufferChairs の物件版。行ごとのエラーはその場で返す
+func tryBufferEstates(c echo.Context, files []uploadedCSV, duplicateMode string) (bool, error) {
+	if !importBufferEnabled {
+		return false, nil
+	}
+	records, rowErrors, err := parseEstateRecords(c.Request().Context(), c.Logger(), files)
+	if err != nil {
+		c.Logger().Infof("%v", err)
+		return true, c.NoContent(http.StatusBadRequest)
+	}
+	if len(rowErrors) > 0 {
+		c.Logger().Infof("invalid estate rows : %v", rowErrors)
+		return true, c.JSON(http.StatusBadRequest, PostEstateErrorResponse{Errors: rowErrors})
+	}
+	return tryBufferImport(c, bufferedImport{kind: "estate", duplicateMode: duplicateMode, estates: records})
+}
+
+// tryBufferImport は queue に積んで 202 を返す。一杯なら false を返して、その場で入れてもらう
+func tryBufferImport(c echo.Context, b bufferedImport) (bool, error) {
+	if !enqueueImport(b) {
+		return false, nil
+	}
+	return true, c.JSON(http.StatusAccepted, BufferedImportResponse{QueuedRows: b.rows()})
+}
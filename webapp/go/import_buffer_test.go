@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+// buffer するときも行は積む前に確かめて、ダメな行があれば 400 と行ごとのエラーを返す
+func TestTryBufferEstatesValidatesRows(t *testing.T) {
+	defer func(enabled bool) { importBufferEnabled = enabled }(importBufferEnabled)
+	importBufferEnabled = true
+
+	valid := []string{"1", "name", "description", "/images/estate/1.png", "東京都", "35.6", "139.7", "50000", "100", "120", "", "10"}
+	outOfRange := []string{"2", "name", "description", "/images/estate/2.png", "東京都", "135.6", "139.7", "50000", "100", "120", "", "10"}
+
+	post := func(records ...[]string) (*httptest.ResponseRecorder, bool) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/api/estate", nil), rec)
+		buffered, err := tryBufferEstates(c, []uploadedCSV{{Filename: "estate.csv", Records: records}}, "flag")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec, buffered
+	}
+
+	rec, buffered := post(valid, outOfRange)
+	if !buffered || rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid rows: buffered = %v, status = %d", buffered, rec.Code)
+	}
+	var res PostEstateErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || len(res.Errors) != 1 || res.Errors[0].Row != 2 {
+		t.Errorf("invalid rows: body = %s", rec.Body)
+	}
+	if n := len(importBufferQueue); n != 0 {
+		t.Fatalf("invalid rows are queued: %d", n)
+	}
+
+	if rec, _ := post([]string{"3", "name"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("broken row: status = %d", rec.Code)
+	}
+
+	rec, buffered = post(valid)
+	if !buffered || rec.Code != http.StatusAccepted {
+		t.Fatalf("valid rows: buffered = %v, status = %d", buffered, rec.Code)
+	}
+	b := <-importBufferQueue
+	if b.kind != "estate" || b.duplicateMode != "flag" || len(b.estates) != 1 || b.estates[0].id != 1 {
+		t.Errorf("queued %+v", b)
+	}
+}
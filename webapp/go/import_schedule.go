@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 定期的な URL 指定の入稿 (毎晩のフィード取り込みなど)
+type ImportSchedule struct {
+	ID         int64     `db:"id" json:"id"`
+	Type       string    `db:"type" json:"type"`
+	URL        string    `db:"url" json:"url"`
+	Cron       string    `db:"cron" json:"cron"`
+	Duplicates string    `db:"duplicates" json:"duplicates"`
+	Enabled    bool      `db:"enabled" json:"enabled"`
+	CreatedAt  time.Time `db:"created_at" json:"createdAt"`
+}
+
+type ImportScheduleRequest struct {
+	Type       string `json:"type"`
+	URL        string `json:"url"`
+	Cron       string `json:"cron"`
+	Duplicates string `json:"duplicates"`
+	Enabled    *bool  `json:"enabled"`
+}
+
+// ImportRun は定期入稿の実行履歴
+type ImportRun struct {
+	ID         int64          `db:"id" json:"id"`
+	ScheduleID int64          `db:"schedule_id" json:"scheduleId"`
+	Status     string         `db:"status" json:"status"`
+	Rows       int64          `db:"rows" json:"rows"`
+	Error      sql.NullString `db:"error" json:"-"`
+	StartedAt  time.Time      `db:"started_at" json:"startedAt"`
+	FinishedAt sql.NullTime   `db:"finished_at" json:"-"`
+}
+
+type ImportRunResponse struct {
+	ImportRun
+	ErrorMessage string     `json:"error,omitempty"`
+	FinishedAt   *time.Time `json:"finishedAt,omitempty"`
+}
+
+type ImportSchedulesResponse struct {
+	Schedules []ImportSchedule `json:"schedules"`
+}
+
+type ImportRunsResponse struct {
+	Runs []ImportRunResponse `json:"runs"`
+}
+
+const (
+	importRunHistoryLimit = 50
+	importScheduleLockTTL = 2 * time.Minute
+)
+
+// postImportSchedule は定期入稿の設定を追加する
+func postImportSchedule(c echo.Context) error {
+	ctx := c.Request().Context()
+	var req ImportScheduleRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Infof("post import schedule failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if _, err := parseCron(req.Cron); err != nil {
+		c.Logger().Infof("post import schedule failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	_, err := validateImportSource(req.Type, req.URL)
+	if err == errImportHostNotAllowed {
+		c.Logger().Infof("post import schedule failed : %v", err)
+		return c.NoContent(http.StatusForbidden)
+	}
+	if err != nil {
+		c.Logger().Infof("post import schedule failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	switch req.Duplicates {
+	case "":
+		req.Duplicates = "flag"
+	case "flag", "reject", "merge":
+	default:
+		c.Logger().Infof("invalid duplicates mode : %v", req.Duplicates)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	enabled := true
+	if req.Enabled != nil {
+		enabled = *req.Enabled
+	}
+
+	res, err := db.ExecContext(ctx, "INSERT INTO import_schedule(type, url, cron, duplicates, enabled) VALUES(?,?,?,?,?)", req.Type, req.URL, req.Cron, req.Duplicates, enabled)
+	if err != nil {
+		c.Logger().Errorf("postImportSchedule DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		c.Logger().Errorf("postImportSchedule DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var schedule ImportSchedule
+	if err := db.GetContext(ctx, &schedule, "SELECT * FROM import_schedule WHERE id = ?", id); err != nil {
+		c.Logger().Errorf("postImportSchedule DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusCreated, schedule)
+}
+
+// getImportSchedules は定期入稿の設定一覧を返す
+func getImportSchedules(c echo.Context) error {
+	schedules := make([]ImportSchedule, 0)
+	if err := db.SelectContext(c.Request().Context(), &schedules, "SELECT * FROM import_schedule ORDER BY id"); err != nil {
+		c.Logger().Errorf("getImportSchedules DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, ImportSchedulesResponse{Schedules: schedules})
+}
+
+// getImportScheduleRuns は定期入稿の実行履歴を新しい順に返す
+func getImportScheduleRuns(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	runs := make([]ImportRun, 0)
+	err = db.SelectContext(c.Request().Context(), &runs, "SELECT * FROM import_run WHERE schedule_id = ? ORDER BY id DESC LIMIT ?", id, importRunHistoryLimit)
+	if err != nil {
+		c.Logger().Errorf("getImportScheduleRuns DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	res := ImportRunsResponse{Runs: make([]ImportRunResponse, 0, len(runs))}
+	for _, r := range runs {
+		run := ImportRunResponse{ImportRun: r, ErrorMessage: r.Error.String}
+		if r.FinishedAt.Valid {
+			run.FinishedAt = &r.FinishedAt.Time
+		}
+		res.Runs = append(res.Runs, run)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// runImportScheduler は毎分、その分に実行する定期入稿を走らせる
+func runImportScheduler(ctx context.Context, logger echo.Logger) {
+	for {
+		// 分の頭に合わせる
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next.Sub(now)):
+		}
+
+		schedules := make([]ImportSchedule, 0)
+		if err := db.SelectContext(ctx, &schedules, "SELECT * FROM import_schedule WHERE enabled = TRUE"); err != nil {
+			logger.Errorf("failed to load import schedules : %v", err)
+			continue
+		}
+		for _, s := range schedules {
+			cron, err := parseCron(s.Cron)
+			if err != nil {
+				logger.Errorf("invalid cron of import schedule %d : %v", s.ID, err)
+				continue
+			}
+			if !cron.Matches(next) {
+				continue
+			}
+			go runScheduledImport(ctx, logger, s, next)
+		}
+	}
+}
+
+// runScheduledImport は定期入稿を 1 回走らせて履歴を残す。
+// 複数台構成でも 1 台だけが実行するように redis で lock を取る
+func runScheduledImport(ctx context.Context, logger echo.Logger, s ImportSchedule, at time.Time) {
+	lockKey := fmt.Sprintf("isuumo:import_schedule:%d:%d", s.ID, at.Unix())
+	locked, err := rdb.SetNX(ctx, lockKey, instanceID, importScheduleLockTTL).Result()
+	if err != nil {
+		// redis が使えないなら協調できないので、そのまま自分で実行する
+		logger.Errorf("failed to acquire import schedule lock : %v", err)
+		locked = true
+	}
+	if !locked {
+		return
+	}
+
+	res, err := db.ExecContext(ctx, "INSERT INTO import_run(schedule_id, status) VALUES(?, ?)", s.ID, importJobRunning)
+	if err != nil {
+		logger.Errorf("failed to record import run : %v", err)
+		return
+	}
+	runID, err := res.LastInsertId()
+	if err != nil {
+		logger.Errorf("failed to record import run : %v", err)
+		return
+	}
+
+	rows, err := runURLImport(ctx, logger, s.Type, s.URL, s.Duplicates)
+	status := importJobSucceeded
+	var errMessage sql.NullString
+	if err != nil {
+		logger.Errorf("scheduled import %d from %s failed: %v", s.ID, s.URL, err)
+		status = importJobFailed
+		errMessage = sql.NullString{String: err.Error(), Valid: true}
+	}
+	_, err = db.ExecContext(ctx, "UPDATE import_run SET status = ?, `rows` = ?, error = ?, finished_at = NOW(6) WHERE id = ?", status, rows, errMessage, runID)
+	if err != nil {
+		logger.Errorf("failed to record import run : %v", err)
+	}
+}
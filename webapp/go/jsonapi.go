@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+const jsonAPIMediaType = "application/vnd.api+json"
+
+type jsonAPIResource struct {
+	Type          string                         `json:"type"`
+	ID            string                         `json:"id"`
+	Attributes    map[string]json.RawMessage     `json:"attributes"`
+	Relationships map[string]jsonAPIRelationship `json:"relationships,omitempty"`
+}
+
+type jsonAPIRelationship struct {
+	Links map[string]string `json:"links"`
+}
+
+type jsonAPIDocument struct {
+	Data  []jsonAPIResource `json:"data"`
+	Meta  map[string]int64  `json:"meta,omitempty"`
+	Links map[string]string `json:"links"`
+}
+
+// wantsJSONAPI は Accept で JSON:API が指定されているか
+func wantsJSONAPI(c echo.Context) bool {
+	for _, t := range strings.Split(c.Request().Header.Get(echo.HeaderAccept), ",") {
+		if strings.TrimSpace(strings.SplitN(t, ";", 2)[0]) == jsonAPIMediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// renderJSONAPI は chair / estate の一覧を JSON:API の resource object の配列にして返す。
+// fields の指定があればそのフィールドだけを attributes に入れる
+func renderJSONAPI(c echo.Context, status int, v interface{}) error {
+	fields := []string{}
+	if c.QueryParam("fields") != "" {
+		fields = parseFields(c.QueryParam("fields"))
+	}
+
+	doc := jsonAPIDocument{Data: []jsonAPIResource{}}
+	var count *int64
+	var err error
+	switch r := v.(type) {
+	case ChairSearchResponse:
+		count = &r.Count
+		doc.Data, err = chairResources(r.Chairs, fields)
+	case ChairListResponse:
+		doc.Data, err = chairResources(r.Chairs, fields)
+	case EstateSearchResponse:
+		count = &r.Count
+		doc.Data, err = estateResources(r.Estates, fields)
+	case EstateListResponse:
+		doc.Data, err = estateResources(r.Estates, fields)
+	default:
+		return c.JSON(status, v)
+	}
+	if err != nil {
+		c.Logger().Infof("Invalid fields parameter : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if count != nil {
+		doc.Meta = map[string]int64{"count": *count}
+	}
+	doc.Links = jsonAPIPaginationLinks(c, count)
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return c.Blob(status, jsonAPIMediaType, b)
+}
+
+func chairResources(chairs []Chair, fields []string) ([]jsonAPIResource, error) {
+	items, err := jsonAPIItems(len(chairs), fields, func(fields []string) ([]json.RawMessage, error) {
+		return sparseChairs(chairs, fields)
+	}, func(i int) interface{} { return chairs[i] })
+	if err != nil {
+		return nil, err
+	}
+	resources := make([]jsonAPIResource, 0, len(chairs))
+	for i, ch := range chairs {
+		id := strconv.FormatInt(ch.ID, 10)
+		resources = append(resources, jsonAPIResource{
+			Type:       "chairs",
+			ID:         id,
+			Attributes: items[i],
+			Relationships: map[string]jsonAPIRelationship{
+				"recommendedEstates": {Links: map[string]string{"related": "/api/recommended_estate/" + id}},
+			},
+		})
+	}
+	return resources, nil
+}
+
+func estateResources(estates []Estate, fields []string) ([]jsonAPIResource, error) {
+	items, err := jsonAPIItems(len(estates), fields, func(fields []string) ([]json.RawMessage, error) {
+		return sparseEstates(estates, fields)
+	}, func(i int) interface{} { return estates[i] })
+	if err != nil {
+		return nil, err
+	}
+	resources := make([]jsonAPIResource, 0, len(estates))
+	for i, e := range estates {
+		id := strconv.FormatInt(e.ID, 10)
+		resources = append(resources, jsonAPIResource{
+			Type:       "estates",
+			ID:         id,
+			Attributes: items[i],
+			Relationships: map[string]jsonAPIRelationship{
+				"recommendedChairs": {Links: map[string]string{"related": "/api/recommended_chair/" + id}},
+			},
+		})
+	}
+	return resources, nil
+}
+
+// jsonAPIItems は各要素を JSON にしてから attributes 用に id を除いた map にする
+func jsonAPIItems(n int, fields []string, sparse func([]string) ([]json.RawMessage, error), item func(int) interface{}) ([]map[string]json.RawMessage, error) {
+	raws := make([]json.RawMessage, 0, n)
+	if len(fields) > 0 {
+		var err error
+		if raws, err = sparse(fields); err != nil {
+			return nil, err
+		}
+	} else {
+		for i := 0; i < n; i++ {
+			b, err := json.Marshal(item(i))
+			if err != nil {
+				return nil, err
+			}
+			raws = append(raws, b)
+		}
+	}
+
+	items := make([]map[string]json.RawMessage, 0, n)
+	for _, raw := range raws {
+		attrs := map[string]json.RawMessage{}
+		if err := json.Unmarshal(raw, &attrs); err != nil {
+			return nil, err
+		}
+		delete(attrs, "id")
+		items = append(items, attrs)
+	}
+	return items, nil
+}
+
+// jsonAPIPaginationLinks は page / perPage で検索しているときに first, prev, next, last を付ける
+func jsonAPIPaginationLinks(c echo.Context, count *int64) map[string]string {
+	u := *c.Request().URL
+	links := map[string]string{"self": u.RequestURI()}
+	page, perPage, err := parsePaging(c)
+	if count == nil || err != nil || c.QueryParam("perPage") == "" {
+		return links
+	}
+
+	link := func(p int) string {
+		q := u.Query()
+		q.Set("page", strconv.Itoa(p))
+		lu := u
+		lu.RawQuery = q.Encode()
+		return lu.RequestURI()
+	}
+	last := 0
+	if *count > 0 {
+		last = int((*count - 1) / int64(perPage))
+	}
+	links["first"] = link(0)
+	links["last"] = link(last)
+	if page > 0 {
+		links["prev"] = link(page - 1)
+	}
+	if page < last {
+		links["next"] = link(page + 1)
+	}
+	return links
+}
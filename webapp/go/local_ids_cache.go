@@ -0,0 +1,157 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// redis が使えない間 (cacheAvailable が false の間) は、検索の ID リストを instance の中の LRU に持つ。
+// 入稿などは他の instance から知らされないので、TTL は短くしておく
+var (
+	localIDsCacheSize = getEnvInt("LOCAL_IDS_CACHE_SIZE", 1000)
+	localIDsCacheTTL  = getEnvDuration("LOCAL_IDS_CACHE_TTL", 5*time.Second)
+)
+
+var (
+	estateLocalIDsCache = newLocalIDsCache("estate_ids_local", localIDsCacheSize)
+	chairLocalIDsCache  = newLocalIDsCache("chair_ids_local", localIDsCacheSize)
+)
+
+func init() {
+	localResetHooks = append(localResetHooks, estateLocalIDsCache.Purge, chairLocalIDsCache.Purge)
+}
+
+type localIDsCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+	stats *cacheStats
+	// fill は redis の方とは別にまとめる
+	group flightGroup
+}
+
+// localIDsCacheEntry は ID リストか、それ以外の値 (memory の backend が持つ件数や物件の行など) のどちらかを持つ
+type localIDsCacheEntry struct {
+	key     string
+	ids     []int64
+	value   []byte
+	expires time.Time
+}
+
+func newLocalIDsCache(name string, size int) *localIDsCache {
+	lc := &localIDsCache{size: size, ll: list.New(), items: make(map[string]*list.Element)}
+	lc.stats = newCacheStats(name, func(ctx context.Context) (int64, error) {
+		lc.mu.Lock()
+		defer lc.mu.Unlock()
+		return int64(lc.ll.Len()), nil
+	})
+	return lc
+}
+
+// hashCacheKey は正規化した条件を key に使える長さにする
+func hashCacheKey(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func (lc *localIDsCache) get(key string) ([]int64, bool) {
+	e, ok := lc.lookup(key)
+	if !ok {
+		return nil, false
+	}
+	return e.ids, true
+}
+
+// getValue は putValue で入れた値を返す
+func (lc *localIDsCache) getValue(key string) ([]byte, bool) {
+	e, ok := lc.lookup(key)
+	if !ok {
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (lc *localIDsCache) lookup(key string) (*localIDsCacheEntry, bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	el, ok := lc.items[key]
+	if !ok {
+		lc.stats.Miss(1)
+		return nil, false
+	}
+	e := el.Value.(*localIDsCacheEntry)
+	if time.Now().After(e.expires) {
+		lc.ll.Remove(el)
+		delete(lc.items, key)
+		lc.stats.Miss(1)
+		return nil, false
+	}
+	lc.ll.MoveToFront(el)
+	lc.stats.Hit(1)
+	return e, true
+}
+
+func (lc *localIDsCache) put(key string, ids []int64, ttl time.Duration) {
+	lc.putEntry(&localIDsCacheEntry{key: key, ids: ids, expires: time.Now().Add(ttl)}, ttl)
+}
+
+func (lc *localIDsCache) putValue(key string, value []byte, ttl time.Duration) {
+	lc.putEntry(&localIDsCacheEntry{key: key, value: value, expires: time.Now().Add(ttl)}, ttl)
+}
+
+func (lc *localIDsCache) putEntry(e *localIDsCacheEntry, ttl time.Duration) {
+	if lc.size <= 0 || ttl <= 0 {
+		return
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	key := e.key
+	if el, ok := lc.items[key]; ok {
+		el.Value = e
+		lc.ll.MoveToFront(el)
+		return
+	}
+	lc.items[key] = lc.ll.PushFront(e)
+	for lc.ll.Len() > lc.size {
+		oldest := lc.ll.Back()
+		lc.ll.Remove(oldest)
+		delete(lc.items, oldest.Value.(*localIDsCacheEntry).key)
+	}
+}
+
+// Purge は全部捨てる。この instance で入稿などがあったときに呼ぶ
+func (lc *localIDsCache) Purge() {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.ll.Init()
+	lc.items = make(map[string]*list.Element)
+}
+
+// getOrFill は key の ID リストを返す。無ければ query で作って入れる。同じ key の fill は 1 つにまとめる
+func (lc *localIDsCache) getOrFill(key string, query func(ctx context.Context) ([]int64, error)) ([]int64, error) {
+	if ids, ok := lc.get(key); ok {
+		return ids, nil
+	}
+	v, err, _ := lc.group.Do(key, func() (interface{}, error) {
+		// 待っている他のリクエストが切断されても困らないように切り離す
+		ctx, cancel := context.WithTimeout(context.Background(), cacheBackgroundTimeout)
+		defer cancel()
+		start := time.Now()
+		ids, err := query(ctx)
+		if err != nil {
+			return nil, err
+		}
+		lc.put(key, ids, localIDsCacheTTL)
+		lc.stats.ObserveFill(time.Since(start))
+		return ids, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]int64), nil
+}
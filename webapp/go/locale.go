@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// fixture の検索条件そのものが ja 向け
+const defaultLocale = "ja"
+
+// ConditionLabel は検索条件 1 項目の表示用ラベル。指定のないものは ja のまま
+type ConditionLabel struct {
+	Prefix *string `json:"prefix"`
+	Suffix *string `json:"suffix"`
+	// Labels は list の値 (検索に使うのはこちら) から表示用の文字列への対応
+	Labels map[string]string `json:"labels"`
+}
+
+// ConditionLabels は 1 つの locale の表示用ラベル (fixture/condition_labels/<locale>.json)
+type ConditionLabels struct {
+	Chair  map[string]ConditionLabel `json:"chair"`
+	Estate map[string]ConditionLabel `json:"estate"`
+}
+
+var localizedChairSearchConditions = map[string]ChairSearchCondition{}
+var localizedEstateSearchConditions = map[string]EstateSearchCondition{}
+
+// 検索条件は起動後に変わらないので、JSON にしたものを持っておいてそのまま返す
+var localizedChairSearchConditionsJSON = map[string][]byte{}
+var localizedEstateSearchConditionsJSON = map[string][]byte{}
+
+// loadConditionLabels は locale ごとのラベルを読んで、検索条件を locale ごとに作っておく。
+// chairSearchCondition / estateSearchCondition を読んだ後に呼ぶ
+func loadConditionLabels(dir string) error {
+	localizedChairSearchConditions[defaultLocale] = chairSearchCondition
+	localizedEstateSearchConditions[defaultLocale] = estateSearchCondition
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		jsonText, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		var labels ConditionLabels
+		if err := json.Unmarshal(jsonText, &labels); err != nil {
+			return err
+		}
+		locale := strings.TrimSuffix(filepath.Base(p), ".json")
+		localizedChairSearchConditions[locale] = ChairSearchCondition{
+			Width:    localizeRange(chairSearchCondition.Width, labels.Chair["width"]),
+			Height:   localizeRange(chairSearchCondition.Height, labels.Chair["height"]),
+			Depth:    localizeRange(chairSearchCondition.Depth, labels.Chair["depth"]),
+			Price:    localizeRange(chairSearchCondition.Price, labels.Chair["price"]),
+			Color:    localizeList(chairSearchCondition.Color, labels.Chair["color"]),
+			Feature:  localizeList(chairSearchCondition.Feature, labels.Chair["feature"]),
+			Kind:     localizeList(chairSearchCondition.Kind, labels.Chair["kind"]),
+			Weight:   localizeRange(chairSearchCondition.Weight, labels.Chair["weight"]),
+			Material: localizeList(chairSearchCondition.Material, labels.Chair["material"]),
+		}
+		localizedEstateSearchConditions[locale] = EstateSearchCondition{
+			DoorWidth:  localizeRange(estateSearchCondition.DoorWidth, labels.Estate["doorWidth"]),
+			DoorHeight: localizeRange(estateSearchCondition.DoorHeight, labels.Estate["doorHeight"]),
+			Rent:       localizeRange(estateSearchCondition.Rent, labels.Estate["rent"]),
+			Feature:    localizeList(estateSearchCondition.Feature, labels.Estate["feature"]),
+			Layout:     localizeList(estateSearchCondition.Layout, labels.Estate["layout"]),
+		}
+	}
+
+	for locale, cond := range localizedChairSearchConditions {
+		b, err := json.Marshal(cond)
+		if err != nil {
+			return err
+		}
+		localizedChairSearchConditionsJSON[locale] = b
+	}
+	for locale, cond := range localizedEstateSearchConditions {
+		b, err := json.Marshal(cond)
+		if err != nil {
+			return err
+		}
+		localizedEstateSearchConditionsJSON[locale] = b
+	}
+	return nil
+}
+
+func localizeRange(rc RangeCondition, l ConditionLabel) RangeCondition {
+	if l.Prefix != nil {
+		rc.Prefix = *l.Prefix
+	}
+	if l.Suffix != nil {
+		rc.Suffix = *l.Suffix
+	}
+	return rc
+}
+
+func localizeList(lc ListCondition, l ConditionLabel) ListCondition {
+	if len(l.Labels) == 0 {
+		return lc
+	}
+	labels := make(map[string]string, len(lc.List))
+	for _, v := range lc.List {
+		if label, ok := l.Labels[v]; ok {
+			labels[v] = label
+		}
+	}
+	lc.Labels = labels
+	return lc
+}
+
+// negotiateLocale は Accept-Language から対応している locale を q の大きい順に探す。
+// 見つからなければ defaultLocale
+func negotiateLocale(c echo.Context, available func(string) bool) string {
+	type candidate struct {
+		locale string
+		q      float64
+	}
+	candidates := []candidate{}
+	for _, part := range strings.Split(c.Request().Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		// en-US は en として扱う
+		locale := strings.ToLower(strings.SplitN(fields[0], "-", 2)[0])
+		if locale != "" && q > 0 {
+			candidates = append(candidates, candidate{locale: locale, q: q})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	for _, cand := range candidates {
+		if available(cand.locale) {
+			return cand.locale
+		}
+	}
+	return defaultLocale
+}
+
+func setLocaleHeaders(c echo.Context, locale string) {
+	c.Response().Header().Set("Content-Language", locale)
+	c.Response().Header().Add("Vary", "Accept-Language")
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/labstack/echo"
+)
+
+// low_priced は叩かれる回数が多いので、JSON にしたものを丸ごと searchIDsCache に持っておく。
+// 入稿や購入で中身が変わったときにその場で作り直して書き込む (write-through)。
+// key は {prefix}:v{版}:{...} で、作り直せなかったときは版を上げて捨てる
+const (
+	lowPricedChairCachePrefix  = "low_priced:chair"
+	lowPricedEstateCachePrefix = "low_priced:estate"
+)
+
+var lowPricedCacheStats = newCacheStats("low_priced", nil)
+
+// isDefaultListRendering は fields や JSON:API の指定がなく、普通の JSON で返すかどうか。
+// cache しているのはこの形だけ
+func isDefaultListRendering(c echo.Context) bool {
+	return c.QueryParam("fields") == "" && c.QueryParam("withTimestamps") != "1" && !wantsJSONAPI(c)
+}
+
+// lowPricedCacheKey は prefix の今の版での key を返す。作り直す前に取っておいて、putLowPricedCache に渡す
+func lowPricedCacheKey(ctx context.Context, prefix string) (string, error) {
+	return searchIDsCache.Key(ctx, prefix, "list")
+}
+
+// getLowPricedCache は cache されている JSON と、作り直したときに書き込む key を返す。
+// 無ければ JSON は nil で、cache が使えなければ key も空
+func getLowPricedCache(ctx context.Context, prefix string) ([]byte, string) {
+	if !cacheAvailable() {
+		return nil, ""
+	}
+	key, err := lowPricedCacheKey(ctx, prefix)
+	var values [][]byte
+	if err == nil {
+		values, err = searchIDsCache.GetValues(ctx, []string{key})
+	}
+	if err != nil {
+		lowPricedCacheStats.Error()
+		if isCacheConnectionError(err) {
+			markCacheUnhealthy(err)
+		}
+		return nil, ""
+	}
+	if values[0] == nil {
+		lowPricedCacheStats.Miss(1)
+		return nil, key
+	}
+	lowPricedCacheStats.Hit(1)
+	return values[0], key
+}
+
+// putLowPricedCache は JSON を key に cache する。ttl が 0 なら cacheDefaultTTL
+func putLowPricedCache(ctx context.Context, key string, b []byte, ttl time.Duration) {
+	if key == "" || !cacheAvailable() {
+		return
+	}
+	if err := searchIDsCache.PutValues(ctx, map[string][]byte{key: b}, ttl); isCacheConnectionError(err) {
+		markCacheUnhealthy(err)
+	}
+}
+
+// purgeLowPricedCache は cache を作り直せなかったときや、中身が変わったのに作り直さないときに呼ぶ
+func purgeLowPricedCache(ctx context.Context, prefix string) {
+	_ = handlePurgeError(searchIDsCache.Purge(ctx, prefix))
+}
+
+// lowPricedChairCacheTTL はセールが終わって価格が変わる椅子があれば、その時刻までを TTL にする
+func lowPricedChairCacheTTL(chairs []Chair, now time.Time) time.Duration {
+	var ttl time.Duration
+	for _, ch := range chairs {
+		if ch.SalePrice == nil || ch.SaleUntil == nil || !ch.SaleUntil.After(now) {
+			continue
+		}
+		if d := ch.SaleUntil.Sub(now); ttl == 0 || d < ttl {
+			ttl = d
+		}
+	}
+	return ttl
+}
+
+// loadLowPricedChairs は安い順に Limit 件の椅子を返す。set が使えなければ SQL で並べる
+func loadLowPricedChairs(ctx context.Context) ([]Chair, error) {
+	var chairs []Chair
+	var err error
+	if ids, setErr := getLowPricedIDs(ctx, lowPricedChairSetKey, rebuildLowPricedChairSet); setErr == nil {
+		err = selectByIDsInOrder(ctx, &chairs, "chair", ids)
+	} else {
+		query := `SELECT * FROM chair ORDER BY ` + chairEffectivePrice + ` ASC, id ASC LIMIT ?`
+		err = db.SelectContext(ctx, &chairs, query, Limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	setChairEffectivePrices(chairs)
+	return chairs, nil
+}
+
+// refreshLowPricedChairCache は椅子の入稿や購入の後に呼んで、cache を今の中身で書き直す。
+// 作り直せなかったときは消しておいて、次に読むときに作ってもらう
+func refreshLowPricedChairCache(ctx context.Context) {
+	if !cacheAvailable() {
+		setCachePurgePending()
+		return
+	}
+	key, err := lowPricedCacheKey(ctx, lowPricedChairCachePrefix)
+	if err != nil {
+		_ = handlePurgeError(err)
+		return
+	}
+	now := time.Now()
+	chairs, err := loadLowPricedChairs(ctx)
+	if err != nil {
+		purgeLowPricedCache(ctx, lowPricedChairCachePrefix)
+		return
+	}
+	// cache しているのは timestamp を出さない普通の JSON だけ
+	for i := range chairs {
+		chairs[i].CreatedAt = nil
+		chairs[i].UpdatedAt = nil
+	}
+	b, _ := marshalListResponse(ChairListResponse{Chairs: chairs})
+	putLowPricedCache(ctx, key, b, lowPricedChairCacheTTL(chairs, now))
+}
+
+// isLowPricedChair は id の椅子が low_priced の set に入っているかどうか。
+// 分からないときは入っていることにする
+func isLowPricedChair(ctx context.Context, id int64) bool {
+	err := rdb.ZScore(ctx, lowPricedChairSetKey, strconv.FormatInt(id, 10)).Err()
+	return err != redis.Nil
+}
+
+func getLowPricedChair(c echo.Context) error {
+	ctx := c.Request().Context()
+	setSurrogateKeys(c, surrogateKeyChairSearch)
+	setSinglePageLinks(c)
+	cacheable := isDefaultListRendering(c)
+	var key string
+	if cacheable {
+		var b []byte
+		if b, key = getLowPricedCache(ctx, lowPricedChairCachePrefix); b != nil {
+			return c.JSONBlob(http.StatusOK, b)
+		}
+	}
+
+	now := time.Now()
+	chairs, err := loadLowPricedChairs(ctx)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.Logger().Error("getLowPricedChair not found")
+			return renderList(c, http.StatusOK, ChairListResponse{[]Chair{}})
+		}
+		c.Logger().Errorf("getLowPricedChair DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	hideChairTimestamps(c, chairs)
+	if !cacheable {
+		return renderList(c, http.StatusOK, ChairListResponse{Chairs: chairs})
+	}
+	b, _ := marshalListResponse(ChairListResponse{Chairs: chairs})
+	putLowPricedCache(ctx, key, b, lowPricedChairCacheTTL(chairs, now))
+	return c.JSONBlob(http.StatusOK, b)
+}
+
+// loadLowPricedEstates は available な物件を安い順に Limit 件返す。set が使えなければ SQL で並べる
+func loadLowPricedEstates(ctx context.Context) ([]Estate, error) {
+	estates := make([]Estate, 0, Limit)
+	var err error
+	if ids, setErr := getLowPricedIDs(ctx, lowPricedEstateSetKey, rebuildLowPricedEstateSet); setErr == nil {
+		err = selectByIDsInOrder(ctx, &estates, "estate", ids)
+	} else {
+		query := `SELECT * FROM estate WHERE status = 'available' ORDER BY rent ASC, id ASC LIMIT ?`
+		err = db.SelectContext(ctx, &estates, query, Limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return estates, nil
+}
+
+// refreshLowPricedEstateCache は物件の入稿や状態の変更の後、set を更新してから呼ぶ。
+// 作り直せなかったときは消しておいて、次に読むときに作ってもらう
+func refreshLowPricedEstateCache(ctx context.Context) {
+	if !cacheAvailable() {
+		setCachePurgePending()
+		return
+	}
+	key, err := lowPricedCacheKey(ctx, lowPricedEstateCachePrefix)
+	if err != nil {
+		_ = handlePurgeError(err)
+		return
+	}
+	estates, err := loadLowPricedEstates(ctx)
+	if err != nil {
+		purgeLowPricedCache(ctx, lowPricedEstateCachePrefix)
+		return
+	}
+	for i := range estates {
+		estates[i].CreatedAt = nil
+		estates[i].UpdatedAt = nil
+	}
+	b, _ := marshalListResponse(EstateListResponse{Estates: estates})
+	putLowPricedCache(ctx, key, b, 0)
+}
+
+func getLowPricedEstate(c echo.Context) error {
+	ctx := c.Request().Context()
+	setSurrogateKeys(c, surrogateKeyEstateSearch)
+	setSinglePageLinks(c)
+	cacheable := isDefaultListRendering(c)
+	var key string
+	if cacheable {
+		var b []byte
+		if b, key = getLowPricedCache(ctx, lowPricedEstateCachePrefix); b != nil {
+			return c.JSONBlob(http.StatusOK, b)
+		}
+	}
+
+	estates, err := loadLowPricedEstates(ctx)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.Logger().Error("getLowPricedEstate not found")
+			return renderList(c, http.StatusOK, EstateListResponse{[]Estate{}})
+		}
+		c.Logger().Errorf("getLowPricedEstate DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	hideEstateTimestamps(c, estates)
+	if !cacheable {
+		return renderList(c, http.StatusOK, EstateListResponse{Estates: estates})
+	}
+	b, _ := marshalListResponse(EstateListResponse{Estates: estates})
+	putLowPricedCache(ctx, key, b, 0)
+	return c.JSONBlob(http.StatusOK, b)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jmoiron/sqlx"
+)
+
+// low_priced の並び (安い順、同じ値段なら id 順) の先頭 lowPricedSetSize 件の ID を redis の sorted set に持っておき、
+// 入稿・購入・状態変更のたびに足したり消したりする。low_priced はここから Limit 件の ID を取って主キーで引くので、
+// 毎回 ORDER BY price LIMIT を投げなくていい。
+// set が Limit 件より少なくなったら (売り切れが続いたときなど) MySQL から作り直す
+var lowPricedSetSize = int64(getEnvInt("LOW_PRICED_SET_SIZE", 100))
+
+const (
+	lowPricedChairSetKey  = "low_priced:chair:set"
+	lowPricedEstateSetKey = "low_priced:estate:set"
+	// score は 値段 * lowPricedIDScale + id にして、同じ値段なら id 順になるようにする (id は 1e7 未満)
+	lowPricedIDScale = 1e7
+)
+
+func lowPricedScore(price int64, id int64) float64 {
+	return float64(price)*lowPricedIDScale + float64(id)
+}
+
+// getLowPricedIDs は set の先頭 Limit 件の ID を返す。足りなければ rebuild で作り直す
+func getLowPricedIDs(ctx context.Context, key string, rebuild func(ctx context.Context) ([]int64, error)) ([]int64, error) {
+	if !cacheAvailable() {
+		return nil, errCacheNotHit
+	}
+	members, err := rdb.ZRange(ctx, key, 0, int64(Limit)-1).Result()
+	if err != nil {
+		if isCacheConnectionError(err) {
+			markCacheUnhealthy(err)
+		}
+		return nil, err
+	}
+	if len(members) < Limit {
+		// 物件・椅子が Limit 件より少ないときも毎回ここに来るが、そのときは元の SQL と同じ
+		return rebuild(ctx)
+	}
+	ids := make([]int64, 0, len(members))
+	for _, m := range members {
+		id, err := strconv.ParseInt(m, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid member %q in %s", m, key)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// replaceLowPricedSet は key を scores で作り直す。ttl が 0 なら期限なし
+func replaceLowPricedSet(ctx context.Context, key string, scores []*redis.Z, ttl time.Duration) error {
+	pipe := rdb.TxPipeline()
+	pipe.Del(ctx, key)
+	if len(scores) > 0 {
+		pipe.ZAdd(ctx, key, scores...)
+		if ttl > 0 {
+			pipe.Expire(ctx, key, ttl)
+		}
+	}
+	_, err := pipe.Exec(ctx)
+	return handlePurgeError(err)
+}
+
+// addToLowPricedSet は新しく入った (か値段が変わった) ものを set に足して lowPricedSetSize 件に切り詰める。
+// set は MySQL の先頭 lowPricedSetSize 件そのものでないといけないので、足せるかどうかは planLowPricedSetAdd で決め、
+// 足せないときは set を捨てる (次に読むときに作り直す)。
+// 読んでから書くまでに他から変えられたら順番が分からなくなるので、そのときも捨てる
+func addToLowPricedSet(ctx context.Context, key string, scores []*redis.Z) error {
+	if len(scores) == 0 || !cacheAvailable() {
+		return nil
+	}
+	err := rdb.Watch(ctx, func(tx *redis.Tx) error {
+		pipe := tx.Pipeline()
+		card := pipe.ZCard(ctx, key)
+		last := pipe.ZRangeWithScores(ctx, key, -1, -1)
+		current := make([]*redis.FloatCmd, len(scores))
+		for i, z := range scores {
+			current[i] = pipe.ZScore(ctx, key, z.Member.(string))
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return err
+		}
+		state := lowPricedSetState{size: card.Val(), current: make([]*float64, len(scores))}
+		if l := last.Val(); len(l) > 0 {
+			state.max = l[0].Score
+		}
+		for i, cmd := range current {
+			if cmd.Err() == nil {
+				v := cmd.Val()
+				state.current[i] = &v
+			}
+		}
+		add, purge := planLowPricedSetAdd(state, scores, lowPricedSetSize)
+		if !purge && len(add) == 0 {
+			return nil
+		}
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if purge {
+				pipe.Del(ctx, key)
+				return nil
+			}
+			pipe.ZAdd(ctx, key, add...)
+			pipe.ZRemRangeByRank(ctx, key, lowPricedSetSize, -1)
+			return nil
+		})
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		err = rdb.Del(ctx, key).Err()
+	}
+	return handlePurgeError(err)
+}
+
+// lowPricedSetState は足す前の set の状態
+type lowPricedSetState struct {
+	// size は set の件数、max は set の最後 (一番高い) の score
+	size int64
+	max  float64
+	// current は足すものそれぞれの set での今の score。set に無ければ nil
+	current []*float64
+}
+
+// planLowPricedSetAdd は scores のうち set に足すものと、set を捨てるかどうかを決める。
+//   - set が無ければ、一部だけの set ができないように何もしない
+//   - set が lowPricedSetSize 件に満たないときは、set の外に売り切れなどで外したものより安いものが無いとは言えないので捨てる
+//   - 既に set にあるものの値段が変わったときは、set の外にあるものとの順番が分からないので捨てる
+//   - set が埋まっていれば、最後の score 以下のものだけ足す (それより高いものは先頭 lowPricedSetSize 件に入らない)
+func planLowPricedSetAdd(state lowPricedSetState, scores []*redis.Z, setSize int64) ([]*redis.Z, bool) {
+	if state.size == 0 {
+		return nil, false
+	}
+	if state.size < setSize {
+		return nil, true
+	}
+	add := make([]*redis.Z, 0, len(scores))
+	for i, z := range scores {
+		if cur := state.current[i]; cur != nil {
+			if *cur != z.Score {
+				return nil, true
+			}
+			continue
+		}
+		if z.Score <= state.max {
+			add = append(add, z)
+		}
+	}
+	return add, false
+}
+
+func removeFromLowPricedSet(ctx context.Context, key string, id int64) error {
+	if !cacheAvailable() {
+		// 戻ったときに古い set を使わないように、全部捨ててもらう
+		setCachePurgePending()
+		return nil
+	}
+	return handlePurgeError(rdb.ZRem(ctx, key, strconv.FormatInt(id, 10)).Err())
+}
+
+// rebuildLowPricedChairSet は MySQL から椅子の set を作り直して、先頭 Limit 件の ID を返す
+func rebuildLowPricedChairSet(ctx context.Context) ([]int64, error) {
+	var chairs []Chair
+	query := `SELECT * FROM chair ORDER BY ` + chairEffectivePrice + ` ASC, id ASC LIMIT ?`
+	if err := db.SelectContext(ctx, &chairs, query, lowPricedSetSize); err != nil {
+		return nil, err
+	}
+	setChairEffectivePrices(chairs)
+	scores := make([]*redis.Z, 0, len(chairs))
+	for _, ch := range chairs {
+		scores = append(scores, &redis.Z{Score: lowPricedScore(ch.EffectivePrice, ch.ID), Member: strconv.FormatInt(ch.ID, 10)})
+	}
+	// セールが終わると値段が変わるので、そこで作り直す
+	if err := replaceLowPricedSet(ctx, lowPricedChairSetKey, scores, lowPricedChairCacheTTL(chairs, time.Now())); err != nil {
+		return nil, err
+	}
+	return firstLowPricedIDs(scores), nil
+}
+
+// rebuildLowPricedEstateSet は MySQL から物件の set を作り直して、先頭 Limit 件の ID を返す
+func rebuildLowPricedEstateSet(ctx context.Context) ([]int64, error) {
+	var estates []struct {
+		ID   int64 `db:"id"`
+		Rent int64 `db:"rent"`
+	}
+	query := `SELECT id, rent FROM estate WHERE status = 'available' ORDER BY rent ASC, id ASC LIMIT ?`
+	if err := db.SelectContext(ctx, &estates, query, lowPricedSetSize); err != nil {
+		return nil, err
+	}
+	scores := make([]*redis.Z, 0, len(estates))
+	for _, e := range estates {
+		scores = append(scores, &redis.Z{Score: lowPricedScore(e.Rent, e.ID), Member: strconv.FormatInt(e.ID, 10)})
+	}
+	if err := replaceLowPricedSet(ctx, lowPricedEstateSetKey, scores, 0); err != nil {
+		return nil, err
+	}
+	return firstLowPricedIDs(scores), nil
+}
+
+// selectByIDsInOrder は ids の行を ids の順に dest に入れる
+func selectByIDsInOrder(ctx context.Context, dest interface{}, table string, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	query, args, err := sqlx.In("SELECT * FROM "+table+" WHERE id IN (?) ORDER BY FIELD(id, ?)", ids, ids)
+	if err != nil {
+		return err
+	}
+	return db.SelectContext(ctx, dest, query, args...)
+}
+
+func firstLowPricedIDs(scores []*redis.Z) []int64 {
+	ids := make([]int64, 0, Limit)
+	for _, z := range scores {
+		if len(ids) >= Limit {
+			break
+		}
+		id, _ := strconv.ParseInt(z.Member.(string), 10, 64)
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// addLowPricedChairs は入稿された椅子を set に足す
+func addLowPricedChairs(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 || !cacheAvailable() {
+		return nil
+	}
+	query, args, err := sqlx.In("SELECT * FROM chair WHERE id IN (?)", ids)
+	if err != nil {
+		return err
+	}
+	var chairs []Chair
+	if err := db.SelectContext(ctx, &chairs, query, args...); err != nil {
+		return err
+	}
+	// セール中の椅子は期限で値段が変わるので、set の期限ごと作り直してもらう
+	if lowPricedChairCacheTTL(chairs, time.Now()) > 0 {
+		return handlePurgeError(rdb.Del(ctx, lowPricedChairSetKey).Err())
+	}
+	setChairEffectivePrices(chairs)
+	scores := make([]*redis.Z, 0, len(chairs))
+	for _, ch := range chairs {
+		scores = append(scores, &redis.Z{Score: lowPricedScore(ch.EffectivePrice, ch.ID), Member: strconv.FormatInt(ch.ID, 10)})
+	}
+	return addToLowPricedSet(ctx, lowPricedChairSetKey, scores)
+}
+
+// addLowPricedEstates は入稿や状態の変更で available になった物件を set に足す
+func addLowPricedEstates(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 || !cacheAvailable() {
+		return nil
+	}
+	query, args, err := sqlx.In("SELECT id, rent FROM estate WHERE status = 'available' AND id IN (?)", ids)
+	if err != nil {
+		return err
+	}
+	var estates []struct {
+		ID   int64 `db:"id"`
+		Rent int64 `db:"rent"`
+	}
+	if err := db.SelectContext(ctx, &estates, query, args...); err != nil {
+		return err
+	}
+	scores := make([]*redis.Z, 0, len(estates))
+	for _, e := range estates {
+		scores = append(scores, &redis.Z{Score: lowPricedScore(e.Rent, e.ID), Member: strconv.FormatInt(e.ID, 10)})
+	}
+	return addToLowPricedSet(ctx, lowPricedEstateSetKey, scores)
+}
+
+// rebuildLowPricedSets は initialize で DB を作り直した後に呼ぶ
+func rebuildLowPricedSets(ctx context.Context) error {
+	if _, err := rebuildLowPricedChairSet(ctx); err != nil {
+		return err
+	}
+	_, err := rebuildLowPricedEstateSet(ctx)
+	return err
+}
+
+// purgeLowPricedSets は set を両方消す。次に読むときに MySQL から作り直される
+func purgeLowPricedSets(ctx context.Context) error {
+	// cluster では key ごとに slot が違うので 1 つずつ
+	pipe := rdb.Pipeline()
+	pipe.Del(ctx, lowPricedChairSetKey)
+	pipe.Del(ctx, lowPricedEstateSetKey)
+	_, err := pipe.Exec(ctx)
+	return err
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestPlanLowPricedSetAdd(t *testing.T) {
+	score := func(v float64) *float64 { return &v }
+	z := func(price, id int64) *redis.Z {
+		return &redis.Z{Score: lowPricedScore(price, id), Member: "m"}
+	}
+	max := lowPricedScore(5000, 3)
+	tests := []struct {
+		name      string
+		state     lowPricedSetState
+		scores    []*redis.Z
+		wantAdd   []*redis.Z
+		wantPurge bool
+	}{
+		{"no set", lowPricedSetState{current: []*float64{nil}}, []*redis.Z{z(100, 1)}, nil, false},
+		// 売り切れで減った set は、外に安いものが残っているかもしれない
+		{"not full", lowPricedSetState{size: 2, max: max, current: []*float64{nil}}, []*redis.Z{z(100, 1)}, nil, true},
+		{"cheaper", lowPricedSetState{size: 3, max: max, current: []*float64{nil}}, []*redis.Z{z(100, 1)}, []*redis.Z{z(100, 1)}, false},
+		{"same price, smaller id", lowPricedSetState{size: 3, max: max, current: []*float64{nil}}, []*redis.Z{z(5000, 2)}, []*redis.Z{z(5000, 2)}, false},
+		{"same as max", lowPricedSetState{size: 3, max: max, current: []*float64{nil}}, []*redis.Z{z(5000, 3)}, []*redis.Z{z(5000, 3)}, false},
+		{"more expensive", lowPricedSetState{size: 3, max: max, current: []*float64{nil, nil}}, []*redis.Z{z(5000, 4), z(100, 1)}, []*redis.Z{z(100, 1)}, false},
+		{"unchanged member", lowPricedSetState{size: 3, max: max, current: []*float64{score(lowPricedScore(100, 1))}}, []*redis.Z{z(100, 1)}, []*redis.Z{}, false},
+		{"price changed", lowPricedSetState{size: 3, max: max, current: []*float64{nil, score(lowPricedScore(100, 1))}}, []*redis.Z{z(200, 2), z(300, 1)}, nil, true},
+	}
+	for _, tt := range tests {
+		add, purge := planLowPricedSetAdd(tt.state, tt.scores, 3)
+		if purge != tt.wantPurge || !reflect.DeepEqual(add, tt.wantAdd) {
+			t.Errorf("%s: planLowPricedSetAdd = %v, %v, want %v, %v", tt.name, add, purge, tt.wantAdd, tt.wantPurge)
+		}
+	}
+}
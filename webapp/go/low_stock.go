@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 在庫が少なくなった椅子を、売り切れて chair から消える前に知らせる。
+// 閾値は LOW_STOCK_THRESHOLD が全体、LOW_STOCK_THRESHOLDS="kind:n,kind:n" が種類ごとの上書き。
+// 購入で閾値を下回ったときに LOW_STOCK_WEBHOOK_URL と LOW_STOCK_EMAIL (SMTP_ADDR があるとき) に送る
+var (
+	lowStockThreshold     = int64(getEnvInt("LOW_STOCK_THRESHOLD", 3))
+	lowStockKindThreshold = parseLowStockThresholds(getEnv("LOW_STOCK_THRESHOLDS", ""))
+	lowStockWebhookURL    = getEnv("LOW_STOCK_WEBHOOK_URL", "")
+	lowStockEmail         = getEnv("LOW_STOCK_EMAIL", "")
+)
+
+const (
+	lowStockDefaultPerPage = 25
+	lowStockMaxPerPage     = 100
+	// 通知は購入のレスポンスを待たせないように裏で送る
+	lowStockNotifyTimeout = 10 * time.Second
+)
+
+// LowStockEvent は在庫が閾値以下になったときに送る内容
+type LowStockEvent struct {
+	ChairID   int64  `json:"chairId"`
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	Stock     int64  `json:"stock"`
+	Threshold int64  `json:"threshold"`
+}
+
+type LowStockChair struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	Stock     int64  `json:"stock"`
+	Threshold int64  `json:"threshold"`
+}
+
+type LowStockResponse struct {
+	Count  int64           `json:"count"`
+	Chairs []LowStockChair `json:"chairs"`
+}
+
+// parseLowStockThresholds は "kind:n,kind:n" を読む。読めないものは起動時に落とす
+func parseLowStockThresholds(s string) map[string]int64 {
+	thresholds := map[string]int64{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i := strings.LastIndex(part, ":")
+		if i < 0 {
+			panic(fmt.Sprintf("invalid LOW_STOCK_THRESHOLDS entry: %q", part))
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(part[i+1:]), 10, 64)
+		if err != nil || n < 0 {
+			panic(fmt.Sprintf("invalid LOW_STOCK_THRESHOLDS entry: %q", part))
+		}
+		thresholds[strings.TrimSpace(part[:i])] = n
+	}
+	return thresholds
+}
+
+func lowStockThresholdFor(kind string) int64 {
+	if n, ok := lowStockKindThreshold[kind]; ok {
+		return n
+	}
+	return lowStockThreshold
+}
+
+// lowStockCondition は stock が kind ごとの閾値以下という条件
+func lowStockCondition() (string, []interface{}) {
+	if len(lowStockKindThreshold) == 0 {
+		return "stock <= ?", []interface{}{lowStockThreshold}
+	}
+	var b strings.Builder
+	params := make([]interface{}, 0, len(lowStockKindThreshold)*2+1)
+	b.WriteString("stock <= CASE kind")
+	for kind, n := range lowStockKindThreshold {
+		b.WriteString(" WHEN ? THEN ?")
+		params = append(params, kind, n)
+	}
+	b.WriteString(" ELSE ? END")
+	params = append(params, lowStockThreshold)
+	return b.String(), params
+}
+
+// notifyLowStock は購入で在庫が before から after に減ったときに呼ぶ。閾値をまたいだときだけ送る
+func notifyLowStock(logger echo.Logger, ch Chair, before int64, after int64) {
+	threshold := lowStockThresholdFor(ch.Kind)
+	if after <= 0 || before <= threshold || after > threshold {
+		return
+	}
+	if lowStockWebhookURL == "" && (lowStockEmail == "" || smtpAddr == "") {
+		return
+	}
+	ev := LowStockEvent{ChairID: ch.ID, Name: ch.Name, Kind: ch.Kind, Stock: after, Threshold: threshold}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), lowStockNotifyTimeout)
+		defer cancel()
+		if lowStockWebhookURL != "" {
+			if err := postWebhook(ctx, notificationHTTPClient, lowStockWebhookURL, ev); err != nil {
+				logger.Errorf("failed to post low stock webhook for chair %d : %v", ev.ChairID, err)
+			}
+		}
+		if lowStockEmail != "" && smtpAddr != "" {
+			if err := sendLowStockMail(lowStockEmail, ev); err != nil {
+				logger.Errorf("failed to send low stock mail for chair %d : %v", ev.ChairID, err)
+			}
+		}
+	}()
+}
+
+func sendLowStockMail(to string, ev LowStockEvent) error {
+	msg := "From: " + notificationFrom + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: ISUUMO low stock\r\n" +
+		"\r\n" +
+		fmt.Sprintf("chair %d (%s, %s) has %d left (threshold %d)\r\n", ev.ChairID, ev.Name, ev.Kind, ev.Stock, ev.Threshold)
+	return smtp.SendMail(smtpAddr, nil, notificationFrom, []string{to}, []byte(msg))
+}
+
+// getLowStockChairs は在庫が閾値以下の椅子を在庫の少ない順に返す。kind で絞れる
+func getLowStockChairs(c echo.Context) error {
+	ctx := c.Request().Context()
+	f := newSQLFilter()
+	cond, params := lowStockCondition()
+	f.Raw(cond, params...)
+	if v := c.QueryParam("kind"); v != "" {
+		f.Eq(colChairKind, v)
+	}
+
+	page := 0
+	if v := c.QueryParam("page"); v != "" {
+		var err error
+		page, err = strconv.Atoi(v)
+		if err != nil || page < 0 {
+			c.Logger().Infof("Invalid format page parameter : %v", v)
+			return c.NoContent(http.StatusBadRequest)
+		}
+	}
+	perPage := lowStockDefaultPerPage
+	if v := c.QueryParam("perPage"); v != "" {
+		var err error
+		perPage, err = strconv.Atoi(v)
+		if err != nil || perPage <= 0 || perPage > lowStockMaxPerPage {
+			c.Logger().Infof("Invalid format perPage parameter : %v", v)
+			return c.NoContent(http.StatusBadRequest)
+		}
+	}
+
+	where, whereParams := f.Where()
+	count, err := countRows(ctx, "chair", where, whereParams)
+	if err != nil {
+		c.Logger().Errorf("getLowStockChairs DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	chairs := make([]Chair, 0, perPage)
+	err = selectRows(ctx, &chairs, "chair", where, whereParams, "stock ASC, id ASC", nil, int64(perPage), int64(page*perPage))
+	if err != nil {
+		c.Logger().Errorf("getLowStockChairs DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	res := LowStockResponse{Count: count, Chairs: make([]LowStockChair, 0, len(chairs))}
+	for _, ch := range chairs {
+		res.Chairs = append(res.Chairs, LowStockChair{ID: ch.ID, Name: ch.Name, Kind: ch.Kind, Stock: ch.Stock, Threshold: lowStockThresholdFor(ch.Kind)})
+	}
+	return c.JSON(http.StatusOK, res)
+}
@@ -2,57 +2,155 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
-	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/astj/isucon10-yosen/webapp/go/geo"
 	"github.com/go-redis/redis/v8"
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
-	"github.com/labstack/gommon/log"
-
-	_ "github.com/go-sql-driver/mysql"
 )
 
 const Limit = 20
 const NazotteLimit = 50
+const NazotteMaxPolygons = 10
 
-var db *sqlx.DB
+var db *countingDB
 var mySQLConnectionData *MySQLConnectionEnv
 var chairSearchCondition ChairSearchCondition
 var estateSearchCondition EstateSearchCondition
 
-var rdb *redis.Client
+var rdb redis.UniversalClient
+
+// initialize で流し込む SQL ファイル (../mysql/db 以下)
+var initializeSQLFiles = []string{
+	"0_Schema.sql",
+	"1_DummyEstateData.sql",
+	"2_DummyChairData.sql",
+}
+
+// INITIALIZE_RELOAD_MODE=data のときに TRUNCATE して入れ直すテーブル。
+// station は入稿し直さない限り変わらないので残す (dump_hash は reload 判定に使うので消さない)
+var initializeMutableTables = []string{
+	"estate",
+	"chair",
+	"name_ngram",
+	"saved_search",
+	"import_schedule",
+	"import_run",
+	"chair_archive",
+	"audit_log",
+	"estate_image",
+	"chair_asset",
+	"item_view",
+	"chair_purchase",
+}
 
 type InitializeResponse struct {
 	Language string `json:"language"`
 }
 
 type Chair struct {
-	ID          int64  `db:"id" json:"id"`
-	Name        string `db:"name" json:"name"`
-	Description string `db:"description" json:"description"`
-	Thumbnail   string `db:"thumbnail" json:"thumbnail"`
-	Price       int64  `db:"price" json:"price"`
-	Height      int64  `db:"height" json:"height"`
-	Width       int64  `db:"width" json:"width"`
-	Depth       int64  `db:"depth" json:"depth"`
-	Color       string `db:"color" json:"color"`
-	Features    string `db:"features" json:"features"`
-	Kind        string `db:"kind" json:"kind"`
-	Popularity  int64  `db:"popularity" json:"-"`
-	Stock       int64  `db:"stock" json:"-"`
+	ID          int64        `db:"id" json:"id"`
+	Name        string       `db:"name" json:"name"`
+	Description string       `db:"description" json:"description"`
+	Thumbnail   ThumbnailURL `db:"thumbnail" json:"thumbnail"`
+	Price       int64        `db:"price" json:"price"`
+	Height      int64        `db:"height" json:"height"`
+	Width       int64        `db:"width" json:"width"`
+	Depth       int64        `db:"depth" json:"depth"`
+	Color       string       `db:"color" json:"color"`
+	Features    string       `db:"features" json:"features"`
+	Kind        string       `db:"kind" json:"kind"`
+	Popularity  int64        `db:"popularity" json:"-"`
+	// NegPopularity は -popularity の generated column
+	NegPopularity int64 `db:"neg_popularity" json:"-"`
+	Stock         int64 `db:"stock" json:"-"`
+	// Score は popularity を時間で減衰させたもの (popularity_score.go)、NegScore は -score の generated column
+	Score    float64 `db:"score" json:"-"`
+	NegScore float64 `db:"neg_score" json:"-"`
+	// ThumbnailHash は thumbnail 画像の perceptual hash
+	ThumbnailHash sql.NullString `db:"thumbnail_hash" json:"-"`
+	// Material は素材、Weight は重さ (g)。入稿されていなければ空と NULL
+	Material string `db:"material" json:"material,omitempty"`
+	Weight   *int64 `db:"weight" json:"weight,omitempty"`
+
+	// SalePrice はセール価格。SaleUntil が NULL なら期限なし
+	SalePrice *int64     `db:"sale_price" json:"salePrice,omitempty"`
+	SaleUntil *time.Time `db:"sale_until" json:"saleUntil,omitempty"`
+	// EffectivePrice はセールを考慮した実際の価格 (effective_price の generated column)
+	EffectivePrice int64 `db:"effective_price" json:"effectivePrice"`
+	// MatchedFeatures は features で検索したときに条件にマッチした特徴
+	MatchedFeatures []string `db:"-" json:"matchedFeatures,omitempty"`
+	// Assets は 3D モデルや寸法図などの素材の URL (種類 -> URL)。詳細だけで返す
+	Assets map[string]string `db:"-" json:"assets,omitempty"`
+
+	CreatedAt *time.Time `db:"created_at" json:"createdAt,omitempty"`
+	UpdatedAt *time.Time `db:"updated_at" json:"updatedAt,omitempty"`
+}
+
+// isValidChairMaterial は chair_condition.json の material にある素材か
+func isValidChairMaterial(material string) bool {
+	for _, m := range chairSearchCondition.Material.List {
+		if m == material {
+			return true
+		}
+	}
+	return false
+}
+
+// chairEffectivePrice はセールを考慮した価格の列。COALESCE(sale_price, price) の generated column で index がある。
+// 期限が来たセールは runSaleExpirer が消す (sale_until は UTC で持っている)
+const chairEffectivePrice = "effective_price"
+
+// setEffectivePrice はセールの期限も見て Go 側で計算し直す。
+// 期限が来てから runSaleExpirer が消すまでの間も、返す値段は期限どおりにする
+func (ch *Chair) setEffectivePrice(now time.Time) {
+	ch.EffectivePrice = ch.Price
+	if ch.SalePrice != nil && (ch.SaleUntil == nil || ch.SaleUntil.After(now)) {
+		ch.EffectivePrice = *ch.SalePrice
+	}
+}
+
+func setChairEffectivePrices(chairs []Chair) {
+	now := time.Now()
+	for i := range chairs {
+		chairs[i].setEffectivePrice(now)
+	}
+}
+
+// hideTimestamps は withTimestamps=1 が指定されていなければ createdAt/updatedAt を返さないようにする
+func (ch *Chair) hideTimestamps(c echo.Context) {
+	if c.QueryParam("withTimestamps") == "1" {
+		return
+	}
+	ch.CreatedAt = nil
+	ch.UpdatedAt = nil
+}
+
+func hideChairTimestamps(c echo.Context, chairs []Chair) {
+	for i := range chairs {
+		chairs[i].hideTimestamps(c)
+	}
 }
 
 type ChairSearchResponse struct {
@@ -66,18 +164,100 @@ type ChairListResponse struct {
 
 //Estate 物件
 type Estate struct {
-	ID          int64   `db:"id" json:"id"`
-	Thumbnail   string  `db:"thumbnail" json:"thumbnail"`
-	Name        string  `db:"name" json:"name"`
-	Description string  `db:"description" json:"description"`
-	Latitude    float64 `db:"latitude" json:"latitude"`
-	Longitude   float64 `db:"longitude" json:"longitude"`
-	Address     string  `db:"address" json:"address"`
-	Rent        int64   `db:"rent" json:"rent"`
-	DoorHeight  int64   `db:"door_height" json:"doorHeight"`
-	DoorWidth   int64   `db:"door_width" json:"doorWidth"`
-	Features    string  `db:"features" json:"features"`
-	Popularity  int64   `db:"popularity" json:"-"`
+	ID          int64        `db:"id" json:"id"`
+	Thumbnail   ThumbnailURL `db:"thumbnail" json:"thumbnail"`
+	Name        string       `db:"name" json:"name"`
+	Description string       `db:"description" json:"description"`
+	Latitude    float64      `db:"latitude" json:"latitude"`
+	Longitude   float64      `db:"longitude" json:"longitude"`
+	Address     string       `db:"address" json:"address"`
+	Rent        int64        `db:"rent" json:"rent"`
+	DoorHeight  int64        `db:"door_height" json:"doorHeight"`
+	DoorWidth   int64        `db:"door_width" json:"doorWidth"`
+	Features    string       `db:"features" json:"features"`
+	Popularity  int64        `db:"popularity" json:"-"`
+	// NegPopularity は -popularity の generated column
+	NegPopularity int64  `db:"neg_popularity" json:"-"`
+	Status        string `db:"status" json:"-"`
+	// Score は popularity を時間で減衰させたもの (popularity_score.go)、NegScore は -score の generated column
+	Score    float64 `db:"score" json:"-"`
+	NegScore float64 `db:"neg_score" json:"-"`
+	// ThumbnailHash は thumbnail 画像の perceptual hash
+	ThumbnailHash sql.NullString `db:"thumbnail_hash" json:"-"`
+	// CellID は緯度経度から求めた geo.CellID
+	CellID uint64 `db:"cell_id" json:"-"`
+	// 最寄り駅と徒歩何分か。駅が入稿されていなければ NULL
+	NearestStation     *string `db:"nearest_station" json:"nearestStation,omitempty"`
+	StationWalkMinutes *int64  `db:"station_walk_minutes" json:"stationWalkMinutes,omitempty"`
+	// Layout は間取り (1K / 1LDK ...)。入稿されていなければ空
+	Layout string `db:"layout" json:"layout,omitempty"`
+	// 管理費と敷金。EffectiveRent は家賃 + 管理費の generated column
+	ManagementFee int64 `db:"management_fee" json:"managementFee,omitempty"`
+	Deposit       int64 `db:"deposit" json:"deposit,omitempty"`
+	EffectiveRent int64 `db:"effective_rent" json:"-"`
+	// CommuteMinutes は通勤時間で検索したときの目的地までの時間
+	CommuteMinutes *int64 `db:"-" json:"commuteMinutes,omitempty"`
+	// MatchedFeatures は features で検索したときに条件にマッチした特徴
+	MatchedFeatures []string `db:"-" json:"matchedFeatures,omitempty"`
+	// Images は estate_image の URL。詳細のときだけ入れる
+	Images []string `db:"-" json:"images,omitempty"`
+
+	CreatedAt *time.Time `db:"created_at" json:"createdAt,omitempty"`
+	UpdatedAt *time.Time `db:"updated_at" json:"updatedAt,omitempty"`
+}
+
+// estate.status の値。available 以外の物件は通常の API からは見えない
+const (
+	EstateStatusAvailable     = "available"
+	EstateStatusUnderContract = "under_contract"
+	EstateStatusUnlisted      = "unlisted"
+)
+
+func isValidEstateStatus(status string) bool {
+	switch status {
+	case EstateStatusAvailable, EstateStatusUnderContract, EstateStatusUnlisted:
+		return true
+	}
+	return false
+}
+
+// isValidEstateLayout は estate_condition.json の layout にある間取りか
+func isValidEstateLayout(layout string) bool {
+	for _, l := range estateSearchCondition.Layout.List {
+		if l == layout {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Estate) hideTimestamps(c echo.Context) {
+	if c.QueryParam("withTimestamps") == "1" {
+		return
+	}
+	e.CreatedAt = nil
+	e.UpdatedAt = nil
+}
+
+func hideEstateTimestamps(c echo.Context, estates []Estate) {
+	for i := range estates {
+		estates[i].hideTimestamps(c)
+	}
+}
+
+// SearchCountResponse は countOnly=1 のときのレスポンス。件数の表示だけに使うので items は常に空
+type SearchCountResponse struct {
+	Count int64         `json:"count"`
+	Items []interface{} `json:"items"`
+}
+
+func newSearchCountResponse(count int64) SearchCountResponse {
+	return SearchCountResponse{Count: count, Items: []interface{}{}}
+}
+
+// isCountOnly は検索で件数だけを返すかどうか。page と perPage は無くてよい
+func isCountOnly(c echo.Context) bool {
+	return c.QueryParam("countOnly") == "1"
 }
 
 //EstateSearchResponse estate/searchへのレスポンスの形式
@@ -90,6 +270,180 @@ type EstateListResponse struct {
 	Estates []Estate `json:"estates"`
 }
 
+// EstateDuplicate は入稿された物件 ID と、重複していそうな既存の物件 ID の組
+type EstateDuplicate struct {
+	ID         int64 `json:"id"`
+	ExistingID int64 `json:"existingId"`
+}
+
+type PostEstateResponse struct {
+	Duplicates []EstateDuplicate  `json:"duplicates"`
+	Files      []FileImportResult `json:"files,omitempty"`
+}
+
+type PostChairResponse struct {
+	Files []FileImportResult `json:"files"`
+}
+
+// FileImportResult は複数ファイルを入稿したときのファイルごとの結果
+type FileImportResult struct {
+	File       string            `json:"file"`
+	Rows       int               `json:"rows"`
+	Status     int               `json:"status"`
+	Errors     []RowError        `json:"errors,omitempty"`
+	Duplicates []EstateDuplicate `json:"duplicates,omitempty"`
+}
+
+// RowError は入稿された CSV の何行目 (1 始まり) がなぜダメだったか
+type RowError struct {
+	File    string `json:"file,omitempty"`
+	Row     int    `json:"row"`
+	Message string `json:"message"`
+}
+
+type PostEstateErrorResponse struct {
+	Errors []RowError `json:"errors"`
+}
+
+// EstateSearchQuery estate/searchの検索条件
+type EstateSearchQuery struct {
+	DoorHeightRangeID string
+	DoorWidthRangeID  string
+	RentRangeID       string
+	Features          string
+	NewerThan         string
+	// Keyword は名前のあいまい検索。指定されたときは cache を使わない
+	Keyword string
+	// Status は社内ツール用 (/api/admin/estate/search のみ)。指定がなければ available だけを返す
+	Status         string
+	StationName    string
+	MaxWalkMinutes string
+	// Layout はカンマ区切りの間取り。どれかに当てはまれば返す
+	Layout string
+	// EffectiveRent が "1" なら rentRangeId (と rentMin / rentMax) を家賃 + 管理費で絞る
+	EffectiveRent string
+	// *Min / *Max は rangeId の区切りを使わずに数値で直接絞るとき
+	RentMin       string
+	RentMax       string
+	DoorWidthMin  string
+	DoorWidthMax  string
+	DoorHeightMin string
+	DoorHeightMax string
+	// MinPopularity は社内ツール用 (/api/admin/*/search のみ)。popularity がこれ以上のものだけ返す
+	MinPopularity string
+	// ExcludeFeatures はカンマ区切りの、持っていてはいけない特徴
+	ExcludeFeatures string
+	// FeaturesMatch は features を全部 (all) 持つか、どれか (any) を持つか
+	FeaturesMatch string
+}
+
+func newEstateSearchQuery(c echo.Context) EstateSearchQuery {
+	return estateSearchQueryFromValues(c.QueryParams())
+}
+
+// newAdminEstateSearchQuery は社内ツール用で、公開の検索では受け付けない status も読む
+func newAdminEstateSearchQuery(c echo.Context) EstateSearchQuery {
+	q := newEstateSearchQuery(c)
+	q.Status = c.QueryParam("status")
+	q.MinPopularity = c.QueryParam("minPopularity")
+	return q
+}
+
+// estateSearchQueryFromValues は保存された検索条件からも作れるように url.Values から組み立てる。
+// 公開の検索と保存検索で使うので、status と minPopularity は読まない
+func estateSearchQueryFromValues(v url.Values) EstateSearchQuery {
+	return EstateSearchQuery{
+		DoorHeightRangeID: v.Get("doorHeightRangeId"),
+		DoorWidthRangeID:  v.Get("doorWidthRangeId"),
+		RentRangeID:       v.Get("rentRangeId"),
+		Features:          v.Get("features"),
+		NewerThan:         v.Get("newerThan"),
+		Keyword:           v.Get("keyword"),
+		StationName:       v.Get("stationName"),
+		MaxWalkMinutes:    v.Get("maxWalkMinutes"),
+		Layout:            v.Get("layout"),
+		EffectiveRent:     v.Get("effectiveRent"),
+		RentMin:           v.Get("rentMin"),
+		RentMax:           v.Get("rentMax"),
+		DoorWidthMin:      v.Get("doorWidthMin"),
+		DoorWidthMax:      v.Get("doorWidthMax"),
+		DoorHeightMin:     v.Get("doorHeightMin"),
+		DoorHeightMax:     v.Get("doorHeightMax"),
+		ExcludeFeatures:   v.Get("excludeFeatures"),
+		FeaturesMatch:     v.Get("featuresMatch"),
+	}
+}
+
+// ChairSearchQuery chair/searchの検索条件
+type ChairSearchQuery struct {
+	PriceRangeID  string
+	HeightRangeID string
+	WidthRangeID  string
+	DepthRangeID  string
+	Kind          string
+	Color         string
+	Features      string
+	NewerThan     string
+	// Keyword は名前のあいまい検索
+	Keyword       string
+	WeightRangeID string
+	Material      string
+	// *Min / *Max は rangeId の区切りを使わずに数値で直接絞るとき
+	PriceMin  string
+	PriceMax  string
+	HeightMin string
+	HeightMax string
+	WidthMin  string
+	WidthMax  string
+	DepthMin  string
+	DepthMax  string
+	// MinPopularity は社内ツール用 (/api/admin/*/search のみ)。popularity がこれ以上のものだけ返す
+	MinPopularity string
+	// ExcludeFeatures はカンマ区切りの、持っていてはいけない特徴
+	ExcludeFeatures string
+	// FeaturesMatch は features を全部 (all) 持つか、どれか (any) を持つか
+	FeaturesMatch string
+}
+
+func newChairSearchQuery(c echo.Context) ChairSearchQuery {
+	return chairSearchQueryFromValues(c.QueryParams())
+}
+
+// newAdminChairSearchQuery は社内ツール用で、公開の検索では受け付けない minPopularity も読む
+func newAdminChairSearchQuery(c echo.Context) ChairSearchQuery {
+	q := newChairSearchQuery(c)
+	q.MinPopularity = c.QueryParam("minPopularity")
+	return q
+}
+
+// chairSearchQueryFromValues は公開の検索と保存検索で使うので、minPopularity は読まない
+
+func chairSearchQueryFromValues(v url.Values) ChairSearchQuery {
+	return ChairSearchQuery{
+		PriceRangeID:    v.Get("priceRangeId"),
+		HeightRangeID:   v.Get("heightRangeId"),
+		WidthRangeID:    v.Get("widthRangeId"),
+		DepthRangeID:    v.Get("depthRangeId"),
+		Kind:            v.Get("kind"),
+		Color:           v.Get("color"),
+		Features:        v.Get("features"),
+		NewerThan:       v.Get("newerThan"),
+		Keyword:         v.Get("keyword"),
+		WeightRangeID:   v.Get("weightRangeId"),
+		Material:        v.Get("material"),
+		PriceMin:        v.Get("priceMin"),
+		PriceMax:        v.Get("priceMax"),
+		HeightMin:       v.Get("heightMin"),
+		HeightMax:       v.Get("heightMax"),
+		WidthMin:        v.Get("widthMin"),
+		WidthMax:        v.Get("widthMax"),
+		DepthMin:        v.Get("depthMin"),
+		DepthMax:        v.Get("depthMax"),
+		ExcludeFeatures: v.Get("excludeFeatures"),
+		FeaturesMatch:   v.Get("featuresMatch"),
+	}
+}
+
 type Coordinate struct {
 	Latitude  float64 `json:"latitude"`
 	Longitude float64 `json:"longitude"`
@@ -97,6 +451,19 @@ type Coordinate struct {
 
 type Coordinates struct {
 	Coordinates []Coordinate `json:"coordinates"`
+	// Polygons は複数の polygon でなぞったとき
+	Polygons []Coordinates `json:"polygons,omitempty"`
+}
+
+// validate は緯度が [-90, 90]、経度が [-180, 180] に収まっているかを確かめる
+func (c Coordinate) validate() error {
+	if c.Latitude < -90 || c.Latitude > 90 {
+		return fmt.Errorf("latitude out of range: %v", c.Latitude)
+	}
+	if c.Longitude < -180 || c.Longitude > 180 {
+		return fmt.Errorf("longitude out of range: %v", c.Longitude)
+	}
+	return nil
 }
 
 type Range struct {
@@ -113,6 +480,8 @@ type RangeCondition struct {
 
 type ListCondition struct {
 	List []string `json:"list"`
+	// Labels は ja 以外の locale での表示用の文字列
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 type EstateSearchCondition struct {
@@ -120,16 +489,19 @@ type EstateSearchCondition struct {
 	DoorHeight RangeCondition `json:"doorHeight"`
 	Rent       RangeCondition `json:"rent"`
 	Feature    ListCondition  `json:"feature"`
+	Layout     ListCondition  `json:"layout"`
 }
 
 type ChairSearchCondition struct {
-	Width   RangeCondition `json:"width"`
-	Height  RangeCondition `json:"height"`
-	Depth   RangeCondition `json:"depth"`
-	Price   RangeCondition `json:"price"`
-	Color   ListCondition  `json:"color"`
-	Feature ListCondition  `json:"feature"`
-	Kind    ListCondition  `json:"kind"`
+	Width    RangeCondition `json:"width"`
+	Height   RangeCondition `json:"height"`
+	Depth    RangeCondition `json:"depth"`
+	Price    RangeCondition `json:"price"`
+	Color    ListCondition  `json:"color"`
+	Feature  ListCondition  `json:"feature"`
+	Kind     ListCondition  `json:"kind"`
+	Weight   RangeCondition `json:"weight"`
+	Material ListCondition  `json:"material"`
 }
 
 type BoundingBox struct {
@@ -145,6 +517,13 @@ type MySQLConnectionEnv struct {
 	User     string
 	DBName   string
 	Password string
+
+	// InterpolateParams はクライアント側でプレースホルダを埋めて prepare の往復を省く
+	InterpolateParams bool
+	ParseTime         bool
+	Collation         string
+	// TCPKeepAlive が 0 より大きければ keepalive を有効にした dialer で繋ぐ
+	TCPKeepAlive time.Duration
 }
 
 type RecordMapper struct {
@@ -201,6 +580,42 @@ func (r *RecordMapper) NextString() string {
 	return s
 }
 
+// NextNullableFloat は空でもいい列用。空なら false を返す
+func (r *RecordMapper) NextNullableFloat() (float64, bool) {
+	s, err := r.next()
+	if err != nil || strings.TrimSpace(s) == "" {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		r.err = err
+		return 0, false
+	}
+	return f, true
+}
+
+// NextOptionalString は後から足した列用。古い形式で列が無ければ空文字を返す
+func (r *RecordMapper) NextOptionalString() string {
+	if r.err == nil && r.offset >= len(r.Record) {
+		return ""
+	}
+	return r.NextString()
+}
+
+// NextOptionalInt は後から足した空でもいい列用。列が無いか空なら false を返す
+func (r *RecordMapper) NextOptionalInt() (int, bool) {
+	s := strings.TrimSpace(r.NextOptionalString())
+	if r.err != nil || s == "" {
+		return 0, false
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		r.err = err
+		return 0, false
+	}
+	return i, true
+}
+
 func (r *RecordMapper) Err() error {
 	return r.err
 }
@@ -212,6 +627,11 @@ func NewMySQLConnectionEnv() *MySQLConnectionEnv {
 		User:     getEnv("MYSQL_USER", "isucon"),
 		DBName:   getEnv("MYSQL_DBNAME", "isuumo"),
 		Password: getEnv("MYSQL_PASS", "isucon"),
+
+		InterpolateParams: getEnvBool("MYSQL_INTERPOLATE_PARAMS", true),
+		ParseTime:         getEnvBool("MYSQL_PARSE_TIME", true),
+		Collation:         getEnv("MYSQL_COLLATION", ""),
+		TCPKeepAlive:      getEnvDuration("MYSQL_TCP_KEEPALIVE", 0),
 	}
 }
 
@@ -223,10 +643,95 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvBool(key string, defaultValue bool) bool {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		fmt.Printf("invalid bool %v=%v : %v\n", key, val, err)
+		return defaultValue
+	}
+	return b
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		fmt.Printf("invalid int %v=%v : %v\n", key, val, err)
+		return defaultValue
+	}
+	return i
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		fmt.Printf("invalid float %v=%v : %v\n", key, val, err)
+		return defaultValue
+	}
+	return f
+}
+
+// getEnvDuration は "500ms" や "10s" のような time.Duration の形式で環境変数を読む
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		fmt.Printf("invalid duration %v=%v : %v\n", key, val, err)
+		return defaultValue
+	}
+	return d
+}
+
+// keepalive を有効にした dialer を登録するときのネットワーク名
+const mysqlKeepAliveNetwork = "tcp-keepalive"
+
+// DSN は go-sql-driver/mysql に渡す DSN を組み立てる
+func (mc *MySQLConnectionEnv) DSN() string {
+	params := url.Values{}
+	if mc.InterpolateParams {
+		params.Set("interpolateParams", "true")
+	}
+	if mc.ParseTime {
+		params.Set("parseTime", "true")
+	}
+	if mc.Collation != "" {
+		params.Set("collation", mc.Collation)
+	}
+	network := "tcp"
+	if mc.TCPKeepAlive > 0 {
+		network = mysqlKeepAliveNetwork
+	}
+	dsn := fmt.Sprintf("%v:%v@%v(%v:%v)/%v", mc.User, mc.Password, network, mc.Host, mc.Port, mc.DBName)
+	if len(params) > 0 {
+		dsn += "?" + params.Encode()
+	}
+	return dsn
+}
+
 //ConnectDB isuumoデータベースに接続する
 func (mc *MySQLConnectionEnv) ConnectDB() (*sqlx.DB, error) {
-	dsn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v", mc.User, mc.Password, mc.Host, mc.Port, mc.DBName)
-	return sqlx.Open("mysql", dsn)
+	if mc.TCPKeepAlive > 0 {
+		keepAlive := mc.TCPKeepAlive
+		mysql.RegisterDialContext(mysqlKeepAliveNetwork, func(ctx context.Context, addr string) (net.Conn, error) {
+			d := net.Dialer{KeepAlive: keepAlive}
+			return d.DialContext(ctx, "tcp", addr)
+		})
+	}
+	return sqlx.Open("mysql", mc.DSN())
 }
 
 func init() {
@@ -243,53 +748,190 @@ func init() {
 		os.Exit(1)
 	}
 	json.Unmarshal(jsonText, &estateSearchCondition)
+
+	// 言い換えは無くても動く
+	jsonText, err = ioutil.ReadFile("../fixture/feature_synonyms.json")
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if err == nil {
+		json.Unmarshal(jsonText, &featureSynonyms)
+	}
+
+	if err := loadConditionLabels("../fixture/condition_labels"); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
 }
 
 func main() {
+	rand.Seed(time.Now().UnixNano())
+
+	gcConfig, err := loadGCConfig()
+	if err == nil {
+		err = applyGCConfig(gcConfig)
+	}
+	if err != nil {
+		fmt.Printf("GC setup failed : %v\n", err)
+		os.Exit(1)
+	}
+
 	// redis
-	rdb = redis.NewClient(&redis.Options{
-		Addr: getEnv("REDIS_DSN", "localhost:6379"),
-	})
+	rdb, err = newRedisClient()
+	if err != nil {
+		fmt.Printf("redis setup failed : %v\n", err)
+		os.Exit(1)
+	}
+	go subscribeReinitialized(context.Background())
 
 	// Echo instance
 	e := echo.New()
 	e.Debug = true
-	e.Logger.SetLevel(log.DEBUG)
+	e.Logger.SetLevel(currentConfig().logLevel())
+
+	trustedProxies, err = parseTrustedProxies(getEnv("TRUSTED_PROXIES", "127.0.0.1/32,::1/128"))
+	if err != nil {
+		e.Logger.Fatalf("TRUSTED_PROXIES parse failed : %v", err)
+	}
 
 	// Middleware
+	e.Pre(realIP())
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
+	e.Use(readinessGate())
+	e.Use(dbQueryHeaders())
+	if requestRecordTarget != "" {
+		recorder, err := newRequestRecorder(requestRecordTarget)
+		if err != nil {
+			e.Logger.Fatalf("REQUEST_RECORD setup failed : %v", err)
+		}
+		e.Use(recordRequests(recorder))
+	}
 
 	// Initialize
-	e.POST("/initialize", initialize)
+	e.POST("/initialize", initialize, audit("initialize"))
+
+	e.GET("/healthz", getHealthz)
+
+	// CSV の入稿は大きめ、JSON を受けるところは小さめに body を制限する (超えたら 413)
+	csvBodyLimit := middleware.BodyLimit(getEnv("CSV_BODY_LIMIT", "20M"))
+	jsonBodyLimit := middleware.BodyLimit(getEnv("JSON_BODY_LIMIT", "1M"))
 
 	// Chair Handler
-	e.GET("/api/chair/:id", getChairDetail)
-	e.POST("/api/chair", postChair)
-	e.GET("/api/chair/search", searchChairs)
+	e.GET("/api/chair/:id", getChairDetail, responseCache(getEnvDuration("RESPONSE_CACHE_TTL_CHAIR_DETAIL", 60*time.Second), responseCacheGroupChair))
+	e.POST("/api/chair", postChair, csvBodyLimit, audit("import_chair"))
+	e.GET("/api/chair/search", searchChairs, responseCache(getEnvDuration("RESPONSE_CACHE_TTL_CHAIR_SEARCH", 30*time.Second), responseCacheGroupChair))
 	e.GET("/api/chair/low_priced", getLowPricedChair)
 	e.GET("/api/chair/search/condition", getChairSearchCondition)
-	e.POST("/api/chair/buy/:id", buyChair)
+	e.POST("/api/chair/buy/:id", buyChair, jsonBodyLimit, audit("buy_chair"))
+	e.POST("/api/chair/:id/view", postChairView)
 
 	// Estate Handler
-	e.GET("/api/estate/:id", getEstateDetail)
-	e.POST("/api/estate", postEstate)
+	e.GET("/api/estate/:id", getEstateDetail, responseCache(getEnvDuration("RESPONSE_CACHE_TTL_ESTATE_DETAIL", 60*time.Second), responseCacheGroupEstate))
+	e.POST("/api/estate", postEstate, csvBodyLimit, audit("import_estate"))
 	e.GET("/api/estate/search", searchEstates)
 	e.GET("/api/estate/low_priced", getLowPricedEstate)
-	e.POST("/api/estate/req_doc/:id", postEstateRequestDocument)
-	e.POST("/api/estate/nazotte", searchEstateNazotte)
+	e.GET("/api/estate/random", getRandomEstates)
+	e.GET("/api/estate/:id/images", getEstateImagesHandler)
+	e.POST("/api/estate/:id/view", postEstateView)
+	e.POST("/api/estate/req_doc/:id", postEstateRequestDocument, jsonBodyLimit, audit("request_document"))
+	e.POST("/api/estate/nazotte", searchEstateNazotte, jsonBodyLimit)
 	e.GET("/api/estate/search/condition", getEstateSearchCondition)
-	e.GET("/api/recommended_estate/:id", searchRecommendedEstateWithChair)
+	e.GET("/api/estate/search/commute", searchEstateCommute)
+	e.GET("/api/fit", getFit)
+	e.POST("/api/recommended_estate/batch", postRecommendedEstateBatch, jsonBodyLimit)
+	e.GET("/api/recommended_chair/:estateId", searchRecommendedChairWithEstate, responseCache(getEnvDuration("RESPONSE_CACHE_TTL_RECOMMENDED_CHAIR", 30*time.Second), responseCacheGroupChair, responseCacheGroupEstate))
+	e.GET("/api/recommended_estate/:id", searchRecommendedEstateWithChair, responseCache(getEnvDuration("RESPONSE_CACHE_TTL_RECOMMENDED_ESTATE", 30*time.Second), responseCacheGroupChair, responseCacheGroupEstate))
+
+	// User Handler
+	e.POST("/api/user/saved_searches", postSavedSearch, jsonBodyLimit, audit("save_search"))
+	e.DELETE("/api/user/saved_searches/:id", deleteSavedSearch, audit("delete_saved_search"))
+
+	// Suggest Handler
+	e.GET("/api/suggest", getSuggest)
+
+	// Metrics
+	e.GET("/metrics", getMetrics)
+
+	// 運用向けの API はベンチマークから叩かれないように Basic 認証をかける
+	internal := e.Group("/internal", adminAuth())
+	internal.GET("/cachestats", getCacheStats)
+	internal.GET("/config", getRuntimeConfig)
+	internal.PUT("/config", putRuntimeConfig, jsonBodyLimit, audit("runtime_config"))
+
+	// Admin Handler
+	admin := e.Group("/api/admin", adminAuth())
+	admin.POST("/cache/snapshot", postCacheSnapshot, audit("cache_snapshot"))
+	admin.PUT("/estate/:id/status", putEstateStatus, jsonBodyLimit, audit("estate_status"))
+	admin.GET("/estate/search", searchEstatesForAdmin)
+	admin.GET("/chair/search", searchChairsForAdmin)
+	admin.GET("/thumbnail_duplicates", getThumbnailDuplicates)
+	admin.GET("/chair/archive", getChairArchive)
+	admin.GET("/chair/low_stock", getLowStockChairs)
+	admin.PUT("/chair/:id/assets", putChairAssets, jsonBodyLimit, audit("chair_assets"))
+	admin.GET("/audit", getAudit)
+	admin.POST("/station", postStation, csvBodyLimit, audit("import_station"))
+	admin.POST("/import", postImport, jsonBodyLimit, audit("import_url"))
+	admin.GET("/import/:id", getImport)
+	admin.POST("/import_schedules", postImportSchedule, jsonBodyLimit, audit("import_schedule"))
+	admin.GET("/import_schedules", getImportSchedules)
+	admin.GET("/import_schedules/:id/runs", getImportScheduleRuns)
 
 	mySQLConnectionData = NewMySQLConnectionEnv()
 
-	var err error
-	db, err = mySQLConnectionData.ConnectDB()
+	conn, err := mySQLConnectionData.ConnectDB()
 	if err != nil {
 		e.Logger.Fatalf("DB connection failed : %v", err)
 	}
+	db = &countingDB{conn}
 	db.SetMaxOpenConns(10)
-	defer db.Close()
+
+	// 遅いクライアントに goroutine を握られ続けないようにする
+	e.Server.ReadTimeout = getEnvDuration("SERVER_READ_TIMEOUT", 30*time.Second)
+	e.Server.ReadHeaderTimeout = getEnvDuration("SERVER_READ_HEADER_TIMEOUT", 5*time.Second)
+	e.Server.WriteTimeout = getEnvDuration("SERVER_WRITE_TIMEOUT", 60*time.Second)
+	e.Server.IdleTimeout = getEnvDuration("SERVER_IDLE_TIMEOUT", 120*time.Second)
+
+	// MySQL と redis は待ちながら裏でつなぎ、つながってから裏の処理を始める
+	go func() {
+		if err := waitForBackends(context.Background(), e.Logger); err != nil {
+			e.Logger.Fatalf("DB connection failed : %v", err)
+		}
+
+		// redis が落ちていたら戻るのを待つ
+		go runCacheHealthProbe(context.Background(), e.Logger)
+
+		// 書き込みの記録
+		go runAuditWriter(context.Background(), e.Logger)
+
+		// 定期入稿
+		if getEnvBool("IMPORT_SCHEDULER", true) {
+			go runImportScheduler(context.Background(), e.Logger)
+		}
+
+		// 閲覧数
+		go runViewFlusher(context.Background(), e.Logger)
+
+		// 入稿の buffer
+		if importBufferEnabled {
+			go runImportBuffer(context.Background(), e.Logger)
+		}
+
+		// 人気の減衰
+		go runScoreRecomputer(context.Background(), e.Logger)
+
+		// 期限が来たセールを消す
+		go runSaleExpirer(context.Background(), e.Logger)
+
+		// 入稿した thumbnail の hash
+		go runThumbnailHasher(context.Background(), e.Logger)
+
+		// サジェストの候補を先に作っておく
+		go rebuildSuggestIndexes(e.Logger)
+
+		markReady()
+	}()
 
 	// Start server
 	serverPort := fmt.Sprintf(":%v", getEnv("SERVER_PORT", "1323"))
@@ -297,37 +939,166 @@ func main() {
 }
 
 func initialize(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	// 複数台のうちどれか 1 台だけが MySQL と redis を作り直す
+	locked, err := acquireInitializeLock(ctx)
+	if err != nil {
+		// redis が使えないなら協調できないので、そのまま自分で initialize する
+		c.Logger().Errorf("failed to acquire initialize lock : %v", err)
+		locked = true
+	}
+	if !locked {
+		if err := waitInitializeLock(ctx); err != nil {
+			c.Logger().Errorf("failed to wait initialize : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.JSON(http.StatusOK, InitializeResponse{
+			Language: "go",
+		})
+	}
+	defer releaseInitializeLock(context.Background())
+
 	// これから db の中身が変わるので redis の cache も吹き飛ばす
-	_ = purgeEstateIDsFromRedis()
+	_ = purgeAllCachesFromRedis()
+	purgeSurrogateKeys(c.Logger(), surrogateKeyChair, surrogateKeyChairSearch, surrogateKeyEstate, surrogateKeyEstateSearch)
 
 	sqlDir := filepath.Join("..", "mysql", "db")
-	paths := []string{
-		filepath.Join(sqlDir, "0_Schema.sql"),
-		filepath.Join(sqlDir, "1_DummyEstateData.sql"),
-		filepath.Join(sqlDir, "2_DummyChairData.sql"),
+	paths := make([]string, 0, len(initializeSQLFiles))
+	for _, f := range initializeSQLFiles {
+		paths = append(paths, filepath.Join(sqlDir, f))
+	}
+
+	dumpHash, err := hashSQLFiles(paths)
+	if err != nil {
+		c.Logger().Errorf("Initialize hash error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// dump が前回流し込んだものと同じなら reload を省略できる
+	mode := getEnv("INITIALIZE_RELOAD_MODE", "full")
+	if mode != "full" && loadedDumpHash(ctx) == dumpHash {
+		switch mode {
+		case "skip":
+			c.Logger().Infof("dump is unchanged, skip reloading : %v", dumpHash)
+			paths = nil
+		case "data":
+			// schema はそのままで、変更されうるテーブルだけ入れ直す
+			for _, t := range initializeMutableTables {
+				if _, err := db.ExecContext(ctx, "TRUNCATE TABLE "+t); err != nil {
+					c.Logger().Errorf("Initialize truncate error : %v", err)
+					return c.NoContent(http.StatusInternalServerError)
+				}
+			}
+			paths = paths[1:]
+		}
 	}
 
 	for _, p := range paths {
-		sqlFile, _ := filepath.Abs(p)
-		cmdStr := fmt.Sprintf("mysql -h %v -u %v -p%v -P %v %v < %v",
-			mySQLConnectionData.Host,
-			mySQLConnectionData.User,
-			mySQLConnectionData.Password,
-			mySQLConnectionData.Port,
-			mySQLConnectionData.DBName,
-			sqlFile,
-		)
-		if err := exec.Command("bash", "-c", cmdStr).Run(); err != nil {
+		if err := execSQLFile(p); err != nil {
 			c.Logger().Errorf("Initialize script error : %v", err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
 	}
 
+	if len(paths) > 0 {
+		// dump には cell_id が入っていないので埋める
+		if err := initializeCellIDs(ctx); err != nil {
+			c.Logger().Errorf("Initialize cell_id error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		// data mode では駅が残っているので最寄り駅も埋め直す
+		if err := initializeNearestStations(ctx); err != nil {
+			c.Logger().Errorf("Initialize nearest station error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+
+		_, err = db.ExecContext(ctx, "INSERT INTO dump_hash (id, hash) VALUES (1, ?) ON DUPLICATE KEY UPDATE hash = VALUES(hash)", dumpHash)
+		if err != nil {
+			// 次回の reload が省略されないだけなので失敗しても続ける
+			c.Logger().Errorf("failed to save dump hash : %v", err)
+		}
+
+		// あいまい検索用の n-gram は時間がかかるので裏で作る
+		logger := c.Logger()
+		go func() {
+			if err := rebuildNgrams(context.Background()); err != nil {
+				logger.Errorf("failed to rebuild ngrams : %v", err)
+			}
+		}()
+		// dump の score は入っていないので計算する
+		go func() {
+			if err := recomputeScores(context.Background(), logger); err != nil {
+				logger.Errorf("failed to recompute scores : %v", err)
+			}
+		}()
+	}
+
+	// 事前に保存しておいた cache を戻して、最初から cache が効くようにする
+	if getEnv("INITIALIZE_RESTORE_CACHE", "") == "1" {
+		n, err := restoreCacheSnapshot(ctx)
+		if err != nil {
+			// cache が無いだけなので失敗しても続ける
+			c.Logger().Errorf("failed to restore cache snapshot : %v", err)
+		} else {
+			c.Logger().Infof("restored %d keys from cache snapshot", n)
+		}
+	}
+
+	// low_priced の set は flush で消えているので作り直す
+	if err := rebuildLowPricedSets(ctx); err != nil {
+		c.Logger().Errorf("failed to rebuild low priced sets : %v", err)
+	}
+
+	if err := notifyReinitialized(ctx); err != nil {
+		c.Logger().Errorf("failed to notify reinitialized : %v", err)
+	}
+
 	return c.JSON(http.StatusOK, InitializeResponse{
 		Language: "go",
 	})
 }
 
+func execSQLFile(p string) error {
+	sqlFile, _ := filepath.Abs(p)
+	cmdStr := fmt.Sprintf("mysql -h %v -u %v -p%v -P %v %v < %v",
+		mySQLConnectionData.Host,
+		mySQLConnectionData.User,
+		mySQLConnectionData.Password,
+		mySQLConnectionData.Port,
+		mySQLConnectionData.DBName,
+		sqlFile,
+	)
+	return exec.Command("bash", "-c", cmdStr).Run()
+}
+
+// hashSQLFiles は initialize で流し込む SQL ファイル群の sha256 を返す
+func hashSQLFiles(paths []string) (string, error) {
+	h := sha256.New()
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// loadedDumpHash は前回 initialize で流し込んだ dump の hash を返す。
+// まだ一度も流し込んでいない場合などは空文字列
+func loadedDumpHash(ctx context.Context) string {
+	var hash string
+	if err := db.GetContext(ctx, &hash, "SELECT hash FROM dump_hash WHERE id = 1"); err != nil {
+		return ""
+	}
+	return hash
+}
+
 func getChairDetail(c echo.Context) error {
 	ctx := c.Request().Context()
 	id, err := strconv.Atoi(c.Param("id"))
@@ -336,9 +1107,7 @@ func getChairDetail(c echo.Context) error {
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	chair := Chair{}
-	query := `SELECT * FROM chair WHERE id = ?`
-	err = db.GetContext(ctx, &chair, query, id)
+	chair, err := getChairByID(ctx, int64(id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.Echo().Logger.Infof("requested id's chair not found : %v", id)
@@ -351,162 +1120,350 @@ func getChairDetail(c echo.Context) error {
 		return c.NoContent(http.StatusNotFound)
 	}
 
+	chair.Assets, err = getChairAssets(ctx, chair.ID)
+	if err != nil {
+		c.Echo().Logger.Errorf("Failed to get the chair assets : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	chair.setEffectivePrice(time.Now())
+	chair.hideTimestamps(c)
+	setSurrogateKeys(c, surrogateKeyChair, surrogateKeyForChair(chair.ID))
 	return c.JSON(http.StatusOK, chair)
 }
 
 func postChair(c echo.Context) error {
-	header, err := c.FormFile("chairs")
-	if err != nil {
-		c.Logger().Errorf("failed to get form file: %v", err)
+	files, status := readUploadedCSVs(c, "chairs")
+	if status != 0 {
+		return c.NoContent(status)
+	}
+	perFile, ok := parseTransactionMode(c)
+	if !ok {
 		return c.NoContent(http.StatusBadRequest)
 	}
-	f, err := header.Open()
-	if err != nil {
-		c.Logger().Errorf("failed to open form file: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+	if !perFile {
+		if buffered, err := tryBufferChairs(c, files); buffered {
+			return err
+		}
 	}
-	defer f.Close()
-	records, err := csv.NewReader(f).ReadAll()
-	if err != nil {
-		c.Logger().Errorf("failed to read csv: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+
+	ctx := c.Request().Context()
+	ngramRows := make([]ngramRow, 0)
+	results := make([]FileImportResult, 0, len(files))
+	if perFile {
+		for _, f := range files {
+			rows, status := importChairs(ctx, c.Logger(), []uploadedCSV{f})
+			results = append(results, newFileImportResult(f, status))
+			ngramRows = append(ngramRows, rows...)
+		}
+	} else {
+		rows, status := importChairs(ctx, c.Logger(), files)
+		if status != 0 {
+			return c.NoContent(status)
+		}
+		for _, f := range files {
+			results = append(results, newFileImportResult(f, 0))
+		}
+		ngramRows = rows
+	}
+
+	afterChairImport(c.Logger(), ngramRows)
+	// 1 ファイルだけのときは今まで通り body を返さない
+	if len(files) == 1 && !perFile {
+		return c.NoContent(http.StatusCreated)
 	}
+	return c.JSON(importResponseStatus(results), PostChairResponse{Files: results})
+}
+
+// afterChairImport は椅子を入れたあとのサジェストの更新や保存検索の通知をする。
+// commit 済みなので、クライアントが切断していても最後までやる
+func afterChairImport(logger echo.Logger, ngramRows []ngramRow) {
+	if len(ngramRows) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cacheBackgroundTimeout)
+	defer cancel()
+	chairDetailCache.Purge()
+	names := make([]string, 0, len(ngramRows))
+	ids := make([]int64, 0, len(ngramRows))
+	for _, r := range ngramRows {
+		names = append(names, r.Name)
+		ids = append(ids, r.ID)
+	}
+	if err := addChairNameSuggestions(ctx, names); err != nil {
+		logger.Errorf("failed to add suggestions: %v", err)
+	}
+	if err := purgeChairIDsFromRedis(ctx); err != nil {
+		logger.Errorf("failed to purge chair ids: %v", err)
+	}
+	if err := addLowPricedChairs(ctx, ids); err != nil {
+		logger.Errorf("failed to add low priced chairs: %v", err)
+	}
+	refreshLowPricedChairCache(ctx)
+	purgeResponseCache(ctx, responseCacheGroupChair)
+	purgeSurrogateKeys(logger, surrogateKeyChairSearch)
+	enqueueThumbnailHashes(logger, "chair", ids)
+	go matchSavedSearches(logger, "chair", ids)
+}
 
-	tx, err := db.Begin()
+// importChairs は files の行を読んで 1 つの transaction で入れる。
+// 失敗したときは返すべき HTTP ステータスを返す (成功なら 0)
+func importChairs(ctx context.Context, logger echo.Logger, files []uploadedCSV) ([]ngramRow, int) {
+	records, err := parseChairRecords(files)
 	if err != nil {
-		c.Logger().Errorf("failed to begin tx: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		logger.Errorf("%v", err)
+		return nil, http.StatusBadRequest
 	}
-	defer tx.Rollback()
-	for _, row := range records {
-		rm := RecordMapper{Record: row}
-		id := rm.NextInt()
-		name := rm.NextString()
-		description := rm.NextString()
-		thumbnail := rm.NextString()
-		price := rm.NextInt()
-		height := rm.NextInt()
-		width := rm.NextInt()
-		depth := rm.NextInt()
-		color := rm.NextString()
-		features := rm.NextString()
-		kind := rm.NextString()
-		popularity := rm.NextInt()
-		stock := rm.NextInt()
-		if err := rm.Err(); err != nil {
-			c.Logger().Errorf("failed to read record: %v", err)
-			return c.NoContent(http.StatusBadRequest)
+	return insertChairs(ctx, logger, records)
+}
+
+// insertChairs は parseChairRecords で読んだ行を 1 つの transaction で入れる
+func insertChairs(ctx context.Context, logger echo.Logger, records []chairRecord) ([]ngramRow, int) {
+	var ngramRows []ngramRow
+	err := withTx(ctx, func(tx *sqlx.Tx) error {
+		ngramRows = make([]ngramRow, 0, len(records))
+		if err := insertChairRecords(ctx, tx, records, &ngramRows); err != nil {
+			return err
 		}
-		_, err := tx.Exec("INSERT INTO chair(id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?)", id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock)
-		if err != nil {
-			c.Logger().Errorf("failed to insert chair: %v", err)
-			return c.NoContent(http.StatusInternalServerError)
+		if err := insertNgrams(ctx, tx, "chair", ngramRows); err != nil {
+			return fmt.Errorf("failed to insert ngrams: %w", err)
 		}
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("%v", err)
+		return nil, http.StatusInternalServerError
 	}
-	if err := tx.Commit(); err != nil {
-		c.Logger().Errorf("failed to commit tx: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	return c.NoContent(http.StatusCreated)
+	return ngramRows, 0
 }
 
-func searchChairs(c echo.Context) error {
-	ctx := c.Request().Context()
-	conditions := make([]string, 0)
-	params := make([]interface{}, 0)
+// errInvalidRecord は入稿された CSV の行が読めなかったとき (400 を返す)
+var errInvalidRecord = errors.New("invalid record")
+
+// chairRecord は入稿された CSV の椅子 1 行
+type chairRecord struct {
+	id          int
+	name        string
+	description string
+	thumbnail   string
+	price       int
+	height      int
+	width       int
+	depth       int
+	color       string
+	features    string
+	kind        string
+	popularity  int
+	stock       int
+	material    string
+	weight      *int
+}
 
-	if c.QueryParam("priceRangeId") != "" {
-		chairPrice, err := getRange(chairSearchCondition.Price, c.QueryParam("priceRangeId"))
-		if err != nil {
-			c.Echo().Logger.Infof("priceRangeID invalid, %v : %v", c.QueryParam("priceRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
+// parseChairRecords は files の行を読んで確かめる。1 行でも読めなければ errInvalidRecord を返す
+func parseChairRecords(files []uploadedCSV) ([]chairRecord, error) {
+	records := make([]chairRecord, 0)
+	for _, file := range files {
+		for _, row := range file.Records {
+			rm := RecordMapper{Record: row}
+			r := chairRecord{
+				id:          rm.NextInt(),
+				name:        rm.NextString(),
+				description: rm.NextString(),
+				thumbnail:   rm.NextString(),
+				price:       rm.NextInt(),
+				height:      rm.NextInt(),
+				width:       rm.NextInt(),
+				depth:       rm.NextInt(),
+				color:       rm.NextString(),
+				features:    rm.NextString(),
+				kind:        rm.NextString(),
+				popularity:  rm.NextInt(),
+				stock:       rm.NextInt(),
+				material:    strings.TrimSpace(rm.NextOptionalString()),
+			}
+			weight, hasWeight := rm.NextOptionalInt()
+			if err := rm.Err(); err != nil {
+				return nil, fmt.Errorf("failed to read record in %s: %v: %w", file.Filename, err, errInvalidRecord)
+			}
+			if r.material != "" && !isValidChairMaterial(r.material) {
+				return nil, fmt.Errorf("unknown material %q in %s: %w", r.material, file.Filename, errInvalidRecord)
+			}
+			if hasWeight {
+				if weight <= 0 {
+					return nil, fmt.Errorf("invalid weight %d in %s: %w", weight, file.Filename, errInvalidRecord)
+				}
+				r.weight = &weight
+			}
+			records = append(records, r)
 		}
+	}
+	return records, nil
+}
 
-		if chairPrice.Min != -1 {
-			conditions = append(conditions, "price >= ?")
-			params = append(params, chairPrice.Min)
-		}
-		if chairPrice.Max != -1 {
-			conditions = append(conditions, "price < ?")
-			params = append(params, chairPrice.Max)
+// insertChairRecords は records を入れて ngramRows に足す
+func insertChairRecords(ctx context.Context, tx *sqlx.Tx, records []chairRecord, ngramRows *[]ngramRow) error {
+	for _, r := range records {
+		_, err := tx.ExecContext(ctx, "INSERT INTO chair(id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, score, stock, material, weight) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)", r.id, r.name, r.description, r.thumbnail, r.price, r.height, r.width, r.depth, r.color, r.features, r.kind, r.popularity, r.popularity, r.stock, r.material, r.weight)
+		if err != nil {
+			return fmt.Errorf("failed to insert chair: %w", err)
 		}
+		*ngramRows = append(*ngramRows, ngramRow{ID: int64(r.id), Name: r.name})
 	}
+	return nil
+}
+
+func makeChairConditions(q ChairSearchQuery) (*sqlFilter, int) {
+	f := newSQLFilter()
 
-	if c.QueryParam("heightRangeId") != "" {
-		chairHeight, err := getRange(chairSearchCondition.Height, c.QueryParam("heightRangeId"))
+	if q.PriceRangeID != "" {
+		chairPrice, err := getRange(chairSearchCondition.Price, q.PriceRangeID)
 		if err != nil {
-			c.Echo().Logger.Infof("heightRangeIf invalid, %v : %v", c.QueryParam("heightRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
+			return f, http.StatusBadRequest
 		}
+		f.Range(colChairEffectivePrice, chairPrice)
+	}
 
-		if chairHeight.Min != -1 {
-			conditions = append(conditions, "height >= ?")
-			params = append(params, chairHeight.Min)
-		}
-		if chairHeight.Max != -1 {
-			conditions = append(conditions, "height < ?")
-			params = append(params, chairHeight.Max)
+	if q.HeightRangeID != "" {
+		chairHeight, err := getRange(chairSearchCondition.Height, q.HeightRangeID)
+		if err != nil {
+			return f, http.StatusBadRequest
 		}
+		f.Range(colChairHeight, chairHeight)
 	}
 
-	if c.QueryParam("widthRangeId") != "" {
-		chairWidth, err := getRange(chairSearchCondition.Width, c.QueryParam("widthRangeId"))
+	if q.WidthRangeID != "" {
+		chairWidth, err := getRange(chairSearchCondition.Width, q.WidthRangeID)
 		if err != nil {
-			c.Echo().Logger.Infof("widthRangeID invalid, %v : %v", c.QueryParam("widthRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
+			return f, http.StatusBadRequest
 		}
+		f.Range(colChairWidth, chairWidth)
+	}
 
-		if chairWidth.Min != -1 {
-			conditions = append(conditions, "width >= ?")
-			params = append(params, chairWidth.Min)
-		}
-		if chairWidth.Max != -1 {
-			conditions = append(conditions, "width < ?")
-			params = append(params, chairWidth.Max)
+	if q.DepthRangeID != "" {
+		chairDepth, err := getRange(chairSearchCondition.Depth, q.DepthRangeID)
+		if err != nil {
+			return f, http.StatusBadRequest
 		}
+		f.Range(colChairDepth, chairDepth)
+	}
+
+	// 数値の直接指定は rangeId と両方あれば両方で絞る
+	if !f.MinMax(colChairEffectivePrice, q.PriceMin, q.PriceMax) ||
+		!f.MinMax(colChairHeight, q.HeightMin, q.HeightMax) ||
+		!f.MinMax(colChairWidth, q.WidthMin, q.WidthMax) ||
+		!f.MinMax(colChairDepth, q.DepthMin, q.DepthMax) {
+		return f, http.StatusBadRequest
+	}
+
+	if !f.MinPopularity(q.MinPopularity) {
+		return f, http.StatusBadRequest
+	}
+
+	if q.Kind != "" {
+		f.Eq(colChairKind, q.Kind)
+	}
+
+	if q.Color != "" {
+		f.Eq(colChairColor, q.Color)
+	}
+
+	if q.Material != "" {
+		f.Eq(colChairMaterial, q.Material)
 	}
 
-	if c.QueryParam("depthRangeId") != "" {
-		chairDepth, err := getRange(chairSearchCondition.Depth, c.QueryParam("depthRangeId"))
+	if q.WeightRangeID != "" {
+		chairWeight, err := getRange(chairSearchCondition.Weight, q.WeightRangeID)
 		if err != nil {
-			c.Echo().Logger.Infof("depthRangeId invalid, %v : %v", c.QueryParam("depthRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
+			return f, http.StatusBadRequest
 		}
+		f.Range(colChairWeight, chairWeight)
+	}
 
-		if chairDepth.Min != -1 {
-			conditions = append(conditions, "depth >= ?")
-			params = append(params, chairDepth.Min)
+	featuresMatch, ok := normalizeFeaturesMatch(q.FeaturesMatch)
+	if !ok {
+		return f, http.StatusBadRequest
+	}
+	if q.Features != "" {
+		if featuresMatch == FeaturesMatchAny {
+			cond, p := anyFeatureCondition(featureSynonyms.Chair, strings.Split(q.Features, ","))
+			f.Raw(cond, p...)
+		} else {
+			for _, feature := range strings.Split(q.Features, ",") {
+				cond, p := featureCondition(featureSynonyms.Chair, feature)
+				f.Raw(cond, p...)
+			}
 		}
-		if chairDepth.Max != -1 {
-			conditions = append(conditions, "depth < ?")
-			params = append(params, chairDepth.Max)
+	}
+
+	if q.ExcludeFeatures != "" {
+		for _, feature := range strings.Split(normalizeFeatureList(q.ExcludeFeatures), ",") {
+			cond, p := featureCondition(featureSynonyms.Chair, feature)
+			f.Raw("NOT "+cond, p...)
 		}
 	}
 
-	if c.QueryParam("kind") != "" {
-		conditions = append(conditions, "kind = ?")
-		params = append(params, c.QueryParam("kind"))
+	if q.NewerThan != "" {
+		newerThan, err := time.Parse(time.RFC3339, q.NewerThan)
+		if err != nil {
+			return f, http.StatusBadRequest
+		}
+		f.Gt(colCreatedAt, newerThan)
 	}
 
-	if c.QueryParam("color") != "" {
-		conditions = append(conditions, "color = ?")
-		params = append(params, c.QueryParam("color"))
+	if f.Empty() && q.Keyword == "" {
+		return f, http.StatusBadRequest
 	}
 
-	if c.QueryParam("features") != "" {
-		for _, f := range strings.Split(c.QueryParam("features"), ",") {
-			conditions = append(conditions, "features LIKE CONCAT('%', ?, '%')")
-			params = append(params, f)
-		}
+	return f, 0
+}
+
+func searchChairs(c echo.Context) error {
+	return renderChairSearch(c, newChairSearchQuery(c))
+}
+
+// searchChairsForAdmin は社内ツール用に minPopularity で絞れる検索
+func searchChairsForAdmin(c echo.Context) error {
+	return renderChairSearch(c, newAdminChairSearchQuery(c))
+}
+
+func renderChairSearch(c echo.Context, q ChairSearchQuery) error {
+	ctx := c.Request().Context()
+	setSurrogateKeys(c, surrogateKeyChairSearch)
+	f, errStatusCode := makeChairConditions(q)
+	if errStatusCode != 0 {
+		c.Echo().Logger.Infof("Invalid search condition : %v", c.QueryParams())
+		return c.NoContent(errStatusCode)
 	}
 
-	if len(conditions) == 0 {
-		c.Echo().Logger.Infof("Search condition not found")
-		return c.NoContent(http.StatusBadRequest)
+	// keyword は名前のあいまい検索。似ている順に並べる
+	var keywordIDs []int64
+	if q.Keyword != "" {
+		ids, err := fuzzyMatchIDs(ctx, "chair", q.Keyword)
+		if err != nil {
+			c.Logger().Errorf("searchChairs fuzzy match error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		keywordIDs = ids
+		if len(keywordIDs) == 0 && isCountOnly(c) {
+			return c.JSON(http.StatusOK, newSearchCountResponse(0))
+		}
+		if len(keywordIDs) == 0 {
+			return renderList(c, http.StatusOK, ChairSearchResponse{Count: 0, Chairs: []Chair{}})
+		}
+		f.In(colID, keywordIDs)
 	}
 
 	// もう stock が 0 のは残ってない
-	// conditions = append(conditions, "stock > 0")
+	// f.Gt("stock", 0)
+
+	if isCountOnly(c) {
+		where, params := f.Where()
+		count, err := countRows(ctx, "chair", where, params)
+		if err != nil {
+			c.Logger().Errorf("searchChairs DB execution error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.JSON(http.StatusOK, newSearchCountResponse(count))
+	}
 
 	page, err := strconv.Atoi(c.QueryParam("page"))
 	if err != nil {
@@ -519,35 +1476,56 @@ func searchChairs(c echo.Context) error {
 		c.Logger().Infof("Invalid format perPage parameter : %v", err)
 		return c.NoContent(http.StatusBadRequest)
 	}
+	if exceedsMaxPerPage(perPage) {
+		c.Logger().Infof("perPage parameter is too large : %v", perPage)
+		return c.NoContent(http.StatusBadRequest)
+	}
 
-	searchQuery := "SELECT * FROM chair WHERE "
-	countQuery := "SELECT COUNT(*) FROM chair WHERE "
-	searchCondition := strings.Join(conditions, " AND ")
-	limitOffset := " ORDER BY popularity DESC, id ASC LIMIT ? OFFSET ?"
+	order := chairOrder
+	if c.QueryParam("sort") != "" {
+		order, err = parseSort(c.QueryParam("sort"), chairSortKeys)
+		if err != nil {
+			c.Logger().Infof("Invalid sort parameter : %v", err)
+			return c.NoContent(http.StatusBadRequest)
+		}
+	}
+
+	sortKey := chairSortCacheKey(order)
+	var orderParams []interface{}
+	if len(keywordIDs) > 0 {
+		order = "FIELD(id, ?), " + order
+		orderParams = []interface{}{keywordIDs}
+	}
+	where, params := f.Where()
 
 	var res ChairSearchResponse
-	err = db.GetContext(ctx, &res.Count, countQuery+searchCondition, params...)
+	limit, offset := clampPaging(int64(perPage), int64(page*perPage))
+	if q.Keyword == "" {
+		res.Chairs, res.Count, err = searchChairsWithCache(ctx, c.Logger(), q, sortKey, where, params, order, limit, offset)
+	} else {
+		countKey := genChairCacheKey(q, "") + "&keyword=" + url.QueryEscape(q.Keyword)
+		res.Chairs, res.Count, err = searchChairsWithoutCache(ctx, countKey, where, params, order, orderParams, limit, offset)
+	}
 	if err != nil {
 		c.Logger().Errorf("searchChairs DB execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	chairs := []Chair{}
-	params = append(params, perPage, page*perPage)
-	err = db.SelectContext(ctx, &chairs, searchQuery+searchCondition+limitOffset, params...)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return c.JSON(http.StatusOK, ChairSearchResponse{Count: 0, Chairs: []Chair{}})
+	if q.Features != "" {
+		wanted := expandFeatures(featureSynonyms.Chair, strings.Split(q.Features, ","))
+		for i := range res.Chairs {
+			res.Chairs[i].MatchedFeatures = matchFeatures(res.Chairs[i].Features, wanted)
 		}
-		c.Logger().Errorf("searchChairs DB execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
 	}
-
-	res.Chairs = chairs
-
-	return c.JSON(http.StatusOK, res)
+	setChairEffectivePrices(res.Chairs)
+	hideChairTimestamps(c, res.Chairs)
+	setPaginationLinks(c, res.Count, page, perPage)
+	return renderList(c, http.StatusOK, res)
 }
 
+// errInsufficientStock は在庫より多く買おうとしたとき
+var errInsufficientStock = errors.New("insufficient stock")
+
 func buyChair(c echo.Context) error {
 	ctx := c.Request().Context()
 	m := echo.Map{}
@@ -556,203 +1534,565 @@ func buyChair(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	_, ok := m["email"].(string)
+	email, ok := m["email"].(string)
 	if !ok {
 		c.Echo().Logger.Info("post buy chair failed : email not found in request body")
 		return c.NoContent(http.StatusBadRequest)
 	}
 
+	// quantity はまとめ買い用。指定がなければ 1 つ
+	quantity := int64(1)
+	if v, ok := m["quantity"]; ok && v != nil {
+		f, ok := v.(float64)
+		if !ok || f < 1 || f != float64(int64(f)) {
+			c.Echo().Logger.Infof("post buy chair failed : invalid quantity %v", v)
+			return c.NoContent(http.StatusBadRequest)
+		}
+		quantity = int64(f)
+	}
+
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		c.Echo().Logger.Infof("post buy chair failed : %v", err)
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	tx, err := db.Beginx()
+	var chair Chair
+	err = withTx(ctx, func(tx *sqlx.Tx) error {
+		err := tx.QueryRowxContext(ctx, "SELECT * FROM chair WHERE id = ? AND stock > 0 FOR UPDATE", id).StructScan(&chair)
+		if err != nil {
+			return err
+		}
+
+		if chair.Stock < quantity {
+			return errInsufficientStock
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO chair_purchase (chair_id, email, quantity) VALUES (?,?,?)", id, email, quantity); err != nil {
+			return fmt.Errorf("chair purchase insert failed : %w", err)
+		}
+
+		// 在庫が全部なくなったら chair_archive に写してから chair を消します
+		if chair.Stock == quantity {
+			if err := archiveChair(ctx, tx, id); err != nil {
+				return fmt.Errorf("chair archive failed : %w", err)
+			}
+			if _, err := tx.ExecContext(ctx, "DELETE FROM chair WHERE id = ?", id); err != nil {
+				return fmt.Errorf("chair stock delete failed : %w", err)
+			}
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE chair SET stock = stock - ? WHERE id = ?", quantity, id); err != nil {
+			return fmt.Errorf("chair stock update failed : %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		c.Echo().Logger.Errorf("failed to create transaction : %v", err)
+		if err == sql.ErrNoRows {
+			c.Echo().Logger.Infof("buyChair chair id \"%v\" not found", id)
+			return c.NoContent(http.StatusNotFound)
+		}
+		if err == errInsufficientStock {
+			c.Echo().Logger.Infof("buyChair chair id \"%v\" has only %v in stock (requested %v)", id, chair.Stock, quantity)
+			return c.NoContent(http.StatusConflict)
+		}
+		c.Echo().Logger.Errorf("buyChair DB execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	defer tx.Rollback()
+	chairDetailCache.Delete(int64(id))
+	// 売り切れて消えたときだけ low_priced の並びが変わる
+	if chair.Stock == quantity {
+		// 在庫が減っただけなら検索結果は変わらない
+		_ = purgeChairIDsFromRedis(ctx)
+		if err := removeFromLowPricedSet(ctx, lowPricedChairSetKey, int64(id)); err != nil {
+			c.Logger().Errorf("failed to remove low priced chair : %v", err)
+		}
+		if err := removeChairNameSuggestion(ctx, chair.Name); err != nil {
+			c.Logger().Errorf("failed to remove chair name suggestion : %v", err)
+		}
+		refreshLowPricedChairCache(ctx)
+		purgeResponseCache(ctx, responseCacheGroupChair)
+		purgeSurrogateKeys(c.Logger(), surrogateKeyForChair(int64(id)), surrogateKeyChairSearch)
+	} else {
+		// 並びは変わらないが、low_priced の JSON には在庫が入っている
+		if cacheAvailable() && isLowPricedChair(ctx, int64(id)) {
+			refreshLowPricedChairCache(ctx)
+		}
+		purgeSurrogateKeys(c.Logger(), surrogateKeyForChair(int64(id)))
+		notifyLowStock(c.Logger(), chair, chair.Stock, chair.Stock-quantity)
+	}
 
-	var chair Chair
-	err = tx.QueryRowxContext(ctx, "SELECT * FROM chair WHERE id = ? AND stock > 0 FOR UPDATE", id).StructScan(&chair)
+	return c.NoContent(http.StatusOK)
+}
+
+func getChairSearchCondition(c echo.Context) error {
+	locale := negotiateLocale(c, func(l string) bool {
+		_, ok := localizedChairSearchConditions[l]
+		return ok
+	})
+	setLocaleHeaders(c, locale)
+	return c.JSONBlob(http.StatusOK, localizedChairSearchConditionsJSON[locale])
+}
+
+func getEstateDetail(c echo.Context) error {
+	ctx := c.Request().Context()
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	estate, err := getEstateByID(ctx, int64(id))
+	if err == nil && estate.Status != "available" {
+		err = sql.ErrNoRows
+	}
 	if err != nil {
 		if err == sql.ErrNoRows {
-			c.Echo().Logger.Infof("buyChair chair id \"%v\" not found", id)
+			c.Echo().Logger.Infof("getEstateDetail estate id %v not found", id)
 			return c.NoContent(http.StatusNotFound)
 		}
-		c.Echo().Logger.Errorf("DB Execution Error: on getting a chair by id : %v", err)
+		c.Echo().Logger.Errorf("Database Execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	estate.Images, err = getEstateImages(ctx, estate.ID)
+	if err != nil {
+		c.Echo().Logger.Errorf("Database Execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	estate.hideTimestamps(c)
+	setSurrogateKeys(c, surrogateKeyEstate, surrogateKeyForEstate(estate.ID))
+	return c.JSON(http.StatusOK, estate)
+}
+
+func getRange(cond RangeCondition, rangeID string) (*Range, error) {
+	RangeIndex, err := strconv.Atoi(rangeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if RangeIndex < 0 || len(cond.Ranges) <= RangeIndex {
+		return nil, fmt.Errorf("Unexpected Range ID")
+	}
+
+	return cond.Ranges[RangeIndex], nil
+}
+
+// verify からしか来ないので newrelic いれない
+func postEstate(c echo.Context) error {
+	files, status := readUploadedCSVs(c, "estates")
+	if status != 0 {
+		return c.NoContent(status)
+	}
+	perFile, ok := parseTransactionMode(c)
+	if !ok {
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	// 重複っぽい物件の扱い (flag: 入れた上で報告, reject: 全部取り消す, merge: 既存の物件を更新する)
+	duplicateMode := c.QueryParam("duplicates")
+	switch duplicateMode {
+	case "":
+		duplicateMode = "flag"
+	case "flag", "reject", "merge":
+	default:
+		c.Logger().Infof("invalid duplicates mode : %v", duplicateMode)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	// reject は重複があったら 409 を返さないといけないので buffer しない
+	if !perFile && duplicateMode != "reject" {
+		if buffered, err := tryBufferEstates(c, files, duplicateMode); buffered {
+			return err
+		}
+	}
+
+	ctx := c.Request().Context()
+	stations, err := loadStations(ctx)
+	if err != nil {
+		c.Logger().Errorf("failed to load stations: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	// 最後のひとつだったら chair を消します
-	if chair.Stock == 1 {
-		_, err = tx.ExecContext(ctx, "DELETE FROM chair WHERE id = ?", id)
+	ngramRows := make([]ngramRow, 0)
+	duplicates := make([]EstateDuplicate, 0)
+	results := make([]FileImportResult, 0, len(files))
+	if perFile {
+		for _, f := range files {
+			res, status := importEstates(ctx, c.Logger(), []uploadedCSV{f}, duplicateMode, stations)
+			result := newFileImportResult(f, status)
+			result.Errors = res.rowErrors
+			result.Duplicates = res.duplicates
+			results = append(results, result)
+			if status == 0 {
+				ngramRows = append(ngramRows, res.ngramRows...)
+				duplicates = append(duplicates, res.duplicates...)
+			}
+		}
+	} else {
+		res, status := importEstates(ctx, c.Logger(), files, duplicateMode, stations)
+		switch {
+		case status == 0:
+		case len(res.rowErrors) > 0:
+			c.Logger().Infof("invalid estate rows : %v", res.rowErrors)
+			return c.JSON(status, PostEstateErrorResponse{Errors: res.rowErrors})
+		case status == http.StatusConflict:
+			return c.JSON(status, PostEstateResponse{Duplicates: res.duplicates})
+		default:
+			return c.NoContent(status)
+		}
+		for _, f := range files {
+			results = append(results, newFileImportResult(f, 0))
+		}
+		ngramRows = res.ngramRows
+		duplicates = res.duplicates
+	}
+
+	afterEstateImport(c.Logger(), ngramRows)
+	// 1 ファイルだけのときは今まで通りのレスポンスにする
+	if len(files) == 1 && !perFile {
+		if len(duplicates) > 0 {
+			return c.JSON(http.StatusCreated, PostEstateResponse{Duplicates: duplicates})
+		}
+		return c.NoContent(http.StatusCreated)
+	}
+	return c.JSON(importResponseStatus(results), PostEstateResponse{Duplicates: duplicates, Files: results})
+}
+
+// afterEstateImport は物件を入れたあとの cache の破棄や保存検索の通知をする
+func afterEstateImport(logger echo.Logger, ngramRows []ngramRow) {
+	if len(ngramRows) == 0 {
+		return
+	}
+	ids := make([]int64, 0, len(ngramRows))
+	for _, r := range ngramRows {
+		ids = append(ids, r.ID)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cacheBackgroundTimeout)
+	defer cancel()
+	// low_priced の JSON を set から作り直すので、先に set に足しておく
+	if err := addLowPricedEstates(ctx, ids); err != nil {
+		logger.Errorf("failed to add low priced estates: %v", err)
+	}
+	// estates が変わったら redis の cache は飛ばさないといけない
+	_ = purgeEstateIDsFromRedis()
+	refreshLowPricedEstateCache(ctx)
+	// 重複を上書きした物件は詳細も変わる
+	purgeSurrogateKeys(logger, surrogateKeyEstate, surrogateKeyEstateSearch)
+	enqueueThumbnailHashes(logger, "estate", ids)
+	go matchSavedSearches(logger, "estate", ids)
+}
+
+type estateImport struct {
+	ngramRows  []ngramRow
+	duplicates []EstateDuplicate
+	rowErrors  []RowError
+}
+
+// importEstates は files の行を読んで 1 つの transaction で入れる。
+// 範囲外の行や (reject のときの) 重複があれば commit せずに、返すべき HTTP ステータスと一緒に返す (成功なら 0)
+func importEstates(ctx context.Context, logger echo.Logger, files []uploadedCSV, duplicateMode string, stations []Station) (estateImport, int) {
+	records, rowErrors, err := parseEstateRecords(ctx, logger, files)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return estateImport{}, http.StatusBadRequest
+	}
+	if len(rowErrors) > 0 {
+		return estateImport{rowErrors: rowErrors}, http.StatusBadRequest
+	}
+	return insertEstates(ctx, logger, records, duplicateMode, stations)
+}
+
+// insertEstates は parseEstateRecords で確かめた行を 1 つの transaction で入れる
+func insertEstates(ctx context.Context, logger echo.Logger, records []estateRecord, duplicateMode string, stations []Station) (estateImport, int) {
+	var res estateImport
+	status := 0
+	err := withTx(ctx, func(tx *sqlx.Tx) error {
+		res = estateImport{
+			ngramRows:  make([]ngramRow, 0, len(records)),
+			duplicates: make([]EstateDuplicate, 0),
+			rowErrors:  make([]RowError, 0),
+		}
+		status = 0
+		if err := insertEstateRecords(ctx, tx, records, duplicateMode, stations, &res); err != nil {
+			return err
+		}
+		if duplicateMode == "reject" && len(res.duplicates) > 0 {
+			status = http.StatusConflict
+			return errImportRejected
+		}
+		if err := insertNgrams(ctx, tx, "estate", res.ngramRows); err != nil {
+			return fmt.Errorf("failed to insert ngrams: %w", err)
+		}
+		return nil
+	})
+	if err != nil && err != errImportRejected {
+		logger.Errorf("%v", err)
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+	}
+	return res, status
+}
+
+// errImportRejected は入稿を commit せずに返すとき
+var errImportRejected = errors.New("import rejected")
+
+// estateRecord は入稿された CSV の物件 1 行
+type estateRecord struct {
+	id               int
+	name             string
+	description      string
+	thumbnail        string
+	address          string
+	latitude         float64
+	longitude        float64
+	rent             int
+	doorHeight       int
+	doorWidth        int
+	features         string
+	popularity       int
+	images           []string
+	layout           string
+	managementFee    int
+	hasManagementFee bool
+	deposit          int
+	hasDeposit       bool
+}
+
+// parseEstateRecords は files の行を読んで確かめる。緯度経度が無い行は住所から埋める。
+// 読めない行があれば errInvalidRecord を、範囲外などの行があれば行ごとのエラーを返す
+func parseEstateRecords(ctx context.Context, logger echo.Logger, files []uploadedCSV) ([]estateRecord, []RowError, error) {
+	// 外部の API を呼ぶこともあるので transaction の外で埋める
+	geocodeMissingCoordinates(ctx, logger, files)
+
+	records := make([]estateRecord, 0)
+	rowErrors := make([]RowError, 0)
+	for _, file := range files {
+		// 複数ファイルのときはどのファイルの行か分かるようにする
+		filename := ""
+		if len(files) > 1 {
+			filename = file.Filename
+		}
+		for i, row := range file.Records {
+			rm := RecordMapper{Record: row}
+			r := estateRecord{
+				id:          rm.NextInt(),
+				name:        rm.NextString(),
+				description: rm.NextString(),
+				thumbnail:   rm.NextString(),
+				address:     rm.NextString(),
+			}
+			var hasLatitude, hasLongitude bool
+			r.latitude, hasLatitude = rm.NextNullableFloat()
+			r.longitude, hasLongitude = rm.NextNullableFloat()
+			r.rent = rm.NextInt()
+			r.doorHeight = rm.NextInt()
+			r.doorWidth = rm.NextInt()
+			r.features = rm.NextString()
+			r.popularity = rm.NextInt()
+			r.images = parseEstateImages(rm.NextOptionalString())
+			r.layout = strings.TrimSpace(rm.NextOptionalString())
+			r.managementFee, r.hasManagementFee = rm.NextOptionalInt()
+			r.deposit, r.hasDeposit = rm.NextOptionalInt()
+			if err := rm.Err(); err != nil {
+				return nil, nil, fmt.Errorf("failed to read record in %s: %v: %w", file.Filename, err, errInvalidRecord)
+			}
+			if r.layout != "" && !isValidEstateLayout(r.layout) {
+				rowErrors = append(rowErrors, RowError{File: filename, Row: i + 1, Message: fmt.Sprintf("unknown layout: %s", r.layout)})
+				continue
+			}
+			// 緯度経度が空なのは geocodeMissingCoordinates で住所から引けなかった行
+			if !hasLatitude || !hasLongitude {
+				rowErrors = append(rowErrors, RowError{File: filename, Row: i + 1, Message: "missing coordinates could not be geocoded from the address"})
+				continue
+			}
+			// 範囲外の緯度経度は bounding box の検索やキャッシュを壊すので入れない
+			if err := (Coordinate{Latitude: r.latitude, Longitude: r.longitude}).validate(); err != nil {
+				rowErrors = append(rowErrors, RowError{File: filename, Row: i + 1, Message: err.Error()})
+				continue
+			}
+			if r.managementFee < 0 || r.deposit < 0 {
+				rowErrors = append(rowErrors, RowError{File: filename, Row: i + 1, Message: "management fee and deposit must not be negative"})
+				continue
+			}
+			records = append(records, r)
+		}
+	}
+	return records, rowErrors, nil
+}
+
+// insertEstateRecords は records を入れて res に結果を足す
+func insertEstateRecords(ctx context.Context, tx *sqlx.Tx, records []estateRecord, duplicateMode string, stations []Station, res *estateImport) error {
+	for _, r := range records {
+		existingID, err := findDuplicateEstate(ctx, tx, r.address, r.latitude, r.longitude, r.doorHeight, r.doorWidth)
 		if err != nil {
-			c.Echo().Logger.Errorf("chair stock delete failed : %v", err)
-			return c.NoContent(http.StatusInternalServerError)
+			return fmt.Errorf("failed to find duplicate estate: %w", err)
+		}
+		if existingID != 0 {
+			res.duplicates = append(res.duplicates, EstateDuplicate{ID: int64(r.id), ExistingID: existingID})
+			if duplicateMode == "merge" {
+				// 間取り・管理費・敷金は古い形式の入稿で消さないように、指定があるときだけ上書きする。
+				// 同じ物件を入稿し直しただけで上位に戻らないように、score はそれまでの減衰を保ったまま新しい popularity に合わせ、
+				// updated_at (score の計算での最後の動き) も進めない。
+				// MySQL の UPDATE は SET を左から順に評価するので、score は popularity を書き換える前に計算する
+				_, err := tx.ExecContext(ctx, "UPDATE estate SET score = IF(popularity = 0, ?, score * ? / popularity), name = ?, description = ?, thumbnail = ?, rent = ?, features = ?, popularity = ?, thumbnail_hash = NULL, layout = IF(? = '', layout, ?), management_fee = IF(?, ?, management_fee), deposit = IF(?, ?, deposit), updated_at = updated_at WHERE id = ?",
+					r.popularity, r.popularity, r.name, r.description, r.thumbnail, r.rent, r.features, r.popularity, r.layout, r.layout, r.hasManagementFee, r.managementFee, r.hasDeposit, r.deposit, existingID)
+				if err != nil {
+					return fmt.Errorf("failed to merge estate: %w", err)
+				}
+				// 画像が指定されていたら差し替える
+				if len(r.images) > 0 {
+					if err := replaceEstateImages(ctx, tx, existingID, r.images); err != nil {
+						return fmt.Errorf("failed to merge estate images: %w", err)
+					}
+				}
+				res.ngramRows = append(res.ngramRows, ngramRow{ID: existingID, Name: r.name})
+				continue
+			}
 		}
-	} else {
-		_, err = tx.ExecContext(ctx, "UPDATE chair SET stock = stock - 1 WHERE id = ?", id)
+		cellID := geo.CellIDFromPoint(geo.Point{Lat: r.latitude, Lng: r.longitude})
+		var stationName *string
+		var walkMinutes *int64
+		if station, minutes := nearestStation(stations, r.latitude, r.longitude); station != nil {
+			stationName, walkMinutes = &station.Name, &minutes
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO estate(id, name, description, thumbnail, address, latitude, longitude, rent, door_height, door_width, features, popularity, score, cell_id, nearest_station, station_walk_minutes, layout, management_fee, deposit) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)", r.id, r.name, r.description, r.thumbnail, r.address, r.latitude, r.longitude, r.rent, r.doorHeight, r.doorWidth, r.features, r.popularity, r.popularity, uint64(cellID), stationName, walkMinutes, r.layout, r.managementFee, r.deposit)
 		if err != nil {
-			c.Echo().Logger.Errorf("chair stock update failed : %v", err)
-			return c.NoContent(http.StatusInternalServerError)
+			return fmt.Errorf("failed to insert estate: %w", err)
 		}
+		if err := replaceEstateImages(ctx, tx, int64(r.id), r.images); err != nil {
+			return fmt.Errorf("failed to insert estate images: %w", err)
+		}
+		res.ngramRows = append(res.ngramRows, ngramRow{ID: int64(r.id), Name: r.name})
 	}
-
-	err = tx.Commit()
-	if err != nil {
-		c.Echo().Logger.Errorf("transaction commit error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	return c.NoContent(http.StatusOK)
+	return nil
 }
 
-func getChairSearchCondition(c echo.Context) error {
-	return c.JSON(http.StatusOK, chairSearchCondition)
-}
+// 緯度経度がこれ以下しか離れていなければ同じ場所とみなす (だいたい 1m)
+const duplicateEstateCoordinateTolerance = 0.00001
 
-func getLowPricedChair(c echo.Context) error {
-	ctx := c.Request().Context()
-	var chairs []Chair
-	query := `SELECT * FROM chair ORDER BY price ASC, id ASC LIMIT ?`
-	err := db.SelectContext(ctx, &chairs, query, Limit)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			c.Logger().Error("getLowPricedChair not found")
-			return c.JSON(http.StatusOK, ChairListResponse{[]Chair{}})
-		}
-		c.Logger().Errorf("getLowPricedChair DB execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+// findDuplicateEstate は住所・ドアの大きさが同じで、ほぼ同じ場所にある物件の ID を返す。
+// 見つからなければ 0
+func findDuplicateEstate(ctx context.Context, tx *sqlx.Tx, address string, latitude float64, longitude float64, doorHeight int, doorWidth int) (int64, error) {
+	var id int64
+	err := tx.QueryRowContext(ctx, "SELECT id FROM estate WHERE address = ? AND door_height = ? AND door_width = ? AND ABS(latitude - ?) <= ? AND ABS(longitude - ?) <= ? ORDER BY id ASC LIMIT 1",
+		address, doorHeight, doorWidth, latitude, duplicateEstateCoordinateTolerance, longitude, duplicateEstateCoordinateTolerance).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
 	}
-
-	return c.JSON(http.StatusOK, ChairListResponse{Chairs: chairs})
+	return id, err
 }
 
-func getEstateDetail(c echo.Context) error {
-	ctx := c.Request().Context()
-	id, err := strconv.Atoi(c.Param("id"))
-	if err != nil {
-		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
-		return c.NoContent(http.StatusBadRequest)
-	}
+// estate の ID リストの key は estate:v{版}:{sha1(正規化した条件)} (sha1 の部分は cluster の hash tag)。
+// 入稿などで物件が変わったら版を上げて、古い版の key は index (estate:v{版}:keys) からたどって消す。
+// 消し損ねた古い版の key も、TTL を指定していなければ cacheDefaultTTL で消える (chair も同じ)
+const estateIDsCacheVersionKey = "estate:version"
 
-	var estate Estate
-	err = db.GetContext(ctx, &estate, "SELECT * FROM estate WHERE id = ?", id)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			c.Echo().Logger.Infof("getEstateDetail estate id %v not found", id)
-			return c.NoContent(http.StatusNotFound)
-		}
-		c.Echo().Logger.Errorf("Database Execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
+func estateIDsCacheTTL(ctx context.Context) time.Duration {
+	return time.Duration(currentConfig().EstateIDsCacheTTL)
+}
 
-	return c.JSON(http.StatusOK, estate)
+// estateIDsCacheKey は今の版での条件 q の key を返す
+func estateIDsCacheKey(ctx context.Context, q EstateSearchQuery) (string, error) {
+	return searchIDsCache.Key(ctx, "estate", genCacheKey(q))
 }
 
-func getRange(cond RangeCondition, rangeID string) (*Range, error) {
-	RangeIndex, err := strconv.Atoi(rangeID)
-	if err != nil {
-		return nil, err
-	}
+// genCacheKey は検索条件を正規化した文字列にする。
+// 書くとき (非同期の fill) も読むときもここを通るので、同じ結果になる条件は同じ key になる
+func genCacheKey(q EstateSearchQuery) string {
+	v := url.Values{}
+	// 空と指定なしは同じ意味なので、全部の項目を空でも入れておく
+	v.Set("doorHeightRangeId", normalizeIntParam(q.DoorHeightRangeID))
+	v.Set("doorWidthRangeId", normalizeIntParam(q.DoorWidthRangeID))
+	v.Set("rentRangeId", normalizeIntParam(q.RentRangeID))
+	v.Set("features", normalizeFeatureList(q.Features))
+	v.Set("newerThan", normalizeTimeParam(q.NewerThan))
+	status := q.Status
+	if status == "" {
+		status = EstateStatusAvailable
+	}
+	v.Set("status", status)
+	v.Set("stationName", q.StationName)
+	v.Set("maxWalkMinutes", normalizeIntParam(q.MaxWalkMinutes))
+	v.Set("layout", normalizeFeatureList(q.Layout))
+	v.Set("effectiveRent", q.EffectiveRent)
+	v.Set("rentMin", normalizeIntParam(q.RentMin))
+	v.Set("rentMax", normalizeIntParam(q.RentMax))
+	v.Set("doorWidthMin", normalizeIntParam(q.DoorWidthMin))
+	v.Set("doorWidthMax", normalizeIntParam(q.DoorWidthMax))
+	v.Set("doorHeightMin", normalizeIntParam(q.DoorHeightMin))
+	v.Set("doorHeightMax", normalizeIntParam(q.DoorHeightMax))
+	v.Set("minPopularity", normalizeIntParam(q.MinPopularity))
+	v.Set("excludeFeatures", normalizeFeatureList(q.ExcludeFeatures))
+	featuresMatch, _ := normalizeFeaturesMatch(q.FeaturesMatch)
+	v.Set("featuresMatch", featuresMatch)
+	// 並び順が違うサーバーとキャッシュを共有しないように戦略名も入れる
+	v.Set("order", estateOrderName)
+	// Encode は key の順に並べて escape するので、区切り文字を含む値でも混ざらない
+	return v.Encode()
+}
 
-	if RangeIndex < 0 || len(cond.Ranges) <= RangeIndex {
-		return nil, fmt.Errorf("Unexpected Range ID")
+// normalizeFeatureList は "b, a,,a" を "a,b" にする。AND でも OR でも順番や重複は結果に関係ない
+func normalizeFeatureList(s string) string {
+	seen := map[string]bool{}
+	features := make([]string, 0)
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" || seen[f] {
+			continue
+		}
+		seen[f] = true
+		features = append(features, f)
 	}
-
-	return cond.Ranges[RangeIndex], nil
+	sort.Strings(features)
+	return strings.Join(features, ",")
 }
 
-// verify からしか来ないので newrelic いれない
-func postEstate(c echo.Context) error {
-	header, err := c.FormFile("estates")
-	if err != nil {
-		c.Logger().Errorf("failed to get form file: %v", err)
-		return c.NoContent(http.StatusBadRequest)
-	}
-	f, err := header.Open()
-	if err != nil {
-		c.Logger().Errorf("failed to open form file: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	defer f.Close()
-	records, err := csv.NewReader(f).ReadAll()
+// normalizeIntParam は "01" と "1" を揃える。数字でなければそのまま (検索側で 400 になる)
+func normalizeIntParam(s string) string {
+	n, err := strconv.Atoi(s)
 	if err != nil {
-		c.Logger().Errorf("failed to read csv: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return s
 	}
+	return strconv.Itoa(n)
+}
 
-	tx, err := db.Begin()
+// normalizeTimeParam はタイムゾーン違いの同じ時刻を揃える
+func normalizeTimeParam(s string) string {
+	t, err := time.Parse(time.RFC3339, s)
 	if err != nil {
-		c.Logger().Errorf("failed to begin tx: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	defer tx.Rollback()
-	for _, row := range records {
-		rm := RecordMapper{Record: row}
-		id := rm.NextInt()
-		name := rm.NextString()
-		description := rm.NextString()
-		thumbnail := rm.NextString()
-		address := rm.NextString()
-		latitude := rm.NextFloat()
-		longitude := rm.NextFloat()
-		rent := rm.NextInt()
-		doorHeight := rm.NextInt()
-		doorWidth := rm.NextInt()
-		features := rm.NextString()
-		popularity := rm.NextInt()
-		if err := rm.Err(); err != nil {
-			c.Logger().Errorf("failed to read record: %v", err)
-			return c.NoContent(http.StatusBadRequest)
-		}
-		_, err := tx.Exec("INSERT INTO estate(id, name, description, thumbnail, address, latitude, longitude, rent, door_height, door_width, features, popularity) VALUES(?,?,?,?,?,?,?,?,?,?,?,?)", id, name, description, thumbnail, address, latitude, longitude, rent, doorHeight, doorWidth, features, popularity)
-		if err != nil {
-			c.Logger().Errorf("failed to insert estate: %v", err)
-			return c.NoContent(http.StatusInternalServerError)
-		}
-	}
-	if err := tx.Commit(); err != nil {
-		c.Logger().Errorf("failed to commit tx: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return s
 	}
-	// estates が変わったら redis の cache は飛ばさないといけない
-	_ = purgeEstateIDsFromRedis()
-	return c.NoContent(http.StatusCreated)
-}
-
-func genCacheKey(doorHeightRangeID string, doorWidthRangeID string, rentRangeID string, features string) string {
-	return strings.Join([]string{doorHeightRangeID, doorWidthRangeID, rentRangeID, features}, "_")
+	return t.UTC().Format(time.RFC3339Nano)
 }
 
 var errCacheNotHit = errors.New("cache not hit")
 
 // getFromRedis は redis から取得する。
 // redis になかった場合は errCacheNotHit が帰ります
-func getEstateIDsFromRedis(key string, limit int64, offset int64) ([]int64, int64, error) {
-	ctx := context.TODO()
-	// 全体の長さ
-	length, err := rdb.LLen(ctx, key).Result()
-	if err != nil {
-		if err == redis.Nil {
+func getIDsFromRedis(ctx context.Context, key string, limit int64, offset int64) ([]int64, int64, error) {
+	if limit <= 0 {
+		// 全体の長さだけ
+		length, err := rdb.LLen(ctx, key).Result()
+		if err != nil {
+			return nil, 0, err
+		}
+		if length == 0 {
 			return nil, 0, errCacheNotHit
 		}
+		return []int64{}, length, nil
+	}
+	// 全体の長さとページを 1 往復で取る。key が無ければ LLEN は 0、LRANGE は空になる
+	pipe := rdb.Pipeline()
+	llen := pipe.LLen(ctx, key)
+	lrange := pipe.LRange(ctx, key, offset, offset+limit-1)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
 		return nil, 0, err
 	}
+	length := llen.Val()
 	if length == 0 {
 		return nil, 0, errCacheNotHit
 	}
-	val, err := rdb.LRange(ctx, key, offset, offset+limit-1).Result()
-	if err != nil {
-		// length があったならこっちがないことはないはず...
-		if err == redis.Nil {
-			return nil, 0, errCacheNotHit
-		}
-		return nil, 0, err
-	}
+	val := lrange.Val()
 	res := make([]int64, len(val))
 	for i, v := range val {
 		intVal, _ := strconv.Atoi(v)
@@ -761,121 +2101,250 @@ func getEstateIDsFromRedis(key string, limit int64, offset int64) ([]int64, int6
 	return res, length, nil
 }
 
-func putEstateIDsToRedis(key string, res []int64) error {
-	ctx := context.TODO()
+// replaceListScript は KEYS[1] の list を ARGV[2:] で置き換えて、ARGV[1] ミリ秒の TTL を付ける。
+// unpack は引数が多すぎると失敗するので、1000 件ずつ RPUSH する
+var replaceListScript = redis.NewScript(`
+redis.call("del", KEYS[1])
+for i = 2, #ARGV, 1000 do
+	redis.call("rpush", KEYS[1], unpack(ARGV, i, math.min(i + 999, #ARGV)))
+end
+redis.call("pexpire", KEYS[1], ARGV[1])
+return 1
+`)
+
+// putIDsToRedis は ID リストを key に入れる。ttl が 0 なら cacheDefaultTTL
+func putIDsToRedis(ctx context.Context, key string, res []int64, ttl time.Duration) error {
 	if len(res) == 0 {
 		return nil
 	}
-	// del と rpush を atomic に行う (書き込み競合しても長さが2倍になったりしないはず)
-	pipe := rdb.Pipeline()
-	pipe.Del(ctx, key)
-	idsStrSlice := make([]interface{}, len(res))
-	for i, v := range res {
-		idsStrSlice[i] = fmt.Sprintf("%d", v)
+	if ttl <= 0 {
+		ttl = cacheDefaultTTL()
 	}
-	pipe.RPush(ctx, key, idsStrSlice...)
-	_, err := pipe.Exec(ctx)
-	if err != nil {
-		fmt.Println(err)
+	expiration := jitterTTL(ttl)
+	args := make([]interface{}, 0, len(res)+1)
+	args = append(args, expiration.Milliseconds())
+	for _, v := range res {
+		args = append(args, strconv.FormatInt(v, 10))
 	}
-	return err
+	// 同じ key を同時に作り直しても、list が混ざったり 2 倍になったりしないように script の中で入れ替える
+	if err := replaceListScript.Run(ctx, rdb, []string{key}, args...).Err(); err != nil {
+		return err
+	}
+	// 版を上げたときに消せるように index に入れておく
+	return addToIDsCacheIndex(ctx, rdb, key, expiration).Err()
 }
 
-// purgeFromRedis は入稿したときにキャッシュを全滅させる
-func purgeEstateIDsFromRedis() error {
-	ctx := context.TODO()
-	return rdb.FlushAllAsync(ctx).Err()
+// idsFillGroup は ID リストの fill を key ごとに 1 つにまとめる
+var idsFillGroup flightGroup
+
+// fillIDsCache は cache に無かった key の ID リストを query で作って、ttl(ctx) の TTL で redis に入れ、そのまま返す。
+// 同じ key の fill が走っていれば MySQL には聞かずにその結果を待つ。
+// 待っている他のリクエストが切断されても困らないように、切り離した context で時間を区切る
+func fillIDsCache(logger echo.Logger, key string, stats *cacheStats, ttl func(ctx context.Context) time.Duration, query func(ctx context.Context) ([]int64, error)) ([]int64, error) {
+	v, err, _ := idsFillGroup.Do(key, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), cacheBackgroundTimeout)
+		defer cancel()
+		start := time.Now()
+		ids, err := query(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := searchIDsCache.PutList(ctx, key, ids, ttl(ctx)); err != nil {
+			logger.Errorf("failed to put ids cache %v : %v", key, err)
+			if isCacheConnectionError(err) {
+				markCacheUnhealthy(err)
+			}
+		}
+		stats.ObserveFill(time.Since(start))
+		return ids, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]int64), nil
 }
 
-// キャッシュに埋める用
-func searchEstateIDsFromMysql(ctx context.Context, doorHeightRangeID string, doorWidthRangeID string, rentRangeID string, features string) ([]int64, error) {
-	conditions, params, errStatusCode := makeEstateConditions(doorHeightRangeID, doorWidthRangeID, rentRangeID, features)
-	if errStatusCode != 0 {
-		return nil, errors.New("failed")
+// pageIDs は ID リスト全体から offset 件目から limit 件を切り出す
+func pageIDs(ids []int64, limit int64, offset int64) []int64 {
+	if limit <= 0 || offset >= int64(len(ids)) {
+		return []int64{}
+	}
+	end := offset + limit
+	if end > int64(len(ids)) {
+		end = int64(len(ids))
 	}
+	return ids[offset:end]
+}
 
-	if len(conditions) == 0 {
-		// c.Echo().Logger.Infof("searchEstates search condition not found")
-		return nil, errors.New("failed")
+// purgeEstateIDsFromRedis は物件が変わったときに estate の cache を捨てる。
+// ID リストは版を上げて古い版の key を消し、low_priced、レスポンスの cache (responseCacheGroupEstate)、
+// 住所のサジェスト、instance の中の物件の cache (estateDetailCache) はここで消す。
+// 書き込みは commit 済みなので、クライアントが切断していても最後まで消す
+func purgeEstateIDsFromRedis() error {
+	estateDetailCache.Purge()
+	estateLocalIDsCache.Purge()
+	ctx, cancel := context.WithTimeout(context.Background(), cacheBackgroundTimeout)
+	defer cancel()
+	var err error
+	for _, prefix := range []string{"estate", lowPricedEstateCachePrefix, suggestEstateAddressPrefix} {
+		if err = searchIDsCache.Purge(ctx, prefix); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		purgeResponseCache(ctx, responseCacheGroupEstate)
 	}
+	return handlePurgeError(err)
+}
 
-	searchQuery := "SELECT id FROM estate WHERE "
-	searchCondition := strings.Join(conditions, " AND ")
-	order := " ORDER BY popularity DESC, id ASC"
+// purgeAllCachesFromRedis は initialize で DB を作り直すときに redis の cache を全部消す。
+// 前の DB に対する閲覧数は resetLocalState で instance ごとに捨てる
+func purgeAllCachesFromRedis() error {
+	estateDetailCache.Purge()
+	estateLocalIDsCache.Purge()
+	chairLocalIDsCache.Purge()
+	ctx, cancel := context.WithTimeout(context.Background(), cacheBackgroundTimeout)
+	defer cancel()
+	// redis 以外の backend の検索の cache
+	if err := searchIDsCache.PurgeAll(ctx); err != nil {
+		return handlePurgeError(err)
+	}
+	return handlePurgeError(deleteKeysByPrefix(ctx, cacheKeyPrefixes...))
+}
 
-	var ids []int64
-	err := db.SelectContext(ctx, &ids, searchQuery+searchCondition+order, params...)
+func handlePurgeError(err error) error {
 	if err != nil {
-		return nil, err
+		// redis が戻ったときに古い cache を使わないように覚えておく
+		setCachePurgePending()
+		if isCacheConnectionError(err) {
+			markCacheUnhealthy(err)
+		}
+	}
+	return err
+}
+
+// キャッシュに埋める用
+func searchEstateIDsFromMysql(ctx context.Context, q EstateSearchQuery) ([]int64, error) {
+	f, errStatusCode := makeEstateConditions(q)
+	if errStatusCode != 0 {
+		return nil, errors.New("failed")
 	}
-	return ids, nil
+	where, params := f.Where()
+	return selectIDs(ctx, "estate", where, params, estateOrder)
 }
 
 func searchEstatesFromIDs(ctx context.Context, ids []int64) ([]Estate, error) {
-	var estates []Estate
-	arg := map[string]interface{}{
-		"ids": ids,
+	// 最後のページより後ろなど。IN () は書けないので聞かずに返す
+	if len(ids) == 0 {
+		return []Estate{}, nil
+	}
+	if cacheAvailable() {
+		return getEstatesFromRowCache(ctx, ids)
 	}
-	// estate.popularity の index は必要そう
-	query, args, _ := sqlx.Named(`SELECT * FROM estate WHERE id IN (:ids) ORDER BY popularity DESC, id ASC`, arg)
-	query, args, _ = sqlx.In(query, args...)
-	query = db.Rebind(query)
-	err := db.SelectContext(ctx, &estates, query, args...)
-	return estates, err
+	return selectEstatesFromIDs(ctx, ids)
 }
 
-func searchEstatesWithCache(ctx context.Context, doorHeightRangeID string, doorWidthRangeID string, rentRangeID string, features string, limit int64, offset int64) ([]Estate, int64, int) {
-	key := genCacheKey(doorHeightRangeID, doorWidthRangeID, rentRangeID, features)
-	ids, count, err := getEstateIDsFromRedis(key, limit, offset)
+func searchEstatesWithCache(ctx context.Context, logger echo.Logger, q EstateSearchQuery, limit int64, offset int64) ([]Estate, int64, int) {
+	if q.Keyword != "" {
+		return searchEstatesWithoutCache(ctx, q, limit, offset)
+	}
+	// redis が落ちている間は instance の中の cache を使う
+	if !cacheAvailable() {
+		return searchEstatesWithLocalCache(ctx, q, limit, offset)
+	}
+	key, err := estateIDsCacheKey(ctx, q)
+	var ids []int64
+	var count int64
+	if err == nil {
+		ids, count, err = searchIDsCache.Get(ctx, key, limit, offset)
+	}
 	if err == errCacheNotHit {
-		estates, count, errStatusCode := searchEstatesWithoutCache(ctx, doorHeightRangeID, doorWidthRangeID, rentRangeID, features, limit, offset)
-		// 非同期で cache を更新する
-		go func(key string) {
-			ctx := context.TODO()
-			ids, err := searchEstateIDsFromMysql(ctx, doorHeightRangeID, doorWidthRangeID, rentRangeID, features)
-			if err != nil {
-				fmt.Println(err)
-			}
-			putEstateIDsToRedis(key, ids)
-		}(key)
-		return estates, count, errStatusCode
+		estateIDsCacheStats.Miss(1)
+		if _, errStatusCode := makeEstateConditions(q); errStatusCode != 0 {
+			return nil, 0, errStatusCode
+		}
+		all, err := fillIDsCache(logger, key, estateIDsCacheStats, estateIDsCacheTTL, func(ctx context.Context) ([]int64, error) {
+			return searchEstateIDsFromMysql(ctx, q)
+		})
+		if err != nil {
+			return nil, 0, http.StatusInternalServerError
+		}
+		count = int64(len(all))
+		ids = pageIDs(all, limit, offset)
+	} else {
+		if err != nil {
+			estateIDsCacheStats.Error()
+		} else {
+			estateIDsCacheStats.Hit(1)
+		}
+		if isCacheConnectionError(err) {
+			markCacheUnhealthy(err)
+			return searchEstatesWithLocalCache(ctx, q, limit, offset)
+		}
+		if err != nil {
+			return nil, 0, http.StatusInternalServerError
+		}
 	}
+	estates, err := searchEstatesFromIDs(ctx, ids)
 	if err != nil {
 		return nil, 0, http.StatusInternalServerError
 	}
-	estates, err := searchEstatesFromIDs(ctx, ids)
+	return estates, count, 0
+}
+
+// searchEstatesWithLocalCache は redis が使えない間に、ID リストを instance の中の LRU から引く
+func searchEstatesWithLocalCache(ctx context.Context, q EstateSearchQuery, limit int64, offset int64) ([]Estate, int64, int) {
+	if _, errStatusCode := makeEstateConditions(q); errStatusCode != 0 {
+		return nil, 0, errStatusCode
+	}
+	all, err := estateLocalIDsCache.getOrFill(hashCacheKey(genCacheKey(q)), func(ctx context.Context) ([]int64, error) {
+		return searchEstateIDsFromMysql(ctx, q)
+	})
 	if err != nil {
 		return nil, 0, http.StatusInternalServerError
 	}
-	return estates, count, 0
+	estates, err := searchEstatesFromIDs(ctx, pageIDs(all, limit, offset))
+	if err != nil {
+		return nil, 0, http.StatusInternalServerError
+	}
+	return estates, int64(len(all)), 0
 }
 
-func searchEstatesWithoutCache(ctx context.Context, doorHeightRangeID string, doorWidthRangeID string, rentRangeID string, features string, limit int64, offset int64) ([]Estate, int64, int) {
-	conditions, params, errStatusCode := makeEstateConditions(doorHeightRangeID, doorWidthRangeID, rentRangeID, features)
+func searchEstatesWithoutCache(ctx context.Context, q EstateSearchQuery, limit int64, offset int64) ([]Estate, int64, int) {
+	f, errStatusCode := makeEstateConditions(q)
 	if errStatusCode != 0 {
 		return nil, 0, errStatusCode
 	}
 
-	if len(conditions) == 0 {
-		// c.Echo().Logger.Infof("searchEstates search condition not found")
-		return nil, 0, http.StatusBadRequest
+	order := estateOrder
+	var orderParams []interface{}
+	if q.Keyword != "" {
+		keywordIDs, err := fuzzyMatchIDs(ctx, "estate", q.Keyword)
+		if err != nil {
+			return nil, 0, http.StatusInternalServerError
+		}
+		if len(keywordIDs) == 0 {
+			return []Estate{}, 0, 0
+		}
+		f.In(colID, keywordIDs)
+		order = "FIELD(id, ?), " + estateOrder
+		orderParams = []interface{}{keywordIDs}
 	}
+	where, params := f.Where()
 
-	searchQuery := "SELECT * FROM estate WHERE "
-	countQuery := "SELECT COUNT(*) FROM estate WHERE "
-	searchCondition := strings.Join(conditions, " AND ")
-	limitOffset := " ORDER BY popularity DESC, id ASC LIMIT ? OFFSET ?"
-
-	var count int64
-	err := db.GetContext(ctx, &count, countQuery+searchCondition, params...)
+	countKey := genCacheKey(q) + "&keyword=" + url.QueryEscape(q.Keyword)
+	count, err := cachedCount(ctx, "estate", countKey, estateIDsCacheTTL, func() (int64, error) {
+		return countRows(ctx, "estate", where, params)
+	})
 	if err != nil {
 		// c.Logger().Errorf("searchEstates DB execution error : %v", err)
 		return nil, 0, http.StatusInternalServerError
 	}
 
 	estates := []Estate{}
-	params = append(params, limit, offset)
-	err = db.SelectContext(ctx, &estates, searchQuery+searchCondition+limitOffset, params...)
+	if limit > 0 {
+		err = selectRows(ctx, &estates, "estate", where, params, order, orderParams, limit, offset)
+	}
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return estates, 0, 0 // 200
@@ -886,72 +2355,146 @@ func searchEstatesWithoutCache(ctx context.Context, doorHeightRangeID string, do
 	return estates, count, 0
 }
 
-func makeEstateConditions(doorHeightRangeID string, doorWidthRangeID string, rentRangeID string, features string) ([]string, []interface{}, int) {
-	conditions := make([]string, 0)
-	params := make([]interface{}, 0)
+func makeEstateConditions(q EstateSearchQuery) (*sqlFilter, int) {
+	f := newSQLFilter()
 
-	if doorHeightRangeID != "" {
-		doorHeight, err := getRange(estateSearchCondition.DoorHeight, doorHeightRangeID)
+	if q.DoorHeightRangeID != "" {
+		doorHeight, err := getRange(estateSearchCondition.DoorHeight, q.DoorHeightRangeID)
 		if err != nil {
 			// c.Echo().Logger.Infof("doorHeightRangeID invalid, %v : %v", doorHeightRangeId, err)
-			return conditions, params, http.StatusBadRequest
+			return f, http.StatusBadRequest
 		}
+		f.Range(colEstateDoorHeight, doorHeight)
+	}
 
-		if doorHeight.Min != -1 {
-			conditions = append(conditions, "door_height >= ?")
-			params = append(params, doorHeight.Min)
-		}
-		if doorHeight.Max != -1 {
-			conditions = append(conditions, "door_height < ?")
-			params = append(params, doorHeight.Max)
+	if q.DoorWidthRangeID != "" {
+		doorWidth, err := getRange(estateSearchCondition.DoorWidth, q.DoorWidthRangeID)
+		if err != nil {
+			// c.Echo().Logger.Infof("doorWidthRangeID invalid, %v : %v", c.QueryParam("doorWidthRangeId"), err)
+			return f, http.StatusBadRequest
 		}
+		f.Range(colEstateDoorWidth, doorWidth)
 	}
 
-	if doorWidthRangeID != "" {
-		doorWidth, err := getRange(estateSearchCondition.DoorWidth, doorWidthRangeID)
+	if q.RentRangeID != "" {
+		estateRent, err := getRange(estateSearchCondition.Rent, q.RentRangeID)
 		if err != nil {
-			// c.Echo().Logger.Infof("doorWidthRangeID invalid, %v : %v", c.QueryParam("doorWidthRangeId"), err)
-			return conditions, params, http.StatusBadRequest
+			// c.Echo().Logger.Infof("rentRangeID invalid, %v : %v", c.QueryParam("rentRangeId"), err)
+			return f, http.StatusBadRequest
+		}
+		if q.EffectiveRent == "1" {
+			f.Range(colEstateEffectiveRent, estateRent)
+		} else {
+			f.Range(colEstateRent, estateRent)
 		}
+	}
+
+	// 数値の直接指定は rangeId と両方あれば両方で絞る
+	rentColumn := colEstateRent
+	if q.EffectiveRent == "1" {
+		rentColumn = colEstateEffectiveRent
+	}
+	if !f.MinMax(rentColumn, q.RentMin, q.RentMax) ||
+		!f.MinMax(colEstateDoorWidth, q.DoorWidthMin, q.DoorWidthMax) ||
+		!f.MinMax(colEstateDoorHeight, q.DoorHeightMin, q.DoorHeightMax) {
+		return f, http.StatusBadRequest
+	}
 
-		if doorWidth.Min != -1 {
-			conditions = append(conditions, "door_width >= ?")
-			params = append(params, doorWidth.Min)
+	if !f.MinPopularity(q.MinPopularity) {
+		return f, http.StatusBadRequest
+	}
+
+	featuresMatch, ok := normalizeFeaturesMatch(q.FeaturesMatch)
+	if !ok {
+		return f, http.StatusBadRequest
+	}
+	if q.Features != "" {
+		if featuresMatch == FeaturesMatchAny {
+			cond, p := anyFeatureCondition(featureSynonyms.Estate, strings.Split(q.Features, ","))
+			f.Raw(cond, p...)
+		} else {
+			for _, feature := range strings.Split(q.Features, ",") {
+				cond, p := featureCondition(featureSynonyms.Estate, feature)
+				f.Raw(cond, p...)
+			}
 		}
-		if doorWidth.Max != -1 {
-			conditions = append(conditions, "door_width < ?")
-			params = append(params, doorWidth.Max)
+	}
+
+	if q.ExcludeFeatures != "" {
+		for _, feature := range strings.Split(normalizeFeatureList(q.ExcludeFeatures), ",") {
+			cond, p := featureCondition(featureSynonyms.Estate, feature)
+			f.Raw("NOT "+cond, p...)
 		}
 	}
 
-	if rentRangeID != "" {
-		estateRent, err := getRange(estateSearchCondition.Rent, rentRangeID)
+	if q.NewerThan != "" {
+		newerThan, err := time.Parse(time.RFC3339, q.NewerThan)
 		if err != nil {
-			// c.Echo().Logger.Infof("rentRangeID invalid, %v : %v", c.QueryParam("rentRangeId"), err)
-			return conditions, params, http.StatusBadRequest
+			return f, http.StatusBadRequest
 		}
+		f.Gt(colCreatedAt, newerThan)
+	}
+
+	if q.StationName != "" {
+		f.Eq(colEstateNearestStation, q.StationName)
+	}
 
-		if estateRent.Min != -1 {
-			conditions = append(conditions, "rent >= ?")
-			params = append(params, estateRent.Min)
+	if q.MaxWalkMinutes != "" {
+		maxWalkMinutes, err := strconv.Atoi(q.MaxWalkMinutes)
+		if err != nil || maxWalkMinutes < 0 {
+			return f, http.StatusBadRequest
 		}
-		if estateRent.Max != -1 {
-			conditions = append(conditions, "rent < ?")
-			params = append(params, estateRent.Max)
+		f.Lte(colEstateStationWalkMinutes, maxWalkMinutes)
+	}
+
+	if q.Layout != "" {
+		layouts := strings.Split(normalizeFeatureList(q.Layout), ",")
+		for _, l := range layouts {
+			if !isValidEstateLayout(l) {
+				return f, http.StatusBadRequest
+			}
 		}
+		f.In(colEstateLayout, layouts)
+	}
+
+	if f.Empty() && q.Keyword == "" {
+		// c.Echo().Logger.Infof("searchEstates search condition not found")
+		return f, http.StatusBadRequest
 	}
 
-	if features != "" {
-		for _, f := range strings.Split(features, ",") {
-			conditions = append(conditions, "features like concat('%', ?, '%')")
-			params = append(params, f)
+	status := EstateStatusAvailable
+	if q.Status != "" {
+		if !isValidEstateStatus(q.Status) {
+			return f, http.StatusBadRequest
 		}
+		status = q.Status
 	}
-	return conditions, params, 0
+	f.Eq(colEstateStatus, status)
+
+	return f, 0
 }
 
 func searchEstates(c echo.Context) error {
+	return renderEstateSearch(c, newEstateSearchQuery(c))
+}
+
+// searchEstatesForAdmin は社内ツール用に status で絞れる検索
+func searchEstatesForAdmin(c echo.Context) error {
+	return renderEstateSearch(c, newAdminEstateSearchQuery(c))
+}
+
+func renderEstateSearch(c echo.Context, q EstateSearchQuery) error {
 	ctx := c.Request().Context()
+	setSurrogateKeys(c, surrogateKeyEstateSearch)
+
+	if isCountOnly(c) {
+		// limit 0 なら cache があれば LLEN だけ、無ければ COUNT だけ
+		_, count, errStatusCode := searchEstatesWithCache(ctx, c.Logger(), q, 0, 0)
+		if errStatusCode != 0 {
+			return c.NoContent(errStatusCode)
+		}
+		return c.JSON(http.StatusOK, newSearchCountResponse(count))
+	}
 
 	page, err := strconv.Atoi(c.QueryParam("page"))
 	if err != nil {
@@ -964,78 +2507,112 @@ func searchEstates(c echo.Context) error {
 		c.Logger().Infof("Invalid format perPage parameter : %v", err)
 		return c.NoContent(http.StatusBadRequest)
 	}
+	if exceedsMaxPerPage(perPage) {
+		c.Logger().Infof("perPage parameter is too large : %v", perPage)
+		return c.NoContent(http.StatusBadRequest)
+	}
 
-	limit := int64(perPage)
-	offset := int64(page * perPage)
-	estates, count, errStatusCode := searchEstatesWithCache(ctx, c.QueryParam("doorHeightRangeId"), c.QueryParam("doorWidthRangeId"), c.QueryParam("rentRangeId"), c.QueryParam("features"), limit, offset)
+	limit, offset := clampPaging(int64(perPage), int64(page*perPage))
+	estates, count, errStatusCode := searchEstatesWithCache(ctx, c.Logger(), q, limit, offset)
 
 	if errStatusCode != 0 {
 		return c.NoContent(errStatusCode)
 	}
 
+	if q.Features != "" {
+		wanted := expandFeatures(featureSynonyms.Estate, strings.Split(q.Features, ","))
+		for i := range estates {
+			estates[i].MatchedFeatures = matchFeatures(estates[i].Features, wanted)
+		}
+	}
+
 	res := EstateSearchResponse{
 		Estates: estates,
 		Count:   count,
 	}
 
-	return c.JSON(http.StatusOK, res)
+	hideEstateTimestamps(c, res.Estates)
+	setPaginationLinks(c, res.Count, page, perPage)
+	return renderList(c, http.StatusOK, res)
 }
 
-func getLowPricedEstate(c echo.Context) error {
+func searchRecommendedEstateWithChair(c echo.Context) error {
 	ctx := c.Request().Context()
-	estates := make([]Estate, 0, Limit)
-	query := `SELECT * FROM estate ORDER BY rent ASC, id ASC LIMIT ?`
-	err := db.SelectContext(ctx, &estates, query, Limit)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Logger().Infof("Invalid format searchRecommendedEstateWithChair id : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	setSurrogateKeys(c, surrogateKeyEstateSearch, surrogateKeyForChair(int64(id)))
+	chair, err := getChairByID(ctx, int64(id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.Logger().Infof("Requested chair id \"%v\" not found", id)
+			return c.NoContent(http.StatusBadRequest)
+		}
+		c.Logger().Errorf("Database execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var estates []Estate
+	s1, s2 := chairPassingSides(&chair)
+	m1, m2 := s1.Length, s2.Length
+
+	query := `SELECT * FROM estate WHERE status = 'available' AND ((door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?)) ORDER BY ` + estateOrder + ` LIMIT ?`
+	err = db.SelectContext(ctx, &estates, query, m1, m2, m2, m1, Limit)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			c.Logger().Error("getLowPricedEstate not found")
-			return c.JSON(http.StatusOK, EstateListResponse{[]Estate{}})
+			return renderList(c, http.StatusOK, EstateListResponse{[]Estate{}})
 		}
-		c.Logger().Errorf("getLowPricedEstate DB execution error : %v", err)
+		c.Logger().Errorf("Database execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	return c.JSON(http.StatusOK, EstateListResponse{Estates: estates})
+	hideEstateTimestamps(c, estates)
+	return renderList(c, http.StatusOK, EstateListResponse{Estates: estates})
 }
 
-func searchRecommendedEstateWithChair(c echo.Context) error {
+// searchRecommendedChairWithEstate は searchRecommendedEstateWithChair の逆で、物件のドアを通る椅子を返す。
+// 短い方の 2 辺が、ドアの幅と高さの短い方 / 長い方にそれぞれ収まれば通る
+func searchRecommendedChairWithEstate(c echo.Context) error {
 	ctx := c.Request().Context()
-	id, err := strconv.Atoi(c.Param("id"))
+	id, err := strconv.Atoi(c.Param("estateId"))
 	if err != nil {
-		c.Logger().Infof("Invalid format searchRecommendedEstateWithChair id : %v", err)
+		c.Logger().Infof("Invalid format searchRecommendedChairWithEstate id : %v", err)
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	chair := Chair{}
-	query := `SELECT * FROM chair WHERE id = ?`
-	err = db.GetContext(ctx, &chair, query, id)
+	setSurrogateKeys(c, surrogateKeyChairSearch, surrogateKeyForEstate(int64(id)))
+	estate, err := getEstateByID(ctx, int64(id))
+	if err == nil && estate.Status != EstateStatusAvailable {
+		err = sql.ErrNoRows
+	}
 	if err != nil {
 		if err == sql.ErrNoRows {
-			c.Logger().Infof("Requested chair id \"%v\" not found", id)
+			c.Logger().Infof("Requested estate id \"%v\" not found", id)
 			return c.NoContent(http.StatusBadRequest)
 		}
 		c.Logger().Errorf("Database execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	var estates []Estate
-	lengths := []int64{chair.Width, chair.Height, chair.Depth}
-	sort.Slice(lengths, func(i, j int) bool {
-		return lengths[i] < lengths[j]
-	})
-	m1, m2 := lengths[0], lengths[1]
+	doorMin, doorMax := estate.DoorWidth, estate.DoorHeight
+	if doorMin > doorMax {
+		doorMin, doorMax = doorMax, doorMin
+	}
 
-	query = `SELECT * FROM estate WHERE (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) ORDER BY popularity DESC, id ASC LIMIT ?`
-	err = db.SelectContext(ctx, &estates, query, m1, m2, m2, m1, Limit)
+	chairs := []Chair{}
+	query := `SELECT * FROM chair WHERE stock > 0 AND LEAST(width, height, depth) <= ? AND width + height + depth - LEAST(width, height, depth) - GREATEST(width, height, depth) <= ? ORDER BY ` + chairOrder + ` LIMIT ?`
+	err = db.SelectContext(ctx, &chairs, query, doorMin, doorMax, Limit)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return c.JSON(http.StatusOK, EstateListResponse{[]Estate{}})
-		}
 		c.Logger().Errorf("Database execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	return c.JSON(http.StatusOK, EstateListResponse{Estates: estates})
+	setChairEffectivePrices(chairs)
+	hideChairTimestamps(c, chairs)
+	return renderList(c, http.StatusOK, ChairListResponse{Chairs: chairs})
 }
 
 func searchEstateNazotte(c echo.Context) error {
@@ -1047,43 +2624,57 @@ func searchEstateNazotte(c echo.Context) error {
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	if len(coordinates.Coordinates) == 0 {
+	// 重いので同時に処理する数を NazotteConcurrency までにする
+	release, err := acquireNazotte(c)
+	if err != nil {
+		c.Echo().Logger.Infof("search estate nazotte canceled : %v", err)
+		return c.NoContent(http.StatusServiceUnavailable)
+	}
+	defer release()
+
+	// polygon ごとに bounding box の条件を作って OR でつなぐ。
+	// 1 クエリで取るので、polygon が重なっていても物件は重複せず並び順も全体で揃う
+	if len(coordinates.polygons()) > NazotteMaxPolygons {
+		c.Echo().Logger.Infof("too many polygons : %v", len(coordinates.polygons()))
 		return c.NoContent(http.StatusBadRequest)
 	}
+	polygons := geo.MultiPolygon{}
+	boxConditions := []string{}
+	params := []interface{}{}
+	for _, p := range coordinates.polygons() {
+		if len(p.Coordinates) == 0 {
+			return c.NoContent(http.StatusBadRequest)
+		}
+		for _, coordinate := range p.Coordinates {
+			if err := coordinate.validate(); err != nil {
+				c.Echo().Logger.Infof("post search estate nazotte failed : %v", err)
+				return c.NoContent(http.StatusBadRequest)
+			}
+		}
+
+		b := p.getBoundingBox()
+		polygon := p.toPolygon()
+		// polygon を覆う cell_id の範囲で大まかに絞ってから緯度経度で bounding box に絞る
+		cellCond, cellParams := polygonCellCondition(polygon)
+		boxConditions = append(boxConditions, `(`+cellCond+` AND latitude <= ? AND latitude >= ? AND longitude <= ? AND longitude >= ?)`)
+		params = append(params, cellParams...)
+		params = append(params, b.BottomRightCorner.Latitude, b.TopLeftCorner.Latitude, b.BottomRightCorner.Longitude, b.TopLeftCorner.Longitude)
+		polygons = append(polygons, polygon)
+	}
 
-	b := coordinates.getBoundingBox()
 	estatesInBoundingBox := []Estate{}
-	query := `SELECT * FROM estate WHERE latitude <= ? AND latitude >= ? AND longitude <= ? AND longitude >= ? ORDER BY popularity DESC, id ASC`
-	err = db.SelectContext(ctx, &estatesInBoundingBox, query, b.BottomRightCorner.Latitude, b.TopLeftCorner.Latitude, b.BottomRightCorner.Longitude, b.TopLeftCorner.Longitude)
+	query := `SELECT * FROM estate WHERE (` + strings.Join(boxConditions, " OR ") + `) AND status = 'available' ORDER BY ` + estateOrder
+	err = db.SelectContext(ctx, &estatesInBoundingBox, query, params...)
 	if err == sql.ErrNoRows {
 		c.Echo().Logger.Infof("select * from estate where latitude ...", err)
-		return c.JSON(http.StatusOK, EstateSearchResponse{Count: 0, Estates: []Estate{}})
+		return renderList(c, http.StatusOK, EstateSearchResponse{Count: 0, Estates: []Estate{}})
 	} else if err != nil {
 		c.Echo().Logger.Errorf("database execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	estatesInPolygon := []Estate{}
-	for _, estate := range estatesInBoundingBox {
-		validatedEstate := Estate{}
-
-		point := fmt.Sprintf("'POINT(%f %f)'", estate.Latitude, estate.Longitude)
-		query := fmt.Sprintf(`SELECT * FROM estate WHERE id = ? AND ST_Contains(ST_PolygonFromText(%s), ST_GeomFromText(%s))`, coordinates.coordinatesToText(), point)
-		err = db.GetContext(ctx, &validatedEstate, query, estate.ID)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				continue
-			} else {
-				c.Echo().Logger.Errorf("db access is failed on executing validate if estate is in polygon : %v", err)
-				return c.NoContent(http.StatusInternalServerError)
-			}
-		} else {
-			estatesInPolygon = append(estatesInPolygon, validatedEstate)
-		}
-		if len(estatesInPolygon) == NazotteLimit {
-			break
-		}
-	}
+	// polygon に入っているかは MySQL に聞かずに Go 側で判定する
+	estatesInPolygon, total := filterEstatesInPolygon(polygons, estatesInBoundingBox, NazotteLimit)
 
 	var re EstateSearchResponse
 	re.Estates = []Estate{}
@@ -1094,7 +2685,13 @@ func searchEstateNazotte(c echo.Context) error {
 	}
 	re.Count = int64(len(re.Estates))
 
-	return c.JSON(http.StatusOK, re)
+	// withTotal=1 なら返すのは NazotteLimit 件のままで、Count には polygon 内の総数を入れる
+	if c.QueryParam("withTotal") == "1" {
+		re.Count = total
+	}
+
+	hideEstateTimestamps(c, re.Estates)
+	return renderList(c, http.StatusOK, re)
 }
 
 func postEstateRequestDocument(c echo.Context) error {
@@ -1117,9 +2714,10 @@ func postEstateRequestDocument(c echo.Context) error {
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	estate := Estate{}
-	query := `SELECT * FROM estate WHERE id = ?`
-	err = db.GetContext(ctx, &estate, query, id)
+	estate, err := getEstateByID(ctx, int64(id))
+	if err == nil && estate.Status != "available" {
+		err = sql.ErrNoRows
+	}
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return c.NoContent(http.StatusNotFound)
@@ -1132,7 +2730,12 @@ func postEstateRequestDocument(c echo.Context) error {
 }
 
 func getEstateSearchCondition(c echo.Context) error {
-	return c.JSON(http.StatusOK, estateSearchCondition)
+	locale := negotiateLocale(c, func(l string) bool {
+		_, ok := localizedEstateSearchConditions[l]
+		return ok
+	})
+	setLocaleHeaders(c, locale)
+	return c.JSONBlob(http.StatusOK, localizedEstateSearchConditionsJSON[locale])
 }
 
 func (cs Coordinates) getBoundingBox() BoundingBox {
@@ -1162,11 +2765,3 @@ func (cs Coordinates) getBoundingBox() BoundingBox {
 	}
 	return boundingBox
 }
-
-func (cs Coordinates) coordinatesToText() string {
-	points := make([]string, 0, len(cs.Coordinates))
-	for _, c := range cs.Coordinates {
-		points = append(points, fmt.Sprintf("%f %f", c.Latitude, c.Longitude))
-	}
-	return fmt.Sprintf("'POLYGON((%s))'", strings.Join(points, ","))
-}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cache に無いときの fill で、間取りの IN (?) が展開されずに slice のまま driver に渡っていた
+func TestSearchEstateIDsFromMysqlLayout(t *testing.T) {
+	var gotQuery string
+	var gotArgs []driver.Value
+	useFakeDB(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		gotQuery, gotArgs = query, args
+		return []string{"id"}, [][]driver.Value{{int64(3)}, {int64(1)}}, nil
+	})
+
+	ids, err := searchEstateIDsFromMysql(context.Background(), EstateSearchQuery{Layout: "2LDK,1LDK"})
+	if err != nil {
+		t.Fatalf("searchEstateIDsFromMysql: %v", err)
+	}
+	if want := []int64{3, 1}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("ids = %v, want %v", ids, want)
+	}
+	if !strings.Contains(gotQuery, "IN (?, ?)") {
+		t.Errorf("layout filter is not expanded: %s", gotQuery)
+	}
+	if want := []driver.Value{"1LDK", "2LDK"}; len(gotArgs) < 2 || !reflect.DeepEqual(gotArgs[:2], want) {
+		t.Errorf("args = %#v, want %#v", gotArgs, want)
+	}
+}
+
+// sqlc の ListEstatesByIDs は id の IN を展開し、並び順は ID リストに合わせる
+func TestSelectEstatesFromIDs(t *testing.T) {
+	var gotQuery string
+	var gotArgs []driver.Value
+	now := time.Now()
+	useFakeDB(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		gotQuery, gotArgs = query, args
+		cols := []string{"id", "name", "description", "thumbnail", "address", "latitude", "longitude", "rent", "door_height", "door_width", "features", "popularity", "neg_popularity", "score", "neg_score", "status", "thumbnail_hash", "cell_id", "nearest_station", "station_walk_minutes", "layout", "management_fee", "deposit", "effective_rent", "created_at", "updated_at"}
+		row := func(id int64, station interface{}) []driver.Value {
+			return []driver.Value{id, "name", "description", "/images/estate/1.png", "address", 35.0, 139.0, int64(50000), int64(100), int64(120), "", int64(10), int64(-10), 1.5, -1.5, "available", nil, int64(7), station, nil, "1LDK", int64(5000), int64(0), int64(55000), now, now}
+		}
+		// MySQL は IN の順には返さない
+		return cols, [][]driver.Value{row(1, "渋谷"), row(3, nil)}, nil
+	})
+
+	estates, err := selectEstatesFromIDs(context.Background(), []int64{3, 2, 1})
+	if err != nil {
+		t.Fatalf("selectEstatesFromIDs: %v", err)
+	}
+	if !strings.Contains(gotQuery, "WHERE id IN (?,?,?)") {
+		t.Errorf("ids are not expanded: %s", gotQuery)
+	}
+	if want := []driver.Value{int64(3), int64(2), int64(1)}; !reflect.DeepEqual(gotArgs, want) {
+		t.Errorf("args = %#v, want %#v", gotArgs, want)
+	}
+	if len(estates) != 2 || estates[0].ID != 3 || estates[1].ID != 1 {
+		t.Fatalf("estates = %+v, want ids [3 1]", estates)
+	}
+	e := estates[1]
+	if e.NearestStation == nil || *e.NearestStation != "渋谷" || e.StationWalkMinutes != nil || e.CellID != 7 || e.EffectiveRent != 55000 || e.CreatedAt == nil {
+		t.Errorf("estate is not converted: %+v", e)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// 一覧のレスポンスは encoding/json の reflection が profile で重いので、手書きの marshaler で組み立てる。
+// 出力は encoding/json と同じになるようにしている (Chair / Estate にフィールドを足したらここも直す)
+
+// marshalListResponse は chair / estate の一覧のレスポンスを JSON にする。対応していない型なら false
+func marshalListResponse(v interface{}) ([]byte, bool) {
+	b := make([]byte, 0, 4096)
+	switch r := v.(type) {
+	case ChairSearchResponse:
+		b = append(b, `{"count":`...)
+		b = strconv.AppendInt(b, r.Count, 10)
+		b = append(b, `,"chairs":`...)
+		b = appendChairsJSON(b, r.Chairs)
+	case ChairListResponse:
+		b = append(b, `{"chairs":`...)
+		b = appendChairsJSON(b, r.Chairs)
+	case EstateSearchResponse:
+		b = append(b, `{"count":`...)
+		b = strconv.AppendInt(b, r.Count, 10)
+		b = append(b, `,"estates":`...)
+		b = appendEstatesJSON(b, r.Estates)
+	case EstateListResponse:
+		b = append(b, `{"estates":`...)
+		b = appendEstatesJSON(b, r.Estates)
+	default:
+		return nil, false
+	}
+	b = append(b, '}')
+	return b, true
+}
+
+func appendChairsJSON(b []byte, chairs []Chair) []byte {
+	if chairs == nil {
+		return append(b, "null"...)
+	}
+	b = append(b, '[')
+	for i := range chairs {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendChairJSON(b, &chairs[i])
+	}
+	return append(b, ']')
+}
+
+func appendChairJSON(b []byte, ch *Chair) []byte {
+	b = append(b, `{"id":`...)
+	b = strconv.AppendInt(b, ch.ID, 10)
+	b = append(b, `,"name":`...)
+	b = appendJSONString(b, ch.Name)
+	b = append(b, `,"description":`...)
+	b = appendJSONString(b, ch.Description)
+	b = append(b, `,"thumbnail":`...)
+	b = appendJSONString(b, ch.Thumbnail.URL())
+	b = append(b, `,"price":`...)
+	b = strconv.AppendInt(b, ch.Price, 10)
+	b = append(b, `,"height":`...)
+	b = strconv.AppendInt(b, ch.Height, 10)
+	b = append(b, `,"width":`...)
+	b = strconv.AppendInt(b, ch.Width, 10)
+	b = append(b, `,"depth":`...)
+	b = strconv.AppendInt(b, ch.Depth, 10)
+	b = append(b, `,"color":`...)
+	b = appendJSONString(b, ch.Color)
+	b = append(b, `,"features":`...)
+	b = appendJSONString(b, ch.Features)
+	b = append(b, `,"kind":`...)
+	b = appendJSONString(b, ch.Kind)
+	if ch.Material != "" {
+		b = append(b, `,"material":`...)
+		b = appendJSONString(b, ch.Material)
+	}
+	if ch.Weight != nil {
+		b = append(b, `,"weight":`...)
+		b = strconv.AppendInt(b, *ch.Weight, 10)
+	}
+	if ch.SalePrice != nil {
+		b = append(b, `,"salePrice":`...)
+		b = strconv.AppendInt(b, *ch.SalePrice, 10)
+	}
+	if ch.SaleUntil != nil {
+		b = append(b, `,"saleUntil":`...)
+		b = appendJSONTime(b, *ch.SaleUntil)
+	}
+	b = append(b, `,"effectivePrice":`...)
+	b = strconv.AppendInt(b, ch.EffectivePrice, 10)
+	if len(ch.MatchedFeatures) > 0 {
+		b = append(b, `,"matchedFeatures":`...)
+		b = appendJSONStrings(b, ch.MatchedFeatures)
+	}
+	if len(ch.Assets) > 0 {
+		b = append(b, `,"assets":`...)
+		b = appendJSONStringMap(b, ch.Assets)
+	}
+	if ch.CreatedAt != nil {
+		b = append(b, `,"createdAt":`...)
+		b = appendJSONTime(b, *ch.CreatedAt)
+	}
+	if ch.UpdatedAt != nil {
+		b = append(b, `,"updatedAt":`...)
+		b = appendJSONTime(b, *ch.UpdatedAt)
+	}
+	return append(b, '}')
+}
+
+func appendEstatesJSON(b []byte, estates []Estate) []byte {
+	if estates == nil {
+		return append(b, "null"...)
+	}
+	b = append(b, '[')
+	for i := range estates {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendEstateJSON(b, &estates[i])
+	}
+	return append(b, ']')
+}
+
+func appendEstateJSON(b []byte, e *Estate) []byte {
+	b = append(b, `{"id":`...)
+	b = strconv.AppendInt(b, e.ID, 10)
+	b = append(b, `,"thumbnail":`...)
+	b = appendJSONString(b, e.Thumbnail.URL())
+	b = append(b, `,"name":`...)
+	b = appendJSONString(b, e.Name)
+	b = append(b, `,"description":`...)
+	b = appendJSONString(b, e.Description)
+	b = append(b, `,"latitude":`...)
+	b = appendJSONFloat(b, e.Latitude)
+	b = append(b, `,"longitude":`...)
+	b = appendJSONFloat(b, e.Longitude)
+	b = append(b, `,"address":`...)
+	b = appendJSONString(b, e.Address)
+	b = append(b, `,"rent":`...)
+	b = strconv.AppendInt(b, e.Rent, 10)
+	b = append(b, `,"doorHeight":`...)
+	b = strconv.AppendInt(b, e.DoorHeight, 10)
+	b = append(b, `,"doorWidth":`...)
+	b = strconv.AppendInt(b, e.DoorWidth, 10)
+	b = append(b, `,"features":`...)
+	b = appendJSONString(b, e.Features)
+	if e.NearestStation != nil {
+		b = append(b, `,"nearestStation":`...)
+		b = appendJSONString(b, *e.NearestStation)
+	}
+	if e.StationWalkMinutes != nil {
+		b = append(b, `,"stationWalkMinutes":`...)
+		b = strconv.AppendInt(b, *e.StationWalkMinutes, 10)
+	}
+	if e.Layout != "" {
+		b = append(b, `,"layout":`...)
+		b = appendJSONString(b, e.Layout)
+	}
+	if e.ManagementFee != 0 {
+		b = append(b, `,"managementFee":`...)
+		b = strconv.AppendInt(b, e.ManagementFee, 10)
+	}
+	if e.Deposit != 0 {
+		b = append(b, `,"deposit":`...)
+		b = strconv.AppendInt(b, e.Deposit, 10)
+	}
+	if e.CommuteMinutes != nil {
+		b = append(b, `,"commuteMinutes":`...)
+		b = strconv.AppendInt(b, *e.CommuteMinutes, 10)
+	}
+	if len(e.MatchedFeatures) > 0 {
+		b = append(b, `,"matchedFeatures":`...)
+		b = appendJSONStrings(b, e.MatchedFeatures)
+	}
+	if len(e.Images) > 0 {
+		b = append(b, `,"images":`...)
+		b = appendJSONStrings(b, e.Images)
+	}
+	if e.CreatedAt != nil {
+		b = append(b, `,"createdAt":`...)
+		b = appendJSONTime(b, *e.CreatedAt)
+	}
+	if e.UpdatedAt != nil {
+		b = append(b, `,"updatedAt":`...)
+		b = appendJSONTime(b, *e.UpdatedAt)
+	}
+	return append(b, '}')
+}
+
+func appendJSONStrings(b []byte, ss []string) []byte {
+	b = append(b, '[')
+	for i, s := range ss {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendJSONString(b, s)
+	}
+	return append(b, ']')
+}
+
+// appendJSONStringMap は encoding/json と同じく key の順で書く
+func appendJSONStringMap(b []byte, m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b = append(b, '{')
+	for i, k := range keys {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendJSONString(b, k)
+		b = append(b, ':')
+		b = appendJSONString(b, m[k])
+	}
+	return append(b, '}')
+}
+
+// appendJSONTime は time.Time.MarshalJSON と同じ形式で書く
+func appendJSONTime(b []byte, t time.Time) []byte {
+	b = append(b, '"')
+	b = t.AppendFormat(b, time.RFC3339Nano)
+	return append(b, '"')
+}
+
+// appendJSONFloat は encoding/json と同じく、桁が大きすぎたり小さすぎたりするときだけ指数表記にする
+func appendJSONFloat(b []byte, f float64) []byte {
+	abs := math.Abs(f)
+	format := byte('f')
+	if abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	b = strconv.AppendFloat(b, f, format, -1, 64)
+	if format == 'e' {
+		// e-09 を e-9 にする
+		n := len(b)
+		if n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	return b
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString は encoding/json と同じく HTML の特殊文字や U+2028/U+2029 もエスケープする
+func appendJSONString(b []byte, s string) []byte {
+	b = append(b, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			b = append(b, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				b = append(b, '\\', c)
+			case '\n':
+				b = append(b, '\\', 'n')
+			case '\r':
+				b = append(b, '\\', 'r')
+			case '\t':
+				b = append(b, '\\', 't')
+			default:
+				b = append(b, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, s[start:i]...)
+			b = append(b, `\ufffd`...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			b = append(b, s[start:i]...)
+			b = append(b, '\\', 'u', '2', '0', '2', hexDigits[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	b = append(b, s[start:]...)
+	return append(b, '"')
+}
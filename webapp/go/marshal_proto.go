@@ -0,0 +1,210 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 社内ツール向けに、検索のレスポンスを protobuf (proto/isuumo.proto) でも返す。
+// protobuf のライブラリは入れずに wire format を手書きしている (Chair / Estate にフィールドを足したらここと .proto も直す)
+
+const protobufMediaType = "application/protobuf"
+
+// wantsProtobuf は Accept が protobuf かどうか
+func wantsProtobuf(c echo.Context) bool {
+	for _, t := range strings.Split(c.Request().Header.Get(echo.HeaderAccept), ",") {
+		switch strings.TrimSpace(strings.SplitN(t, ";", 2)[0]) {
+		case protobufMediaType, "application/x-protobuf":
+			return true
+		}
+	}
+	return false
+}
+
+// wire type
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+)
+
+// marshalProtoResponse は検索のレスポンスを protobuf にする。対応していない型なら false
+func marshalProtoResponse(v interface{}) ([]byte, bool) {
+	b := make([]byte, 0, 4096)
+	switch r := v.(type) {
+	case ChairSearchResponse:
+		b = appendProtoInt(b, 1, r.Count)
+		for i := range r.Chairs {
+			b = appendProtoMessage(b, 2, appendChairProto(nil, &r.Chairs[i]))
+		}
+	case EstateSearchResponse:
+		b = appendProtoInt(b, 1, r.Count)
+		for i := range r.Estates {
+			b = appendProtoMessage(b, 2, appendEstateProto(nil, &r.Estates[i]))
+		}
+	default:
+		return nil, false
+	}
+	return b, true
+}
+
+func appendChairProto(b []byte, ch *Chair) []byte {
+	b = appendProtoInt(b, 1, ch.ID)
+	b = appendProtoString(b, 2, ch.Name)
+	b = appendProtoString(b, 3, ch.Description)
+	b = appendProtoString(b, 4, ch.Thumbnail.URL())
+	b = appendProtoInt(b, 5, ch.Price)
+	b = appendProtoInt(b, 6, ch.Height)
+	b = appendProtoInt(b, 7, ch.Width)
+	b = appendProtoInt(b, 8, ch.Depth)
+	b = appendProtoString(b, 9, ch.Color)
+	b = appendProtoString(b, 10, ch.Features)
+	b = appendProtoString(b, 11, ch.Kind)
+	if ch.SalePrice != nil {
+		b = appendProtoOptionalInt(b, 12, *ch.SalePrice)
+	}
+	if ch.SaleUntil != nil {
+		b = appendProtoTimestamp(b, 13, *ch.SaleUntil)
+	}
+	b = appendProtoInt(b, 14, ch.EffectivePrice)
+	for _, f := range ch.MatchedFeatures {
+		b = appendProtoOptionalString(b, 15, f)
+	}
+	// map<string, string> は key = 1, value = 2 の entry の repeated
+	for k, v := range ch.Assets {
+		var entry []byte
+		entry = appendProtoOptionalString(entry, 1, k)
+		entry = appendProtoOptionalString(entry, 2, v)
+		b = appendProtoMessage(b, 18, entry)
+	}
+	if ch.Material != "" {
+		b = appendProtoOptionalString(b, 19, ch.Material)
+	}
+	if ch.Weight != nil {
+		b = appendProtoOptionalInt(b, 20, *ch.Weight)
+	}
+	if ch.CreatedAt != nil {
+		b = appendProtoTimestamp(b, 16, *ch.CreatedAt)
+	}
+	if ch.UpdatedAt != nil {
+		b = appendProtoTimestamp(b, 17, *ch.UpdatedAt)
+	}
+	return b
+}
+
+func appendEstateProto(b []byte, e *Estate) []byte {
+	b = appendProtoInt(b, 1, e.ID)
+	b = appendProtoString(b, 2, e.Thumbnail.URL())
+	b = appendProtoString(b, 3, e.Name)
+	b = appendProtoString(b, 4, e.Description)
+	b = appendProtoDouble(b, 5, e.Latitude)
+	b = appendProtoDouble(b, 6, e.Longitude)
+	b = appendProtoString(b, 7, e.Address)
+	b = appendProtoInt(b, 8, e.Rent)
+	b = appendProtoInt(b, 9, e.DoorHeight)
+	b = appendProtoInt(b, 10, e.DoorWidth)
+	b = appendProtoString(b, 11, e.Features)
+	if e.NearestStation != nil {
+		b = appendProtoOptionalString(b, 12, *e.NearestStation)
+	}
+	if e.StationWalkMinutes != nil {
+		b = appendProtoOptionalInt(b, 13, *e.StationWalkMinutes)
+	}
+	if e.CommuteMinutes != nil {
+		b = appendProtoOptionalInt(b, 14, *e.CommuteMinutes)
+	}
+	for _, f := range e.MatchedFeatures {
+		b = appendProtoOptionalString(b, 15, f)
+	}
+	for _, url := range e.Images {
+		b = appendProtoOptionalString(b, 18, url)
+	}
+	if e.Layout != "" {
+		b = appendProtoOptionalString(b, 19, e.Layout)
+	}
+	if e.ManagementFee != 0 {
+		b = appendProtoOptionalInt(b, 20, e.ManagementFee)
+	}
+	if e.Deposit != 0 {
+		b = appendProtoOptionalInt(b, 21, e.Deposit)
+	}
+	if e.CreatedAt != nil {
+		b = appendProtoTimestamp(b, 16, *e.CreatedAt)
+	}
+	if e.UpdatedAt != nil {
+		b = appendProtoTimestamp(b, 17, *e.UpdatedAt)
+	}
+	return b
+}
+
+// appendProtoVarint は 7 bit ずつ下から書く
+func appendProtoVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendProtoTag(b []byte, field int, wireType int) []byte {
+	return appendProtoVarint(b, uint64(field<<3|wireType))
+}
+
+// appendProtoInt は proto3 の int64。0 は書かない
+func appendProtoInt(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	return appendProtoOptionalInt(b, field, v)
+}
+
+// appendProtoOptionalInt は optional の int64。0 でも書く
+func appendProtoOptionalInt(b []byte, field int, v int64) []byte {
+	b = appendProtoTag(b, field, protoVarint)
+	// 負の値も int64 は 10 byte の varint にする
+	return appendProtoVarint(b, uint64(v))
+}
+
+// appendProtoString は proto3 の string。空文字は書かない
+func appendProtoString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return appendProtoOptionalString(b, field, s)
+}
+
+// appendProtoOptionalString は optional と repeated の string。空文字でも書く
+func appendProtoOptionalString(b []byte, field int, s string) []byte {
+	b = appendProtoTag(b, field, protoBytes)
+	b = appendProtoVarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendProtoDouble(b []byte, field int, f float64) []byte {
+	if f == 0 && !math.Signbit(f) {
+		return b
+	}
+	b = appendProtoTag(b, field, protoFixed64)
+	bits := math.Float64bits(f)
+	for i := 0; i < 8; i++ {
+		b = append(b, byte(bits>>(8*i)))
+	}
+	return b
+}
+
+func appendProtoMessage(b []byte, field int, msg []byte) []byte {
+	b = appendProtoTag(b, field, protoBytes)
+	b = appendProtoVarint(b, uint64(len(msg)))
+	return append(b, msg...)
+}
+
+// appendProtoTimestamp は google.protobuf.Timestamp (seconds = 1, nanos = 2)
+func appendProtoTimestamp(b []byte, field int, t time.Time) []byte {
+	var msg []byte
+	msg = appendProtoInt(msg, 1, t.Unix())
+	msg = appendProtoInt(msg, 2, int64(t.Nanosecond()))
+	return appendProtoMessage(b, field, msg)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// protoField は test で wire format を読み戻すときの 1 フィールド
+type protoField struct {
+	num, wireType int
+	varint        uint64
+	bytes         []byte
+}
+
+// decodeProto は marshal_proto.go とは別に、仕様どおりに wire format を読む
+func decodeProto(t *testing.T, b []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(b) > 0 {
+		tag, n := decodeProtoVarint(t, b)
+		b = b[n:]
+		f := protoField{num: int(tag >> 3), wireType: int(tag & 7)}
+		switch f.wireType {
+		case protoVarint:
+			f.varint, n = decodeProtoVarint(t, b)
+			b = b[n:]
+		case protoFixed64:
+			if len(b) < 8 {
+				t.Fatalf("truncated fixed64")
+			}
+			for i := 7; i >= 0; i-- {
+				f.varint = f.varint<<8 | uint64(b[i])
+			}
+			b = b[8:]
+		case protoBytes:
+			l, n := decodeProtoVarint(t, b)
+			b = b[n:]
+			if uint64(len(b)) < l {
+				t.Fatalf("truncated length-delimited field %d", f.num)
+			}
+			f.bytes, b = b[:l], b[l:]
+		default:
+			t.Fatalf("unexpected wire type %d", f.wireType)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func decodeProtoVarint(t *testing.T, b []byte) (uint64, int) {
+	t.Helper()
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	t.Fatalf("invalid varint % x", b)
+	return 0, 0
+}
+
+func decodeProtoTimestamp(t *testing.T, b []byte) *time.Time {
+	var sec, nsec int64
+	for _, f := range decodeProto(t, b) {
+		switch f.num {
+		case 1:
+			sec = int64(f.varint)
+		case 2:
+			nsec = int64(f.varint)
+		}
+	}
+	ts := time.Unix(sec, nsec).UTC()
+	return &ts
+}
+
+func int64Ptr(v int64) *int64 { return &v }
+
+func decodeChairProto(t *testing.T, b []byte) Chair {
+	var ch Chair
+	for _, f := range decodeProto(t, b) {
+		v := int64(f.varint)
+		s := string(f.bytes)
+		switch f.num {
+		case 1:
+			ch.ID = v
+		case 2:
+			ch.Name = s
+		case 3:
+			ch.Description = s
+		case 4:
+			ch.Thumbnail = ThumbnailURL(s)
+		case 5:
+			ch.Price = v
+		case 6:
+			ch.Height = v
+		case 7:
+			ch.Width = v
+		case 8:
+			ch.Depth = v
+		case 9:
+			ch.Color = s
+		case 10:
+			ch.Features = s
+		case 11:
+			ch.Kind = s
+		case 12:
+			ch.SalePrice = int64Ptr(v)
+		case 13:
+			ch.SaleUntil = decodeProtoTimestamp(t, f.bytes)
+		case 14:
+			ch.EffectivePrice = v
+		case 15:
+			ch.MatchedFeatures = append(ch.MatchedFeatures, s)
+		case 16:
+			ch.CreatedAt = decodeProtoTimestamp(t, f.bytes)
+		case 17:
+			ch.UpdatedAt = decodeProtoTimestamp(t, f.bytes)
+		case 18:
+			if ch.Assets == nil {
+				ch.Assets = map[string]string{}
+			}
+			var k, val string
+			for _, e := range decodeProto(t, f.bytes) {
+				if e.num == 1 {
+					k = string(e.bytes)
+				} else {
+					val = string(e.bytes)
+				}
+			}
+			ch.Assets[k] = val
+		case 19:
+			ch.Material = s
+		case 20:
+			ch.Weight = int64Ptr(v)
+		default:
+			t.Errorf("unknown chair field %d", f.num)
+		}
+	}
+	return ch
+}
+
+func decodeEstateProto(t *testing.T, b []byte) Estate {
+	var e Estate
+	for _, f := range decodeProto(t, b) {
+		v := int64(f.varint)
+		s := string(f.bytes)
+		switch f.num {
+		case 1:
+			e.ID = v
+		case 2:
+			e.Thumbnail = ThumbnailURL(s)
+		case 3:
+			e.Name = s
+		case 4:
+			e.Description = s
+		case 5:
+			e.Latitude = math.Float64frombits(f.varint)
+		case 6:
+			e.Longitude = math.Float64frombits(f.varint)
+		case 7:
+			e.Address = s
+		case 8:
+			e.Rent = v
+		case 9:
+			e.DoorHeight = v
+		case 10:
+			e.DoorWidth = v
+		case 11:
+			e.Features = s
+		case 12:
+			e.NearestStation = &s
+		case 13:
+			e.StationWalkMinutes = int64Ptr(v)
+		case 14:
+			e.CommuteMinutes = int64Ptr(v)
+		case 15:
+			e.MatchedFeatures = append(e.MatchedFeatures, s)
+		case 16:
+			e.CreatedAt = decodeProtoTimestamp(t, f.bytes)
+		case 17:
+			e.UpdatedAt = decodeProtoTimestamp(t, f.bytes)
+		case 18:
+			e.Images = append(e.Images, s)
+		case 19:
+			e.Layout = s
+		case 20:
+			e.ManagementFee = v
+		case 21:
+			e.Deposit = v
+		default:
+			t.Errorf("unknown estate field %d", f.num)
+		}
+	}
+	return e
+}
+
+func TestAppendProtoVarint(t *testing.T) {
+	// int64 は zigzag (sint64) ではないので、負の値は 2 の補数の 10 byte になる
+	tests := []struct {
+		v    int64
+		want []byte
+	}{
+		{1, []byte{0x08, 0x01}},
+		{127, []byte{0x08, 0x7f}},
+		{128, []byte{0x08, 0x80, 0x01}},
+		{300, []byte{0x08, 0xac, 0x02}},
+		{16384, []byte{0x08, 0x80, 0x80, 0x01}},
+		{math.MaxInt64, []byte{0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}},
+		{-1, []byte{0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{math.MinInt64, []byte{0x08, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}},
+	}
+	for _, tt := range tests {
+		if got := appendProtoInt(nil, 1, tt.v); !bytes.Equal(got, tt.want) {
+			t.Errorf("appendProtoInt(%d) = % x, want % x", tt.v, got, tt.want)
+		}
+	}
+	if got := appendProtoInt(nil, 1, 0); len(got) != 0 {
+		t.Errorf("appendProtoInt(0) = % x, want empty", got)
+	}
+	if got := appendProtoOptionalInt(nil, 1, 0); !bytes.Equal(got, []byte{0x08, 0x00}) {
+		t.Errorf("appendProtoOptionalInt(0) = % x", got)
+	}
+	// field 番号が 16 以上だと tag が 2 byte になる
+	if got := appendProtoOptionalString(nil, 16, "ab"); !bytes.Equal(got, []byte{0x82, 0x01, 0x02, 'a', 'b'}) {
+		t.Errorf("appendProtoOptionalString(16) = % x", got)
+	}
+}
+
+func TestMarshalProtoRoundTrip(t *testing.T) {
+	at := time.Date(2020, 9, 11, 10, 0, 0, 123456789, time.UTC)
+	before1970 := time.Date(1960, 1, 1, 0, 0, 0, 0, time.UTC)
+	long := string(bytes.Repeat([]byte("椅"), 100))
+	chairs := []Chair{
+		{
+			ID: 1, Name: long, Description: "説明\x00", Thumbnail: "/images/chair/1.png",
+			Price: 12000, Height: 80, Width: 50, Depth: 40, Color: "黒", Features: "折りたたみ可", Kind: "ゲーミングチェア",
+			Material: "木", Weight: int64Ptr(0), SalePrice: int64Ptr(-1), SaleUntil: &before1970, EffectivePrice: math.MaxInt64,
+			MatchedFeatures: []string{"折りたたみ可", ""}, Assets: map[string]string{"model": "/m.glb", "": ""},
+			CreatedAt: &at, UpdatedAt: &at,
+		},
+		{ID: math.MinInt64},
+	}
+	b, ok := marshalProtoResponse(ChairSearchResponse{Count: 300, Chairs: chairs})
+	if !ok {
+		t.Fatal("ChairSearchResponse is not supported")
+	}
+	var gotChairs []Chair
+	for _, f := range decodeProto(t, b) {
+		switch f.num {
+		case 1:
+			if f.varint != 300 {
+				t.Errorf("count = %d, want 300", f.varint)
+			}
+		case 2:
+			gotChairs = append(gotChairs, decodeChairProto(t, f.bytes))
+		}
+	}
+	if !reflect.DeepEqual(gotChairs, chairs) {
+		t.Errorf("chairs round trip:\n got %+v\nwant %+v", gotChairs, chairs)
+	}
+
+	station := ""
+	estates := []Estate{
+		{
+			ID: 1, Thumbnail: "/images/estate/1.png", Name: "物件", Description: long,
+			Latitude: 35.681236, Longitude: -139.767125, Address: "東京都", Rent: 100000, DoorHeight: 200, DoorWidth: 90,
+			Features: "駅近", NearestStation: &station, StationWalkMinutes: int64Ptr(0), CommuteMinutes: int64Ptr(45),
+			Layout: "1LDK", ManagementFee: 5000, Deposit: -1,
+			MatchedFeatures: []string{"駅近"}, Images: []string{"/1.png", "/2.png"}, CreatedAt: &at, UpdatedAt: &before1970,
+		},
+		// -0 は proto3 の既定値ではないので書く
+		{ID: 2, Latitude: math.Copysign(0, -1), Longitude: math.SmallestNonzeroFloat64},
+	}
+	b, ok = marshalProtoResponse(EstateSearchResponse{Estates: estates})
+	if !ok {
+		t.Fatal("EstateSearchResponse is not supported")
+	}
+	var gotEstates []Estate
+	for _, f := range decodeProto(t, b) {
+		switch f.num {
+		case 1:
+			t.Errorf("count 0 is written")
+		case 2:
+			gotEstates = append(gotEstates, decodeEstateProto(t, f.bytes))
+		}
+	}
+	if !reflect.DeepEqual(gotEstates, estates) {
+		t.Errorf("estates round trip:\n got %+v\nwant %+v", gotEstates, estates)
+	}
+	if !math.Signbit(gotEstates[1].Latitude) {
+		t.Error("-0 latitude is lost")
+	}
+
+	if _, ok := marshalProtoResponse(ChairListResponse{}); ok {
+		t.Error("ChairListResponse is supported")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestMarshalListResponse(t *testing.T) {
+	weight := int64(12)
+	salePrice := int64(9800)
+	zero := int64(0)
+	station := "東京"
+	empty := ""
+	at := time.Date(2020, 9, 11, 10, 0, 0, 123456789, time.FixedZone("JST", 9*60*60))
+	utc := time.Date(2020, 9, 11, 1, 0, 0, 0, time.UTC)
+
+	fullChair := Chair{
+		ID: 1, Name: `<椅子> "A" & \B`, Description: "tab\tcr\rnl\n\x00\x1f\x7f", Thumbnail: "/images/chair/1.png",
+		Price: 12000, Height: 80, Width: 50, Depth: 40, Color: "黒", Features: "折りたたみ可,肘掛け", Kind: "ゲーミングチェア",
+		Material: "木", Weight: &weight, SalePrice: &salePrice, SaleUntil: &at, EffectivePrice: 9800,
+		MatchedFeatures: []string{"折りたたみ可", "<b>"}, Assets: map[string]string{"model": "/m.glb", "dimension": "/d.png", "": "&"},
+		CreatedAt: &utc, UpdatedAt: &at,
+	}
+	fullEstate := Estate{
+		ID: 1, Thumbnail: "https://cdn.example.com/1.png", Name: "物件\u2028\u2029", Description: "😀 emoji",
+		Latitude: 35.681236, Longitude: 139.767125, Address: "東京都", Rent: 100000, DoorHeight: 200, DoorWidth: 90,
+		Features: "駅近", NearestStation: &station, StationWalkMinutes: &zero, Layout: "1LDK",
+		ManagementFee: 5000, Deposit: 100000, CommuteMinutes: &zero,
+		MatchedFeatures: []string{"駅近"}, Images: []string{"/1.png", "/2.png"}, CreatedAt: &at, UpdatedAt: &utc,
+	}
+
+	tests := []struct {
+		name string
+		v    interface{}
+	}{
+		{"chair search", ChairSearchResponse{Count: 2, Chairs: []Chair{fullChair, {ID: 2}}}},
+		// 空のスライスや map は omitempty で消え、ポインタの 0 や空文字列は残る
+		{"chair zero values", ChairListResponse{Chairs: []Chair{{MatchedFeatures: []string{}, Assets: map[string]string{}, Weight: &zero, SalePrice: &zero}}}},
+		{"chair empty list", ChairSearchResponse{Chairs: []Chair{}}},
+		{"chair nil list", ChairListResponse{}},
+		{"estate search", EstateSearchResponse{Count: 1, Estates: []Estate{fullEstate}}},
+		{"estate zero values", EstateListResponse{Estates: []Estate{{NearestStation: &empty, MatchedFeatures: []string{}, Images: []string{}}}}},
+		{"estate floats", EstateListResponse{Estates: []Estate{{Latitude: 1e-7, Longitude: -1e21}, {Latitude: -0.000001, Longitude: 123456789012345678901}, {Latitude: 35, Longitude: -180}}}},
+		{"estate empty list", EstateSearchResponse{Estates: []Estate{}}},
+		{"estate nil list", EstateListResponse{}},
+	}
+	for _, tt := range tests {
+		got, ok := marshalListResponse(tt.v)
+		if !ok {
+			t.Errorf("%s: marshalListResponse(%T) is not supported", tt.name, tt.v)
+			continue
+		}
+		want, err := json.Marshal(tt.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, want)
+		}
+	}
+
+	if _, ok := marshalListResponse(SearchCountResponse{}); ok {
+		t.Error("marshalListResponse(SearchCountResponse) is supported")
+	}
+}
+
+// 不正な UTF-8 は U+FFFD にする。encoding/json はバージョンによってエスケープしたりしなかったりするので、値で比べる
+func TestAppendJSONStringInvalidUTF8(t *testing.T) {
+	for _, s := range []string{"\xff", "a\xc3(b", "\xed\xa0\x80", "ok\xe3\x81"} {
+		got := appendJSONString(nil, s)
+		var v, w string
+		if err := json.Unmarshal(got, &v); err != nil {
+			t.Errorf("appendJSONString(%q) = %s: %v", s, got, err)
+			continue
+		}
+		want, _ := json.Marshal(s)
+		if err := json.Unmarshal(want, &w); err != nil {
+			t.Fatal(err)
+		}
+		if v != w || !utf8.Valid(got) {
+			t.Errorf("appendJSONString(%q) = %s, want %s", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// memcachedIDsCache は検索の cache を memcached に持つ (IDS_CACHE_BACKEND=memcached)。
+// 接続先は MEMCACHED_ADDRS (カンマ区切り、key の hash で振り分ける)。
+// memcached では key を列挙できないので、Purge は版を上げるだけで古い版の key は TTL で消える
+type memcachedIDsCache struct {
+	client *memcache.Client
+}
+
+func newMemcachedIDsCache(addrs string) *memcachedIDsCache {
+	servers := []string{}
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			servers = append(servers, addr)
+		}
+	}
+	return &memcachedIDsCache{client: memcache.New(servers...)}
+}
+
+func (m *memcachedIDsCache) Ping(ctx context.Context) error {
+	return m.client.Ping()
+}
+
+func (m *memcachedIDsCache) Version(ctx context.Context, prefix string) (int64, error) {
+	item, err := m.client.Get(idsCacheVersionKey(prefix))
+	if err == memcache.ErrCacheMiss {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(item.Value)), 10, 64)
+}
+
+func (m *memcachedIDsCache) Key(ctx context.Context, prefix string, normalized string) (string, error) {
+	return m.HashedKey(ctx, prefix, hashCacheKey(normalized))
+}
+
+func (m *memcachedIDsCache) HashedKey(ctx context.Context, prefix string, hash string) (string, error) {
+	version, err := m.Version(ctx, prefix)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:v%d:%s", prefix, version, hash), nil
+}
+
+// Get は list 全体を 1 つの item に入れているので、取ってから切り出す
+func (m *memcachedIDsCache) Get(ctx context.Context, key string, limit int64, offset int64) ([]int64, int64, error) {
+	item, err := m.client.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return nil, 0, errCacheNotHit
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	ids, err := decodeIDs(item.Value)
+	if err != nil || len(ids) == 0 {
+		return nil, 0, errCacheNotHit
+	}
+	return pageIDs(ids, limit, offset), int64(len(ids)), nil
+}
+
+// PutList は item を丸ごと置き換えるので、同時に作り直しても混ざらない
+func (m *memcachedIDsCache) PutList(ctx context.Context, key string, ids []int64, ttl time.Duration) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return m.client.Set(&memcache.Item{Key: key, Value: encodeIDs(ids), Expiration: memcachedExpiration(ttl)})
+}
+
+func (m *memcachedIDsCache) GetValues(ctx context.Context, keys []string) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	if len(keys) == 0 {
+		return values, nil
+	}
+	items, err := m.client.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		if item, ok := items[key]; ok {
+			values[i] = item.Value
+		}
+	}
+	return values, nil
+}
+
+func (m *memcachedIDsCache) PutValues(ctx context.Context, values map[string][]byte, ttl time.Duration) error {
+	for key, value := range values {
+		if err := m.client.Set(&memcache.Item{Key: key, Value: value, Expiration: memcachedExpiration(ttl)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Purge は版を上げる。版の item が無ければ 1 で作る (同時に作られたら incr し直す)
+func (m *memcachedIDsCache) Purge(ctx context.Context, prefix string) error {
+	key := idsCacheVersionKey(prefix)
+	_, err := m.client.Increment(key, 1)
+	if err != memcache.ErrCacheMiss {
+		return err
+	}
+	err = m.client.Add(&memcache.Item{Key: key, Value: []byte("1")})
+	if err == memcache.ErrNotStored {
+		_, err = m.client.Increment(key, 1)
+	}
+	return err
+}
+
+// PurgeAll は memcached には検索の cache しか入れていないので全部消す
+func (m *memcachedIDsCache) PurgeAll(ctx context.Context) error {
+	return m.client.FlushAll()
+}
+
+func (m *memcachedIDsCache) Len(ctx context.Context) (int64, error) {
+	return 0, errors.New("memcached cannot count keys")
+}
+
+// memcachedMaxRelativeExpiration より大きい expiration は memcached では unix time として読まれて、すぐに切れてしまう
+const memcachedMaxRelativeExpiration = 30 * 24 * time.Hour
+
+// memcachedExpiration は ttl を memcached の秒単位の expiration にする。ttl が 0 なら cacheDefaultTTL。
+// 30 日より長い ttl は 30 日にする
+func memcachedExpiration(ttl time.Duration) int32 {
+	if ttl <= 0 {
+		ttl = cacheDefaultTTL()
+	}
+	ttl = jitterTTL(ttl)
+	if ttl > memcachedMaxRelativeExpiration {
+		ttl = memcachedMaxRelativeExpiration
+	}
+	exp := int32(ttl / time.Second)
+	// 0 は無期限になってしまう
+	if exp < 1 {
+		return 1
+	}
+	return exp
+}
+
+// encodeIDs は ID リストを varint で詰める
+func encodeIDs(ids []int64) []byte {
+	b := make([]byte, 0, len(ids)*binary.MaxVarintLen32)
+	buf := make([]byte, binary.MaxVarintLen64)
+	for _, id := range ids {
+		n := binary.PutVarint(buf, id)
+		b = append(b, buf[:n]...)
+	}
+	return b
+}
+
+func decodeIDs(b []byte) ([]int64, error) {
+	ids := []int64{}
+	for len(b) > 0 {
+		id, n := binary.Varint(b)
+		if n <= 0 {
+			return nil, errors.New("broken id list")
+		}
+		ids = append(ids, id)
+		b = b[n:]
+	}
+	return ids, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/astj/isucon10-yosen/webapp/go/geo"
+)
+
+const (
+	// これより頂点の多い polygon は判定の前に簡略化する
+	nazotteSimplifyThreshold = 64
+	// 一直線に並んだ点 (とほぼ一直線の点) しか落とさないように十分小さくする (1e-9 度でだいたい 0.1mm)
+	nazotteSimplifyEpsilon = 1e-9
+)
+
+// filterEstatesInPolygon は candidates (並び順どおり) のうちどれかの polygon に含まれるものを先頭から limit 件まで返す。
+// 2 つめの戻り値は polygon に含まれる物件の総数
+func filterEstatesInPolygon(polygon geo.MultiPolygon, candidates []Estate, limit int) ([]Estate, int64) {
+	estatesInPolygon := []Estate{}
+	var total int64
+	for _, estate := range candidates {
+		if !polygon.Contains(geo.Point{Lat: estate.Latitude, Lng: estate.Longitude}) {
+			continue
+		}
+		total++
+		if len(estatesInPolygon) < limit {
+			estatesInPolygon = append(estatesInPolygon, estate)
+		}
+	}
+	return estatesInPolygon, total
+}
+
+// UnmarshalJSON は独自形式 ({"coordinates":[{"latitude":..,"longitude":..}]} か
+// 複数の polygon の {"polygons":[{"coordinates":[...]}, ...]}) に加えて、
+// GeoJSON の Polygon ({"type":"Polygon","coordinates":[[[lng,lat],...]]}) と MultiPolygon も受け付ける
+func (cs *Coordinates) UnmarshalJSON(data []byte) error {
+	var head struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return err
+	}
+
+	switch head.Type {
+	case "":
+		// 独自形式。UnmarshalJSON を持たない型を経由して再帰を避ける
+		var raw struct {
+			Coordinates []Coordinate  `json:"coordinates"`
+			Polygons    []Coordinates `json:"polygons"`
+		}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return err
+		}
+		cs.Coordinates = raw.Coordinates
+		cs.Polygons = raw.Polygons
+		return nil
+	case "Polygon":
+		var p struct {
+			Coordinates [][][]float64 `json:"coordinates"`
+		}
+		if err := json.Unmarshal(data, &p); err != nil {
+			return err
+		}
+		coordinates, err := geoJSONPolygonToCoordinates(p.Coordinates)
+		if err != nil {
+			return err
+		}
+		cs.Coordinates = coordinates
+		return nil
+	case "MultiPolygon":
+		var mp struct {
+			Coordinates [][][][]float64 `json:"coordinates"`
+		}
+		if err := json.Unmarshal(data, &mp); err != nil {
+			return err
+		}
+		cs.Polygons = make([]Coordinates, 0, len(mp.Coordinates))
+		for _, p := range mp.Coordinates {
+			coordinates, err := geoJSONPolygonToCoordinates(p)
+			if err != nil {
+				return err
+			}
+			cs.Polygons = append(cs.Polygons, Coordinates{Coordinates: coordinates})
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported geojson type: %v", head.Type)
+	}
+}
+
+// geoJSONPolygonToCoordinates は GeoJSON の Polygon の座標 (座標は [経度, 緯度] の順) を外周の Coordinate に変換する
+func geoJSONPolygonToCoordinates(rings [][][]float64) ([]Coordinate, error) {
+	if len(rings) == 0 {
+		return nil, errors.New("geojson polygon has no rings")
+	}
+	// 穴あきの polygon は受け付けない
+	if len(rings) > 1 {
+		return nil, errors.New("geojson polygon with holes is not supported")
+	}
+	coordinates := make([]Coordinate, 0, len(rings[0]))
+	for _, pos := range rings[0] {
+		if len(pos) < 2 {
+			return nil, fmt.Errorf("invalid geojson position: %v", pos)
+		}
+		coordinates = append(coordinates, Coordinate{Latitude: pos[1], Longitude: pos[0]})
+	}
+	return coordinates, nil
+}
+
+// polygons は指定された polygon を全部返す
+func (cs Coordinates) polygons() []Coordinates {
+	if len(cs.Polygons) > 0 {
+		return cs.Polygons
+	}
+	return []Coordinates{{Coordinates: cs.Coordinates}}
+}
+
+// toPolygon は Coordinates を geo.Polygon (穴なし) に変換する。頂点が多ければ簡略化する
+func (cs Coordinates) toPolygon() geo.Polygon {
+	ring := make(geo.Ring, 0, len(cs.Coordinates))
+	for _, c := range cs.Coordinates {
+		ring = append(ring, geo.Point{Lat: c.Latitude, Lng: c.Longitude})
+	}
+	polygon := geo.Polygon{ring}
+	if len(ring) > nazotteSimplifyThreshold {
+		polygon = polygon.Simplify(nazotteSimplifyEpsilon)
+	}
+	return polygon
+}
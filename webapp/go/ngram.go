@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 名前のあいまい検索用の n-gram。日本語の名前が多いので 2 文字ずつに区切る
+const ngramSize = 2
+
+// keyword 検索では n-gram の半分以上が一致したものを候補にする
+const (
+	fuzzyMatchRatio = 0.5
+	fuzzyMatchLimit = 100
+)
+
+const ngramInsertBatchSize = 1000
+
+type execerContext interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// nameNgrams は名前を重複のない n-gram に分解する
+func nameNgrams(name string) []string {
+	runes := []rune(strings.ToLower(strings.TrimSpace(name)))
+	if len(runes) == 0 {
+		return nil
+	}
+	if len(runes) < ngramSize {
+		return []string{string(runes)}
+	}
+	seen := make(map[string]bool, len(runes))
+	grams := make([]string, 0, len(runes))
+	for i := 0; i+ngramSize <= len(runes); i++ {
+		g := string(runes[i : i+ngramSize])
+		if seen[g] {
+			continue
+		}
+		seen[g] = true
+		grams = append(grams, g)
+	}
+	return grams
+}
+
+type ngramRow struct {
+	ID   int64  `db:"id"`
+	Name string `db:"name"`
+}
+
+// insertNgrams は kind ("chair" / "estate") の名前の n-gram を name_ngram に登録する
+func insertNgrams(ctx context.Context, e execerContext, kind string, rows []ngramRow) error {
+	placeholders := make([]string, 0, ngramInsertBatchSize)
+	params := make([]interface{}, 0, ngramInsertBatchSize*3)
+	flush := func() error {
+		if len(placeholders) == 0 {
+			return nil
+		}
+		query := "INSERT IGNORE INTO name_ngram (kind, item_id, gram) VALUES " + strings.Join(placeholders, ",")
+		_, err := e.ExecContext(ctx, query, params...)
+		placeholders = placeholders[:0]
+		params = params[:0]
+		return err
+	}
+	for _, r := range rows {
+		for _, g := range nameNgrams(r.Name) {
+			placeholders = append(placeholders, "(?,?,?)")
+			params = append(params, kind, r.ID, g)
+			if len(placeholders) >= ngramInsertBatchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return flush()
+}
+
+// rebuildNgrams は chair と estate の全件から name_ngram を作り直す。
+// 件数が多いので initialize からは非同期で呼ぶ
+func rebuildNgrams(ctx context.Context) error {
+	for _, kind := range []string{"chair", "estate"} {
+		var rows []ngramRow
+		if err := db.SelectContext(ctx, &rows, fmt.Sprintf("SELECT id, name FROM %s", kind)); err != nil {
+			return err
+		}
+		if err := insertNgrams(ctx, db, kind, rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fuzzyMatchIDs は keyword と n-gram が多く重なる item の ID を、重なりが多い順に返す。
+// 多少の typo があっても引っかかるようにするためのもの
+func fuzzyMatchIDs(ctx context.Context, kind string, keyword string) ([]int64, error) {
+	grams := nameNgrams(keyword)
+	if len(grams) == 0 {
+		return nil, nil
+	}
+	minHits := int(float64(len(grams))*fuzzyMatchRatio + 0.5)
+	if minHits < 1 {
+		minHits = 1
+	}
+	query, args, err := sqlx.In(`SELECT item_id FROM name_ngram WHERE kind = ? AND gram IN (?) GROUP BY item_id HAVING COUNT(*) >= ? ORDER BY COUNT(*) DESC, item_id ASC LIMIT ?`, kind, grams, minHits, fuzzyMatchLimit)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	if err := db.SelectContext(ctx, &ids, db.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
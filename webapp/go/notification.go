@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+var (
+	// SMTP_ADDR が空ならメールは送らない
+	smtpAddr         = getEnv("SMTP_ADDR", "")
+	notificationFrom = getEnv("NOTIFICATION_FROM", "noreply@isuumo.example")
+	// notificationHTTPClient は設定で決めた宛先 (LOW_STOCK_WEBHOOK_URL) に送るときに使う
+	notificationHTTPClient = &http.Client{Timeout: 5 * time.Second}
+
+	// 保存検索の webhook はユーザーが指定する URL なので、ここに書いたホストにしか送らない。空なら webhook は受け付けない
+	savedSearchWebhookAllowedHosts = parseImportAllowedHosts(getEnv("SAVED_SEARCH_WEBHOOK_ALLOWED_HOSTS", ""))
+	// savedSearchWebhookClient は許可したホストの名前が内部のアドレスを指していても繋がない
+	savedSearchWebhookClient = &http.Client{
+		Timeout: 2 * time.Second,
+		Transport: &http.Transport{
+			// 環境変数の proxy を通すと、繋ぎに行くアドレスを確かめられない
+			Proxy: nil,
+			DialContext: (&net.Dialer{
+				Timeout: 2 * time.Second,
+				Control: refuseInternalAddress,
+			}).DialContext,
+			TLSHandshakeTimeout: 2 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if !isSavedSearchWebhookAllowed(req.URL) {
+				return errWebhookHostNotAllowed
+			}
+			return nil
+		},
+	}
+	// 保存検索の通知を同時に送る数。入稿がいくつ重なってもこれ以上は並べない
+	savedSearchNotifySem = make(chan struct{}, getEnvInt("SAVED_SEARCH_NOTIFY_WORKERS", 4))
+)
+
+var (
+	errWebhookHostNotAllowed    = errors.New("webhook host is not allowed")
+	errWebhookAddressNotAllowed = errors.New("webhook address is not allowed")
+)
+
+// internalNetworks は webhook で繋がない private なアドレス。loopback と link-local は net.IP のメソッドで見る
+var internalNetworks = mustParseCIDRs("0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7")
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// isSavedSearchWebhookAllowed は保存検索の webhook に送ってよい URL か。保存するときと送るときの両方で見る
+func isSavedSearchWebhookAllowed(u *url.URL) bool {
+	return (u.Scheme == "http" || u.Scheme == "https") && savedSearchWebhookAllowedHosts[strings.ToLower(u.Hostname())]
+}
+
+// refuseInternalAddress は名前を引いた後の接続先が loopback・link-local・private なら繋がない
+func refuseInternalAddress(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || isInternalIP(ip) {
+		return fmt.Errorf("%w: %s", errWebhookAddressNotAllowed, address)
+	}
+	return nil
+}
+
+func isInternalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range internalNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Notification は保存された検索条件に合う新着があったときに webhook に POST する内容
+type Notification struct {
+	SavedSearchID int64   `json:"savedSearchId"`
+	Kind          string  `json:"kind"`
+	IDs           []int64 `json:"ids"`
+}
+
+// sendNotification は保存された検索条件に合う新着を webhook と email に送る。
+// 片方が失敗してももう片方は送る
+func sendNotification(ctx context.Context, logger echo.Logger, s SavedSearch, ids []int64) {
+	n := Notification{SavedSearchID: s.ID, Kind: s.Kind, IDs: ids}
+	if s.WebhookURL.Valid {
+		if err := postSavedSearchWebhook(ctx, s.WebhookURL.String, n); err != nil {
+			logger.Errorf("failed to post webhook for saved search %d : %v", s.ID, err)
+		}
+	}
+	if s.Email.Valid && smtpAddr != "" {
+		if err := sendNotificationMail(s.Email.String, n); err != nil {
+			logger.Errorf("failed to send mail for saved search %d : %v", s.ID, err)
+		}
+	}
+}
+
+// postSavedSearchWebhook は保存したあとに許可するホストが変わっていることがあるので、送る前にもう一度確かめる
+func postSavedSearchWebhook(ctx context.Context, webhookURL string, n Notification) error {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return err
+	}
+	if !isSavedSearchWebhookAllowed(u) {
+		return errWebhookHostNotAllowed
+	}
+	return postWebhook(ctx, savedSearchWebhookClient, u.String(), n)
+}
+
+// postWebhook は v を JSON にして webhookURL に POST する
+func postWebhook(ctx context.Context, client *http.Client, webhookURL string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %v", resp.Status)
+	}
+	return nil
+}
+
+func sendNotificationMail(to string, n Notification) error {
+	ids := make([]string, 0, len(n.IDs))
+	for _, id := range n.IDs {
+		ids = append(ids, fmt.Sprint(id))
+	}
+	msg := "From: " + notificationFrom + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: ISUUMO new listings\r\n" +
+		"\r\n" +
+		fmt.Sprintf("saved search %d matched new %s: %s\r\n", n.SavedSearchID, n.Kind, strings.Join(ids, ", "))
+	return smtp.SendMail(smtpAddr, nil, notificationFrom, []string{to}, []byte(msg))
+}
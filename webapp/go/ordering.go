@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// 並び順の戦略。どれも最後に id ASC を付けて順序が一意に決まるようにしている。
+// popularity と score の降順は、ASC と DESC が混ざると index で並べられないので neg_popularity / neg_score の昇順にする
+// 値段は effective_price (セールを考慮した generated column) で並べて、popularity_price も index で並べられるようにする
+var chairOrderStrategies = map[string]string{
+	"popularity":       "neg_popularity ASC, id ASC",
+	"popularity_price": "neg_popularity ASC, " + chairEffectivePrice + " ASC, id ASC",
+	"score":            "neg_score ASC, id ASC",
+}
+
+var estateOrderStrategies = map[string]string{
+	"popularity":      "neg_popularity ASC, id ASC",
+	"popularity_rent": "neg_popularity ASC, rent ASC, id ASC",
+	"score":           "neg_score ASC, id ASC",
+}
+
+const defaultOrderStrategy = "popularity"
+
+// CHAIR_ORDER / ESTATE_ORDER で選んだ戦略。
+// 検索、なぞって検索、おすすめ、キャッシュの全部でこれを使う
+var chairOrderName, chairOrder = loadOrderStrategy("CHAIR_ORDER", chairOrderStrategies)
+var estateOrderName, estateOrder = loadOrderStrategy("ESTATE_ORDER", estateOrderStrategies)
+
+func loadOrderStrategy(key string, strategies map[string]string) (string, string) {
+	name := getEnv(key, defaultOrderStrategy)
+	order, ok := strategies[name]
+	if !ok {
+		fmt.Printf("unknown order strategy %v=%v\n", key, name)
+		os.Exit(1)
+	}
+	return name, order
+}
+
+// sort パラメータで指定できるキーと ORDER BY で使う式。ここにないキーは受け付けない。
+// popularity と score は index を使えるように neg_popularity / neg_score で並べるので、向きは descendingSortExprs で逆にする
+var chairSortKeys = map[string]string{
+	"price":      chairEffectivePrice,
+	"popularity": "neg_popularity",
+	"score":      "neg_score",
+	"createdAt":  "created_at",
+	"id":         "id",
+}
+
+// descendingSortExprs は符号を反転して持っている列。desc (人気の高い順) は ASC で並べる
+var descendingSortExprs = map[string]bool{
+	"neg_popularity": true,
+	"neg_score":      true,
+}
+
+// parseSort は sort=price:asc,popularity:desc のような指定を ORDER BY に渡す式に変換する。
+// 順序が一意に決まるように id が含まれていなければ最後に id ASC を付ける
+func parseSort(sort string, keys map[string]string) (string, error) {
+	seen := map[string]bool{}
+	orders := []string{}
+	for _, s := range strings.Split(sort, ",") {
+		key, dir := s, "asc"
+		if i := strings.Index(s, ":"); i >= 0 {
+			key, dir = s[:i], s[i+1:]
+		}
+		expr, ok := keys[key]
+		if !ok {
+			return "", fmt.Errorf("unknown sort key: %q", key)
+		}
+		if seen[key] {
+			return "", fmt.Errorf("duplicated sort key: %q", key)
+		}
+		seen[key] = true
+		if descendingSortExprs[expr] {
+			switch dir {
+			case "asc":
+				dir = "desc"
+			case "desc":
+				dir = "asc"
+			}
+		}
+		switch dir {
+		case "asc":
+			orders = append(orders, expr+" ASC")
+		case "desc":
+			orders = append(orders, expr+" DESC")
+		default:
+			return "", fmt.Errorf("invalid sort direction: %q", dir)
+		}
+	}
+	if !seen["id"] {
+		orders = append(orders, "id ASC")
+	}
+	return strings.Join(orders, ", "), nil
+}
+
+// chairSortCacheKey は cache の key に入れる並び順を返す。sort を解釈した後の ORDER BY で揃えるので、
+// 向きや id の有無だけが違う指定は同じ key になり、既定の並び順と同じなら sort が空のときと同じ key になる
+func chairSortCacheKey(order string) string {
+	if order == chairOrder {
+		return ""
+	}
+	return order
+}
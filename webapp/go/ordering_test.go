@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestParseSort(t *testing.T) {
+	tests := []struct {
+		sort string
+		want string
+	}{
+		{"popularity", "neg_popularity DESC, id ASC"},
+		{"popularity:desc", "neg_popularity ASC, id ASC"},
+		{"price:asc,popularity:desc", chairEffectivePrice + " ASC, neg_popularity ASC, id ASC"},
+		{"price:desc,popularity", chairEffectivePrice + " DESC, neg_popularity DESC, id ASC"},
+		{"id:desc,createdAt", "id DESC, created_at ASC"},
+		{"score:desc", "neg_score ASC, id ASC"},
+	}
+	for _, tt := range tests {
+		got, err := parseSort(tt.sort, chairSortKeys)
+		if err != nil || got != tt.want {
+			t.Errorf("parseSort(%q) = %q, %v, want %q", tt.sort, got, err, tt.want)
+		}
+	}
+	for _, sort := range []string{"unknown", "price:up", "price,price:desc"} {
+		if _, err := parseSort(sort, chairSortKeys); err == nil {
+			t.Errorf("parseSort(%q) is accepted", sort)
+		}
+	}
+}
+
+// 空の sort と既定の並び順と同じ指定が別々の cache にならないこと
+func TestChairSortCacheKey(t *testing.T) {
+	defer func(name, order string) { chairOrderName, chairOrder = name, order }(chairOrderName, chairOrder)
+	chairOrderName, chairOrder = "popularity", chairOrderStrategies["popularity"]
+
+	for _, sort := range []string{"popularity:desc", "popularity:desc,id:asc"} {
+		order, _ := parseSort(sort, chairSortKeys)
+		if key := chairSortCacheKey(order); key != "" {
+			t.Errorf("cache key of %q = %q, want the default", sort, key)
+		}
+	}
+	a, _ := parseSort("price", chairSortKeys)
+	b, _ := parseSort("price:asc,id:asc", chairSortKeys)
+	if chairSortCacheKey(a) != chairSortCacheKey(b) || chairSortCacheKey(a) == "" {
+		t.Errorf("cache keys of price = %q, %q", chairSortCacheKey(a), chairSortCacheKey(b))
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// 一覧のレスポンスに RFC 5988 の Link ヘッダ (first / prev / next / last) を付けて、
+// body を読まなくてもページをたどれるようにする。page は 0 始まり。
+// 前段のホスト名は分からないので、URL は path と query だけの相対参照にする
+
+func paginationLink(c echo.Context, page int64, rel string) string {
+	u := *c.Request().URL
+	q := u.Query()
+	q.Set("page", strconv.FormatInt(page, 10))
+	u.RawQuery = q.Encode()
+	return "<" + u.RequestURI() + `>; rel="` + rel + `"`
+}
+
+// setPaginationLinks は count 件を perPage 件ずつに分けたときの page の前後のページを Link に入れる
+func setPaginationLinks(c echo.Context, count int64, page int, perPage int) {
+	if perPage <= 0 {
+		return
+	}
+	last := int64(0)
+	if count > 0 {
+		last = (count - 1) / int64(perPage)
+	}
+	p := int64(page)
+	links := []string{paginationLink(c, 0, "first")}
+	if p > 0 {
+		// 最後より後ろのページを見ているときは、prev を最後のページにする
+		prev := p - 1
+		if prev > last {
+			prev = last
+		}
+		links = append(links, paginationLink(c, prev, "prev"))
+	}
+	if p < last {
+		links = append(links, paginationLink(c, p+1, "next"))
+	}
+	links = append(links, paginationLink(c, last, "last"))
+	c.Response().Header().Set("Link", strings.Join(links, ", "))
+}
+
+// setSinglePageLinks は low_priced のようにページ分けしない一覧用。first と last が自分自身になる
+func setSinglePageLinks(c echo.Context) {
+	self := "<" + c.Request().URL.RequestURI() + ">"
+	c.Response().Header().Set("Link", self+`; rel="first", `+self+`; rel="last"`)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+// dHash を計算するときに縮める大きさ (横に隣り合う画素を比べるので幅は 1 つ多い)
+const (
+	dHashWidth  = 9
+	dHashHeight = 8
+)
+
+// thumbnail の path (/images/chair/xxx.png) はこのディレクトリからの相対で探す
+func thumbnailRoot() string {
+	return getEnv("THUMBNAIL_ROOT", "../public")
+}
+
+// thumbnailHash は thumbnail 画像の perceptual hash (dHash) を 16 進数の文字列で返す。
+// 画像が見つからないときなどは NULL にする
+func thumbnailHash(thumbnail string) sql.NullString {
+	path := filepath.Join(thumbnailRoot(), filepath.Clean("/"+thumbnail))
+	f, err := os.Open(path)
+	if err != nil {
+		return sql.NullString{}
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: fmt.Sprintf("%016x", dHash(img)), Valid: true}
+}
+
+// dHash は画像を 9x8 のグレースケールに縮めて、横に隣り合う画素の明るさを比べた 64bit の hash。
+// 拡大縮小や再圧縮された程度の画像なら同じ値になる
+func dHash(img image.Image) uint64 {
+	b := img.Bounds()
+	var gray [dHashHeight][dHashWidth]float64
+	for y := 0; y < dHashHeight; y++ {
+		y0 := b.Min.Y + y*b.Dy()/dHashHeight
+		y1 := b.Min.Y + (y+1)*b.Dy()/dHashHeight
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < dHashWidth; x++ {
+			x0 := b.Min.X + x*b.Dx()/dHashWidth
+			x1 := b.Min.X + (x+1)*b.Dx()/dHashWidth
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			// 領域内の明るさの平均をとる
+			var sum float64
+			for py := y0; py < y1; py++ {
+				for px := x0; px < x1; px++ {
+					r, g, b, _ := img.At(px, py).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+				}
+			}
+			gray[y][x] = sum / float64((x1-x0)*(y1-y0))
+		}
+	}
+
+	var h uint64
+	for y := 0; y < dHashHeight; y++ {
+		for x := 0; x < dHashWidth-1; x++ {
+			h <<= 1
+			if gray[y][x] < gray[y][x+1] {
+				h |= 1
+			}
+		}
+	}
+	return h
+}
+
+// 画像を開いて縮めるのは重いので、入稿のリクエストでは thumbnail_hash を NULL で入れておき、
+// commit した後に runThumbnailHasher が計算して埋める
+const (
+	thumbnailHashQueueSize = 1024
+	thumbnailHashBatchSize = 500
+)
+
+type thumbnailHashJob struct {
+	table string
+	ids   []int64
+}
+
+var thumbnailHashQueue = make(chan thumbnailHashJob, thumbnailHashQueueSize)
+
+// enqueueThumbnailHashes は table の ids の行の thumbnail_hash を裏で計算してもらう。
+// queue が詰まっているときは入稿を待たせずに捨てる (hash が NULL の行は重複の一覧に出ないだけ)
+func enqueueThumbnailHashes(logger echo.Logger, table string, ids []int64) {
+	if len(ids) == 0 {
+		return
+	}
+	select {
+	case thumbnailHashQueue <- thumbnailHashJob{table: table, ids: ids}:
+	default:
+		logger.Warnf("thumbnail hash queue is full, dropped %d %s rows", len(ids), table)
+	}
+}
+
+// runThumbnailHasher は queue に積まれた行の thumbnail の hash を計算して書き込む
+func runThumbnailHasher(ctx context.Context, logger echo.Logger) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-thumbnailHashQueue:
+			if err := hashThumbnails(ctx, job); err != nil {
+				logger.Errorf("failed to hash %s thumbnails : %v", job.table, err)
+			}
+		}
+	}
+}
+
+func hashThumbnails(ctx context.Context, job thumbnailHashJob) error {
+	for start := 0; start < len(job.ids); start += thumbnailHashBatchSize {
+		end := start + thumbnailHashBatchSize
+		if end > len(job.ids) {
+			end = len(job.ids)
+		}
+		query, args, err := sqlx.In("SELECT id, thumbnail FROM "+job.table+" WHERE id IN (?)", job.ids[start:end])
+		if err != nil {
+			return err
+		}
+		rows := []struct {
+			ID        int64  `db:"id"`
+			Thumbnail string `db:"thumbnail"`
+		}{}
+		if err := db.SelectContext(ctx, &rows, query, args...); err != nil {
+			return err
+		}
+		for _, r := range rows {
+			hash := thumbnailHash(r.Thumbnail)
+			if !hash.Valid {
+				continue
+			}
+			// 計算している間に別の入稿で thumbnail が変わっていたら、そちらの計算に任せる。
+			// hash は動きではないので updated_at はそのままにする
+			_, err := db.ExecContext(ctx, "UPDATE "+job.table+" SET thumbnail_hash = ?, updated_at = updated_at WHERE id = ? AND thumbnail = ?", hash, r.ID, r.Thumbnail)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type ThumbnailDuplicateGroup struct {
+	Hash string  `json:"hash"`
+	IDs  []int64 `json:"ids"`
+}
+
+type ThumbnailDuplicatesResponse struct {
+	Groups []ThumbnailDuplicateGroup `json:"groups"`
+}
+
+// getThumbnailDuplicates は同じ画像 (thumbnail の hash が同じ) を使っている chair / estate をまとめて返す
+func getThumbnailDuplicates(c echo.Context) error {
+	ctx := c.Request().Context()
+	table := c.QueryParam("type")
+	if table != "chair" && table != "estate" {
+		c.Logger().Infof("invalid type : %v", table)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	rows := []struct {
+		ID   int64  `db:"id"`
+		Hash string `db:"thumbnail_hash"`
+	}{}
+	query := fmt.Sprintf(`SELECT id, thumbnail_hash FROM %[1]s WHERE thumbnail_hash IN (SELECT thumbnail_hash FROM %[1]s WHERE thumbnail_hash IS NOT NULL GROUP BY thumbnail_hash HAVING COUNT(*) > 1) ORDER BY thumbnail_hash, id`, table)
+	if err := db.SelectContext(ctx, &rows, query); err != nil {
+		c.Logger().Errorf("getThumbnailDuplicates DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := ThumbnailDuplicatesResponse{Groups: []ThumbnailDuplicateGroup{}}
+	for _, r := range rows {
+		if len(res.Groups) == 0 || res.Groups[len(res.Groups)-1].Hash != r.Hash {
+			res.Groups = append(res.Groups, ThumbnailDuplicateGroup{Hash: r.Hash})
+		}
+		g := &res.Groups[len(res.Groups)-1]
+		g.IDs = append(g.IDs, r.ID)
+	}
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// score は popularity を最後の動き (入稿や購入で更新される updated_at と、最後に閲覧された時刻の新しい方) からの
+// 経過時間で減衰させたもの。
+// 昔の人気で上位に居座り続けないように、ESTATE_ORDER / CHAIR_ORDER=score や sort=score:desc で使う。
+// 入稿した直後は popularity と同じで、SCORE_RECOMPUTE_CRON の時刻に計算し直す
+var (
+	scoreRecomputeCron = getEnv("SCORE_RECOMPUTE_CRON", "*/10 * * * *")
+	// popularityHalfLife だけ経つと score が popularity の半分になる
+	popularityHalfLife = getEnvDuration("POPULARITY_HALF_LIFE", 30*24*time.Hour)
+)
+
+const (
+	// 1 回の UPDATE で計算し直す行数。テーブル全体を長く lock しないように分ける
+	scoreRecomputeBatchSize = 1000
+	scoreRecomputeLockTTL   = 10 * time.Minute
+)
+
+// runScoreRecomputer は SCORE_RECOMPUTE_CRON の時刻に score を計算し直す
+func runScoreRecomputer(ctx context.Context, logger echo.Logger) {
+	cron, err := parseCron(scoreRecomputeCron)
+	if err != nil {
+		logger.Errorf("invalid SCORE_RECOMPUTE_CRON : %v", err)
+		return
+	}
+	for {
+		now := time.Now()
+		next := cron.Next(now)
+		if next.IsZero() {
+			logger.Errorf("SCORE_RECOMPUTE_CRON never runs : %q", scoreRecomputeCron)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next.Sub(now)):
+		}
+
+		// 複数台構成でも 1 台だけが計算する
+		lockKey := fmt.Sprintf("isuumo:score_recompute:%d", next.Unix())
+		locked, err := rdb.SetNX(ctx, lockKey, instanceID, scoreRecomputeLockTTL).Result()
+		if err != nil {
+			logger.Errorf("failed to acquire score recompute lock : %v", err)
+			locked = true
+		}
+		if !locked {
+			continue
+		}
+		if err := recomputeScores(ctx, logger); err != nil {
+			logger.Errorf("failed to recompute scores : %v", err)
+		}
+	}
+}
+
+// recomputeScores は chair と estate の score を計算し直して、並び順が変わるので一覧の cache を飛ばす
+func recomputeScores(ctx context.Context, logger echo.Logger) error {
+	for _, table := range []string{"chair", "estate"} {
+		if err := recomputeTableScores(ctx, table); err != nil {
+			return fmt.Errorf("%s: %v", table, err)
+		}
+	}
+	_ = purgeEstateIDsFromRedis()
+	purgeResponseCache(ctx, responseCacheGroupChair, responseCacheGroupEstate)
+	purgeSurrogateKeys(logger, surrogateKeyChairSearch, surrogateKeyEstateSearch)
+	return nil
+}
+
+func recomputeTableScores(ctx context.Context, table string) error {
+	// score の更新は動きではないので updated_at はそのままにする
+	query := `UPDATE ` + table + ` AS t LEFT JOIN item_view AS v ON v.kind = '` + table + `' AND v.item_id = t.id
+		SET t.score = t.popularity * POW(0.5, TIMESTAMPDIFF(SECOND, GREATEST(t.updated_at, COALESCE(v.last_viewed_at, t.updated_at)), NOW(6)) / ?), t.updated_at = t.updated_at
+		WHERE t.id > ? AND t.id <= ?`
+	var maxID int64
+	if err := db.GetContext(ctx, &maxID, "SELECT COALESCE(MAX(id), 0) FROM "+table); err != nil {
+		return err
+	}
+	halfLife := popularityHalfLife.Seconds()
+	for from := int64(0); from < maxID; from += scoreRecomputeBatchSize {
+		if _, err := db.ExecContext(ctx, query, halfLife, from, from+scoreRecomputeBatchSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/astj/isucon10-yosen/webapp/go/dbq"
+)
+
+// 固定の query は sqlc で queries/*.sql から生成した dbq を使う (sqlc.yaml、作り直すときは make sqlc)。
+// カラムは 0_Schema.sql から生成されるので、typo や型の違いはコンパイルエラーになる。
+// 検索のように WHERE が条件で変わるものは sqlc では書けないので、sqlFilter で組み立てる
+
+func queries() *dbq.Queries {
+	return dbq.New(db)
+}
+
+// selectEstatesFromIDs は ids の物件を ids の順に返す。消えたものは詰める
+func selectEstatesFromIDs(ctx context.Context, ids []int64) ([]Estate, error) {
+	rows, err := queries().ListEstatesByIDs(ctx, int32IDs(ids))
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int64]Estate, len(rows))
+	for _, r := range rows {
+		byID[int64(r.ID)] = estateFromRow(r)
+	}
+	estates := make([]Estate, 0, len(ids))
+	for _, id := range ids {
+		if e, ok := byID[id]; ok {
+			estates = append(estates, e)
+		}
+	}
+	return estates, nil
+}
+
+// selectChairsFromIDs は ids の椅子を ids の順に返す。消えたものは詰める
+func selectChairsFromIDs(ctx context.Context, ids []int64) ([]Chair, error) {
+	rows, err := queries().ListChairsByIDs(ctx, int32IDs(ids))
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int64]Chair, len(rows))
+	for _, r := range rows {
+		byID[int64(r.ID)] = chairFromRow(r)
+	}
+	chairs := make([]Chair, 0, len(ids))
+	for _, id := range ids {
+		if ch, ok := byID[id]; ok {
+			chairs = append(chairs, ch)
+		}
+	}
+	return chairs, nil
+}
+
+func estateFromRow(r dbq.Estate) Estate {
+	return Estate{
+		ID:                 int64(r.ID),
+		Thumbnail:          ThumbnailURL(r.Thumbnail),
+		Name:               r.Name,
+		Description:        r.Description,
+		Latitude:           r.Latitude,
+		Longitude:          r.Longitude,
+		Address:            r.Address,
+		Rent:               int64(r.Rent),
+		DoorHeight:         int64(r.DoorHeight),
+		DoorWidth:          int64(r.DoorWidth),
+		Features:           r.Features,
+		Popularity:         int64(r.Popularity),
+		NegPopularity:      int64(r.NegPopularity),
+		Status:             r.Status,
+		Score:              r.Score,
+		NegScore:           r.NegScore,
+		ThumbnailHash:      r.ThumbnailHash,
+		CellID:             r.CellID,
+		NearestStation:     nullStringPtr(r.NearestStation),
+		StationWalkMinutes: nullInt32Ptr(r.StationWalkMinutes),
+		Layout:             r.Layout,
+		ManagementFee:      int64(r.ManagementFee),
+		Deposit:            int64(r.Deposit),
+		EffectiveRent:      int64(r.EffectiveRent),
+		CreatedAt:          timePtr(r.CreatedAt),
+		UpdatedAt:          timePtr(r.UpdatedAt),
+	}
+}
+
+func chairFromRow(r dbq.Chair) Chair {
+	return Chair{
+		ID:             int64(r.ID),
+		Name:           r.Name,
+		Description:    r.Description,
+		Thumbnail:      ThumbnailURL(r.Thumbnail),
+		Price:          int64(r.Price),
+		Height:         int64(r.Height),
+		Width:          int64(r.Width),
+		Depth:          int64(r.Depth),
+		Color:          r.Color,
+		Features:       r.Features,
+		Kind:           r.Kind,
+		Popularity:     int64(r.Popularity),
+		NegPopularity:  int64(r.NegPopularity),
+		Stock:          int64(r.Stock),
+		Score:          r.Score,
+		NegScore:       r.NegScore,
+		ThumbnailHash:  r.ThumbnailHash,
+		Material:       r.Material,
+		Weight:         nullInt32Ptr(r.Weight),
+		SalePrice:      nullInt32Ptr(r.SalePrice),
+		SaleUntil:      nullTimePtr(r.SaleUntil),
+		EffectivePrice: int64(r.EffectivePrice),
+		CreatedAt:      timePtr(r.CreatedAt),
+		UpdatedAt:      timePtr(r.UpdatedAt),
+	}
+}
+
+// id は INTEGER なので sqlc では int32 になる
+func int32IDs(ids []int64) []int32 {
+	res := make([]int32, len(ids))
+	for i, id := range ids {
+		res[i] = int32(id)
+	}
+	return res
+}
+
+func nullStringPtr(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
+
+func nullInt32Ptr(n sql.NullInt32) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	v := int64(n.Int32)
+	return &v
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
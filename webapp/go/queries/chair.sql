@@ -0,0 +1,3 @@
+-- name: ListChairsByIDs :many
+-- 検索の ID リストのページの椅子を取る。並び順は呼ぶ側で ID リストに合わせる
+SELECT * FROM isuumo.chair WHERE id IN (sqlc.slice('ids'));
@@ -0,0 +1,3 @@
+-- name: ListEstatesByIDs :many
+-- 検索の ID リストのページの物件を取る。並び順は呼ぶ側で ID リストに合わせる
+SELECT * FROM isuumo.estate WHERE id IN (sqlc.slice('ids'));
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// sqlColumn はテーブルのカラム名。文字列で直書きせずに定数を使えば、
+// typo はコンパイルエラーになる (0_Schema.sql にカラムを足したらここにも足す)
+type sqlColumn string
+
+const (
+	colID            sqlColumn = "id"
+	colFeatures      sqlColumn = "features"
+	colPopularity    sqlColumn = "popularity"
+	colNegPopularity sqlColumn = "neg_popularity"
+	colScore         sqlColumn = "score"
+	colCreatedAt     sqlColumn = "created_at"
+
+	colChairName     sqlColumn = "name"
+	colChairHeight   sqlColumn = "height"
+	colChairWidth    sqlColumn = "width"
+	colChairDepth    sqlColumn = "depth"
+	colChairKind     sqlColumn = "kind"
+	colChairColor    sqlColumn = "color"
+	colChairMaterial sqlColumn = "material"
+	colChairWeight   sqlColumn = "weight"
+	// colChairEffectivePrice はカラムではないがセールを考慮した価格の式
+	colChairEffectivePrice sqlColumn = chairEffectivePrice
+
+	colEstateDoorHeight         sqlColumn = "door_height"
+	colEstateDoorWidth          sqlColumn = "door_width"
+	colEstateRent               sqlColumn = "rent"
+	colEstateStatus             sqlColumn = "status"
+	colEstateNearestStation     sqlColumn = "nearest_station"
+	colEstateStationWalkMinutes sqlColumn = "station_walk_minutes"
+	colEstateLayout             sqlColumn = "layout"
+	colEstateEffectiveRent      sqlColumn = "effective_rent"
+
+	colAuditAction sqlColumn = "action"
+	colAuditActor  sqlColumn = "actor"
+	colAuditIP     sqlColumn = "ip"
+	colAuditStatus sqlColumn = "status"
+)
+
+// sqlFilter は WHERE 句の条件を AND でつないで組み立てる
+type sqlFilter struct {
+	conditions []string
+	params     []interface{}
+}
+
+func newSQLFilter() *sqlFilter {
+	return &sqlFilter{
+		conditions: make([]string, 0),
+		params:     make([]interface{}, 0),
+	}
+}
+
+func (f *sqlFilter) add(cond string, params ...interface{}) {
+	f.conditions = append(f.conditions, cond)
+	f.params = append(f.params, params...)
+}
+
+func (f *sqlFilter) Eq(col sqlColumn, v interface{}) {
+	f.add(string(col)+" = ?", v)
+}
+
+func (f *sqlFilter) Gt(col sqlColumn, v interface{}) {
+	f.add(string(col)+" > ?", v)
+}
+
+func (f *sqlFilter) Gte(col sqlColumn, v interface{}) {
+	f.add(string(col)+" >= ?", v)
+}
+
+func (f *sqlFilter) Lt(col sqlColumn, v interface{}) {
+	f.add(string(col)+" < ?", v)
+}
+
+func (f *sqlFilter) Lte(col sqlColumn, v interface{}) {
+	f.add(string(col)+" <= ?", v)
+}
+
+// In は col IN (?) を足す。? は sqlx.In で展開する
+func (f *sqlFilter) In(col sqlColumn, values interface{}) {
+	f.add(string(col)+" IN (?)", values)
+}
+
+// Range は検索条件の Range (Min 以上 Max 未満、-1 は指定なし) を足す
+func (f *sqlFilter) Range(col sqlColumn, r *Range) {
+	if r.Min != -1 {
+		f.Gte(col, r.Min)
+	}
+	if r.Max != -1 {
+		f.Lt(col, r.Max)
+	}
+}
+
+// MinMax は priceMin= / priceMax= のような数値の直接指定を足す。どちらも含む。
+// 空なら指定なし。数字でない、負、min > max のときは false を返す
+func (f *sqlFilter) MinMax(col sqlColumn, min, max string) bool {
+	lo, hi := int64(-1), int64(-1)
+	for _, p := range []struct {
+		s string
+		v *int64
+	}{{min, &lo}, {max, &hi}} {
+		if p.s == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(p.s, 10, 64)
+		if err != nil || n < 0 {
+			return false
+		}
+		*p.v = n
+	}
+	if lo != -1 && hi != -1 && lo > hi {
+		return false
+	}
+	if lo != -1 {
+		f.Gte(col, lo)
+	}
+	if hi != -1 {
+		f.Lte(col, hi)
+	}
+	return true
+}
+
+// MinPopularity は popularity >= min を足す。neg_popularity の index が使えるように
+// neg_popularity <= -min で書く。空なら指定なし、数字でないか負なら false を返す
+func (f *sqlFilter) MinPopularity(min string) bool {
+	if min == "" {
+		return true
+	}
+	n, err := strconv.ParseInt(min, 10, 64)
+	if err != nil || n < 0 {
+		return false
+	}
+	f.Lte(colNegPopularity, -n)
+	return true
+}
+
+// Raw はカラム 1 つで書けない条件 (features の OR など) を足す
+func (f *sqlFilter) Raw(cond string, params ...interface{}) {
+	f.add(cond, params...)
+}
+
+func (f *sqlFilter) Empty() bool {
+	return len(f.conditions) == 0
+}
+
+// Where は AND でつないだ条件と、それに対応する params を返す
+func (f *sqlFilter) Where() (string, []interface{}) {
+	return strings.Join(f.conditions, " AND "), f.params
+}
+
+// countRows は table のうち条件に合う行数を返す
+func countRows(ctx context.Context, table string, where string, params []interface{}) (int64, error) {
+	query, args, err := sqlx.In("SELECT COUNT(*) FROM "+table+" WHERE "+where, params...)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	err = db.GetContext(ctx, &count, query, args...)
+	return count, err
+}
+
+// selectIDs は table のうち条件に合う行の id を order の順に全部返す。cache を埋める用
+func selectIDs(ctx context.Context, table string, where string, params []interface{}, order string) ([]int64, error) {
+	query, args, err := sqlx.In("SELECT id FROM "+table+" WHERE "+where+" ORDER BY "+order, params...)
+	if err != nil {
+		return nil, err
+	}
+	ids := []int64{}
+	err = db.SelectContext(ctx, &ids, query, args...)
+	return ids, err
+}
+
+// selectRows は table のうち条件に合う行を order の順に dest に入れる。
+// orderParams は order の中の ? (FIELD(id, ?) など) に渡す値
+func selectRows(ctx context.Context, dest interface{}, table string, where string, params []interface{}, order string, orderParams []interface{}, limit int64, offset int64) error {
+	args := make([]interface{}, 0, len(params)+len(orderParams)+2)
+	args = append(args, params...)
+	args = append(args, orderParams...)
+	args = append(args, limit, offset)
+	query, args, err := sqlx.In("SELECT * FROM "+table+" WHERE "+where+" ORDER BY "+order+" LIMIT ? OFFSET ?", args...)
+	if err != nil {
+		return err
+	}
+	return db.SelectContext(ctx, dest, query, args...)
+}
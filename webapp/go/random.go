@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+const (
+	defaultRandomEstateCount = 10
+	maxRandomEstateCount     = 50
+	// id の抜けや status で弾かれる分を見込んで多めに引く回数
+	randomEstateProbeRounds = 5
+)
+
+// getRandomEstates は物件を count 件ランダムに返す。
+// ORDER BY RAND() は全件なめるので、id の範囲から乱数で id を引いて存在するものを拾う
+func getRandomEstates(c echo.Context) error {
+	ctx := c.Request().Context()
+	count := defaultRandomEstateCount
+	if c.QueryParam("count") != "" {
+		var err error
+		count, err = strconv.Atoi(c.QueryParam("count"))
+		if err != nil || count <= 0 || count > maxRandomEstateCount {
+			c.Logger().Infof("Invalid count parameter : %v", c.QueryParam("count"))
+			return c.NoContent(http.StatusBadRequest)
+		}
+	}
+
+	var idRange struct {
+		Min *int64 `db:"min_id"`
+		Max *int64 `db:"max_id"`
+	}
+	err := db.GetContext(ctx, &idRange, "SELECT MIN(id) AS min_id, MAX(id) AS max_id FROM estate")
+	if err != nil {
+		c.Logger().Errorf("getRandomEstates DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	estates := make([]Estate, 0, count)
+	if idRange.Min == nil || idRange.Max == nil {
+		return renderList(c, http.StatusOK, EstateListResponse{Estates: estates})
+	}
+
+	tried := map[int64]bool{}
+	span := *idRange.Max - *idRange.Min + 1
+	for round := 0; round < randomEstateProbeRounds && len(estates) < count; round++ {
+		// 足りない分の倍の id を試す
+		ids := []int64{}
+		for i := 0; i < (count-len(estates))*2 && int64(len(tried)) < span; i++ {
+			id := *idRange.Min + rand.Int63n(span)
+			if tried[id] {
+				continue
+			}
+			tried[id] = true
+			ids = append(ids, id)
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		found := []Estate{}
+		query, args, err := sqlx.In("SELECT * FROM estate WHERE id IN (?) AND status = 'available'", ids)
+		if err != nil {
+			c.Logger().Errorf("getRandomEstates query build error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if err := db.SelectContext(ctx, &found, query, args...); err != nil {
+			c.Logger().Errorf("getRandomEstates DB execution error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		// IN の結果は id 順になるので混ぜてから詰める
+		rand.Shuffle(len(found), func(i, j int) { found[i], found[j] = found[j], found[i] })
+		for _, e := range found {
+			if len(estates) == count {
+				break
+			}
+			estates = append(estates, e)
+		}
+	}
+
+	hideEstateTimestamps(c, estates)
+	return renderList(c, http.StatusOK, EstateListResponse{Estates: estates})
+}
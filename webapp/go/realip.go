@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// trustedProxies は X-Forwarded-For / X-Real-IP を信用してよい接続元 (nginx など)
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies はカンマ区切りの CIDR (または IP) をパースする
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy : %v", v)
+			}
+			if ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveClientIP は接続元が信用できる proxy のときだけ X-Forwarded-For を右から辿り、
+// 最初に出てきた信用できない IP をクライアントとみなす
+func resolveClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+
+	forwarded := make([]string, 0)
+	for _, h := range r.Header.Values(echo.HeaderXForwardedFor) {
+		for _, v := range strings.Split(h, ",") {
+			forwarded = append(forwarded, strings.TrimSpace(v))
+		}
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(forwarded[i])
+		if ip == nil {
+			// 壊れた値より手前は信用できない
+			break
+		}
+		if !isTrustedProxy(ip) || i == 0 {
+			return ip.String()
+		}
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get(echo.HeaderXRealIP))); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// realIP は RemoteAddr を実際のクライアントの IP に書き換える。
+// 書き換えたあとは c.RealIP() や middleware.Logger の remote_ip もそのまま使える
+func realIP() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			ip := resolveClientIP(req)
+			_, port, err := net.SplitHostPort(req.RemoteAddr)
+			if err != nil {
+				port = "0"
+			}
+			req.RemoteAddr = net.JoinHostPort(ip, port)
+			// c.RealIP() はヘッダを無条件に信用するので消しておく
+			req.Header.Del(echo.HeaderXForwardedFor)
+			req.Header.Del(echo.HeaderXRealIP)
+			return next(c)
+		}
+	}
+}
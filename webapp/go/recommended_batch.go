@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+// 1 回の batch で渡せる椅子の数
+var recommendedBatchMaxChairs = getEnvInt("RECOMMENDED_BATCH_MAX_CHAIRS", 50)
+
+type RecommendedBatchRequest struct {
+	ChairIDs []int64 `json:"chairIds"`
+}
+
+type RecommendedBatchItem struct {
+	ChairID int64    `json:"chairId"`
+	Estates []Estate `json:"estates"`
+}
+
+type RecommendedBatchResponse struct {
+	Recommendations []RecommendedBatchItem `json:"recommendations"`
+	// NotFound は見つからなかった (売り切れを含む) 椅子の ID
+	NotFound []int64 `json:"notFound"`
+}
+
+// recommendedRow は (m1, m2) の組ごとのおすすめの 1 行。Pair は組の番号
+type recommendedRow struct {
+	Pair int `db:"pair"`
+	Estate
+}
+
+// postRecommendedEstateBatch は複数の椅子のおすすめ物件をまとめて返す。
+// 椅子の短い 2 辺 (m1, m2) が同じなら結果も同じなので、組を重複なしにして 1 クエリで引く
+func postRecommendedEstateBatch(c echo.Context) error {
+	ctx := c.Request().Context()
+	var req RecommendedBatchRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Infof("post recommended estate batch failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if len(req.ChairIDs) == 0 || len(req.ChairIDs) > recommendedBatchMaxChairs {
+		c.Logger().Infof("post recommended estate batch failed : invalid chairIds length %v", len(req.ChairIDs))
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	query, args, err := sqlx.In("SELECT * FROM chair WHERE id IN (?) AND stock > 0", req.ChairIDs)
+	if err != nil {
+		c.Logger().Errorf("post recommended estate batch failed : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	chairs := []Chair{}
+	if err := db.SelectContext(ctx, &chairs, query, args...); err != nil {
+		c.Logger().Errorf("Database execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	chairByID := make(map[int64]*Chair, len(chairs))
+	for i := range chairs {
+		chairByID[chairs[i].ID] = &chairs[i]
+	}
+
+	type pair struct{ m1, m2 int64 }
+	pairIndex := map[pair]int{}
+	chairPair := map[int64]int{}
+	subqueries := []string{}
+	params := []interface{}{}
+	for _, ch := range chairs {
+		s1, s2 := chairPassingSides(&ch)
+		p := pair{s1.Length, s2.Length}
+		i, ok := pairIndex[p]
+		if !ok {
+			i = len(pairIndex)
+			pairIndex[p] = i
+			subqueries = append(subqueries, `(SELECT ? AS pair, estate.* FROM estate WHERE status = 'available' AND ((door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?)) ORDER BY `+estateOrder+` LIMIT ?)`)
+			params = append(params, i, p.m1, p.m2, p.m2, p.m1, Limit)
+		}
+		chairPair[ch.ID] = i
+	}
+
+	estatesByPair := make([][]Estate, len(pairIndex))
+	if len(subqueries) > 0 {
+		rows := []recommendedRow{}
+		query := `SELECT * FROM (` + strings.Join(subqueries, " UNION ALL ") + `) AS r ORDER BY pair, ` + estateOrder
+		if err := db.SelectContext(ctx, &rows, query, params...); err != nil {
+			c.Logger().Errorf("Database execution error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		for _, r := range rows {
+			r.Estate.hideTimestamps(c)
+			estatesByPair[r.Pair] = append(estatesByPair[r.Pair], r.Estate)
+		}
+	}
+
+	res := RecommendedBatchResponse{Recommendations: []RecommendedBatchItem{}, NotFound: []int64{}}
+	seen := map[int64]bool{}
+	for _, id := range req.ChairIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if _, ok := chairByID[id]; !ok {
+			res.NotFound = append(res.NotFound, id)
+			continue
+		}
+		estates := estatesByPair[chairPair[id]]
+		if estates == nil {
+			estates = []Estate{}
+		}
+		res.Recommendations = append(res.Recommendations, RecommendedBatchItem{ChairID: id, Estates: estates})
+	}
+	return c.JSON(http.StatusOK, res)
+}
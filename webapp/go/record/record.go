@@ -0,0 +1,60 @@
+// Package record は受けたリクエストを記録・再生するときの形式をまとめたもの
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// StreamField は redis stream に記録するときの field 名
+const StreamField = "request"
+
+// RecordedHeaders は記録する header。認証情報などは残さない
+var RecordedHeaders = []string{
+	"Content-Type",
+	"Content-Encoding",
+	"Accept",
+	"Accept-Encoding",
+	"Accept-Language",
+	"User-Agent",
+}
+
+// Request は記録された 1 リクエスト
+type Request struct {
+	Time   time.Time         `json:"time"`
+	Method string            `json:"method"`
+	URI    string            `json:"uri"`
+	Header map[string]string `json:"header,omitempty"`
+	Body   []byte            `json:"body,omitempty"`
+	// Truncated は body が大きすぎて途中までしか記録していないとき
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Reader は 1 行 1 リクエストの JSON を読む
+type Reader struct {
+	s *bufio.Scanner
+}
+
+func NewReader(r io.Reader) *Reader {
+	s := bufio.NewScanner(r)
+	// CSV の入稿など body が大きい行がある
+	s.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	return &Reader{s: s}
+}
+
+// Next は次のリクエストを返す。終わりなら io.EOF
+func (r *Reader) Next() (*Request, error) {
+	if !r.s.Scan() {
+		if err := r.s.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	var req Request
+	if err := json.Unmarshal(r.s.Bytes(), &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
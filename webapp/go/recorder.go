@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astj/isucon10-yosen/webapp/go/record"
+	"github.com/go-redis/redis/v8"
+	"github.com/labstack/echo"
+)
+
+// REQUEST_RECORD=file:/path/to/requests.jsonl か redis:<stream key> で受けたリクエストを記録する。
+// 記録したものは cmd/isuumo-replay で再生できる。
+var (
+	requestRecordTarget  = getEnv("REQUEST_RECORD", "")
+	requestRecordMaxBody = getEnvInt("REQUEST_RECORD_MAX_BODY", 1<<20)
+)
+
+type requestRecorder interface {
+	write(ctx context.Context, line []byte) error
+}
+
+type fileRecorder struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func (r *fileRecorder) write(ctx context.Context, line []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err := r.f.Write(append(line, '\n'))
+	return err
+}
+
+type streamRecorder struct {
+	key string
+}
+
+func (r *streamRecorder) write(ctx context.Context, line []byte) error {
+	return rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: r.key,
+		Values: map[string]interface{}{record.StreamField: line},
+	}).Err()
+}
+
+func newRequestRecorder(target string) (requestRecorder, error) {
+	switch {
+	case strings.HasPrefix(target, "file:"):
+		f, err := os.OpenFile(strings.TrimPrefix(target, "file:"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return &fileRecorder{f: f}, nil
+	case strings.HasPrefix(target, "redis:"):
+		return &streamRecorder{key: strings.TrimPrefix(target, "redis:")}, nil
+	default:
+		return nil, errUnknownRecordTarget
+	}
+}
+
+var errUnknownRecordTarget = errors.New("unknown REQUEST_RECORD target (use file:<path> or redis:<stream>)")
+
+// recordRequests はリクエストを記録する middleware。記録に失敗してもリクエストは処理する
+func recordRequests(recorder requestRecorder) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			rec := record.Request{
+				Time:   time.Now(),
+				Method: req.Method,
+				URI:    req.RequestURI,
+				Header: map[string]string{},
+			}
+			for _, h := range record.RecordedHeaders {
+				if v := req.Header.Get(h); v != "" {
+					rec.Header[h] = v
+				}
+			}
+			if req.Body != nil {
+				body, err := ioutil.ReadAll(io.LimitReader(req.Body, int64(requestRecordMaxBody)+1))
+				if err != nil {
+					return err
+				}
+				// 読んだ分を戻して残りと繋げる
+				req.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+				if len(body) > requestRecordMaxBody {
+					body = body[:requestRecordMaxBody]
+					rec.Truncated = true
+				}
+				rec.Body = body
+			}
+
+			if line, err := json.Marshal(rec); err == nil {
+				if err := recorder.write(req.Context(), line); err != nil {
+					c.Logger().Errorf("failed to record request : %v", err)
+				}
+			}
+			return next(c)
+		}
+	}
+}
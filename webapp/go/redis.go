@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// newRedisClient は REDIS_MODE に合わせて redis の client を作る。
+// single なら REDIS_ADDRS (なければ REDIS_DSN) の 1 台、cluster なら REDIS_ADDRS を起点にした Redis Cluster、
+// sentinel なら REDIS_ADDRS の Sentinel に REDIS_MASTER_NAME の master を聞いてつなぐ。
+// 設定が食い違っていたら (single に複数台など) どれかを黙って使わずに起動を止める。
+// sentinel では failover で master が替わると go-redis が Sentinel に聞き直すので、デプロイし直さなくていい
+func newRedisClient() (redis.UniversalClient, error) {
+	addrs := splitRedisAddrs(getEnv("REDIS_ADDRS", getEnv("REDIS_DSN", "localhost:6379")))
+	mode := getEnv("REDIS_MODE", "single")
+	if getEnv("REDIS_CLUSTER_ADDRS", "") != "" {
+		return nil, fmt.Errorf("REDIS_CLUSTER_ADDRS is no longer supported, use REDIS_MODE=cluster and REDIS_ADDRS")
+	}
+	if getEnv("REDIS_SENTINEL_ADDRS", "") != "" {
+		return nil, fmt.Errorf("REDIS_SENTINEL_ADDRS is no longer supported, use REDIS_MODE=sentinel and REDIS_ADDRS")
+	}
+	if mode == "single" && len(addrs) > 1 {
+		return nil, fmt.Errorf("REDIS_MODE=single takes one address but REDIS_ADDRS has %d", len(addrs))
+	}
+	if mode != "sentinel" && getEnv("REDIS_MASTER_NAME", "") != "" {
+		return nil, fmt.Errorf("REDIS_MASTER_NAME is only used in sentinel mode but REDIS_MODE=%s", mode)
+	}
+	if getEnv("REDIS_DSN", "") != "" && getEnv("REDIS_ADDRS", "") != "" {
+		return nil, fmt.Errorf("REDIS_DSN and REDIS_ADDRS are both set")
+	}
+	pool := loadRedisPoolConfig()
+	switch mode {
+	case "single":
+		return redis.NewClient(&redis.Options{
+			Addr:         addrs[0],
+			PoolSize:     pool.PoolSize,
+			MinIdleConns: pool.MinIdleConns,
+			DialTimeout:  pool.DialTimeout,
+			ReadTimeout:  pool.ReadTimeout,
+			WriteTimeout: pool.WriteTimeout,
+			PoolTimeout:  pool.PoolTimeout,
+		}), nil
+	case "cluster":
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        addrs,
+			PoolSize:     pool.PoolSize,
+			MinIdleConns: pool.MinIdleConns,
+			DialTimeout:  pool.DialTimeout,
+			ReadTimeout:  pool.ReadTimeout,
+			WriteTimeout: pool.WriteTimeout,
+			PoolTimeout:  pool.PoolTimeout,
+		}), nil
+	case "sentinel":
+		masterName := getEnv("REDIS_MASTER_NAME", "")
+		if masterName == "" {
+			return nil, fmt.Errorf("REDIS_MASTER_NAME is required in sentinel mode")
+		}
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    masterName,
+			SentinelAddrs: addrs,
+			PoolSize:      pool.PoolSize,
+			MinIdleConns:  pool.MinIdleConns,
+			DialTimeout:   pool.DialTimeout,
+			ReadTimeout:   pool.ReadTimeout,
+			WriteTimeout:  pool.WriteTimeout,
+			PoolTimeout:   pool.PoolTimeout,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown REDIS_MODE: %s", mode)
+	}
+}
+
+// redisPoolConfig は接続 pool の設定。0 なら go-redis のデフォルト (PoolSize は CPU 数 x 10)
+type redisPoolConfig struct {
+	PoolSize     int
+	MinIdleConns int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	PoolTimeout  time.Duration
+}
+
+func loadRedisPoolConfig() redisPoolConfig {
+	return redisPoolConfig{
+		PoolSize:     getEnvInt("REDIS_POOL_SIZE", 0),
+		MinIdleConns: getEnvInt("REDIS_MIN_IDLE_CONNS", 0),
+		DialTimeout:  getEnvDuration("REDIS_DIAL_TIMEOUT", 0),
+		ReadTimeout:  getEnvDuration("REDIS_READ_TIMEOUT", 0),
+		WriteTimeout: getEnvDuration("REDIS_WRITE_TIMEOUT", 0),
+		PoolTimeout:  getEnvDuration("REDIS_POOL_TIMEOUT", 0),
+	}
+}
+
+func splitRedisAddrs(s string) []string {
+	addrs := make([]string, 0)
+	for _, a := range strings.Split(s, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = append(addrs, "localhost:6379")
+	}
+	return addrs
+}
+
+// forEachRedisMaster は全 master に対して fn を呼ぶ。
+// SCAN などは node ごとにしか効かないので、cluster ではこれを使う
+func forEachRedisMaster(ctx context.Context, fn func(ctx context.Context, c redis.Cmdable) error) error {
+	if cc, ok := rdb.(*redis.ClusterClient); ok {
+		return cc.ForEachMaster(ctx, func(ctx context.Context, c *redis.Client) error {
+			return fn(ctx, c)
+		})
+	}
+	return fn(ctx, rdb)
+}
+
+// getMulti は keys の値を 1 往復で取る。無い key は nil。
+// cluster では MGET は同じ slot の key にしか使えないので、GET を pipeline にまとめる
+func getMulti(ctx context.Context, keys []string) ([][]byte, error) {
+	if len(keys) == 0 {
+		return [][]byte{}, nil
+	}
+	pipe := rdb.Pipeline()
+	cmds := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Get(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	values := make([][]byte, len(keys))
+	for i, cmd := range cmds {
+		b, err := cmd.Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[i] = b
+	}
+	return values, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// GET のレスポンスを丸ごと searchIDsCache に cache する middleware。RESPONSE_CACHE=1 のときだけ有効。
+// key は path と並べ替えたクエリ (と Accept / Accept-Language) から作る。
+// グループごとに版を持って key に入れておき、書き込みの handler からは purgeResponseCache でグループの版を上げる
+var responseCacheEnabled = getEnvBool("RESPONSE_CACHE", false)
+
+const responseCacheKeyPrefix = "respcache:"
+
+// purge するときの単位。chair は椅子が、estate は物件が変わったときに消す
+const (
+	responseCacheGroupChair  = "chair"
+	responseCacheGroupEstate = "estate"
+)
+
+// cache したときにそのまま返すヘッダ
+var responseCacheHeaders = []string{
+	echo.HeaderContentType,
+	"Content-Language",
+	echo.HeaderVary,
+	"Link",
+	surrogateKeyHeader,
+}
+
+var responseCacheStats = newCacheStats("response", nil)
+
+type cachedResponse struct {
+	Status int               `json:"status"`
+	Header map[string]string `json:"header"`
+	Body   []byte            `json:"body"`
+}
+
+// responseCacheWriter は handler が書いたレスポンスを手元にも残す
+type responseCacheWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseCacheWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// normalizedRequestKey は path とクエリを並べ替えたものから cache の key を作る
+func normalizedRequestKey(r *http.Request) string {
+	query := r.URL.Query()
+	names := make([]string, 0, len(query))
+	for name, values := range query {
+		// 空と指定なしは同じ扱い
+		if strings.Join(values, "") == "" {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	params := make([]string, 0, len(names))
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, v := range values {
+			if name == "features" || name == "excludeFeatures" || name == "layout" {
+				v = normalizeFeatureList(v)
+			}
+			params = append(params, url.QueryEscape(name)+"="+url.QueryEscape(v))
+		}
+	}
+	var b strings.Builder
+	b.WriteString(r.URL.Path)
+	b.WriteString("?" + strings.Join(params, "&"))
+	// 同じ URL でも Accept や言語で中身が変わる
+	b.WriteString("\n" + r.Header.Get(echo.HeaderAccept))
+	b.WriteString("\n" + r.Header.Get("Accept-Language"))
+
+	sum := sha1.Sum([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// responseCache は ttl の間 GET のレスポンスを cache する。groups は purgeResponseCache で消すときの単位
+func responseCache(ttl time.Duration, groups ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if !responseCacheEnabled {
+			return next
+		}
+		return func(c echo.Context) error {
+			req := c.Request()
+			if req.Method != http.MethodGet || !cacheAvailable() {
+				return next(c)
+			}
+			ctx := req.Context()
+			key, err := responseCacheKey(ctx, normalizedRequestKey(req), groups)
+			var values [][]byte
+			if err == nil {
+				values, err = searchIDsCache.GetValues(ctx, []string{key})
+			}
+			if err == nil && values[0] != nil {
+				var cached cachedResponse
+				if err := json.Unmarshal(values[0], &cached); err == nil {
+					responseCacheStats.Hit(1)
+					for name, v := range cached.Header {
+						c.Response().Header().Set(name, v)
+					}
+					c.Response().Header().Set("X-Cache", "HIT")
+					return c.Blob(cached.Status, cached.Header[echo.HeaderContentType], cached.Body)
+				}
+			}
+			if err != nil {
+				responseCacheStats.Error()
+				if isCacheConnectionError(err) {
+					markCacheUnhealthy(err)
+				}
+				return next(c)
+			}
+			responseCacheStats.Miss(1)
+
+			start := time.Now()
+			w := &responseCacheWriter{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = w
+			c.Response().Header().Set("X-Cache", "MISS")
+			if err := next(c); err != nil {
+				return err
+			}
+			if c.Response().Status != http.StatusOK {
+				return nil
+			}
+
+			cached := cachedResponse{
+				Status: c.Response().Status,
+				Header: map[string]string{},
+				Body:   w.body.Bytes(),
+			}
+			for _, name := range responseCacheHeaders {
+				if v := c.Response().Header().Get(name); v != "" {
+					cached.Header[name] = v
+				}
+			}
+			b, err := json.Marshal(cached)
+			if err != nil {
+				return nil
+			}
+			if err := searchIDsCache.PutValues(ctx, map[string][]byte{key: b}, ttl); isCacheConnectionError(err) {
+				markCacheUnhealthy(err)
+			}
+			responseCacheStats.ObserveFill(time.Since(start))
+			return nil
+		}
+	}
+}
+
+// responseCacheKey は groups の今の版を入れた key を返す。
+// グループが 1 つなら respcache:{group}:v{版}:{hash} で、Purge のときに index から消える。
+// 複数なら respcache:{group}+{group}:v{版}.{版}:{hash} で、どれかの版が上がったら読まれなくなる (TTL で消える)
+func responseCacheKey(ctx context.Context, normalized string, groups []string) (string, error) {
+	versions := make([]string, len(groups))
+	for i, g := range groups {
+		version, err := searchIDsCache.Version(ctx, responseCacheKeyPrefix+g)
+		if err != nil {
+			return "", err
+		}
+		versions[i] = strconv.FormatInt(version, 10)
+	}
+	return fmt.Sprintf("%s%s:v%s:{%s}", responseCacheKeyPrefix, strings.Join(groups, "+"), strings.Join(versions, "."), normalized), nil
+}
+
+// purgeResponseCache は groups に入っているレスポンスの cache を消す
+func purgeResponseCache(ctx context.Context, groups ...string) {
+	if !responseCacheEnabled {
+		return
+	}
+	for _, g := range groups {
+		if err := searchIDsCache.Purge(ctx, responseCacheKeyPrefix+g); err != nil {
+			setCachePurgePending()
+			if isCacheConnectionError(err) {
+				markCacheUnhealthy(err)
+			}
+		}
+	}
+}
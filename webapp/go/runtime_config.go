@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+)
+
+// 走らせたまま変えたい設定。起動時は env から読み、PUT /internal/config で丸ごと差し替える。
+// 読む側は currentConfig() で取ったものをそのまま使う (途中で書き換えない)。
+// 既定値は元の実装と同じ動き (perPage と offset の上限なし、log は debug) にして、env.sh.sample もこれに合わせる
+type RuntimeConfig struct {
+	// EstateIDsCacheTTL は estate の ID リストの cache の TTL。0 なら CacheDefaultTTL
+	EstateIDsCacheTTL configDuration `json:"estateIdsCacheTtl"`
+	// ChairIDsCacheTTL は chair の検索結果の ID リストの cache の TTL。0 なら CacheDefaultTTL
+	ChairIDsCacheTTL configDuration `json:"chairIdsCacheTtl"`
+	// CacheDefaultTTL は TTL を指定していない redis の cache (ID リスト、件数、物件の行) の TTL。
+	// 入稿で版が上がって読まれなくなった key や、あまり使われない条件の key もこれだけ経ったら消える
+	CacheDefaultTTL configDuration `json:"cacheDefaultTtl"`
+	// DetailCacheTTL は instance の中の chair / estate の行の cache の TTL。0 なら使わない
+	DetailCacheTTL configDuration `json:"detailCacheTtl"`
+	// CacheTTLJitter は TTL を ±この割合だけばらつかせて、warmup 後に一斉に切れないようにする
+	CacheTTLJitter float64 `json:"cacheTtlJitter"`
+	// MaxPerPage は検索の perPage の上限。0 なら制限しない
+	MaxPerPage int `json:"maxPerPage"`
+	// MaxOffset は検索の page*perPage の上限。超えたら行は返さず count だけ返す。0 なら制限しない
+	MaxOffset int64 `json:"maxOffset"`
+	// NazotteConcurrency は同時に処理するなぞって検索の数。0 なら制限しない
+	NazotteConcurrency int `json:"nazotteConcurrency"`
+	// LogLevel は debug / info / warn / error / off
+	LogLevel string `json:"logLevel"`
+	// DBQueryHeaders はレスポンスに X-DB-Queries / X-DB-Time を付けるか
+	DBQueryHeaders bool `json:"dbQueryHeaders"`
+}
+
+// configDuration は JSON で "10s" のように読み書きする time.Duration
+type configDuration time.Duration
+
+func (d configDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *configDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = configDuration(v)
+	return nil
+}
+
+var logLevels = map[string]log.Lvl{
+	"debug": log.DEBUG,
+	"info":  log.INFO,
+	"warn":  log.WARN,
+	"error": log.ERROR,
+	"off":   log.OFF,
+}
+
+var (
+	runtimeConfig atomic.Value
+	// 書き込みは read-modify-write なので 1 つずつ
+	runtimeConfigMu sync.Mutex
+	// nazotteSem は NazotteConcurrency 分の枠。nil なら制限しない
+	nazotteSem atomic.Value
+)
+
+func init() {
+	conf := RuntimeConfig{
+		EstateIDsCacheTTL:  configDuration(getEnvDuration("ESTATE_IDS_CACHE_TTL", 0)),
+		ChairIDsCacheTTL:   configDuration(getEnvDuration("CHAIR_IDS_CACHE_TTL", 0)),
+		CacheDefaultTTL:    configDuration(getEnvDuration("CACHE_DEFAULT_TTL", time.Hour)),
+		DetailCacheTTL:     configDuration(getEnvDuration("DETAIL_CACHE_TTL", time.Second)),
+		CacheTTLJitter:     getEnvFloat("CACHE_TTL_JITTER", 0.2),
+		MaxPerPage:         getEnvInt("MAX_PER_PAGE", 0),
+		MaxOffset:          int64(getEnvInt("MAX_SEARCH_OFFSET", 0)),
+		NazotteConcurrency: getEnvInt("NAZOTTE_CONCURRENCY", 0),
+		LogLevel:           getEnv("LOG_LEVEL", "debug"),
+		DBQueryHeaders:     getEnvBool("DB_QUERY_HEADERS", false),
+	}
+	if err := conf.validate(); err != nil {
+		// echo の logger はまだ無いので、同じ gommon/log の既定の logger に出す
+		log.Fatalf("invalid runtime config : %v", err)
+	}
+	setRuntimeConfig(conf)
+}
+
+func currentConfig() RuntimeConfig {
+	return runtimeConfig.Load().(RuntimeConfig)
+}
+
+func (conf RuntimeConfig) validate() error {
+	if conf.EstateIDsCacheTTL < 0 || conf.ChairIDsCacheTTL < 0 || conf.DetailCacheTTL < 0 {
+		return fmt.Errorf("cache TTL must not be negative")
+	}
+	if conf.CacheDefaultTTL <= 0 {
+		return fmt.Errorf("cacheDefaultTtl must be positive")
+	}
+	if conf.CacheTTLJitter < 0 || conf.CacheTTLJitter >= 1 {
+		return fmt.Errorf("cacheTtlJitter must be in [0, 1) : %v", conf.CacheTTLJitter)
+	}
+	if conf.MaxPerPage < 0 || conf.MaxOffset < 0 || conf.NazotteConcurrency < 0 {
+		return fmt.Errorf("maxPerPage, maxOffset and nazotteConcurrency must not be negative")
+	}
+	if _, ok := logLevels[conf.LogLevel]; !ok {
+		return fmt.Errorf("unknown logLevel : %v", conf.LogLevel)
+	}
+	return nil
+}
+
+func (conf RuntimeConfig) logLevel() log.Lvl {
+	return logLevels[conf.LogLevel]
+}
+
+// setRuntimeConfig は conf に差し替える。nazotte の枠が変わったら作り直す。
+// 古い枠で処理中のものはそのまま古い枠に返すので、切り替え直後は一時的に両方の合計まで走る
+func setRuntimeConfig(conf RuntimeConfig) {
+	prev, ok := runtimeConfig.Load().(RuntimeConfig)
+	runtimeConfig.Store(conf)
+	if ok && prev.NazotteConcurrency == conf.NazotteConcurrency {
+		return
+	}
+	var sem chan struct{}
+	if conf.NazotteConcurrency > 0 {
+		sem = make(chan struct{}, conf.NazotteConcurrency)
+	}
+	nazotteSem.Store(sem)
+}
+
+// acquireNazotte はなぞって検索の枠を取る。返した関数で枠を返す
+func acquireNazotte(c echo.Context) (func(), error) {
+	sem := nazotteSem.Load().(chan struct{})
+	if sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-c.Request().Context().Done():
+		return nil, c.Request().Context().Err()
+	}
+}
+
+// exceedsMaxPerPage は perPage が上限を超えているか
+func exceedsMaxPerPage(perPage int) bool {
+	max := currentConfig().MaxPerPage
+	return max > 0 && perPage > max
+}
+
+// clampPaging は offset が MaxOffset を超えていたら limit を 0 にする。
+// 大きな OFFSET は MySQL が読み捨てる行が増えるだけなので、行は取らずに count だけ返す
+func clampPaging(limit int64, offset int64) (int64, int64) {
+	max := currentConfig().MaxOffset
+	if max > 0 && offset > max {
+		return 0, 0
+	}
+	return limit, offset
+}
+
+func getRuntimeConfig(c echo.Context) error {
+	return c.JSON(http.StatusOK, currentConfig())
+}
+
+// putRuntimeConfig は body に書かれた項目だけを今の設定に上書きする
+func putRuntimeConfig(c echo.Context) error {
+	runtimeConfigMu.Lock()
+	defer runtimeConfigMu.Unlock()
+
+	conf := currentConfig()
+	if err := json.NewDecoder(c.Request().Body).Decode(&conf); err != nil {
+		c.Logger().Infof("put runtime config failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if err := conf.validate(); err != nil {
+		c.Logger().Infof("put runtime config failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	setRuntimeConfig(conf)
+	c.Echo().Logger.SetLevel(conf.logLevel())
+	return c.JSON(http.StatusOK, conf)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// chair.effective_price は COALESCE(sale_price, price) の generated column で、値段の絞り込みと並び替えはこれの index を使う。
+// 期限 (UTC_TIMESTAMP との比較) は generated column の式に入れられないので、期限が来たセールはここで sale_price ごと消す
+const (
+	// saleExpiryPollInterval は次のセールの期限が無いときや遠いときに、新しいセールを見に行く間隔
+	saleExpiryPollInterval = time.Minute
+	saleExpiryTimeout      = 10 * time.Second
+)
+
+// runSaleExpirer は一番早いセールの期限まで待って、期限が来たセールを消す
+func runSaleExpirer(ctx context.Context, logger echo.Logger) {
+	for {
+		wait, err := untilNextSaleExpiry(ctx)
+		if err != nil {
+			logger.Errorf("failed to get next sale expiry : %v", err)
+			wait = saleExpiryPollInterval
+		}
+		if wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+		if err := expireSales(ctx, logger); err != nil {
+			logger.Errorf("failed to expire sales : %v", err)
+		}
+	}
+}
+
+// untilNextSaleExpiry は一番早いセールの期限までの時間を返す。DB とこちらの時計がずれていても待ちすぎないように DB の時刻で測る
+func untilNextSaleExpiry(ctx context.Context) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, saleExpiryTimeout)
+	defer cancel()
+	var micros sql.NullInt64
+	err := db.GetContext(ctx, &micros, "SELECT TIMESTAMPDIFF(MICROSECOND, UTC_TIMESTAMP(6), MIN(sale_until)) FROM chair WHERE sale_price IS NOT NULL AND sale_until IS NOT NULL")
+	if err != nil {
+		return 0, err
+	}
+	if !micros.Valid {
+		return saleExpiryPollInterval, nil
+	}
+	wait := time.Duration(micros.Int64) * time.Microsecond
+	if wait > saleExpiryPollInterval {
+		wait = saleExpiryPollInterval
+	}
+	return wait, nil
+}
+
+// expireSales は期限が来たセールを消して effective_price を price に戻し、値段の順番を持っている cache を捨てる
+func expireSales(ctx context.Context, logger echo.Logger) error {
+	ctx, cancel := context.WithTimeout(ctx, saleExpiryTimeout)
+	defer cancel()
+	// セールが終わるのは動きではないので updated_at はそのままにする
+	res, err := db.ExecContext(ctx, "UPDATE chair SET sale_price = NULL, sale_until = NULL, updated_at = updated_at WHERE sale_until <= UTC_TIMESTAMP(6)")
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	chairDetailCache.Purge()
+	if err := purgeChairIDsFromRedis(ctx); err != nil {
+		logger.Errorf("failed to purge chair ids: %v", err)
+	}
+	if cacheAvailable() {
+		if err := handlePurgeError(rdb.Del(ctx, lowPricedChairSetKey).Err()); err != nil {
+			logger.Errorf("failed to purge low priced chair set: %v", err)
+		}
+	}
+	refreshLowPricedChairCache(ctx)
+	purgeResponseCache(ctx, responseCacheGroupChair)
+	purgeSurrogateKeys(logger, surrogateKeyChairSearch)
+	return nil
+}
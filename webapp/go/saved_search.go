@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+type SavedSearch struct {
+	ID         int64          `db:"id" json:"id"`
+	Kind       string         `db:"kind" json:"kind"`
+	Query      string         `db:"query" json:"query"`
+	Email      sql.NullString `db:"email" json:"-"`
+	WebhookURL sql.NullString `db:"webhook_url" json:"-"`
+}
+
+type SavedSearchRequest struct {
+	// Kind は estate か chair
+	Kind string `json:"kind"`
+	// Query は検索 API に渡すクエリ文字列 (doorHeightRangeId=1&features=... など)
+	Query      string `json:"query"`
+	Email      string `json:"email"`
+	WebhookURL string `json:"webhookUrl"`
+}
+
+type SavedSearchResponse struct {
+	ID int64 `json:"id"`
+	// DeleteToken は DELETE /api/user/saved_searches/:id の X-Delete-Token に入れる
+	DeleteToken string `json:"deleteToken"`
+}
+
+const (
+	// 1 回の SELECT でまとめて突き合わせる保存検索の数の目安。入稿した行の数が多いときは減らす
+	savedSearchMatchBatchSize = 50
+	savedSearchMatchMaxParams = 10000
+	savedSearchMatchTimeout   = time.Minute
+)
+
+// newDeleteToken は保存検索を消すときに使う推測できない token を作る
+func newDeleteToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// postSavedSearch は検索条件を保存する。
+// 以降に入稿された物件・椅子が条件に合えば email か webhook で通知する
+func postSavedSearch(c echo.Context) error {
+	ctx := c.Request().Context()
+	var req SavedSearchRequest
+	if err := c.Bind(&req); err != nil {
+		c.Logger().Infof("post saved search failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if req.Email == "" && req.WebhookURL == "" {
+		c.Logger().Info("post saved search failed : neither email nor webhookUrl is given")
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if strings.ContainsAny(req.Email, "\r\n") {
+		c.Logger().Infof("post saved search failed : invalid email %q", req.Email)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if req.WebhookURL != "" {
+		u, err := url.Parse(req.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			c.Logger().Infof("post saved search failed : invalid webhookUrl %v", req.WebhookURL)
+			return c.NoContent(http.StatusBadRequest)
+		}
+		if !isSavedSearchWebhookAllowed(u) {
+			c.Logger().Infof("post saved search failed : webhookUrl host is not allowed %v", req.WebhookURL)
+			return c.NoContent(http.StatusForbidden)
+		}
+	}
+	values, err := url.ParseQuery(req.Query)
+	if err != nil {
+		c.Logger().Infof("post saved search failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	// あいまい検索は n-gram が作り直される途中だと結果がぶれるので保存できないことにする
+	if values.Get("keyword") != "" {
+		c.Logger().Info("post saved search failed : keyword is not supported")
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if _, errStatusCode := savedSearchConditions(req.Kind, values); errStatusCode != 0 {
+		c.Logger().Infof("post saved search failed : invalid condition %v", req.Query)
+		return c.NoContent(errStatusCode)
+	}
+
+	token, err := newDeleteToken()
+	if err != nil {
+		c.Logger().Errorf("post saved search failed to make token : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	res, err := db.ExecContext(ctx, "INSERT INTO saved_search(kind, query, email, webhook_url, delete_token) VALUES(?,?,?,?,?)",
+		req.Kind, values.Encode(), sql.NullString{String: req.Email, Valid: req.Email != ""}, sql.NullString{String: req.WebhookURL, Valid: req.WebhookURL != ""}, token)
+	if err != nil {
+		c.Logger().Errorf("post saved search DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		c.Logger().Errorf("post saved search DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusCreated, SavedSearchResponse{ID: id, DeleteToken: token})
+}
+
+// deleteSavedSearch は保存した検索条件を消す。保存したときに返した token が X-Delete-Token に無ければ 404 にする
+func deleteSavedSearch(c echo.Context) error {
+	ctx := c.Request().Context()
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.Logger().Infof("delete saved search failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	token := c.Request().Header.Get("X-Delete-Token")
+	if token == "" {
+		return c.NoContent(http.StatusNotFound)
+	}
+	res, err := db.ExecContext(ctx, "DELETE FROM saved_search WHERE id = ? AND delete_token = ?", id, token)
+	if err != nil {
+		c.Logger().Errorf("delete saved search DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return c.NoContent(http.StatusNotFound)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func savedSearchConditions(kind string, values url.Values) (*sqlFilter, int) {
+	switch kind {
+	case "estate":
+		return makeEstateConditions(estateSearchQueryFromValues(values))
+	case "chair":
+		return makeChairConditions(chairSearchQueryFromValues(values))
+	default:
+		return nil, http.StatusBadRequest
+	}
+}
+
+// matchSavedSearches は入稿された ids を保存された検索条件と突き合わせて、合うものがあれば通知する。
+// 入稿のレスポンスを遅らせないように goroutine で呼ぶ。
+// 条件は UNION ALL でまとめて聞き、通知は savedSearchNotifySem の数だけ並べて送る
+func matchSavedSearches(logger echo.Logger, kind string, ids []int64) {
+	if len(ids) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), savedSearchMatchTimeout)
+	defer cancel()
+	searches := []SavedSearch{}
+	if err := db.SelectContext(ctx, &searches, "SELECT id, kind, query, email, webhook_url FROM saved_search WHERE kind = ?", kind); err != nil {
+		logger.Errorf("failed to load saved searches : %v", err)
+		return
+	}
+
+	batchSize := savedSearchMatchBatchSize
+	if n := savedSearchMatchMaxParams / len(ids); n < batchSize {
+		batchSize = n
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	var wg sync.WaitGroup
+	for start := 0; start < len(searches); start += batchSize {
+		end := start + batchSize
+		if end > len(searches) {
+			end = len(searches)
+		}
+		matched, err := matchSavedSearchBatch(ctx, kind, searches[start:end], ids)
+		if err != nil {
+			logger.Errorf("failed to match saved searches : %v", err)
+			continue
+		}
+		for _, s := range searches[start:end] {
+			if len(matched[s.ID]) == 0 {
+				continue
+			}
+			wg.Add(1)
+			savedSearchNotifySem <- struct{}{}
+			go func(s SavedSearch, matched []int64) {
+				defer wg.Done()
+				defer func() { <-savedSearchNotifySem }()
+				sendNotification(ctx, logger, s, matched)
+			}(s, matched[s.ID])
+		}
+	}
+	wg.Wait()
+}
+
+// matchSavedSearchBatch は searches の条件それぞれに合う ids を 1 回の SELECT で調べて、保存検索の ID ごとに返す
+func matchSavedSearchBatch(ctx context.Context, kind string, searches []SavedSearch, ids []int64) (map[int64][]int64, error) {
+	subqueries := make([]string, 0, len(searches))
+	params := make([]interface{}, 0)
+	for _, s := range searches {
+		values, err := url.ParseQuery(s.Query)
+		if err != nil {
+			continue
+		}
+		f, errStatusCode := savedSearchConditions(kind, values)
+		if errStatusCode != 0 {
+			continue
+		}
+		f.In(colID, ids)
+		where, p := f.Where()
+		subqueries = append(subqueries, "(SELECT ? AS saved_search_id, id FROM "+kind+" WHERE "+where+")")
+		params = append(params, s.ID)
+		params = append(params, p...)
+	}
+	matched := make(map[int64][]int64)
+	if len(subqueries) == 0 {
+		return matched, nil
+	}
+	query, args, err := sqlx.In(strings.Join(subqueries, " UNION ALL ")+" ORDER BY saved_search_id, id", params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build saved search query : %w", err)
+	}
+	rows := []struct {
+		SavedSearchID int64 `db:"saved_search_id"`
+		ID            int64 `db:"id"`
+	}{}
+	if err := db.SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		matched[r.SavedSearchID] = append(matched[r.SavedSearchID], r.ID)
+	}
+	return matched, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// golang.org/x/sync/singleflight と同じもの。同じ key の呼び出しが同時に来たら 1 回だけ fn を実行して、
+// 残りはその結果を待って受け取る。cache が無いときに同じ条件の検索で MySQL に同じクエリが並ぶのを防ぐ
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+// flightPanicError は fn が panic したときに待っていた側に返すエラー
+type flightPanicError struct {
+	value interface{}
+}
+
+func (e *flightPanicError) Error() string {
+	return fmt.Sprintf("singleflight: fn panicked: %v", e.value)
+}
+
+// Do は key で fn を実行して結果を返す。shared は他の呼び出しと結果を共有したかどうか。
+// fn が panic したら key を外して待っている側には flightPanicError を返し、fn を呼んだ側ではそのまま panic し直す
+func (g *flightGroup) Do(key string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.val, call.err, true
+	}
+	call := &flightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	normalReturn := false
+	defer func() {
+		var recovered interface{}
+		if !normalReturn {
+			recovered = recover()
+			call.val, call.err = nil, &flightPanicError{value: recovered}
+		}
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		call.wg.Done()
+		// recovered が nil なら runtime.Goexit なのでそのまま抜ける
+		if !normalReturn && recovered != nil {
+			panic(recovered)
+		}
+	}()
+	call.val, call.err = fn()
+	normalReturn = true
+	return call.val, call.err, false
+}
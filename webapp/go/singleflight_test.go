@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlightGroupShared(t *testing.T) {
+	var g flightGroup
+	release := make(chan struct{})
+	started := make(chan struct{})
+	leader := make(chan interface{})
+	go func() {
+		v, _, _ := g.Do("k", func() (interface{}, error) {
+			close(started)
+			<-release
+			return 1, nil
+		})
+		leader <- v
+	}()
+	<-started
+
+	done := make(chan bool)
+	go func() {
+		v, err, shared := g.Do("k", func() (interface{}, error) { return 2, nil })
+		done <- v == 1 && err == nil && shared
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	if v := <-leader; v != 1 {
+		t.Errorf("leader got %v", v)
+	}
+	if !<-done {
+		t.Error("waiter did not share the leader's result")
+	}
+}
+
+// fn が panic しても待っている側が止まったままにならず、key も残らない
+func TestFlightGroupPanic(t *testing.T) {
+	var g flightGroup
+	release := make(chan struct{})
+	started := make(chan struct{})
+	leader := make(chan interface{})
+	go func() {
+		defer func() { leader <- recover() }()
+		g.Do("k", func() (interface{}, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+
+	waiter := make(chan error)
+	go func() {
+		_, err, _ := g.Do("k", func() (interface{}, error) { return nil, nil })
+		waiter <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	if r := <-leader; r != "boom" {
+		t.Errorf("leader recovered %v, want boom", r)
+	}
+	select {
+	case err := <-waiter:
+		if _, ok := err.(*flightPanicError); !ok {
+			t.Errorf("waiter err = %v, want flightPanicError", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter is blocked after panic")
+	}
+
+	v, err, shared := g.Do("k", func() (interface{}, error) { return 3, nil })
+	if v != 3 || err != nil || shared {
+		t.Errorf("Do after panic = %v, %v, %v", v, err, shared)
+	}
+}
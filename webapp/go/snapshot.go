@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/labstack/echo"
+)
+
+// cacheSnapshot は redis にある estate / chair の今の版の ID リストの cache を丸ごと保存したもの。
+// 版は initialize で 0 に戻るので、key ではなく条件の hash で持っておき、戻すときに今の版の key にする
+type cacheSnapshot struct {
+	Lists []cacheSnapshotList `json:"lists"`
+}
+
+type cacheSnapshotList struct {
+	Prefix string  `json:"prefix"`
+	Hash   string  `json:"hash"`
+	IDs    []int64 `json:"ids"`
+}
+
+// snapshotIDsCacheTTLs は戻した ID リストに付ける TTL。検索で入れるときと揃える
+var snapshotIDsCacheTTLs = map[string]func(ctx context.Context) time.Duration{
+	"estate": estateIDsCacheTTL,
+	"chair":  chairIDsCacheTTL,
+}
+
+type CacheSnapshotResponse struct {
+	Keys int `json:"keys"`
+}
+
+func cacheSnapshotPath() string {
+	return getEnv("CACHE_SNAPSHOT_PATH", "../cache_snapshot.json")
+}
+
+// postCacheSnapshot は今 redis にある cache をファイルに書き出す。
+// 負荷走行後に叩いておけば、次の initialize で温まった cache から始められる
+func postCacheSnapshot(c echo.Context) error {
+	// memcached や memory は key を列挙できないので書き出せない (戻すのはどの backend でもできる)
+	if _, ok := searchIDsCache.(redisIDsCache); !ok {
+		c.Logger().Infof("cache snapshot needs IDS_CACHE_BACKEND=redis")
+		return c.NoContent(http.StatusBadRequest)
+	}
+	n, err := dumpCacheSnapshot(c.Request().Context())
+	if err != nil {
+		c.Logger().Errorf("failed to dump cache snapshot : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, CacheSnapshotResponse{Keys: n})
+}
+
+func dumpCacheSnapshot(ctx context.Context) (int, error) {
+	snapshot := cacheSnapshot{Lists: []cacheSnapshotList{}}
+	// 今の版の index に入っている key だけを見る。件数や物件の行 (string) も index に入っているので list だけにする
+	for prefix, versionKey := range idsCacheVersionKeys {
+		version, err := rdb.Get(ctx, versionKey).Int64()
+		if err != nil && err != redis.Nil {
+			return 0, err
+		}
+		keys, err := rdb.SMembers(ctx, idsCacheIndexKey(prefix, version)).Result()
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range keys {
+			t, err := rdb.Type(ctx, key).Result()
+			if err != nil {
+				return 0, err
+			}
+			if t != "list" {
+				continue
+			}
+			vals, err := rdb.LRange(ctx, key, 0, -1).Result()
+			if err != nil {
+				return 0, err
+			}
+			if len(vals) == 0 {
+				continue
+			}
+			ids := make([]int64, 0, len(vals))
+			for _, v := range vals {
+				id, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return 0, err
+				}
+				ids = append(ids, id)
+			}
+			// key は {prefix}:v{版}:{{hash}}
+			hash := strings.Trim(key[strings.LastIndexByte(key, ':')+1:], "{}")
+			snapshot.Lists = append(snapshot.Lists, cacheSnapshotList{Prefix: prefix, Hash: hash, IDs: ids})
+		}
+	}
+
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return 0, err
+	}
+	// 書きかけのファイルを読まないように rename で置き換える
+	path := cacheSnapshotPath()
+	if err := ioutil.WriteFile(path+".tmp", b, 0644); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return 0, err
+	}
+	return len(snapshot.Lists), nil
+}
+
+// restoreCacheSnapshot は dumpCacheSnapshot で書き出した cache を今の版の key で searchIDsCache に戻す。
+// snapshot が無い場合は何もしない
+func restoreCacheSnapshot(ctx context.Context) (int, error) {
+	b, err := ioutil.ReadFile(cacheSnapshotPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var snapshot cacheSnapshot
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return 0, err
+	}
+	// searchIDsCache を通して入れるので、TTL と index (版を上げたときに消すため) は検索で入れたときと同じになる
+	n := 0
+	for _, l := range snapshot.Lists {
+		ttl, ok := snapshotIDsCacheTTLs[l.Prefix]
+		if !ok || len(l.IDs) == 0 {
+			continue
+		}
+		key, err := searchIDsCache.HashedKey(ctx, l.Prefix, l.Hash)
+		if err != nil {
+			return n, err
+		}
+		if err := searchIDsCache.PutList(ctx, key, l.IDs, ttl(ctx)); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// systemd の起動順によっては MySQL や redis がまだ上がっていないので、起動時は待ってつなぎ直す。
+// つながるまでは /healthz 以外に 503 を返し (readinessGate)、つながってから裏の処理を動かす
+var (
+	startupRetryAttempts       = getEnvInt("STARTUP_RETRY_ATTEMPTS", 10)
+	startupRetryInitialBackoff = getEnvDuration("STARTUP_RETRY_INITIAL_BACKOFF", 200*time.Millisecond)
+	startupRetryMaxBackoff     = getEnvDuration("STARTUP_RETRY_MAX_BACKOFF", 5*time.Second)
+	healthzTimeout             = getEnvDuration("HEALTHZ_TIMEOUT", time.Second)
+)
+
+var backendsReady int32
+
+func isReady() bool {
+	return atomic.LoadInt32(&backendsReady) == 1
+}
+
+func markReady() {
+	atomic.StoreInt32(&backendsReady, 1)
+}
+
+// retryWithBackoff は fn が成功するまで startupRetryAttempts 回まで、待ち時間を倍にしながら呼ぶ
+func retryWithBackoff(ctx context.Context, logger echo.Logger, name string, fn func(ctx context.Context) error) error {
+	backoff := startupRetryInitialBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(ctx); err == nil {
+			return nil
+		}
+		if attempt >= startupRetryAttempts {
+			return err
+		}
+		logger.Warnf("%s is not ready (attempt %d/%d), retrying in %v : %v", name, attempt, startupRetryAttempts, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > startupRetryMaxBackoff {
+			backoff = startupRetryMaxBackoff
+		}
+	}
+}
+
+// waitForBackends は MySQL と searchIDsCache (IDS_CACHE_BACKEND) につながるまで待つ。
+// MySQL につながらなければ動けないのでエラーを返すが、cache は使わないことにして進める
+func waitForBackends(ctx context.Context, logger echo.Logger) error {
+	if err := retryWithBackoff(ctx, logger, "mysql", func(ctx context.Context) error {
+		return db.PingContext(ctx)
+	}); err != nil {
+		return err
+	}
+	if err := retryWithBackoff(ctx, logger, "cache", func(ctx context.Context) error {
+		return searchIDsCache.Ping(ctx)
+	}); err != nil {
+		logger.Errorf("cache is not reachable, starting without cache : %v", err)
+		markCacheUnhealthy(err)
+	}
+	return nil
+}
+
+// readinessGate は waitForBackends が終わるまで /healthz 以外に 503 を返す
+func readinessGate() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if isReady() || c.Path() == "/healthz" {
+				return next(c)
+			}
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(startupRetryMaxBackoff/time.Second)+1))
+			return c.NoContent(http.StatusServiceUnavailable)
+		}
+	}
+}
+
+type HealthzResponse struct {
+	Ready bool   `json:"ready"`
+	MySQL string `json:"mysql"`
+	Redis string `json:"redis"`
+}
+
+// getHealthz は起動が終わっていて MySQL に今つながるなら 200 を返す。
+// つなぎ直しは database/sql と go-redis の pool が勝手にやるので、ここでは今の状態だけを見る。
+// redis は落ちていても cache を使わないだけなので 200 のまま unavailable と返す
+func getHealthz(c echo.Context) error {
+	res := HealthzResponse{Ready: isReady(), MySQL: "unknown", Redis: "unknown"}
+	if !res.Ready {
+		return c.JSON(http.StatusServiceUnavailable, res)
+	}
+	ctx, cancel := context.WithTimeout(c.Request().Context(), healthzTimeout)
+	defer cancel()
+
+	status := http.StatusOK
+	res.MySQL = "ok"
+	if err := db.PingContext(ctx); err != nil {
+		c.Logger().Errorf("healthz mysql ping failed : %v", err)
+		res.MySQL = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+	res.Redis = "ok"
+	if !cacheAvailable() {
+		// 戻ったかどうかは runCacheHealthProbe が見ている
+		res.Redis = "unavailable"
+	}
+	return c.JSON(status, res)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"math"
+	"net/http"
+
+	"github.com/astj/isucon10-yosen/webapp/go/geo"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+// 不動産の表示ルールにならって徒歩 1 分 = 80m で計算する (距離は直線距離)
+const walkMetersPerMinute = 80
+
+type Station struct {
+	ID        int64   `db:"id" json:"id"`
+	Name      string  `db:"name" json:"name"`
+	Latitude  float64 `db:"latitude" json:"latitude"`
+	Longitude float64 `db:"longitude" json:"longitude"`
+}
+
+func loadStations(ctx context.Context) ([]Station, error) {
+	stations := []Station{}
+	err := db.SelectContext(ctx, &stations, "SELECT * FROM station")
+	return stations, err
+}
+
+// nearestStation は一番近い駅と徒歩何分かを返す。駅がなければ nil
+func nearestStation(stations []Station, latitude float64, longitude float64) (*Station, int64) {
+	var nearest *Station
+	minDistance := math.Inf(1)
+	p := geo.Point{Lat: latitude, Lng: longitude}
+	for i := range stations {
+		d := geo.Distance(p, geo.Point{Lat: stations[i].Latitude, Lng: stations[i].Longitude})
+		if d < minDistance {
+			minDistance = d
+			nearest = &stations[i]
+		}
+	}
+	if nearest == nil {
+		return nil, 0
+	}
+	return nearest, int64(math.Ceil(minDistance / walkMetersPerMinute))
+}
+
+// postStation は駅の CSV (id,name,latitude,longitude) を入稿して、全物件の最寄り駅を計算し直す
+func postStation(c echo.Context) error {
+	ctx := c.Request().Context()
+	header, err := c.FormFile("stations")
+	if err != nil {
+		c.Logger().Errorf("failed to get form file: %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	f, err := openUpload(header)
+	if err == errUnsupportedEncoding {
+		c.Logger().Infof("failed to open form file: %v", err)
+		return c.NoContent(http.StatusUnsupportedMediaType)
+	}
+	if errors.Is(err, errCorruptUpload) {
+		c.Logger().Infof("failed to open form file: %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if err != nil {
+		c.Logger().Errorf("failed to open form file: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if errors.Is(err, errCorruptUpload) {
+		c.Logger().Infof("failed to read csv: %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if err != nil {
+		c.Logger().Errorf("failed to read csv: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("failed to begin tx: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+	for _, row := range records {
+		rm := RecordMapper{Record: row}
+		id := rm.NextInt()
+		name := rm.NextString()
+		latitude := rm.NextFloat()
+		longitude := rm.NextFloat()
+		if err := rm.Err(); err != nil {
+			c.Logger().Errorf("failed to read record: %v", err)
+			return c.NoContent(http.StatusBadRequest)
+		}
+		if err := (Coordinate{Latitude: latitude, Longitude: longitude}).validate(); err != nil {
+			c.Logger().Infof("invalid station coordinate: %v", err)
+			return c.NoContent(http.StatusBadRequest)
+		}
+		_, err := tx.Exec("INSERT INTO station(id, name, latitude, longitude) VALUES(?,?,?,?) ON DUPLICATE KEY UPDATE name = VALUES(name), latitude = VALUES(latitude), longitude = VALUES(longitude)", id, name, latitude, longitude)
+		if err != nil {
+			c.Logger().Errorf("failed to insert station: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	if err := updateNearestStations(ctx, tx); err != nil {
+		c.Logger().Errorf("failed to update nearest stations: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Errorf("failed to commit tx: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// 検索結果が変わるので cache も飛ばす
+	_ = purgeEstateIDsFromRedis()
+	purgeSurrogateKeys(c.Logger(), surrogateKeyEstate, surrogateKeyEstateSearch)
+	return c.NoContent(http.StatusCreated)
+}
+
+// updateNearestStations は全物件の最寄り駅を計算し直す。駅がなければ何もしない
+func updateNearestStations(ctx context.Context, tx *sqlx.Tx) error {
+	stations := []Station{}
+	if err := tx.SelectContext(ctx, &stations, "SELECT * FROM station"); err != nil {
+		return err
+	}
+	if len(stations) == 0 {
+		return nil
+	}
+	locations := []struct {
+		ID        int64   `db:"id"`
+		Latitude  float64 `db:"latitude"`
+		Longitude float64 `db:"longitude"`
+	}{}
+	if err := tx.SelectContext(ctx, &locations, "SELECT id, latitude, longitude FROM estate"); err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, "UPDATE estate SET nearest_station = ?, station_walk_minutes = ? WHERE id = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, l := range locations {
+		station, minutes := nearestStation(stations, l.Latitude, l.Longitude)
+		if _, err := stmt.ExecContext(ctx, station.Name, minutes, l.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func initializeNearestStations(ctx context.Context) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := updateNearestStations(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 前方一致の候補は instance の中に並べて持ち、二分探索で引く。
+// 候補が変わったら searchIDsCache の版 ({prefix}:version) を上げ、各 instance は版が変わったのを見て裏で作り直す。
+// 作っている間は待たずに前の候補 (無ければ空) を返す
+const (
+	suggestChairNamePrefix     = "suggest:chair_name"
+	suggestEstateAddressPrefix = "suggest:estate_address"
+
+	suggestLimit        = 10
+	suggestBuildTimeout = time.Minute
+)
+
+// SuggestResponse は /api/suggest のレスポンス
+type SuggestResponse struct {
+	Features        []string `json:"features"`
+	ChairNames      []string `json:"chairNames"`
+	EstateAddresses []string `json:"estateAddresses"`
+}
+
+// suggestIndex は 1 種類の候補。prefix が空なら版を見ずに 1 度だけ作る
+type suggestIndex struct {
+	name   string
+	prefix string
+	load   func(ctx context.Context) ([]string, error)
+
+	mu      sync.RWMutex
+	built   bool
+	version int64
+	values  []string
+
+	building int32
+}
+
+var (
+	suggestFeatures = &suggestIndex{name: "feature", load: func(ctx context.Context) ([]string, error) {
+		features := make([]string, 0)
+		features = append(features, chairSearchCondition.Feature.List...)
+		features = append(features, estateSearchCondition.Feature.List...)
+		return features, nil
+	}}
+	// 売り切れた椅子は chair から消えているので、ここにある名前は全部買える
+	suggestChairNames = &suggestIndex{name: "chair_name", prefix: suggestChairNamePrefix, load: func(ctx context.Context) ([]string, error) {
+		var names []string
+		err := db.SelectContext(ctx, &names, "SELECT DISTINCT name FROM chair")
+		return names, err
+	}}
+	suggestEstateAddresses = &suggestIndex{name: "estate_address", prefix: suggestEstateAddressPrefix, load: func(ctx context.Context) ([]string, error) {
+		var addresses []string
+		err := db.SelectContext(ctx, &addresses, "SELECT DISTINCT address FROM estate WHERE status = 'available'")
+		return addresses, err
+	}}
+
+	suggestIndexes = []*suggestIndex{suggestFeatures, suggestChairNames, suggestEstateAddresses}
+)
+
+func init() {
+	for _, s := range suggestIndexes {
+		localResetHooks = append(localResetHooks, s.reset)
+	}
+}
+
+func getSuggest(c echo.Context) error {
+	ctx := c.Request().Context()
+	q := c.QueryParam("q")
+	res := SuggestResponse{
+		Features:        []string{},
+		ChairNames:      []string{},
+		EstateAddresses: []string{},
+	}
+	if q == "" {
+		return c.JSON(http.StatusOK, res)
+	}
+	res.Features = suggestFeatures.lookup(ctx, c.Logger(), q)
+	res.ChairNames = suggestChairNames.lookup(ctx, c.Logger(), q)
+	res.EstateAddresses = suggestEstateAddresses.lookup(ctx, c.Logger(), q)
+	return c.JSON(http.StatusOK, res)
+}
+
+// currentVersion は候補の今の版を返す。cache が使えなければ今持っている版のままにする
+func (s *suggestIndex) currentVersion(ctx context.Context) (int64, bool) {
+	if s.prefix == "" || !cacheAvailable() {
+		return 0, false
+	}
+	version, err := searchIDsCache.Version(ctx, s.prefix)
+	if err != nil {
+		if isCacheConnectionError(err) {
+			markCacheUnhealthy(err)
+		}
+		return 0, false
+	}
+	return version, true
+}
+
+// lookup は q から始まる候補を suggestLimit 件まで返す。
+// まだ作っていないか版が変わっていたら、裏で作り直して今ある候補を返す
+func (s *suggestIndex) lookup(ctx context.Context, logger echo.Logger, q string) []string {
+	version, ok := s.currentVersion(ctx)
+	s.mu.RLock()
+	values := s.values
+	stale := !s.built || (ok && s.version != version)
+	if !ok {
+		version = s.version
+	}
+	s.mu.RUnlock()
+	if stale {
+		go s.rebuild(logger, version)
+	}
+	return suggestByPrefix(values, q)
+}
+
+// rebuild は候補を MySQL から作り直して version 版として持つ。この instance の中では同時に 1 つしか走らない。
+// 読んでいる途中で版が上がったら、次の lookup でもう一度作り直す
+func (s *suggestIndex) rebuild(logger echo.Logger, version int64) {
+	if !atomic.CompareAndSwapInt32(&s.building, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&s.building, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), suggestBuildTimeout)
+	defer cancel()
+	values, err := s.load(ctx)
+	if err != nil {
+		logger.Errorf("failed to build suggest index %s : %v", s.name, err)
+		return
+	}
+	values = sortUniqueStrings(values)
+	s.mu.Lock()
+	s.built, s.version, s.values = true, version, values
+	s.mu.Unlock()
+}
+
+// reset は initialize で DB が作り直されたときに候補を捨てる
+func (s *suggestIndex) reset() {
+	s.mu.Lock()
+	s.built, s.version, s.values = false, 0, nil
+	s.mu.Unlock()
+}
+
+// purge は候補が変わったことを他の instance にも伝えて、次に引かれたときに作り直してもらう
+func (s *suggestIndex) purge(ctx context.Context) error {
+	return handlePurgeError(searchIDsCache.Purge(ctx, s.prefix))
+}
+
+// rebuildSuggestIndexes は起動したときに候補を先に作っておく
+func rebuildSuggestIndexes(logger echo.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), suggestBuildTimeout)
+	defer cancel()
+	for _, s := range suggestIndexes {
+		version, _ := s.currentVersion(ctx)
+		s.rebuild(logger, version)
+	}
+}
+
+// suggestByPrefix は並べた values から prefix で始まるものを suggestLimit 件まで返す
+func suggestByPrefix(values []string, prefix string) []string {
+	res := []string{}
+	for i := sort.SearchStrings(values, prefix); i < len(values) && len(res) < suggestLimit; i++ {
+		if !strings.HasPrefix(values[i], prefix) {
+			break
+		}
+		res = append(res, values[i])
+	}
+	return res
+}
+
+// sortUniqueStrings は values を並べて重複を除く (values は書き換える)
+func sortUniqueStrings(values []string) []string {
+	sort.Strings(values)
+	n := 0
+	for i, v := range values {
+		if i > 0 && v == values[n-1] {
+			continue
+		}
+		values[n] = v
+		n++
+	}
+	return values[:n]
+}
+
+// addChairNameSuggestions は入稿された椅子の名前を候補に入れるために、各 instance に作り直してもらう
+func addChairNameSuggestions(ctx context.Context, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	return suggestChairNames.purge(ctx)
+}
+
+// removeChairNameSuggestion は売り切れて消えた椅子の名前を、同じ名前の椅子がもう無ければ候補から消す
+func removeChairNameSuggestion(ctx context.Context, name string) error {
+	var n int64
+	if err := db.GetContext(ctx, &n, "SELECT COUNT(*) FROM chair WHERE name = ?", name); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	return suggestChairNames.purge(ctx)
+}
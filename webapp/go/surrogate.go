@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 前段の Varnish / Fastly 互換の cache 向けに、レスポンスに Surrogate-Key を付けて、
+// 書き込みがあったときはその key だけを purge する。SURROGATE_PURGE_URL が空なら purge はしない
+var (
+	surrogatePurgeURL    = getEnv("SURROGATE_PURGE_URL", "")
+	surrogatePurgeMethod = getEnv("SURROGATE_PURGE_METHOD", http.MethodPost)
+	// Fastly の API token。Varnish なら空でいい
+	surrogatePurgeToken = getEnv("SURROGATE_PURGE_TOKEN", "")
+)
+
+const (
+	surrogateKeyHeader = "Surrogate-Key"
+
+	// 椅子 / 物件の詳細すべて
+	surrogateKeyChair  = "chair"
+	surrogateKeyEstate = "estate"
+	// 検索や low_priced などの一覧
+	surrogateKeyChairSearch  = "chair-search"
+	surrogateKeyEstateSearch = "estate-search"
+)
+
+var surrogatePurgeClient = &http.Client{Timeout: getEnvDuration("SURROGATE_PURGE_TIMEOUT", 5*time.Second)}
+
+func surrogateKeyForChair(id int64) string {
+	return fmt.Sprintf("chair:%d", id)
+}
+
+func surrogateKeyForEstate(id int64) string {
+	return fmt.Sprintf("estate:%d", id)
+}
+
+// setSurrogateKeys はレスポンスに Surrogate-Key を足す
+func setSurrogateKeys(c echo.Context, keys ...string) {
+	h := c.Response().Header()
+	if prev := h.Get(surrogateKeyHeader); prev != "" {
+		keys = append([]string{prev}, keys...)
+	}
+	h.Set(surrogateKeyHeader, strings.Join(keys, " "))
+}
+
+// purgeSurrogateKeys は前段の cache から keys の付いたレスポンスを消す。
+// 書き込みのレスポンスを待たせないように裏で投げる
+func purgeSurrogateKeys(logger echo.Logger, keys ...string) {
+	if surrogatePurgeURL == "" || len(keys) == 0 {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cacheBackgroundTimeout)
+		defer cancel()
+		if err := sendSurrogatePurge(ctx, keys); err != nil {
+			logger.Errorf("failed to purge surrogate keys %v : %v", keys, err)
+		}
+	}()
+}
+
+func sendSurrogatePurge(ctx context.Context, keys []string) error {
+	req, err := http.NewRequest(surrogatePurgeMethod, surrogatePurgeURL, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(surrogateKeyHeader, strings.Join(keys, " "))
+	if surrogatePurgeToken != "" {
+		req.Header.Set("Fastly-Key", surrogatePurgeToken)
+	}
+	res, err := surrogatePurgeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
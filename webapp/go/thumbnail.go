@@ -0,0 +1,22 @@
+package main
+
+import "strings"
+
+// THUMBNAIL_BASE_URL (https://cdn.example など) を設定すると、レスポンスの thumbnail の前に付けて
+// 画像を CDN から配れるようにする。DB には入稿された /images/... のまま持つ
+var thumbnailBaseURL = strings.TrimSuffix(getEnv("THUMBNAIL_BASE_URL", ""), "/")
+
+// ThumbnailURL は chair / estate の thumbnail。JSON にするときに THUMBNAIL_BASE_URL を付ける
+type ThumbnailURL string
+
+// URL はレスポンスに出す URL。/ で始まらないもの (外部の URL) はそのまま
+func (t ThumbnailURL) URL() string {
+	if thumbnailBaseURL == "" || !strings.HasPrefix(string(t), "/") {
+		return string(t)
+	}
+	return thumbnailBaseURL + string(t)
+}
+
+func (t ThumbnailURL) MarshalJSON() ([]byte, error) {
+	return appendJSONString(nil, t.URL()), nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// デッドロックや lock 待ちの timeout で失敗した transaction をやり直す回数
+var txMaxRetries = getEnvInt("TX_MAX_RETRIES", 2)
+
+const (
+	mysqlErrLockWaitTimeout = 1205
+	mysqlErrLockDeadlock    = 1213
+)
+
+// txStats は /metrics に出す transaction の数と時間
+var txStats struct {
+	commits   int64
+	rollbacks int64
+	retries   int64
+	nanos     int64
+}
+
+// withTx は fn を transaction の中で実行する。fn が error を返したら rollback、そうでなければ commit する。
+// デッドロックなどやり直せば通るものは txMaxRetries 回までやり直すので、fn は何度呼ばれてもいいように書く
+func withTx(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	start := time.Now()
+	defer func() {
+		atomic.AddInt64(&txStats.nanos, int64(time.Since(start)))
+	}()
+	for attempt := 0; ; attempt++ {
+		err := runTx(ctx, fn)
+		if err == nil {
+			atomic.AddInt64(&txStats.commits, 1)
+			return nil
+		}
+		atomic.AddInt64(&txStats.rollbacks, 1)
+		if attempt >= txMaxRetries || !isRetryableTxError(err) || ctx.Err() != nil {
+			return err
+		}
+		atomic.AddInt64(&txStats.retries, 1)
+	}
+}
+
+func runTx(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// commit したあとの Rollback は何もしない
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// writeTxMetrics は txStats を Prometheus の形式で書く
+func writeTxMetrics(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP isuumo_tx_total Number of finished transactions.\n# TYPE isuumo_tx_total counter\n")
+	fmt.Fprintf(b, "isuumo_tx_total{result=\"commit\"} %d\n", atomic.LoadInt64(&txStats.commits))
+	fmt.Fprintf(b, "isuumo_tx_total{result=\"rollback\"} %d\n", atomic.LoadInt64(&txStats.rollbacks))
+	fmt.Fprintf(b, "# HELP isuumo_tx_retries_total Number of retried transactions.\n# TYPE isuumo_tx_retries_total counter\n")
+	fmt.Fprintf(b, "isuumo_tx_retries_total %d\n", atomic.LoadInt64(&txStats.retries))
+	fmt.Fprintf(b, "# HELP isuumo_tx_seconds_sum Total time spent in transactions including retries.\n# TYPE isuumo_tx_seconds_sum counter\n")
+	fmt.Fprintf(b, "isuumo_tx_seconds_sum %g\n", time.Duration(atomic.LoadInt64(&txStats.nanos)).Seconds())
+}
+
+func isRetryableTxError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	return mysqlErr.Number == mysqlErrLockDeadlock || mysqlErr.Number == mysqlErrLockWaitTimeout
+}
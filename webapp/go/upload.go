@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// errUnsupportedEncoding は展開できない形式で圧縮されていたとき
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// errCorruptUpload は圧縮されたファイルが壊れていて展開できなかったとき (入稿した側の問題なので 400 にする)
+var errCorruptUpload = errors.New("corrupt compressed upload")
+
+type uploadReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+// decompressReader は展開中のエラーを errCorruptUpload として返す
+type decompressReader struct {
+	io.Reader
+}
+
+func (r decompressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%v: %w", err, errCorruptUpload)
+	}
+	return n, err
+}
+
+func (r *uploadReader) Close() error {
+	var firstErr error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if err := r.closers[i].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// openUpload は入稿された multipart の file を開く。
+// part の Content-Encoding か先頭の magic bytes で gzip か zstd と分かれば展開しながら読む。
+// それ以外の Content-Encoding なら errUnsupportedEncoding を返す
+func openUpload(header *multipart.FileHeader) (io.ReadCloser, error) {
+	f, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(len(zstdMagic))
+	encoding := strings.ToLower(header.Header.Get("Content-Encoding"))
+
+	switch {
+	case encoding == "gzip" || bytes.HasPrefix(magic, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%v: %w", err, errCorruptUpload)
+		}
+		return &uploadReader{Reader: decompressReader{gr}, closers: []io.Closer{f, gr}}, nil
+	case encoding == "zstd" || bytes.HasPrefix(magic, zstdMagic):
+		dec, err := zstd.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%v: %w", err, errCorruptUpload)
+		}
+		zr := dec.IOReadCloser()
+		return &uploadReader{Reader: decompressReader{zr}, closers: []io.Closer{f, zr}}, nil
+	case encoding != "" && encoding != "identity":
+		f.Close()
+		return nil, errUnsupportedEncoding
+	}
+	return &uploadReader{Reader: br, closers: []io.Closer{f}}, nil
+}
+
+// uploadedCSV は入稿された CSV 1 ファイル分
+type uploadedCSV struct {
+	Filename string
+	Records  [][]string
+}
+
+// readUploadedCSVs は field に入っている CSV を全部読む (field は繰り返してもよい)。
+// 失敗したときは返すべき HTTP ステータスを返す (成功なら 0)
+func readUploadedCSVs(c echo.Context, field string) ([]uploadedCSV, int) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		c.Logger().Errorf("failed to get multipart form: %v", err)
+		return nil, http.StatusBadRequest
+	}
+	headers := form.File[field]
+	if len(headers) == 0 {
+		c.Logger().Errorf("failed to get form file: %v", http.ErrMissingFile)
+		return nil, http.StatusBadRequest
+	}
+	files := make([]uploadedCSV, 0, len(headers))
+	for _, header := range headers {
+		records, err := readUploadedCSV(header)
+		if err == errUnsupportedEncoding {
+			c.Logger().Infof("failed to open form file %s: %v", header.Filename, err)
+			return nil, http.StatusUnsupportedMediaType
+		}
+		if errors.Is(err, errCorruptUpload) {
+			c.Logger().Infof("failed to read csv %s: %v", header.Filename, err)
+			return nil, http.StatusBadRequest
+		}
+		if err != nil {
+			c.Logger().Errorf("failed to read csv %s: %v", header.Filename, err)
+			return nil, http.StatusInternalServerError
+		}
+		files = append(files, uploadedCSV{Filename: header.Filename, Records: records})
+	}
+	return files, 0
+}
+
+func readUploadedCSV(header *multipart.FileHeader) ([][]string, error) {
+	f, err := openUpload(header)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return csv.NewReader(f).ReadAll()
+}
+
+// parseTransactionMode は複数ファイルをどう入れるかを見る。
+// single (デフォルト) なら全部 1 つの transaction で、per_file ならファイルごとに別々に入れる
+func parseTransactionMode(c echo.Context) (bool, bool) {
+	switch mode := c.QueryParam("transaction"); mode {
+	case "", "single":
+		return false, true
+	case "per_file":
+		return true, true
+	default:
+		c.Logger().Infof("invalid transaction mode : %v", mode)
+		return false, false
+	}
+}
+
+func newFileImportResult(f uploadedCSV, status int) FileImportResult {
+	if status != 0 {
+		return FileImportResult{File: f.Filename, Status: status}
+	}
+	return FileImportResult{File: f.Filename, Rows: len(f.Records), Status: http.StatusCreated}
+}
+
+// importResponseStatus は全部入ったら 201、一部だけなら 207 を返す
+func importResponseStatus(results []FileImportResult) int {
+	failed := 0
+	for _, r := range results {
+		if r.Status != http.StatusCreated {
+			failed++
+		}
+	}
+	switch {
+	case failed == 0:
+		return http.StatusCreated
+	case failed == len(results) && len(results) == 1:
+		return results[0].Status
+	default:
+		return http.StatusMultiStatus
+	}
+}
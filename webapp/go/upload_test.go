@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const uploadTestCSV = "1,foo\n2,bar\n"
+
+// newUploadHeader は body を 1 ファイルだけ入れた multipart を作って、その FileHeader を返す
+func newUploadHeader(t *testing.T, encoding string, body []byte) *multipart.FileHeader {
+	t.Helper()
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", `form-data; name="file"; filename="data.csv"`)
+	if encoding != "" {
+		h.Set("Content-Encoding", encoding)
+	}
+	part, err := w.CreatePart(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(body)
+	w.Close()
+
+	form, err := multipart.NewReader(&buf, w.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return form.File["file"][0]
+}
+
+func gzipBytes(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(b)
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstdBytes(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(b)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOpenUpload(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		body     func(t *testing.T) []byte
+	}{
+		{"plain", "", func(t *testing.T) []byte { return []byte(uploadTestCSV) }},
+		{"identity", "identity", func(t *testing.T) []byte { return []byte(uploadTestCSV) }},
+		{"gzip header", "gzip", func(t *testing.T) []byte { return gzipBytes(t, []byte(uploadTestCSV)) }},
+		{"gzip magic", "", func(t *testing.T) []byte { return gzipBytes(t, []byte(uploadTestCSV)) }},
+		{"zstd header", "zstd", func(t *testing.T) []byte { return zstdBytes(t, []byte(uploadTestCSV)) }},
+		{"zstd magic", "", func(t *testing.T) []byte { return zstdBytes(t, []byte(uploadTestCSV)) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := openUpload(newUploadHeader(t, tt.encoding, tt.body(t)))
+			if err != nil {
+				t.Fatalf("openUpload: %v", err)
+			}
+			defer f.Close()
+			got, err := ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if string(got) != uploadTestCSV {
+				t.Errorf("got %q, want %q", got, uploadTestCSV)
+			}
+		})
+	}
+}
+
+func TestOpenUploadError(t *testing.T) {
+	gz := gzipBytes(t, []byte(uploadTestCSV))
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		want     error
+	}{
+		{"corrupt gzip header", "gzip", []byte("this is not gzip"), errCorruptUpload},
+		{"truncated gzip", "", gz[:len(gz)-4], errCorruptUpload},
+		{"corrupt zstd", "zstd", []byte("this is not zstd"), errCorruptUpload},
+		{"unknown encoding", "br", []byte(uploadTestCSV), errUnsupportedEncoding},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readUploadedCSV(newUploadHeader(t, tt.encoding, tt.body))
+			if !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
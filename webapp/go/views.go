@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 詳細ページの閲覧数。フロントから POST /api/{chair,estate}/:id/view で送られてきたら
+// instance の中で数えておき、viewFlushInterval ごとにまとめて item_view に足す。
+// item_view には足し込むので、複数台がそれぞれ書いてもよい (落ちたら最後に書いてからの分は数え損ねる)。
+// item_view.last_viewed_at は score の計算で最後の動きとして使う
+var viewFlushInterval = getEnvDuration("VIEW_FLUSH_INTERVAL", 10*time.Second)
+
+// 1 回の INSERT で書く行数
+const viewInsertBatchSize = 500
+
+var viewKinds = []string{"chair", "estate"}
+
+// viewCounter は kind ごとに、まだ item_view に書いていない閲覧数を ID ごとに持つ
+type viewCounter struct {
+	mu     sync.Mutex
+	counts map[string]map[int64]int64
+}
+
+var pendingViews = &viewCounter{counts: make(map[string]map[int64]int64)}
+
+func init() {
+	// 前の DB に対する閲覧数を書かないように、initialize されたら捨てる
+	localResetHooks = append(localResetHooks, pendingViews.reset)
+}
+
+func (v *viewCounter) add(kind string, id int64, n int64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	m, ok := v.counts[kind]
+	if !ok {
+		m = make(map[int64]int64)
+		v.counts[kind] = m
+	}
+	m[id] += n
+}
+
+// take は kind の閲覧数を取り出して 0 にする
+func (v *viewCounter) take(kind string) map[int64]int64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	m := v.counts[kind]
+	delete(v.counts, kind)
+	return m
+}
+
+func (v *viewCounter) reset() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.counts = make(map[string]map[int64]int64)
+}
+
+func postChairView(c echo.Context) error {
+	id, ok := parseViewID(c)
+	if !ok {
+		return c.NoContent(http.StatusBadRequest)
+	}
+	chair, err := getChairByID(c.Request().Context(), id)
+	if err == nil && chair.Stock <= 0 {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		return viewLookupError(c, "chair", id, err)
+	}
+	return recordView(c, "chair", id)
+}
+
+func postEstateView(c echo.Context) error {
+	id, ok := parseViewID(c)
+	if !ok {
+		return c.NoContent(http.StatusBadRequest)
+	}
+	estate, err := getEstateByID(c.Request().Context(), id)
+	if err == nil && estate.Status != "available" {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		return viewLookupError(c, "estate", id, err)
+	}
+	return recordView(c, "estate", id)
+}
+
+func parseViewID(c echo.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.Logger().Infof("Request parameter \"id\" parse error : %v", c.Param("id"))
+		return 0, false
+	}
+	return id, true
+}
+
+// viewLookupError は無い ID の閲覧を数えないように 404 にする。詳細ページと同じく売り切れや掲載終了も無い扱い
+func viewLookupError(c echo.Context, kind string, id int64, err error) error {
+	if err == sql.ErrNoRows {
+		c.Logger().Infof("viewed %s not found : %v", kind, id)
+		return c.NoContent(http.StatusNotFound)
+	}
+	c.Logger().Errorf("failed to get the viewed %s : %v", kind, err)
+	return c.NoContent(http.StatusInternalServerError)
+}
+
+// recordView は閲覧を数える。書くのは runViewFlusher なので、ここでは失敗しない
+func recordView(c echo.Context, kind string, id int64) error {
+	pendingViews.add(kind, id, 1)
+	return c.NoContent(http.StatusAccepted)
+}
+
+// runViewFlusher は viewFlushInterval ごとに数えた閲覧数を item_view に書く
+func runViewFlusher(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(viewFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, kind := range viewKinds {
+			if err := flushViews(ctx, kind); err != nil {
+				logger.Errorf("failed to flush %s views : %v", kind, err)
+			}
+		}
+	}
+}
+
+// flushViews は kind の閲覧数を取り出して MySQL に書く。
+// 書けなかったら次回に回すが、途中まで書けていた分ももう一度足すことになる (閲覧数なので気にしない)
+func flushViews(ctx context.Context, kind string) error {
+	counts := pendingViews.take(kind)
+	if len(counts) == 0 {
+		return nil
+	}
+	placeholders := make([]string, 0, viewInsertBatchSize)
+	params := make([]interface{}, 0, viewInsertBatchSize*3)
+	write := func() error {
+		if len(placeholders) == 0 {
+			return nil
+		}
+		query := "INSERT INTO item_view (kind, item_id, views, last_viewed_at) VALUES " + strings.Join(placeholders, ",") +
+			" ON DUPLICATE KEY UPDATE views = views + VALUES(views), last_viewed_at = VALUES(last_viewed_at)"
+		_, err := db.ExecContext(ctx, query, params...)
+		placeholders, params = placeholders[:0], params[:0]
+		return err
+	}
+	err := func() error {
+		for id, views := range counts {
+			placeholders = append(placeholders, "(?,?,?,NOW(6))")
+			params = append(params, kind, id, views)
+			if len(placeholders) >= viewInsertBatchSize {
+				if err := write(); err != nil {
+					return err
+				}
+			}
+		}
+		return write()
+	}()
+	if err != nil {
+		for id, views := range counts {
+			pendingViews.add(kind, id, views)
+		}
+	}
+	return err
+}
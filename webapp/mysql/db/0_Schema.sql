@@ -3,6 +3,18 @@ CREATE DATABASE isuumo;
 
 DROP TABLE IF EXISTS isuumo.estate;
 DROP TABLE IF EXISTS isuumo.chair;
+DROP TABLE IF EXISTS isuumo.dump_hash;
+DROP TABLE IF EXISTS isuumo.name_ngram;
+DROP TABLE IF EXISTS isuumo.station;
+DROP TABLE IF EXISTS isuumo.saved_search;
+DROP TABLE IF EXISTS isuumo.import_schedule;
+DROP TABLE IF EXISTS isuumo.import_run;
+DROP TABLE IF EXISTS isuumo.chair_archive;
+DROP TABLE IF EXISTS isuumo.audit_log;
+DROP TABLE IF EXISTS isuumo.estate_image;
+DROP TABLE IF EXISTS isuumo.chair_asset;
+DROP TABLE IF EXISTS isuumo.item_view;
+DROP TABLE IF EXISTS isuumo.chair_purchase;
 
 CREATE TABLE isuumo.estate
 (
@@ -17,13 +29,42 @@ CREATE TABLE isuumo.estate
     door_height INTEGER             NOT NULL,
     door_width  INTEGER             NOT NULL,
     features    VARCHAR(64)         NOT NULL,
-    popularity  INTEGER             NOT NULL
+    popularity  INTEGER             NOT NULL,
+    -- 5.7 は DESC の index が使えないので、popularity の降順はこれの昇順で並べる
+    neg_popularity INTEGER AS (-popularity) STORED NOT NULL,
+    score       DOUBLE PRECISION    NOT NULL DEFAULT 0,
+    -- score の降順も neg_popularity と同じくこれの昇順で並べる
+    neg_score   DOUBLE PRECISION AS (-score) STORED NOT NULL,
+    status      VARCHAR(16)         NOT NULL DEFAULT 'available',
+    thumbnail_hash CHAR(16)         NULL,
+    cell_id     BIGINT UNSIGNED     NOT NULL DEFAULT 0,
+    nearest_station VARCHAR(64)     NULL,
+    station_walk_minutes INTEGER    NULL,
+    -- 間取り (1K / 1LDK / 2LDK ...)。入稿に無ければ空
+    layout      VARCHAR(8)          NOT NULL DEFAULT '',
+    -- 管理費と敷金。家賃の比較には effective_rent (家賃 + 管理費) を使う
+    management_fee INTEGER          NOT NULL DEFAULT 0,
+    deposit     INTEGER             NOT NULL DEFAULT 0,
+    effective_rent INTEGER AS (rent + management_fee) STORED NOT NULL,
+    created_at  DATETIME(6)         NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    updated_at  DATETIME(6)         NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6)
 );
 
-create index `idx_estate_door_width_height_popularity` on isuumo.estate (`door_width`, `door_height`, `popularity`);
-create index `idx_estate_rent_id` on isuumo.estate (`rent`, `id`);
-create index `idx_estate_rent_popularity_id` on isuumo.estate (`rent`, `popularity`, `id`);
-create index `idx_estate_latitude_longitude_id` on isuumo.estate (`latitude`, `longitude`, `popularity`, `id`);
+-- 検索は必ず status で絞るので、検索に使う index は status を先頭にする
+create index `idx_estate_status_door_width_height_neg_popularity` on isuumo.estate (`status`, `door_width`, `door_height`, `neg_popularity`);
+create index `idx_estate_status_rent_id` on isuumo.estate (`status`, `rent`, `id`);
+create index `idx_estate_status_rent_neg_popularity_id` on isuumo.estate (`status`, `rent`, `neg_popularity`, `id`);
+create index `idx_estate_status_latitude_longitude_id` on isuumo.estate (`status`, `latitude`, `longitude`, `neg_popularity`, `id`);
+create index `idx_estate_status_neg_popularity_id` on isuumo.estate (`status`, `neg_popularity`, `id`);
+create index `idx_estate_status_cell_id_neg_popularity_id` on isuumo.estate (`status`, `cell_id`, `neg_popularity`, `id`);
+create index `idx_estate_created_at` on isuumo.estate (`created_at`);
+create index `idx_estate_address` on isuumo.estate (`address`);
+create index `idx_estate_thumbnail_hash` on isuumo.estate (`thumbnail_hash`);
+create index `idx_estate_status_nearest_station` on isuumo.estate (`status`, `nearest_station`, `station_walk_minutes`);
+create index `idx_estate_status_station_walk_minutes` on isuumo.estate (`status`, `station_walk_minutes`);
+create index `idx_estate_status_neg_score_id` on isuumo.estate (`status`, `neg_score`, `id`);
+create index `idx_estate_status_effective_rent_neg_popularity_id` on isuumo.estate (`status`, `effective_rent`, `neg_popularity`, `id`);
+create index `idx_estate_status_layout_neg_popularity_id` on isuumo.estate (`status`, `layout`, `neg_popularity`, `id`);
 
 CREATE TABLE isuumo.chair
 (
@@ -39,8 +80,184 @@ CREATE TABLE isuumo.chair
     features    VARCHAR(64)     NOT NULL,
     kind        VARCHAR(64)     NOT NULL,
     popularity  INTEGER         NOT NULL,
-    stock       INTEGER         NOT NULL
+    neg_popularity INTEGER AS (-popularity) STORED NOT NULL,
+    score       DOUBLE PRECISION NOT NULL DEFAULT 0,
+    neg_score   DOUBLE PRECISION AS (-score) STORED NOT NULL,
+    stock       INTEGER         NOT NULL,
+    sale_price  INTEGER         NULL,
+    sale_until  DATETIME(6)     NULL,
+    -- セールを考慮した価格。期限が来たセールは runSaleExpirer が sale_price を消して price に戻す
+    effective_price INTEGER AS (COALESCE(sale_price, price)) STORED NOT NULL,
+    thumbnail_hash CHAR(16)     NULL,
+    -- 素材と重さ (g)。入稿に無ければ空と NULL
+    material    VARCHAR(64)     NOT NULL DEFAULT '',
+    weight      INTEGER         NULL,
+    created_at  DATETIME(6)     NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    updated_at  DATETIME(6)     NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6)
 );
 
-create index `idx_chair_price_popularity` on isuumo.chair (`price`, `popularity`);
+create index `idx_chair_price_neg_popularity` on isuumo.chair (`price`, `neg_popularity`);
 create index `idx_chair_price_id` on isuumo.chair (`price`, `id`);
+create index `idx_chair_created_at` on isuumo.chair (`created_at`);
+create index `idx_chair_neg_popularity_id` on isuumo.chair (`neg_popularity`, `id`);
+create index `idx_chair_kind_neg_popularity_id` on isuumo.chair (`kind`, `neg_popularity`, `id`);
+create index `idx_chair_material_neg_popularity_id` on isuumo.chair (`material`, `neg_popularity`, `id`);
+create index `idx_chair_weight` on isuumo.chair (`weight`);
+create index `idx_chair_thumbnail_hash` on isuumo.chair (`thumbnail_hash`);
+create index `idx_chair_neg_score_id` on isuumo.chair (`neg_score`, `id`);
+create index `idx_chair_effective_price_id` on isuumo.chair (`effective_price`, `id`);
+create index `idx_chair_effective_price_neg_popularity_id` on isuumo.chair (`effective_price`, `neg_popularity`, `id`);
+create index `idx_chair_neg_popularity_effective_price_id` on isuumo.chair (`neg_popularity`, `effective_price`, `id`);
+create index `idx_chair_name` on isuumo.chair (`name`);
+
+-- initialize で流し込んだ dump の hash
+CREATE TABLE isuumo.dump_hash
+(
+    id          INTEGER         NOT NULL PRIMARY KEY,
+    hash        VARCHAR(64)     NOT NULL
+);
+
+-- chair / estate の名前のあいまい検索用
+CREATE TABLE isuumo.name_ngram
+(
+    kind        VARCHAR(16)     NOT NULL,
+    item_id     INTEGER         NOT NULL,
+    gram        VARCHAR(16)     NOT NULL,
+    PRIMARY KEY (`kind`, `gram`, `item_id`)
+);
+
+-- 最寄り駅の計算用
+CREATE TABLE isuumo.station
+(
+    id          INTEGER             NOT NULL PRIMARY KEY,
+    name        VARCHAR(64)         NOT NULL,
+    latitude    DOUBLE PRECISION    NOT NULL,
+    longitude   DOUBLE PRECISION    NOT NULL
+);
+
+-- 新着通知用に保存された検索条件
+CREATE TABLE isuumo.saved_search
+(
+    id          INTEGER         NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    kind        VARCHAR(16)     NOT NULL,
+    query       VARCHAR(1024)   NOT NULL,
+    email       VARCHAR(256)    NULL,
+    webhook_url VARCHAR(1024)   NULL,
+    -- 保存したときに返す、消すときに必要な token
+    delete_token CHAR(32)       NOT NULL,
+    created_at  DATETIME(6)     NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    INDEX idx_kind (`kind`)
+);
+
+-- 定期的な URL 指定の入稿の設定
+CREATE TABLE isuumo.import_schedule
+(
+    id          INTEGER         NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    type        VARCHAR(16)     NOT NULL,
+    url         VARCHAR(1024)   NOT NULL,
+    cron        VARCHAR(128)    NOT NULL,
+    duplicates  VARCHAR(16)     NOT NULL DEFAULT 'flag',
+    enabled     BOOLEAN         NOT NULL DEFAULT TRUE,
+    created_at  DATETIME(6)     NOT NULL DEFAULT CURRENT_TIMESTAMP(6)
+);
+
+-- 定期入稿の実行履歴
+CREATE TABLE isuumo.import_run
+(
+    id          INTEGER         NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    schedule_id INTEGER         NOT NULL,
+    status      VARCHAR(16)     NOT NULL,
+    `rows`      INTEGER         NOT NULL DEFAULT 0,
+    error       VARCHAR(1024)   NULL,
+    started_at  DATETIME(6)     NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    finished_at DATETIME(6)     NULL,
+    INDEX idx_schedule_id (`schedule_id`, `id`)
+);
+
+-- 売り切れて chair から消した椅子。同じ id が何度も売り切れることがあるので archive_id を別に振る
+CREATE TABLE isuumo.chair_archive
+(
+    archive_id  INTEGER         NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    id          INTEGER         NOT NULL,
+    name        VARCHAR(64)     NOT NULL,
+    description VARCHAR(4096)   NOT NULL,
+    thumbnail   VARCHAR(128)    NOT NULL,
+    price       INTEGER         NOT NULL,
+    height      INTEGER         NOT NULL,
+    width       INTEGER         NOT NULL,
+    depth       INTEGER         NOT NULL,
+    color       VARCHAR(64)     NOT NULL,
+    features    VARCHAR(64)     NOT NULL,
+    kind        VARCHAR(64)     NOT NULL,
+    popularity  INTEGER         NOT NULL,
+    neg_popularity INTEGER AS (-popularity) STORED NOT NULL,
+    score       DOUBLE PRECISION NOT NULL DEFAULT 0,
+    neg_score   DOUBLE PRECISION AS (-score) STORED NOT NULL,
+    stock       INTEGER         NOT NULL,
+    sale_price  INTEGER         NULL,
+    sale_until  DATETIME(6)     NULL,
+    thumbnail_hash CHAR(16)     NULL,
+    material    VARCHAR(64)     NOT NULL DEFAULT '',
+    weight      INTEGER         NULL,
+    created_at  DATETIME(6)     NOT NULL,
+    updated_at  DATETIME(6)     NOT NULL,
+    archived_at DATETIME(6)     NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    INDEX idx_id (`id`),
+    INDEX idx_archived_at (`archived_at`)
+);
+
+-- 書き込み系の API の記録。追記だけする
+CREATE TABLE isuumo.audit_log
+(
+    id          BIGINT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    action      VARCHAR(32)     NOT NULL,
+    actor       VARCHAR(80)     NOT NULL,
+    ip          VARCHAR(64)     NOT NULL,
+    method      VARCHAR(8)      NOT NULL,
+    path        VARCHAR(256)    NOT NULL,
+    status      INTEGER         NOT NULL,
+    summary     VARCHAR(1024)   NOT NULL,
+    created_at  DATETIME(6)     NOT NULL,
+    INDEX idx_action (`action`, `id`),
+    INDEX idx_actor (`actor`, `id`),
+    INDEX idx_created_at (`created_at`)
+);
+
+-- 物件の画像。thumbnail とは別に何枚でも持てる
+CREATE TABLE isuumo.estate_image
+(
+    estate_id   INTEGER         NOT NULL,
+    position    INTEGER         NOT NULL,
+    url         VARCHAR(256)    NOT NULL,
+    PRIMARY KEY (`estate_id`, `position`)
+);
+
+-- 椅子の 3D モデル (model_glb) や寸法図 (dimension_png) などの素材。種類ごとに 1 つ
+CREATE TABLE isuumo.chair_asset
+(
+    chair_id    INTEGER         NOT NULL,
+    type        VARCHAR(32)     NOT NULL,
+    url         VARCHAR(256)    NOT NULL,
+    PRIMARY KEY (`chair_id`, `type`)
+);
+
+-- 詳細ページの閲覧数。redis で数えたものをまとめて足す (kind は chair / estate)
+CREATE TABLE isuumo.item_view
+(
+    kind            VARCHAR(16)     NOT NULL,
+    item_id         INTEGER         NOT NULL,
+    views           BIGINT          NOT NULL,
+    last_viewed_at  DATETIME(6)     NOT NULL,
+    PRIMARY KEY (`kind`, `item_id`)
+);
+
+-- 椅子の購入。まとめ買いでも 1 回の購入で 1 行
+CREATE TABLE isuumo.chair_purchase
+(
+    id          BIGINT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    chair_id    INTEGER         NOT NULL,
+    email       VARCHAR(256)    NOT NULL,
+    quantity    INTEGER         NOT NULL,
+    created_at  DATETIME(6)     NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    INDEX idx_chair_id (`chair_id`)
+);